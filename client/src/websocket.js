@@ -1,5 +1,16 @@
 const ROOM_AUTH_CACHE_KEY = 'roomAuthCache';
 const DEFAULT_ROOM_KEY = '__default__';
+const DEVICE_ID_KEY = 'deviceId';
+
+// 服务端签发的设备ID（设备密钥保存在 HttpOnly 的 cc_device Cookie 中，这里只用于标记“本设备”）
+function storedDeviceId() {
+    return localStorage.getItem(DEVICE_ID_KEY) || '';
+}
+
+// 服务端签发的令牌（用户会话、API 令牌、OIDC 会话或 JWT），其余的视为房间密码
+function isIssuedToken(token) {
+    return /^cc[sto]_/.test(token) || /^[\w-]+\.[\w-]+\.[\w-]+$/.test(token);
+}
 
 function loadRoomAuthCache() {
     try {
@@ -26,8 +37,10 @@ export default {
             authCodeError: '',
             authDialogLoading: false,
             roomAuthCache: loadRoomAuthCache(),
+            oidcLoginUrl: '',
             roomProtectionCache: {},
             room: this.$router.currentRoute.query.room || '',
+            deviceId: storedDeviceId(),
             roomInput: '',
             roomDialog: false,
             retry: 0,
@@ -35,6 +48,7 @@ export default {
             event: {
                 receive: data => {
                     this.$root.received.unshift(data);
+                    this.sendAck(data.id);
                 },
                 receiveMulti: data => {
                     this.$root.received.unshift(...Array.from(data).reverse());
@@ -53,7 +67,17 @@ export default {
                     );
                 },
                 connect: data => {
-                    this.$root.device.push(data);
+                    let index = this.$root.device.findIndex(e => e.id === data.id);
+                    if (index === -1) {
+                        this.$root.device.push(data);
+                    } else {
+                        this.$root.device.splice(index, 1, data);
+                    }
+                },
+                device: data => {
+                    let index = this.$root.device.findIndex(e => e.id === data.id);
+                    if (index === -1) return;
+                    this.$root.device.splice(index, 1, { ...this.$root.device[index], ...data });
                 },
                 disconnect: data => {
                     let index = this.$root.device.findIndex(e => e.id === data.id);
@@ -68,6 +92,11 @@ export default {
                         this.$root.received.splice(index, 1, { ...this.$root.received[index], ...data });
                     }
                 },
+                receipt: data => {
+                    let index = this.$root.received.findIndex(e => e.id === data.id);
+                    if (index === -1) return;
+                    this.$root.received.splice(index, 1, { ...this.$root.received[index], receipts: data });
+                },
                 forbidden: () => {
                     this.clearAuthTokenForRoom(this.room);
                 },
@@ -135,6 +164,10 @@ export default {
                 if (routeRoom === this.normalizeRoomName(this.room)) {
                     this.authCode = routeAuth;
                 }
+                // 从地址栏和浏览历史中去掉密码，连接时再换成会话 Cookie
+                const query = { ...route.query };
+                delete query.auth;
+                this.$router.replace({ query }).catch(() => {});
                 return;
             }
 
@@ -142,6 +175,23 @@ export default {
                 this.authCode = this.getAuthTokenForRoom(routeRoom);
             }
         },
+        // 兑换配对码：服务端返回绑定到本设备、只能访问该房间的令牌，保存后从地址栏中去掉配对码
+        async redeemPairCode(code) {
+            try {
+                const response = await this.$http.post('pair', { code }, {
+                    __skipRoomAuthHandling: true,
+                });
+                this.setDeviceId(response.data.deviceId);
+                this.cacheAuthTokenForRoom(response.data.room, response.data.token);
+                this.$toast(this.$t('pairSucceeded'));
+            } catch (error) {
+                console.log(error);
+                this.$toast(this.$t('pairFailed'));
+            }
+            const query = { ...this.$route.query };
+            delete query.pair;
+            this.$router.replace({ query }).catch(() => {});
+        },
         getKnownAuthTokens(room = this.room) {
             const tokens = [];
             const pushToken = token => {
@@ -157,6 +207,10 @@ export default {
 
             return tokens;
         },
+        // 本地保存了密码的房间，获取房间列表时只对这些房间校验密码
+        getKnownAuthRooms() {
+            return Object.keys(this.roomAuthCache).filter(room => (this.roomAuthCache[room] || '').trim());
+        },
         getRequestRoom(config = {}) {
             if (config.params instanceof URLSearchParams) {
                 return this.normalizeRoomName(config.params.get('room') || this.room);
@@ -175,6 +229,28 @@ export default {
             const normalizedRoom = this.normalizeRoomName(room);
             this.$set(this.roomProtectionCache, normalizedRoom, Boolean(isProtected));
         },
+        setDeviceId(deviceId) {
+            if (deviceId) {
+                this.deviceId = deviceId;
+                localStorage.setItem(DEVICE_ID_KEY, deviceId);
+            }
+        },
+        // 设备ID由服务端签发：/server 没有返回有效的设备ID时先注册设备，注册失败时以临时ID连接
+        async ensureDevice(room, serverInfo) {
+            if (serverInfo.deviceId) {
+                this.setDeviceId(serverInfo.deviceId);
+                return;
+            }
+            try {
+                const response = await this.$http.post('devices', {}, {
+                    params: new URLSearchParams([['room', room]]),
+                    __skipRoomAuthHandling: true,
+                });
+                this.setDeviceId(response.data.id);
+            } catch (error) {
+                console.log(error);
+            }
+        },
         async fetchServerInfo(room = this.room, { token = '' } = {}) {
             const normalizedRoom = this.normalizeRoomName(room);
             const response = await this.$http.get('server', {
@@ -187,6 +263,8 @@ export default {
             if (Object.prototype.hasOwnProperty.call(response.data || {}, 'roomProtected')) {
                 this.setRoomProtection(normalizedRoom, response.data.roomProtected);
             }
+            // 服务器启用了 OIDC 时，认证对话框显示单点登录按钮
+            this.oidcLoginUrl = response.data && response.data.oidc ? response.data.oidc.login : '';
             return response.data;
         },
         async verifyRoomAccess(room, token) {
@@ -201,6 +279,38 @@ export default {
             });
             return serverInfo.auth ? serverInfo.authorized === true : true;
         },
+        loginWithSSO() {
+            const room = this.authPendingRoom || this.normalizeRoomName(this.room);
+            this.clearAuthTokenForRoom(room);
+            location.href = `${this.oidcLoginUrl}?room=${encodeURIComponent(room)}`;
+        },
+        // 用房间密码换取 HttpOnly 的会话 Cookie，服务端未启用会话登录或房间不需要密码时返回 false
+        async loginRoomSession(room, password) {
+            if (isIssuedToken(password)) {
+                return false;
+            }
+            try {
+                const response = await this.$http.post('login', {
+                    room: this.normalizeRoomName(room),
+                    password,
+                }, {
+                    __skipRoomAuthHandling: true,
+                });
+                return response.data.required !== false;
+            } catch (error) {
+                console.log(error);
+                return false;
+            }
+        },
+        // 保存通过验证的令牌：房间密码换成会话 Cookie 后不再保存在本地，否则继续缓存
+        async storeRoomAccess(room, token) {
+            if (await this.loginRoomSession(room, token)) {
+                this.clearAuthTokenForRoom(room);
+                return '';
+            }
+            this.cacheAuthTokenForRoom(room, token);
+            return token;
+        },
         openAuthDialog(room, initialToken = '') {
             this.authPendingRoom = this.normalizeRoomName(room);
             this.roomDialog = false;
@@ -215,13 +325,17 @@ export default {
             if (!serverInfo.auth) {
                 return '';
             }
+            // 已经通过单点登录（会话 Cookie）获得该房间的访问权限，不再发送缓存的密码（请求头优先于 Cookie）
+            if (serverInfo.session) {
+                this.clearAuthTokenForRoom(normalizedRoom);
+                return '';
+            }
 
             const candidateTokens = this.getKnownAuthTokens(normalizedRoom);
             for (const token of candidateTokens) {
                 const verified = await this.verifyRoomAccess(normalizedRoom, token);
                 if (verified) {
-                    this.cacheAuthTokenForRoom(normalizedRoom, token);
-                    return token;
+                    return this.storeRoomAccess(normalizedRoom, token);
                 }
             }
 
@@ -261,7 +375,7 @@ export default {
                     return;
                 }
 
-                this.cacheAuthTokenForRoom(targetRoom, token);
+                await this.storeRoomAccess(targetRoom, token);
                 this.authCodeDialog = false;
                 this.authPendingRoom = '';
 
@@ -279,6 +393,12 @@ export default {
                 this.authDialogLoading = false;
             }
         },
+        sendAck(id, status = 'delivered') {
+            if (!id || !this.websocket || this.websocket.readyState !== WebSocket.OPEN) {
+                return;
+            }
+            this.websocket.send(JSON.stringify({ event: 'ack', data: { id, status } }));
+        },
         handleHttpUnauthorized(config = {}) {
             const room = this.getRequestRoom(config);
             this.clearAuthTokenForRoom(room);
@@ -305,6 +425,8 @@ export default {
                     }
                 }
 
+                await this.ensureDevice(currentRoom, serverInfo);
+
                 const ws = await new Promise((resolve, reject) => {
                     const wsUrl = new URL(serverInfo.server);
                     wsUrl.protocol = location.protocol === 'https:' ? 'wss:' : 'ws:';
@@ -373,7 +495,11 @@ export default {
             }
         },
     },
-    mounted() {
+    async mounted() {
+        const pairCode = String(this.$route.query.pair || '').trim();
+        if (pairCode) {
+            await this.redeemPairCode(pairCode);
+        }
         this.syncAuthFromRoute(this.$route);
         this.authCode = this.getAuthTokenForRoom(this.room);
         this.connect();
@@ -6,19 +6,27 @@ toolchain go1.23.9
 
 require (
 	github.com/andybalholm/brotli v1.1.1
+	github.com/coreos/go-oidc/v3 v3.14.1
+	github.com/go-jose/go-jose/v4 v4.0.5
 	github.com/google/uuid v1.6.0
 	github.com/gorilla/websocket v1.5.3
 	github.com/klauspost/compress v1.18.0
+	github.com/mattn/go-sqlite3 v1.14.32
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	github.com/spaolacci/murmur3 v1.1.0
 	github.com/ua-parser/uap-go v0.0.0-20250326155420-f7f5a2f9f5bc
+	github.com/yuin/goldmark v1.7.8
+	golang.org/x/crypto v0.38.0
 	golang.org/x/image v0.27.0
 	golang.org/x/mobile v0.0.0-20250218173823-21e291c9c26e
+	golang.org/x/oauth2 v0.28.0
 )
 
 require (
 	github.com/hashicorp/golang-lru v1.0.2 // indirect
 	golang.org/x/mod v0.23.0 // indirect
 	golang.org/x/sync v0.11.0 // indirect
+	golang.org/x/sys v0.33.0 // indirect
 	golang.org/x/tools v0.30.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
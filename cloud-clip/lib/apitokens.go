@@ -0,0 +1,647 @@
+package lib
+
+/**
+*** FILE: apitokens.go
+***   scoped, expiring API tokens (stored hashed), per-route scope checks, /admin/tokens and CLI
+**/
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// API 令牌的权限
+const (
+	scopeRead     = "read"      // 读取消息、文件，连接 /push 和 /events
+	scopePostText = "post-text" // 发送和修改文本消息
+	scopeUpload   = "upload"    // 上传文件
+	scopeRevoke   = "revoke"    // 撤销消息、清空房间
+	scopeAdmin    = "admin"     // 包含以上所有权限，并可以管理 API 令牌
+
+	apiTokenPrefix = "cct_"
+	apiTokenBytes  = 32
+)
+
+var allScopes = []string{scopeRead, scopePostText, scopeUpload, scopeRevoke, scopeAdmin}
+
+var (
+	errTokenNotFound = errors.New("令牌不存在")
+	errInvalidScope  = errors.New("无效的权限")
+)
+
+// APIToken 是令牌存储中的一个 API 令牌，只保存令牌的 SHA-256。Rooms 为空表示不限制房间，Expires 为 0 表示永不过期
+type APIToken struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	Hash      string   `json:"hash"`
+	Scopes    []string `json:"scopes"`
+	Rooms     []string `json:"rooms"`
+	Created   int64    `json:"created"`
+	Expires   int64    `json:"expires"`
+	CreatedBy string   `json:"createdBy,omitempty"`
+	DeviceID  string   `json:"deviceId,omitempty"` // 配对生成的令牌绑定的设备ID，只能由该设备使用
+	LastUsed  int64    `json:"lastUsed,omitempty"` // 只在内存中更新，随其他修改一起保存
+}
+
+// APITokenInfo 是返回给客户端的令牌信息（不含哈希），Token 只在创建时返回一次
+type APITokenInfo struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	Token     string   `json:"token,omitempty"`
+	Scopes    []string `json:"scopes"`
+	Rooms     []string `json:"rooms"`
+	Created   int64    `json:"created"`
+	Expires   int64    `json:"expires"`
+	CreatedBy string   `json:"createdBy,omitempty"`
+	DeviceID  string   `json:"deviceId,omitempty"`
+	LastUsed  int64    `json:"lastUsed,omitempty"`
+	Expired   bool     `json:"expired,omitempty"`
+}
+
+func (t *APIToken) info() APITokenInfo {
+	return APITokenInfo{
+		ID: t.ID, Name: t.Name, Scopes: t.Scopes, Rooms: t.Rooms, Created: t.Created, Expires: t.Expires,
+		CreatedBy: t.CreatedBy, DeviceID: t.DeviceID, LastUsed: t.LastUsed, Expired: t.expired(time.Now().Unix()),
+	}
+}
+
+func (t *APIToken) expired(now int64) bool {
+	return t.Expires > 0 && now >= t.Expires
+}
+
+// hasScope 判断令牌是否具有权限，admin 包含所有权限
+func (t *APIToken) hasScope(scope string) bool {
+	for _, granted := range t.Scopes {
+		if granted == scope || granted == scopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// canAccessRoom 判断令牌是否可以访问房间
+func (t *APIToken) canAccessRoom(room string) bool {
+	if len(t.Rooms) == 0 {
+		return true
+	}
+	room = normalizeRoomName(room)
+	for _, allowed := range t.Rooms {
+		if normalizeRoomName(allowed) == room {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenStore 保存 API 令牌，持久化到 tokens.json。命令行修改文件后，服务端在下次认证时按修改时间重新加载
+type tokenStore struct {
+	mu      sync.Mutex
+	path    string
+	modTime time.Time
+	tokens  map[string]*APIToken // 令牌的 SHA-256 -> 令牌
+	logf    func(format string, v ...any)
+}
+
+// tokensFilePath 返回 API 令牌存储文件路径（与用户存储在同一目录）
+func tokensFilePath(cfg *Config) string {
+	return filepath.Join(filepath.Dir(usersFilePath(cfg)), "tokens.json")
+}
+
+func newTokenStore(path string, logf func(format string, v ...any)) *tokenStore {
+	st := &tokenStore{
+		path:   path,
+		tokens: make(map[string]*APIToken),
+		logf:   logf,
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if err := st.loadLocked(); err != nil && !os.IsNotExist(err) {
+		logf("警告: 加载 API 令牌存储 %s 失败: %v", path, err)
+	}
+	return st
+}
+
+// loadLocked 从文件加载令牌，必须在 st.mu 锁定时调用
+func (st *tokenStore) loadLocked() error {
+	info, err := os.Stat(st.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(st.path)
+	if err != nil {
+		return err
+	}
+	var tokens []APIToken
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return err
+	}
+
+	st.tokens = make(map[string]*APIToken, len(tokens))
+	for i := range tokens {
+		st.tokens[tokens[i].Hash] = &tokens[i]
+	}
+	st.modTime = info.ModTime()
+	return nil
+}
+
+// reloadIfChangedLocked 令牌文件在外部被修改时重新加载，必须在 st.mu 锁定时调用
+func (st *tokenStore) reloadIfChangedLocked() {
+	info, err := os.Stat(st.path)
+	if err != nil || info.ModTime().Equal(st.modTime) {
+		return
+	}
+	if err := st.loadLocked(); err != nil {
+		st.logf("警告: 重新加载 API 令牌存储 %s 失败: %v", st.path, err)
+		return
+	}
+	st.logf("API 令牌存储已重新加载: %d 个令牌", len(st.tokens))
+}
+
+// saveLocked 将令牌写入文件，必须在 st.mu 锁定时调用
+func (st *tokenStore) saveLocked() error {
+	tokens := make([]APIToken, 0, len(st.tokens))
+	for _, t := range st.tokens {
+		tokens = append(tokens, *t)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Created < tokens[j].Created })
+
+	data, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(st.path, data, 0600); err != nil {
+		return err
+	}
+	if info, err := os.Stat(st.path); err == nil {
+		st.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// create 创建令牌，返回的 Token 字段为令牌明文（只在此时可见）。expires 为 Unix 时间戳，0 表示永不过期；
+// deviceID 不为空时令牌绑定到该设备
+func (st *tokenStore) create(name string, scopes []string, rooms []string, expires int64, createdBy string, deviceID string) (APITokenInfo, error) {
+	scopes, err := normalizeScopes(scopes)
+	if err != nil {
+		return APITokenInfo{}, err
+	}
+	normalizedRooms := []string{}
+	for _, room := range normalizeUserRooms(rooms) {
+		if room != "*" {
+			normalizedRooms = append(normalizedRooms, room)
+		}
+	}
+
+	secret := apiTokenPrefix + base64.RawURLEncoding.EncodeToString(random_bytes(apiTokenBytes))
+	t := &APIToken{
+		ID:        hex.EncodeToString(random_bytes(4)),
+		Name:      strings.TrimSpace(name),
+		Hash:      hashSessionToken(secret),
+		Scopes:    scopes,
+		Rooms:     normalizedRooms,
+		Created:   time.Now().Unix(),
+		Expires:   expires,
+		CreatedBy: createdBy,
+		DeviceID:  deviceID,
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.reloadIfChangedLocked()
+	st.tokens[t.Hash] = t
+	if err := st.saveLocked(); err != nil {
+		delete(st.tokens, t.Hash)
+		return APITokenInfo{}, err
+	}
+	info := t.info()
+	info.Token = secret
+	return info, nil
+}
+
+// revoke 按 ID 删除令牌
+func (st *tokenStore) revoke(id string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.reloadIfChangedLocked()
+	for hash, t := range st.tokens {
+		if t.ID == id {
+			delete(st.tokens, hash)
+			return st.saveLocked()
+		}
+	}
+	return errTokenNotFound
+}
+
+// has 判断 ID 对应的令牌是否存在且未过期
+func (st *tokenStore) has(id string) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.reloadIfChangedLocked()
+	now := time.Now().Unix()
+	for _, t := range st.tokens {
+		if t.ID == id {
+			return !t.expired(now)
+		}
+	}
+	return false
+}
+
+// revokeDevice 删除绑定到设备的令牌，room 不为空时只删除可以访问该房间的令牌，返回被删除的令牌ID
+func (st *tokenStore) revokeDevice(deviceID string, room string) ([]string, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.reloadIfChangedLocked()
+
+	var ids []string
+	for hash, t := range st.tokens {
+		if t.DeviceID == deviceID && (room == "" || t.canAccessRoom(room)) {
+			delete(st.tokens, hash)
+			ids = append(ids, t.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	return ids, st.saveLocked()
+}
+
+// list 按创建时间返回所有令牌
+func (st *tokenStore) list() []APITokenInfo {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.reloadIfChangedLocked()
+
+	infos := make([]APITokenInfo, 0, len(st.tokens))
+	for _, t := range st.tokens {
+		infos = append(infos, t.info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Created < infos[j].Created })
+	return infos
+}
+
+// lookup 返回令牌明文对应的有效令牌，令牌不存在或已过期时返回 false
+func (st *tokenStore) lookup(secret string) (*APIToken, bool) {
+	if !strings.HasPrefix(secret, apiTokenPrefix) {
+		return nil, false
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.reloadIfChangedLocked()
+	t, ok := st.tokens[hashSessionToken(secret)]
+	now := time.Now().Unix()
+	if !ok || t.expired(now) {
+		return nil, false
+	}
+	t.LastUsed = now
+	copied := *t
+	return &copied, true
+}
+
+// normalizeScopes 校验并去重权限
+func normalizeScopes(scopes []string) ([]string, error) {
+	normalized := []string{}
+	seen := make(map[string]bool)
+	for _, scope := range scopes {
+		scope = strings.ToLower(strings.TrimSpace(scope))
+		if scope == "" || seen[scope] {
+			continue
+		}
+		valid := false
+		for _, known := range allScopes {
+			if scope == known {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("%w: %s（可用: %s）", errInvalidScope, scope, strings.Join(allScopes, ", "))
+		}
+		seen[scope] = true
+		normalized = append(normalized, scope)
+	}
+	if len(normalized) == 0 {
+		return nil, fmt.Errorf("%w: 至少需要一个权限", errInvalidScope)
+	}
+	return normalized, nil
+}
+
+// parseTokenExpiry 解析有效期，支持 Go 时长（如 12h）和天数（如 30d），空字符串或 0 表示永不过期
+func parseTokenExpiry(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if value == "" || value == "0" {
+		return 0, nil
+	}
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("无效的有效期: %s", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("无效的有效期: %s", value)
+	}
+	return d, nil
+}
+
+// apiToken 返回令牌明文对应的有效 API 令牌
+func (s *ClipboardServer) apiToken(token string) (*APIToken, bool) {
+	if s.tokens == nil || token == "" {
+		return nil, false
+	}
+	return s.tokens.lookup(token)
+}
+
+// apiTokenCanAccessRoom 判断 token 是否是可以访问房间的 API 令牌（不检查权限，权限由 withScope 按路由检查）
+func (s *ClipboardServer) apiTokenCanAccessRoom(room string, token string) bool {
+	t, ok := s.apiToken(token)
+	return ok && t.canAccessRoom(room)
+}
+
+// tokenHasScope 判断 token 是否具有权限。不是 API 令牌的 token（房间密码、登录会话）不受权限限制
+func (s *ClipboardServer) tokenHasScope(token string, scope string) bool {
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return true
+	}
+	t, ok := s.apiToken(token)
+	return ok && t.hasScope(scope)
+}
+
+// isAdminToken 判断 token 是否可以管理 API 令牌：全局密码 server.auth、管理员用户的登录会话或具有 admin 权限的 API 令牌
+func (s *ClipboardServer) isAdminToken(token string) bool {
+	if token == "" {
+		return false
+	}
+	if globalPassword := normalizeAuthValue(s.config.Server.Auth); globalPassword != "" && token == globalPassword {
+		return true
+	}
+	if u, ok := s.sessionUser(token); ok && u.Admin {
+		return true
+	}
+	if id, ok := s.oidcUser(token); ok && id.Admin {
+		return true
+	}
+	t, ok := s.apiToken(token)
+	return ok && t.hasScope(scopeAdmin)
+}
+
+// routeScope 返回请求所需的 API 令牌权限
+type routeScope func(r *http.Request) string
+
+// fixedScope 所有请求方法都需要同一个权限
+func fixedScope(scope string) routeScope {
+	return func(*http.Request) string { return scope }
+}
+
+// methodScope DELETE 请求需要 deleteScope，其他请求需要 scope
+func methodScope(scope string, deleteScope string) routeScope {
+	return func(r *http.Request) string {
+		if r.Method == http.MethodDelete {
+			return deleteScope
+		}
+		return scope
+	}
+}
+
+// withScope 按路由检查请求中的 API 令牌权限和房间限制：令牌无效或过期返回 401，缺少权限、不能访问请求的房间
+// 或绑定的设备与请求的设备ID不符时返回 403
+// （即使房间本身不需要密码）。不携带 API 令牌的请求不受影响，仍由房间认证处理。
+func (s *ClipboardServer) withScope(required routeScope, next http.HandlerFunc) http.HandlerFunc {
+	return s.scopeMiddleware(required, true, next)
+}
+
+// withScopeAnyRoom 与 withScope 相同，但不检查房间限制（用于 /rooms 等不针对单个房间的路由）
+func (s *ClipboardServer) withScopeAnyRoom(required routeScope, next http.HandlerFunc) http.HandlerFunc {
+	return s.scopeMiddleware(required, false, next)
+}
+
+// requestRooms 返回请求作用的房间：已上传文件的实际房间，其次是所有 room 查询参数，都没有时为 default
+func (s *ClipboardServer) requestRooms(r *http.Request) []string {
+	if room, ok := s.uploadPathRoom(r); ok {
+		return []string{room}
+	}
+	if _, hasRoom := r.URL.Query()["room"]; hasRoom {
+		return parsePushRooms(r)
+	}
+	return []string{s.inferRequestRoom(r)}
+}
+
+func (s *ClipboardServer) scopeMiddleware(required routeScope, checkRoom bool, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		scope := required(r)
+		for _, token := range extractAuthTokens(r) {
+			if !strings.HasPrefix(token, apiTokenPrefix) {
+				continue
+			}
+			t, ok := s.apiToken(token)
+			if !ok {
+				s.logger.Printf("认证失败: 无效或已过期的 API 令牌。来自 IP: %s, 路径: %s", get_remote_ip(r), r.URL.Path)
+				writeAuthJSONError(w, http.StatusUnauthorized, "无效或已过期的 API 令牌")
+				return
+			}
+			if !t.hasScope(scope) {
+				s.logger.Printf("认证失败: API 令牌 %s 缺少权限 %s。来自 IP: %s, 路径: %s", t.ID, scope, get_remote_ip(r), r.URL.Path)
+				writeAuthJSONError(w, http.StatusForbidden, "API 令牌缺少权限: "+scope)
+				return
+			}
+			if t.DeviceID != "" {
+				if s.requestDeviceID(r) != t.DeviceID {
+					s.logger.Printf("认证失败: API 令牌 %s 绑定的设备与请求不符。来自 IP: %s, 路径: %s", t.ID, get_remote_ip(r), r.URL.Path)
+					writeAuthJSONError(w, http.StatusForbidden, "该令牌只能由配对的设备使用")
+					return
+				}
+			}
+			if !checkRoom {
+				continue
+			}
+			for _, room := range s.requestRooms(r) {
+				if !t.canAccessRoom(room) {
+					s.logger.Printf("认证失败: API 令牌 %s 不能访问房间 %s。来自 IP: %s, 路径: %s", t.ID, room, get_remote_ip(r), r.URL.Path)
+					writeAuthJSONError(w, http.StatusForbidden, "API 令牌不能访问该房间: "+room)
+					return
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// frameScope 返回 /push 帧所需的 API 令牌权限
+func frameScope(event string) string {
+	switch event {
+	case "send_text", "update":
+		return scopePostText
+	case "revoke", "clear":
+		return scopeRevoke
+	default:
+		return scopeRead
+	}
+}
+
+// handleAdminTokens 处理 /admin/tokens：GET 列出令牌，POST 创建令牌，DELETE /admin/tokens/{id} 撤销令牌
+func (s *ClipboardServer) handleAdminTokens(w http.ResponseWriter, r *http.Request) {
+	// 添加 CORS 头
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+	// 处理预检请求
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	token := extractAuthToken(r)
+	if !s.isAdminToken(token) {
+		s.logger.Printf("认证失败: 无权管理 API 令牌。来自 IP: %s", get_remote_ip(r))
+		writeAuthJSONError(w, http.StatusUnauthorized, "需要管理员权限")
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, s.config.Server.Prefix+"/admin/tokens"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"tokens": s.tokens.list()})
+	case id == "" && r.Method == http.MethodPost:
+		s.handleCreateToken(w, r, token)
+	case id != "" && r.Method == http.MethodDelete:
+		if err := s.tokens.revoke(id); err != nil {
+			if err == errTokenNotFound {
+				http.Error(w, "令牌不存在", http.StatusNotFound)
+				return
+			}
+			s.logger.Printf("错误: 保存 API 令牌存储失败: %v", err)
+			http.Error(w, "保存令牌失败", http.StatusInternalServerError)
+			return
+		}
+		s.logger.Printf("API 令牌 %s 已撤销，来自 IP: %s", id, get_remote_ip(r))
+		s.recordAudit(r, auditTokenRevoke, "", id, nil)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "不支持的请求方法", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *ClipboardServer) handleCreateToken(w http.ResponseWriter, r *http.Request, adminToken string) {
+	var body struct {
+		Name      string   `json:"name"`
+		Scopes    []string `json:"scopes"`
+		Rooms     []string `json:"rooms"`
+		ExpiresIn string   `json:"expiresIn"` // 如 "30d"、"12h"，为空表示永不过期
+		ExpiresAt int64    `json:"expiresAt"` // Unix 时间戳，优先于 expiresIn
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 16*1024)).Decode(&body); err != nil {
+		http.Error(w, "无效的请求体", http.StatusBadRequest)
+		return
+	}
+
+	expires := body.ExpiresAt
+	if expires == 0 {
+		ttl, err := parseTokenExpiry(body.ExpiresIn)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if ttl > 0 {
+			expires = time.Now().Add(ttl).Unix()
+		}
+	}
+
+	createdBy := "admin"
+	if u, ok := s.sessionUser(adminToken); ok {
+		createdBy = u.Name
+	} else if t, ok := s.apiToken(adminToken); ok {
+		createdBy = "token:" + t.ID
+	}
+
+	info, err := s.tokens.create(body.Name, body.Scopes, body.Rooms, expires, createdBy, "")
+	if err != nil {
+		if errors.Is(err, errInvalidScope) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.logger.Printf("错误: 保存 API 令牌存储失败: %v", err)
+		http.Error(w, "保存令牌失败", http.StatusInternalServerError)
+		return
+	}
+	s.logger.Printf("创建 API 令牌 %s [%s]，权限: %s，房间: %s，创建者: %s", info.ID, info.Name, strings.Join(info.Scopes, ","), strings.Join(info.Rooms, ","), createdBy)
+	s.recordAudit(r, auditTokenCreate, "", info.ID, map[string]any{"name": info.Name, "scopes": info.Scopes, "rooms": info.Rooms, "expiresAt": info.Expires})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(info)
+}
+
+// runTokenCommand 执行 -tokenadd / -tokenlist / -tokenrevoke 命令，没有指定令牌管理命令时返回 false
+func runTokenCommand(cfg *Config) bool {
+	if *flg_tokenadd == "" && *flg_tokenrevoke == "" && !*flg_tokenlist {
+		return false
+	}
+
+	st := newTokenStore(tokensFilePath(cfg), log.Printf)
+	var err error
+	switch {
+	case *flg_tokenadd != "":
+		var ttl time.Duration
+		if ttl, err = parseTokenExpiry(*flg_expire); err != nil {
+			break
+		}
+		var expires int64
+		if ttl > 0 {
+			expires = time.Now().Add(ttl).Unix()
+		}
+		var info APITokenInfo
+		if info, err = st.create(*flg_tokenadd, strings.Split(*flg_scopes, ","), splitUserRooms(*flg_rooms), expires, "cli", ""); err == nil {
+			fmt.Printf("已创建 API 令牌 %s（只显示这一次，请妥善保存）:\n%s\n", info.ID, info.Token)
+			auditCLI(cfg, auditTokenCreate, info.ID, map[string]any{"name": info.Name, "scopes": info.Scopes, "rooms": info.Rooms, "expiresAt": info.Expires})
+		}
+	case *flg_tokenrevoke != "":
+		if err = st.revoke(*flg_tokenrevoke); err == nil {
+			fmt.Printf("已撤销 API 令牌 %s\n", *flg_tokenrevoke)
+			auditCLI(cfg, auditTokenRevoke, *flg_tokenrevoke, nil)
+		}
+	default:
+		for _, t := range st.list() {
+			rooms := strings.Join(t.Rooms, ",")
+			if rooms == "" {
+				rooms = "*"
+			}
+			expires := "永不过期"
+			if t.Expires > 0 {
+				expires = time.Unix(t.Expires, 0).Format("2006-01-02 15:04")
+				if t.Expired {
+					expires += " (已过期)"
+				}
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\n", t.ID, t.Name, strings.Join(t.Scopes, ","), rooms, expires)
+		}
+	}
+
+	if err != nil {
+		fmt.Printf("错误: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("令牌存储: %s\n", st.path)
+	return true
+}
@@ -0,0 +1,484 @@
+package lib
+
+/**
+*** FILE: audit.go
+***   append-only audit log (JSON lines with size-based rotation, optional SQLite table) of administrative and destructive actions
+**/
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 审计事件类型
+const (
+	auditMessagePost   = "message.post"
+	auditMessageUpload = "message.upload"
+	auditMessageEdit   = "message.edit"
+	auditMessageRevoke = "message.revoke"
+	auditRoomClear     = "room.clear"
+	auditRoomCreate    = "room.create"
+	auditRoomUpdate    = "room.update"
+	auditRoomRename    = "room.rename"
+	auditRoomDelete    = "room.delete"
+	auditAuthFailure   = "auth.failure"
+	auditAuthLogin     = "auth.login"
+	auditTokenCreate   = "token.create"
+	auditTokenRevoke   = "token.revoke"
+	auditUserAdd       = "user.add"
+	auditUserDelete    = "user.delete"
+	auditUserPassword  = "user.password"
+	auditUserRooms     = "user.rooms"
+	auditDeviceRename  = "device.rename"
+	auditDevicePair    = "device.pair"
+	auditDeviceUnpair  = "device.unpair"
+	auditPairCode      = "pair.code"
+	auditShareCreate   = "share.create"
+	auditShareRevoke   = "share.revoke"
+	auditUnlock        = "ratelimit.unlock"
+	auditConfigLoad    = "config.load"
+	auditConfigChange  = "config.change"
+)
+
+const (
+	defaultAuditQueryLimit = 100
+	maxAuditQueryLimit     = 1000
+)
+
+// AuditEntry 是审计日志中的一条记录
+type AuditEntry struct {
+	Time   int64          `json:"time"`             // Unix 时间戳（秒）
+	Action string         `json:"action"`           // 事件类型，如 message.revoke
+	Actor  string         `json:"actor"`            // 操作者：user:名称、token:ID、admin、room:房间（房间密码）、cli、system 或 anonymous
+	Device string         `json:"device,omitempty"` // 请求携带的设备ID
+	IP     string         `json:"ip,omitempty"`     // 客户端 IP（按 trustedProxies 解析）
+	Room   string         `json:"room,omitempty"`
+	Target string         `json:"target,omitempty"` // 操作对象：消息 ID、令牌 ID、用户名、设备ID 等
+	Detail map[string]any `json:"detail,omitempty"`
+}
+
+// AuditQuery 是查询审计日志的过滤条件，空字段表示不过滤
+type AuditQuery struct {
+	Action string // 完全匹配，或以 . 结尾时按前缀匹配（如 token.）
+	Actor  string
+	IP     string
+	Room   string
+	Target string
+	Since  int64
+	Until  int64
+	Limit  int
+}
+
+func (q AuditQuery) matches(e AuditEntry) bool {
+	if q.Action != "" {
+		if strings.HasSuffix(q.Action, ".") {
+			if !strings.HasPrefix(e.Action, q.Action) {
+				return false
+			}
+		} else if e.Action != q.Action {
+			return false
+		}
+	}
+	return (q.Actor == "" || e.Actor == q.Actor) &&
+		(q.IP == "" || e.IP == q.IP) &&
+		(q.Room == "" || e.Room == q.Room) &&
+		(q.Target == "" || e.Target == q.Target) &&
+		(q.Since == 0 || e.Time >= q.Since) &&
+		(q.Until == 0 || e.Time <= q.Until)
+}
+
+// auditDB 是审计日志的数据库后端（SQLite，需要使用 -tags sqlite 构建）
+type auditDB interface {
+	insert(e AuditEntry) error
+	query(q AuditQuery) ([]AuditEntry, error)
+	close() error
+}
+
+// auditLog 只追加写入审计日志文件，超过 maxSize 后轮转为 .1、.2 ……，最多保留 maxFiles 个旧文件
+type auditLog struct {
+	mu       sync.Mutex
+	path     string
+	file     *os.File
+	size     int64
+	maxSize  int64
+	maxFiles int
+	db       auditDB
+	logf     func(format string, v ...any)
+}
+
+func auditFilePath(cfg *Config) string {
+	if cfg.Audit.File != "" {
+		return cfg.Audit.File
+	}
+	return filepath.Join(filepath.Dir(usersFilePath(cfg)), "audit.log")
+}
+
+func newAuditLog(cfg *Config, logf func(format string, v ...any)) (*auditLog, error) {
+	a := &auditLog{
+		path:     auditFilePath(cfg),
+		maxSize:  int64(cfg.Audit.MaxSize) << 20,
+		maxFiles: cfg.Audit.MaxFiles,
+		logf:     logf,
+	}
+	if err := os.MkdirAll(filepath.Dir(a.path), 0755); err != nil {
+		return nil, fmt.Errorf("创建审计日志目录失败: %w", err)
+	}
+	if err := a.openLocked(); err != nil {
+		return nil, err
+	}
+	if cfg.Audit.SQLite != "" {
+		db, err := openAuditDB(cfg.Audit.SQLite)
+		if err != nil {
+			// 数据库不可用时仍然写入文件
+			logf("警告: 打开审计数据库 %s 失败: %v，只写入审计日志文件", cfg.Audit.SQLite, err)
+		} else {
+			a.db = db
+		}
+	}
+	return a, nil
+}
+
+func (a *auditLog) openLocked() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("打开审计日志 %s 失败: %w", a.path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("读取审计日志 %s 失败: %w", a.path, err)
+	}
+	a.file = f
+	a.size = info.Size()
+	return nil
+}
+
+// rotateLocked 把当前文件改名为 .1，已有的 .n 改名为 .n+1，超出 maxFiles 的最旧文件被删除
+func (a *auditLog) rotateLocked() error {
+	a.file.Close()
+	a.file = nil
+	if a.maxFiles <= 0 {
+		os.Remove(a.path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", a.path, a.maxFiles))
+		for i := a.maxFiles - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", a.path, i), fmt.Sprintf("%s.%d", a.path, i+1))
+		}
+		if err := os.Rename(a.path, a.path+".1"); err != nil {
+			a.logf("警告: 轮转审计日志 %s 失败: %v", a.path, err)
+		}
+	}
+	return a.openLocked()
+}
+
+// record 追加一条记录，写入失败只记录日志，不影响调用方的操作
+func (a *auditLog) record(e AuditEntry) {
+	if e.Time == 0 {
+		e.Time = time.Now().Unix()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		a.logf("警告: 序列化审计记录失败: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		if err := a.openLocked(); err != nil {
+			a.logf("警告: %v", err)
+			return
+		}
+	}
+	// 命令行进程也会追加写入同一个文件，按文件的实际大小判断是否需要轮转
+	if info, err := a.file.Stat(); err == nil {
+		a.size = info.Size()
+	}
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotateLocked(); err != nil {
+			a.logf("警告: %v", err)
+			return
+		}
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		a.logf("警告: 写入审计日志 %s 失败: %v", a.path, err)
+	}
+	if a.db != nil {
+		if err := a.db.insert(e); err != nil {
+			a.logf("警告: 写入审计数据库失败: %v", err)
+		}
+	}
+}
+
+// query 返回符合条件的最新记录（按时间倒序）。配置了 SQLite 时从数据库查询，否则从新到旧读取轮转文件
+func (a *auditLog) query(q AuditQuery) ([]AuditEntry, error) {
+	if q.Limit <= 0 {
+		q.Limit = defaultAuditQueryLimit
+	}
+	if q.Limit > maxAuditQueryLimit {
+		q.Limit = maxAuditQueryLimit
+	}
+
+	a.mu.Lock()
+	db := a.db
+	a.mu.Unlock()
+	if db != nil {
+		return db.query(q)
+	}
+
+	// 从最旧的轮转文件读到当前文件，只保留最后 Limit 条匹配的记录
+	paths := []string{a.path}
+	for i := 1; i <= a.maxFiles; i++ {
+		paths = append([]string{fmt.Sprintf("%s.%d", a.path, i)}, paths...)
+	}
+	var matched []AuditEntry
+	for _, path := range paths {
+		if err := scanAuditFile(path, func(e AuditEntry) {
+			if q.matches(e) {
+				matched = append(matched, e)
+				if len(matched) > q.Limit {
+					matched = matched[1:]
+				}
+			}
+		}); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	for i, j := 0, len(matched)-1; i < j; i, j = i+1, j-1 {
+		matched[i], matched[j] = matched[j], matched[i]
+	}
+	return matched, nil
+}
+
+func scanAuditFile(path string, fn func(AuditEntry)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var e AuditEntry
+		if json.Unmarshal(scanner.Bytes(), &e) == nil {
+			fn(e)
+		}
+	}
+	return scanner.Err()
+}
+
+func (a *auditLog) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+	if a.db != nil {
+		a.db.close()
+		a.db = nil
+	}
+}
+
+// auditActor 按令牌确定操作者：登录用户、API 令牌、全局密码（admin）、房间密码或匿名。
+// 房间密码按 room 的认证要求（resolveRoomAuth）识别，包括通过房间管理 API 设置的密码（只使用已缓存的校验结果，不计算 argon2）
+func (s *ClipboardServer) auditActor(room string, token string) string {
+	if token == "" {
+		return "anonymous"
+	}
+	if u, ok := s.sessionUser(token); ok {
+		return "user:" + u.Name
+	}
+	if id, ok := s.oidcUser(token); ok {
+		return "oidc:" + id.Name
+	}
+	if room, ok := s.roomSessionRoom(token); ok {
+		return "room:" + room
+	}
+	if t, ok := s.apiToken(token); ok {
+		return "token:" + t.ID
+	}
+	if globalPassword := normalizeAuthValue(s.config.Server.Auth); globalPassword != "" && token == globalPassword {
+		return "admin"
+	}
+	if room != "" {
+		requirement := s.resolveRoomAuth(room)
+		if requirement.Password != "" && token == requirement.Password {
+			return "room:" + requirement.Room
+		}
+		if requirement.PasswordHash != "" && s.rooms.checkPasswordCached(requirement.Room, token) {
+			return "room:" + requirement.Room
+		}
+	}
+	for room, password := range s.config.Server.RoomAuth {
+		if password != "" && token == password {
+			return "room:" + normalizeRoomName(room)
+		}
+	}
+	return "anonymous"
+}
+
+// recordAudit 记录请求发起的操作，操作者按请求的认证令牌确定（指定了 room 时使用该房间的会话 Cookie）
+func (s *ClipboardServer) recordAudit(r *http.Request, action string, room string, target string, detail map[string]any) {
+	token := extractAuthToken(r)
+	if room != "" {
+		token = requestRoomToken(r, room)
+	}
+	s.recordAuditToken(r, token, action, room, target, detail)
+}
+
+// recordAuditToken 与 recordAudit 相同，但使用指定的令牌（WebSocket 帧使用连接加入房间时的令牌）
+func (s *ClipboardServer) recordAuditToken(r *http.Request, token string, action string, room string, target string, detail map[string]any) {
+	if s.audit == nil {
+		return
+	}
+	s.audit.record(AuditEntry{
+		Action: action,
+		Actor:  s.auditActor(room, token),
+		Device: s.requestDeviceID(r),
+		IP:     get_remote_ip(r),
+		Room:   room,
+		Target: target,
+		Detail: detail,
+	})
+}
+
+// auditConfig 在启动时记录配置摘要：每个配置段一个哈希，与上一次启动的记录不同时记为 config.change
+func (s *ClipboardServer) auditConfig() {
+	if s.audit == nil {
+		return
+	}
+	data, err := json.Marshal(s.config)
+	if err != nil {
+		return
+	}
+	var sections map[string]json.RawMessage
+	if err := json.Unmarshal(data, &sections); err != nil {
+		return
+	}
+	hashes := make(map[string]any, len(sections))
+	for name, raw := range sections {
+		sum := sha256.Sum256(raw)
+		hashes[name] = hex.EncodeToString(sum[:8])
+	}
+
+	action := auditConfigLoad
+	detail := map[string]any{"version": server_version, "sections": hashes}
+	if last, err := s.audit.query(AuditQuery{Action: "config.", Limit: 1}); err == nil && len(last) > 0 {
+		previous, _ := last[0].Detail["sections"].(map[string]any)
+		var changed []string
+		for name, hash := range hashes {
+			if previous[name] != hash {
+				changed = append(changed, name)
+			}
+		}
+		for name := range previous {
+			if _, ok := hashes[name]; !ok {
+				changed = append(changed, name)
+			}
+		}
+		if len(changed) > 0 {
+			sort.Strings(changed)
+			action = auditConfigChange
+			detail["changed"] = changed
+		}
+	}
+	s.audit.record(AuditEntry{Action: action, Actor: "system", Detail: detail})
+	if action == auditConfigChange {
+		s.logger.Printf("配置自上次启动后已修改: %v", detail["changed"])
+	}
+}
+
+// auditCLI 记录命令行（-useradd、-tokenadd 等）执行的操作
+func auditCLI(cfg *Config, action string, target string, detail map[string]any) {
+	if !cfg.Audit.Enable {
+		return
+	}
+	a, err := newAuditLog(cfg, log.Printf)
+	if err != nil {
+		log.Printf("警告: %v", err)
+		return
+	}
+	defer a.close()
+	actor := "cli"
+	if name := os.Getenv("USER"); name != "" {
+		actor += ":" + name
+	}
+	a.record(AuditEntry{Action: action, Actor: actor, Target: target, Detail: detail})
+}
+
+// handleAdminAudit 处理 GET /admin/audit：按 action、actor、ip、room、target、since、until 过滤，返回最新的 limit 条记录
+func (s *ClipboardServer) handleAdminAudit(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdminToken(extractAuthToken(r)) {
+		writeAuthJSONError(w, http.StatusUnauthorized, "需要管理员权限")
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "仅允许 GET 请求", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.audit == nil {
+		http.Error(w, "审计日志未启用", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	q := AuditQuery{
+		Action: query.Get("action"),
+		Actor:  query.Get("actor"),
+		IP:     query.Get("ip"),
+		Target: query.Get("target"),
+	}
+	if _, ok := query["room"]; ok {
+		q.Room = normalizeRoomName(query.Get("room"))
+	}
+	for _, p := range []struct {
+		name string
+		dst  *int64
+	}{{"since", &q.Since}, {"until", &q.Until}} {
+		if v := query.Get(p.name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				http.Error(w, "无效的参数: "+p.name, http.StatusBadRequest)
+				return
+			}
+			*p.dst = n
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "无效的参数: limit", http.StatusBadRequest)
+			return
+		}
+		q.Limit = n
+	}
+
+	entries, err := s.audit.query(q)
+	if err != nil {
+		s.logger.Printf("错误: 查询审计日志失败: %v", err)
+		http.Error(w, "查询审计日志失败", http.StatusInternalServerError)
+		return
+	}
+	if entries == nil {
+		entries = []AuditEntry{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{"entries": entries})
+}
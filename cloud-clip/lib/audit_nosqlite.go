@@ -0,0 +1,11 @@
+//go:build !sqlite
+// +build !sqlite
+
+package lib
+
+import "errors"
+
+// openAuditDB 默认构建不包含 SQLite 驱动，audit.sqlite 只在使用 -tags sqlite 构建时生效
+func openAuditDB(path string) (auditDB, error) {
+	return nil, errors.New("当前程序未包含 SQLite 支持，请使用 -tags sqlite 重新构建")
+}
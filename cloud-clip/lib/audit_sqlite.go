@@ -0,0 +1,131 @@
+//go:build sqlite
+// +build sqlite
+
+package lib
+
+/**
+*** FILE: audit_sqlite.go
+***   SQLite backend for the audit log (go build -tags sqlite, requires cgo); UPDATE and DELETE are rejected by triggers
+**/
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const auditSchema = `
+CREATE TABLE IF NOT EXISTS audit_log (
+	id     INTEGER PRIMARY KEY AUTOINCREMENT,
+	time   INTEGER NOT NULL,
+	action TEXT NOT NULL,
+	actor  TEXT NOT NULL,
+	device TEXT NOT NULL DEFAULT '',
+	ip     TEXT NOT NULL DEFAULT '',
+	room   TEXT NOT NULL DEFAULT '',
+	target TEXT NOT NULL DEFAULT '',
+	detail TEXT
+);
+CREATE INDEX IF NOT EXISTS audit_log_time ON audit_log (time);
+CREATE INDEX IF NOT EXISTS audit_log_action ON audit_log (action);
+CREATE INDEX IF NOT EXISTS audit_log_room ON audit_log (room);
+CREATE TRIGGER IF NOT EXISTS audit_log_no_update BEFORE UPDATE ON audit_log
+BEGIN SELECT RAISE(ABORT, 'audit_log is append-only'); END;
+CREATE TRIGGER IF NOT EXISTS audit_log_no_delete BEFORE DELETE ON audit_log
+BEGIN SELECT RAISE(ABORT, 'audit_log is append-only'); END;
+`
+
+type sqliteAuditDB struct {
+	db *sql.DB
+}
+
+func openAuditDB(path string) (auditDB, error) {
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(auditSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("初始化审计表失败: %w", err)
+	}
+	return &sqliteAuditDB{db: db}, nil
+}
+
+func (d *sqliteAuditDB) insert(e AuditEntry) error {
+	var detail sql.NullString
+	if len(e.Detail) > 0 {
+		data, err := json.Marshal(e.Detail)
+		if err != nil {
+			return err
+		}
+		detail = sql.NullString{String: string(data), Valid: true}
+	}
+	_, err := d.db.Exec(`INSERT INTO audit_log (time, action, actor, device, ip, room, target, detail) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.Time, e.Action, e.Actor, e.Device, e.IP, e.Room, e.Target, detail)
+	return err
+}
+
+func (d *sqliteAuditDB) query(q AuditQuery) ([]AuditEntry, error) {
+	var where []string
+	var args []any
+	if q.Action != "" {
+		if strings.HasSuffix(q.Action, ".") {
+			where = append(where, "substr(action, 1, ?) = ?")
+			args = append(args, len(q.Action), q.Action)
+		} else {
+			where = append(where, "action = ?")
+			args = append(args, q.Action)
+		}
+	}
+	for _, f := range []struct {
+		column string
+		value  string
+	}{{"actor", q.Actor}, {"ip", q.IP}, {"room", q.Room}, {"target", q.Target}} {
+		if f.value != "" {
+			where = append(where, f.column+" = ?")
+			args = append(args, f.value)
+		}
+	}
+	if q.Since != 0 {
+		where = append(where, "time >= ?")
+		args = append(args, q.Since)
+	}
+	if q.Until != 0 {
+		where = append(where, "time <= ?")
+		args = append(args, q.Until)
+	}
+
+	stmt := "SELECT time, action, actor, device, ip, room, target, detail FROM audit_log"
+	if len(where) > 0 {
+		stmt += " WHERE " + strings.Join(where, " AND ")
+	}
+	stmt += " ORDER BY id DESC LIMIT ?"
+	args = append(args, q.Limit)
+
+	rows, err := d.db.Query(stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		var detail sql.NullString
+		if err := rows.Scan(&e.Time, &e.Action, &e.Actor, &e.Device, &e.IP, &e.Room, &e.Target, &detail); err != nil {
+			return nil, err
+		}
+		if detail.Valid {
+			json.Unmarshal([]byte(detail.String), &e.Detail)
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (d *sqliteAuditDB) close() error {
+	return d.db.Close()
+}
@@ -0,0 +1,60 @@
+package lib
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+// newAuditTestServer 创建启用审计日志的服务器，并在其中创建受密码保护的 team 房间
+func newAuditTestServer(t *testing.T, session bool) *ClipboardServer {
+	t.Helper()
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Server.Auth = testAdminPassword
+		cfg.Session.Enable = session
+		cfg.Audit.Enable = true
+		cfg.Audit.File = filepath.Join(t.TempDir(), "audit.log")
+	})
+	t.Cleanup(s.audit.close)
+	rec := do(t, s, http.MethodPost, "/rooms", `{"name":"team","password":"team-pw"}`,
+		"Content-Type", "application/json", "Authorization", "Bearer "+testAdminPassword)
+	expectStatus(t, rec, http.StatusCreated)
+	return s
+}
+
+func TestAuditTextPostWithRegistryRoomPassword(t *testing.T) {
+	s := newAuditTestServer(t, false)
+	id := postText(t, s, "/text?room=team", "team secret", "Authorization", "Bearer team-pw")
+
+	entries, err := s.audit.query(AuditQuery{Action: auditMessagePost})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("message.post 记录数 = %d，期望 1", len(entries))
+	}
+	e := entries[0]
+	if e.Actor != "room:team" || e.Room != "team" || e.Target != id {
+		t.Fatalf("审计记录 = %+v", e)
+	}
+	if length, _ := e.Detail["length"].(float64); int(length) != len("team secret") {
+		t.Fatalf("detail = %v", e.Detail)
+	}
+	if _, ok := e.Detail["content"]; ok {
+		t.Fatal("审计记录不应包含文本内容")
+	}
+}
+
+func TestAuditActorUsesRoomSessionCookie(t *testing.T) {
+	s := newAuditTestServer(t, true)
+	cookie := loginRoom(t, s, "team", "team-pw")
+	postText(t, s, "/text?room=team", "via cookie", "Cookie", cookie)
+
+	entries, err := s.audit.query(AuditQuery{Action: auditMessagePost})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Actor != "room:team" {
+		t.Fatalf("审计记录 = %+v", entries)
+	}
+}
@@ -8,9 +8,10 @@ import (
 )
 
 type RoomAuthRequirement struct {
-	Room     string
-	Required bool
-	Password string
+	Room         string
+	Required     bool
+	Password     string
+	PasswordHash string // 通过房间管理 API 设置的房间密码（argon2id 哈希）
 }
 
 func normalizeAuthValue(auth interface{}) string {
@@ -46,6 +47,11 @@ func normalizeRoomAuthConfig(roomAuth map[string]string) map[string]string {
 }
 
 func extractAuthToken(r *http.Request) string {
+	return requestRoomToken(r, r.URL.Query().Get("room"))
+}
+
+// requestRoomToken 返回请求访问 room 时使用的令牌：Authorization 头和 ?auth= 优先，其次是该房间的会话 Cookie，最后是 OIDC 会话 Cookie
+func requestRoomToken(r *http.Request, room string) string {
 	authHeader := r.Header.Get("Authorization")
 	if authHeader != "" {
 		parts := strings.Split(authHeader, " ")
@@ -55,14 +61,26 @@ func extractAuthToken(r *http.Request) string {
 		return authHeader
 	}
 
-	return r.URL.Query().Get("auth")
+	if token := r.URL.Query().Get("auth"); token != "" {
+		return token
+	}
+
+	// 浏览器通过 POST /login 或 OIDC 登录后只携带会话 Cookie
+	if token := roomSessionCookieToken(r, room); token != "" {
+		return token
+	}
+	return sessionCookieToken(r)
 }
 
+// maxAuthTokens 是一个请求最多使用的令牌数量（Authorization、Cookie 和 X-Room-Auth-Tokens 合计），多余的被忽略
+const maxAuthTokens = 8
+
+// extractAuthTokens 返回请求携带的所有令牌（去重，最多 maxAuthTokens 个）
 func extractAuthTokens(r *http.Request) []string {
 	tokens := []string{}
 	pushToken := func(token string) {
 		normalized := strings.TrimSpace(token)
-		if normalized == "" {
+		if normalized == "" || len(tokens) >= maxAuthTokens {
 			return
 		}
 		for _, existing := range tokens {
@@ -74,6 +92,10 @@ func extractAuthTokens(r *http.Request) []string {
 	}
 
 	pushToken(extractAuthToken(r))
+	for _, token := range roomSessionCookieTokens(r) {
+		pushToken(token)
+	}
+	pushToken(sessionCookieToken(r))
 
 	extraHeader := strings.TrimSpace(r.Header.Get("X-Room-Auth-Tokens"))
 	if extraHeader == "" {
@@ -104,6 +126,13 @@ func (s *ClipboardServer) resolveRoomAuth(room string) RoomAuthRequirement {
 		return RoomAuthRequirement{Room: normalizedRoom, Required: true, Password: roomPassword}
 	}
 
+	// 配置文件中没有设置的房间，使用房间存储中的密码
+	if s.rooms != nil && !hasRoomPassword {
+		if passwordHash := s.rooms.passwordHash(normalizedRoom); passwordHash != "" {
+			return RoomAuthRequirement{Room: normalizedRoom, Required: true, PasswordHash: passwordHash}
+		}
+	}
+
 	if globalPassword != "" {
 		return RoomAuthRequirement{Room: normalizedRoom, Required: true, Password: globalPassword}
 	}
@@ -112,14 +141,47 @@ func (s *ClipboardServer) resolveRoomAuth(room string) RoomAuthRequirement {
 		return RoomAuthRequirement{Room: normalizedRoom}
 	}
 
+	// 没有房间密码时，启用 users.requireLogin 的房间只允许登录用户访问
+	if s.users != nil && s.config.Users.RequireLogin {
+		return RoomAuthRequirement{Room: normalizedRoom, Required: true}
+	}
+
+	// 同样，启用 oidc.requireLogin 后只允许通过 IdP 登录的用户（或 Bearer JWT）访问
+	if s.oidc != nil && s.config.OIDC.RequireLogin {
+		return RoomAuthRequirement{Room: normalizedRoom, Required: true}
+	}
+
 	return RoomAuthRequirement{Room: normalizedRoom}
 }
 
+// issuedTokenCanAccessRoom 判断 token 是否是可以访问房间的登录会话令牌（房间成员或所有者）、OIDC 会话或 JWT、房间会话，或 API 令牌
+func (s *ClipboardServer) issuedTokenCanAccessRoom(room string, token string) bool {
+	if u, ok := s.sessionUser(token); ok {
+		return u.canAccessRoom(room) || s.isRoomOwner(room, "user:"+u.Name)
+	}
+	if id, ok := s.oidcUser(token); ok {
+		return id.canAccessRoom(room) || s.isRoomOwner(room, "oidc:"+id.Name)
+	}
+	if sessionRoom, ok := s.roomSessionRoom(token); ok {
+		return sessionRoom == normalizeRoomName(room)
+	}
+	return s.apiTokenCanAccessRoom(room, token)
+}
+
 func (s *ClipboardServer) tokenMatchesRoom(room string, token string) bool {
+	return s.matchRoomToken(room, token, true)
+}
+
+// matchRoomToken 判断令牌能否访问房间，hashPasswords 为 false 时房间存储中的密码只使用缓存的校验结果
+func (s *ClipboardServer) matchRoomToken(room string, token string, hashPasswords bool) bool {
 	if token == "" {
 		return false
 	}
 
+	if s.issuedTokenCanAccessRoom(room, token) {
+		return true
+	}
+
 	globalPassword := normalizeAuthValue(s.config.Server.Auth)
 	if globalPassword != "" && token == globalPassword {
 		return true
@@ -130,6 +192,13 @@ func (s *ClipboardServer) tokenMatchesRoom(room string, token string) bool {
 		return token == roomPassword
 	}
 
+	if s.rooms != nil {
+		if !hashPasswords {
+			return s.rooms.checkPasswordCached(normalizedRoom, token)
+		}
+		return s.rooms.checkPassword(normalizedRoom, token)
+	}
+
 	return false
 }
 
@@ -142,11 +211,44 @@ func (s *ClipboardServer) canAccessRoom(room string, token string) bool {
 	return s.tokenMatchesRoom(room, token)
 }
 
+// requestCanAccessRoom 判断请求能否访问房间，请求没有携带令牌时使用该房间的会话 Cookie
+func (s *ClipboardServer) requestCanAccessRoom(r *http.Request, room string) bool {
+	return s.canAccessRoom(room, requestRoomToken(r, room))
+}
+
+// roomAccessToken 返回 tokens 中可以访问房间的 token，房间无需认证时返回空字符串
+func (s *ClipboardServer) roomAccessToken(room string, tokens []string) (string, bool) {
+	if s.canAccessRoom(room, "") {
+		return "", true
+	}
+	for _, token := range tokens {
+		if s.canAccessRoom(room, token) {
+			return token, true
+		}
+	}
+	return "", false
+}
+
+// roomListAccessToken 与 roomAccessToken 相同，但房间存储中的密码只使用缓存的校验结果，
+// 用于请求没有指定的房间，避免为每个房间、每个令牌计算 argon2
+func (s *ClipboardServer) roomListAccessToken(room string, tokens []string) (string, bool) {
+	if !s.resolveRoomAuth(room).Required {
+		return "", true
+	}
+	for _, token := range tokens {
+		if s.matchRoomToken(room, token, false) {
+			return token, true
+		}
+	}
+	return "", false
+}
+
 func (s *ClipboardServer) hasRoomAuthEntry(room string) bool {
 	normalizedRoom := normalizeRoomName(room)
-	_, ok := s.config.Server.RoomAuth[normalizedRoom]
-	return ok
-
+	if _, ok := s.config.Server.RoomAuth[normalizedRoom]; ok {
+		return true
+	}
+	return s.rooms != nil && s.rooms.passwordHash(normalizedRoom) != ""
 }
 
 func (s *ClipboardServer) getUploadedFileRoom(uuid string) (string, bool) {
@@ -161,11 +263,8 @@ func (s *ClipboardServer) getUploadedFileRoom(uuid string) (string, bool) {
 	return normalizeRoomName(fileInfo.Room), true
 }
 
-func (s *ClipboardServer) inferRequestRoom(r *http.Request) string {
-	if _, hasRoom := r.URL.Query()["room"]; hasRoom {
-		return normalizeRoomName(r.URL.Query().Get("room"))
-	}
-
+// uploadPathRoom 返回 /file/、/upload/chunk/、/upload/finish/ 路径所指文件的实际房间
+func (s *ClipboardServer) uploadPathRoom(r *http.Request) (string, bool) {
 	filePrefix := s.config.Server.Prefix + "/file/"
 	chunkPrefix := s.config.Server.Prefix + "/upload/chunk/"
 	finishPrefix := s.config.Server.Prefix + "/upload/finish/"
@@ -180,13 +279,21 @@ func (s *ClipboardServer) inferRequestRoom(r *http.Request) string {
 	case strings.HasPrefix(r.URL.Path, finishPrefix):
 		uuid = strings.TrimPrefix(r.URL.Path, finishPrefix)
 	}
-
-	if uuid != "" {
-		if room, ok := s.getUploadedFileRoom(uuid); ok {
-			return room
-		}
+	if uuid == "" {
+		return "", false
 	}
+	return s.getUploadedFileRoom(uuid)
+}
 
+// inferRequestRoom 返回请求作用的房间。指向已上传文件的路径总是使用文件的实际房间，
+// 忽略 room 查询参数，避免用其他房间的令牌访问文件
+func (s *ClipboardServer) inferRequestRoom(r *http.Request) string {
+	if room, ok := s.uploadPathRoom(r); ok {
+		return room
+	}
+	if _, hasRoom := r.URL.Query()["room"]; hasRoom {
+		return normalizeRoomName(r.URL.Query().Get("room"))
+	}
 	return "default"
 }
 
@@ -0,0 +1,118 @@
+package lib
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// addTestFile 在房间中登记一个已上传的文件
+func addTestFile(t *testing.T, s *ClipboardServer, uuid string, room string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(s.storageFolder, uuid), []byte("secret of "+room), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.runMutex.Lock()
+	s.uploadFileMap[uuid] = File{
+		Name:       uuid + ".txt",
+		UUID:       uuid,
+		Size:       int64(len("secret of " + room)),
+		UploadTime: time.Now().Unix(),
+		ExpireTime: time.Now().Add(time.Hour).Unix(),
+		Room:       room,
+	}
+	s.runMutex.Unlock()
+}
+
+// loginRoom 通过 POST /login 获取房间会话 Cookie
+func loginRoom(t *testing.T, s *ClipboardServer, room string, password string) string {
+	t.Helper()
+	rec := do(t, s, http.MethodPost, "/login", `{"room":"`+room+`","password":"`+password+`"}`, "Content-Type", "application/json")
+	expectStatus(t, rec, http.StatusOK)
+	value, ok := cookieValue(rec, roomSessionCookieName(room))
+	if !ok {
+		t.Fatal("登录后应设置房间会话 Cookie")
+	}
+	return roomSessionCookieName(room) + "=" + value
+}
+
+func TestFileAccessUsesFileRoom(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Server.RoomAuth = map[string]string{"alpha": "pw-alpha", "beta": "pw-beta"}
+		cfg.Session.Enable = true
+	})
+	addTestFile(t, s, "file-beta", "beta")
+	alphaCookie := loginRoom(t, s, "alpha", "pw-alpha")
+
+	tests := []struct {
+		name    string
+		method  string
+		target  string
+		headers []string
+		want    int
+	}{
+		{"其他房间的密码", http.MethodGet, "/file/file-beta", []string{"Authorization", "Bearer pw-alpha"}, http.StatusUnauthorized},
+		{"其他房间的密码加 room 参数", http.MethodGet, "/file/file-beta?room=alpha", []string{"Authorization", "Bearer pw-alpha"}, http.StatusUnauthorized},
+		{"其他房间的会话 Cookie 加 room 参数", http.MethodGet, "/file/file-beta?room=alpha", []string{"Cookie", alphaCookie}, http.StatusUnauthorized},
+		{"删除时使用其他房间的密码加 room 参数", http.MethodDelete, "/file/file-beta?room=alpha", []string{"Authorization", "Bearer pw-alpha"}, http.StatusUnauthorized},
+		{"本房间密码但 room 参数不符", http.MethodGet, "/file/file-beta?room=alpha", []string{"Authorization", "Bearer pw-beta"}, http.StatusForbidden},
+		{"本房间密码", http.MethodGet, "/file/file-beta", []string{"Authorization", "Bearer pw-beta"}, http.StatusOK},
+		{"本房间密码和 room 参数", http.MethodGet, "/file/file-beta?room=beta", []string{"Authorization", "Bearer pw-beta"}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := do(t, s, tt.method, tt.target, "", tt.headers...)
+			expectStatus(t, rec, tt.want)
+		})
+	}
+
+	s.runMutex.Lock()
+	_, exists := s.uploadFileMap["file-beta"]
+	s.runMutex.Unlock()
+	if !exists {
+		t.Fatal("其他房间的令牌不应能删除文件")
+	}
+}
+
+func TestFileAccessAPITokenScopedToFileRoom(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Server.RoomAuth = map[string]string{"alpha": "pw-alpha", "beta": "pw-beta"}
+	})
+	addTestFile(t, s, "file-beta", "beta")
+
+	created, err := s.tokens.create("alpha-only", []string{scopeRead, scopeRevoke}, []string{"alpha"}, 0, "test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		rec := do(t, s, method, "/file/file-beta?room=alpha", "", "Authorization", "Bearer "+created.Token)
+		if rec.Code == http.StatusOK {
+			t.Fatalf("%s: 限定 alpha 房间的令牌不应能访问 beta 房间的文件", method)
+		}
+	}
+}
+
+func TestRevokeUsesMessageRoomCookie(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Server.RoomAuth = map[string]string{"alpha": "pw-alpha", "beta": "pw-beta"}
+		cfg.Session.Enable = true
+	})
+	alphaCookie := loginRoom(t, s, "alpha", "pw-alpha")
+	betaCookie := loginRoom(t, s, "beta", "pw-beta")
+	post := func() string {
+		return postText(t, s, "/text?room=alpha", "alpha secret", "Authorization", "Bearer pw-alpha")
+	}
+
+	// 只有其他房间的会话 Cookie 时不能撤销
+	id := post()
+	expectStatus(t, do(t, s, http.MethodDelete, "/revoke/"+id, "", "Cookie", betaCookie), http.StatusUnauthorized)
+	expectStatus(t, do(t, s, http.MethodDelete, "/revoke/"+id+"?room=alpha", "", "Cookie", betaCookie), http.StatusUnauthorized)
+
+	// 不带 ?room 时按消息所在房间选择会话 Cookie
+	expectStatus(t, do(t, s, http.MethodDelete, "/revoke/"+id, "", "Cookie", betaCookie+"; "+alphaCookie), http.StatusOK)
+	id = post()
+	expectStatus(t, do(t, s, http.MethodDelete, "/revoke/"+id+"?room=alpha", "", "Cookie", alphaCookie), http.StatusOK)
+}
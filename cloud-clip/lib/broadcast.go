@@ -1,7 +1,10 @@
 package lib
 
 import (
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -9,89 +12,76 @@ import (
 
 // broadcastMessageToRoomExcept 将消息广播到房间中的所有客户端，除了一个特定的连接。
 func (s *ClipboardServer) broadcastMessageToRoomExcept(message PostEvent, room string, exceptConn *websocket.Conn) {
-	// 第一步：在锁内收集需要发送的连接
-	var targetConnections []*websocket.Conn
-	s.runMutex.Lock()
-	for client, clientRoom := range s.room_ws {
-		if client == exceptConn {
-			continue
-		}
-		if room == "" || clientRoom == room {
-			targetConnections = append(targetConnections, client)
-		}
-	}
-	s.runMutex.Unlock()
-
-	// 第二步：在锁外进行网络操作
-	var failedConnections []*websocket.Conn
-	for _, client := range targetConnections {
-		if err := client.WriteJSON(message); err != nil {
-			s.logger.Printf("错误: 写入消息到 WebSocket 客户端 %s 失败: %v。计划移除客户端。", client.RemoteAddr(), err)
-			failedConnections = append(failedConnections, client)
-		}
-	}
-
-	// 第三步：清理失败的连接
-	if len(failedConnections) > 0 {
-		s.runMutex.Lock()
-		for _, client := range failedConnections {
-			client.Close()
-			delete(s.websockets, client)
-			delete(s.room_ws, client)
-			if deviceID, ok := s.connDeviceIDMap[client]; ok {
-				delete(s.connDeviceIDMap, client)
-				delete(s.deviceConnected, deviceID)
-			}
-		}
-		s.runMutex.Unlock()
-	}
+	s.broadcastWebSocketMessageToRoomExcept(postEventMessage(message), room, exceptConn)
 }
 
-// broadcastMessage 向所有连接的 WebSocket 客户端（可选地，特定房间）广播消息。
-// 这个方法需要是线程安全的，因为它会被多个 goroutine 调用。
+// broadcastMessage 向所有订阅者（可选地，特定房间）广播消息。
+// 只向 hub 中对应房间的订阅者分发，不需要遍历所有连接，可以被多个 goroutine 同时调用。
 func (s *ClipboardServer) broadcastMessage(message PostEvent, room string) {
 	s.logger.Printf("广播消息 (ID: %d, 类型: %s) 到房间 '%s'", message.Data.ID(), message.Event, room)
+	s.hub.publish(hubEvent{Room: room, Message: postEventMessage(message)})
+}
 
-	// 第一步：在锁内收集需要发送的连接
-	var targetConnections []*websocket.Conn
-	s.runMutex.Lock()
-	for client, clientRoom := range s.room_ws {
-		if room == "" || clientRoom == room {
-			targetConnections = append(targetConnections, client)
+// postEventMessage 将内部事件转换为发送给客户端的 WebSocketMessage，敏感文本只发送遮盖后的内容
+func postEventMessage(message PostEvent) WebSocketMessage {
+	return WebSocketMessage{Event: message.Event, Data: message.Data.Payload()}
+}
+
+// 待投递私信队列的上限
+const (
+	maxPendingDirectPerDevice = 100
+	maxPendingDirectDevices   = 1000
+)
+
+// messageOptions 是发送消息时的可选参数
+type messageOptions struct {
+	To      string // 私信目标设备ID，为空表示发送给整个房间
+	ReplyTo int    // 回复的父消息ID
+}
+
+// parseMessageOptions 从请求参数中解析私信目标 (?to=) 和回复的父消息 (?replyTo=)，并校验父消息属于同一房间
+func (s *ClipboardServer) parseMessageOptions(r *http.Request, room string) (messageOptions, error) {
+	replyTo := 0
+	if replyToStr := strings.TrimSpace(r.URL.Query().Get("replyTo")); replyToStr != "" {
+		var err error
+		if replyTo, err = strconv.Atoi(replyToStr); err != nil || replyTo <= 0 {
+			return messageOptions{}, fmt.Errorf("无效的 replyTo 参数: %s", replyToStr)
 		}
 	}
-	s.runMutex.Unlock()
+	return s.newMessageOptions(room, r.URL.Query().Get("to"), replyTo)
+}
+
+// newMessageOptions 构建消息选项，私信目标必须是已注册的设备，replyTo 不为 0 时校验父消息属于同一房间
+func (s *ClipboardServer) newMessageOptions(room string, to string, replyTo int) (messageOptions, error) {
+	opts := messageOptions{
+		To: strings.TrimSpace(to),
+	}
 
-	// 第二步：在锁外进行网络操作
-	var failedConnections []*websocket.Conn
-	for _, client := range targetConnections {
-		if err := client.WriteJSON(message); err != nil {
-			s.logger.Printf("错误: 写入消息到 WebSocket 客户端 %s 失败: %v。移除客户端。", client.RemoteAddr(), err)
-			failedConnections = append(failedConnections, client)
+	if opts.To != "" {
+		if _, ok := s.devices.get(opts.To); !ok {
+			return opts, fmt.Errorf("私信目标设备不存在: %s", opts.To)
 		}
 	}
 
-	// 第三步：清理失败的连接
-	if len(failedConnections) > 0 {
-		s.runMutex.Lock()
-		for _, client := range failedConnections {
-			client.Close()
-			delete(s.websockets, client)
-			delete(s.room_ws, client)
-			if deviceID, ok := s.connDeviceIDMap[client]; ok {
-				delete(s.connDeviceIDMap, client)
-				delete(s.deviceConnected, deviceID)
-			}
+	if replyTo < 0 {
+		return opts, fmt.Errorf("无效的 replyTo 参数: %d", replyTo)
+	}
+	if replyTo > 0 {
+		if err := s.validateReplyParent(room, replyTo); err != nil {
+			return opts, err
 		}
-		s.runMutex.Unlock()
+		opts.ReplyTo = replyTo
 	}
+
+	return opts, nil
 }
 
 // addMessageToQueueAndBroadcast 添加消息到队列并广播
 // 这是一个辅助函数，供 handle_text, handle_finish 等调用
-func (s *ClipboardServer) addMessageToQueueAndBroadcast(dataType string, data interface{}, room string, r *http.Request) PostEvent {
+// opts.To 不为空时消息为私信，只投递给该设备的连接
+func (s *ClipboardServer) addMessageToQueueAndBroadcast(dataType string, data interface{}, room string, opts messageOptions, r *http.Request) PostEvent {
 	ip := get_remote_ip(r)
-	ua := s.parse_user_agent(r.UserAgent())
+	ua := s.senderDevice(r)
 
 	// Create ReceiveBase first
 	receiveBase := ReceiveBase{
@@ -101,6 +91,8 @@ func (s *ClipboardServer) addMessageToQueueAndBroadcast(dataType string, data in
 		Timestamp:    time.Now().Unix(),
 		SenderIP:     ip,
 		SenderDevice: ua,
+		To:           opts.To,
+		ReplyTo:      opts.ReplyTo,
 	}
 
 	// Create ReceiveHolder
@@ -111,6 +103,7 @@ func (s *ClipboardServer) addMessageToQueueAndBroadcast(dataType string, data in
 			ReceiveBase: receiveBase,
 			Content:     data.(string),
 		}
+		s.markSensitive(rh.TextReceive)
 	case "file":
 		fileRec := data.(*FileReceive)
 		// Ensure FileReceive's own ReceiveBase is also populated if it's not already
@@ -132,104 +125,159 @@ func (s *ClipboardServer) addMessageToQueueAndBroadcast(dataType string, data in
 		Data:  rh,       // ReceiveHolder
 	}
 	s.messageQueue.Append(&storeEvent) // msg.go 处理这个 PostEvent
+	s.pruneReceipts()                  // 清理被淘汰消息的回执
+	if rh.FileReceive != nil {
+		s.recordAudit(r, auditMessageUpload, room, strconv.Itoa(storeEvent.Data.ID()), map[string]any{"name": rh.FileReceive.Name, "size": rh.FileReceive.Size})
+	} else {
+		// 不记录文本内容，只记录长度
+		detail := map[string]any{"length": len(rh.TextReceive.Content)}
+		if opts.To != "" {
+			detail["to"] = opts.To
+		}
+		s.recordAudit(r, auditMessagePost, room, strconv.Itoa(storeEvent.Data.ID()), detail)
+	}
 	// 更新房间消息统计
 	s.updateRoomStats(room, 1)
 	// 准备发送给客户端的 WebSocket 消息
-	var clientPayload interface{}
-	if rh.TextReceive != nil {
-		clientPayload = rh.TextReceive
-	} else if rh.FileReceive != nil {
-		clientPayload = rh.FileReceive
-	}
+	clientPayload := rh.Payload() // 敏感文本只发送遮盖后的内容
 
 	if clientPayload != nil {
 		wsMsg := WebSocketMessage{
 			Event: "receive",     // 前端期望的事件名
 			Data:  clientPayload, // 前端期望的直接数据
 		}
-		s.broadcastWebSocketMessage(wsMsg, room) // 新的广播函数
+		if opts.To != "" {
+			if s.sendWebSocketMessageToDevice(wsMsg, room, opts.To) == 0 {
+				s.queuePendingDirect(opts.To, storeEvent)
+			}
+		} else {
+			s.broadcastWebSocketMessage(wsMsg, room) // 新的广播函数
+		}
 	}
 
 	s.saveHistoryData()
 	return storeEvent // 返回内部事件，例如用于获取ID
 }
 
-// broadcastWebSocketMessage 向所有连接的 WebSocket 客户端（可选地，特定房间）广播 WebSocketMessage。
+// broadcastWebSocketMessage 向所有订阅者（可选地，特定房间）广播 WebSocketMessage，WebSocket 和 SSE 订阅者都会收到。
 func (s *ClipboardServer) broadcastWebSocketMessage(message WebSocketMessage, room string) {
 	s.logger.Printf("广播 WebSocket 消消息 (类型: %s) 到房间 '%s'", message.Event, room)
+	s.hub.publish(hubEvent{Room: room, Message: message})
+}
 
-	// 第一步：在锁内收集需要发送的连接
-	var targetConnections []*websocket.Conn
+// broadcastWebSocketMessageToRoomExcept 将 WebSocketMessage 广播到房间中的所有订阅者，除了一个特定的连接。
+func (s *ClipboardServer) broadcastWebSocketMessageToRoomExcept(message WebSocketMessage, room string, exceptConn *websocket.Conn) {
 	s.runMutex.Lock()
-	for client, clientRoom := range s.room_ws {
-		if room == "" || clientRoom == room {
-			targetConnections = append(targetConnections, client)
-		}
-	}
+	except := s.wsSubscribers[exceptConn]
 	s.runMutex.Unlock()
 
-	// 第二步：在锁外进行网络操作
-	var failedConnections []*websocket.Conn
-	for _, client := range targetConnections {
-		if err := client.WriteJSON(message); err != nil {
-			s.logger.Printf("错误: 写入 WebSocketMessage 到客户端 %s 失败: %v。计划移除客户端。", client.RemoteAddr(), err)
-			failedConnections = append(failedConnections, client)
-		}
+	s.hub.publish(hubEvent{Room: room, Except: except, Message: message})
+}
+
+// sendWebSocketMessageToDevice 将 WebSocketMessage 发送给房间中指定设备的所有连接，返回接收到消息的连接数。
+func (s *ClipboardServer) sendWebSocketMessageToDevice(message WebSocketMessage, room string, deviceID string) int {
+	s.logger.Printf("发送 WebSocket 私信 (类型: %s) 到房间 '%s' 的设备 %s", message.Event, room, deviceID)
+	return s.hub.publish(hubEvent{Room: room, To: deviceID, Message: message})
+}
+
+// sendToWebSocket 通过连接的写入 goroutine 向单个连接发送消息，连接已关闭时返回 false
+func (s *ClipboardServer) sendToWebSocket(conn *websocket.Conn, message WebSocketMessage) bool {
+	s.runMutex.Lock()
+	sub := s.wsSubscribers[conn]
+	s.runMutex.Unlock()
+
+	if sub == nil {
+		return false
 	}
+	return sub.send(message)
+}
 
-	// 第三步：清理失败的连接
-	if len(failedConnections) > 0 {
-		s.runMutex.Lock()
-		for _, client := range failedConnections {
-			client.Close()
-			delete(s.websockets, client)
-			delete(s.room_ws, client)
-			// 从 connDeviceIDMap 中查找并删除对应的设备ID
-			if deviceID, ok := s.connDeviceIDMap[client]; ok {
-				delete(s.connDeviceIDMap, client)
-				delete(s.deviceConnected, deviceID)
+// writeWebSocketLoop 是连接唯一的写入者，按顺序将订阅到的事件写入 WebSocket。
+// 写入失败或订阅被 hub 断开时关闭连接，读取 goroutine 随后负责清理。
+func (s *ClipboardServer) writeWebSocketLoop(conn *websocket.Conn, sub *hubSubscriber) {
+	for {
+		select {
+		case ev := <-sub.events:
+			message := ev.Message
+			if message.Room == "" {
+				message.Room = ev.Room // 标记事件所属的房间
+			}
+			if err := conn.WriteJSON(message); err != nil {
+				s.logger.Printf("错误: 写入 WebSocketMessage 到客户端 %s 失败: %v。关闭连接。", conn.RemoteAddr(), err)
+				conn.Close()
+				return
 			}
+		case <-sub.done:
+			for _, ev := range sub.drain() {
+				message := ev.Message
+				if message.Room == "" {
+					message.Room = ev.Room
+				}
+				if conn.WriteJSON(message) != nil {
+					break
+				}
+			}
+			conn.Close()
+			return
 		}
-		s.runMutex.Unlock()
 	}
 }
 
-// broadcastWebSocketMessageToRoomExcept 将 WebSocketMessage 广播到房间中的所有客户端，除了一个特定的连接。
-func (s *ClipboardServer) broadcastWebSocketMessageToRoomExcept(message WebSocketMessage, room string, exceptConn *websocket.Conn) {
-	// 第一步：在锁内收集需要发送的连接
-	var targetConnections []*websocket.Conn
+// queuePendingDirect 目标设备不在线时暂存私信，等待其下次连接时投递。
+// 每个设备最多暂存 maxPendingDirectPerDevice 条（超过时丢弃最早的），最多为 maxPendingDirectDevices 个设备暂存
+func (s *ClipboardServer) queuePendingDirect(deviceID string, event PostEvent) {
 	s.runMutex.Lock()
-	for client, clientRoom := range s.room_ws {
-		if client == exceptConn {
-			continue
-		}
-		if room == "" || clientRoom == room {
-			targetConnections = append(targetConnections, client)
-		}
+	defer s.runMutex.Unlock()
+
+	queue, exists := s.pendingDirect[deviceID]
+	if !exists && len(s.pendingDirect) >= maxPendingDirectDevices {
+		s.logger.Printf("待投递私信的设备数量已达上限 (%d)，私信 (ID: %d) 不再暂存，设备 %s 上线后仍可从历史记录中获取", maxPendingDirectDevices, event.Data.ID(), deviceID)
+		return
 	}
-	s.runMutex.Unlock()
+	if len(queue) >= maxPendingDirectPerDevice {
+		queue = append(queue[:0:0], queue[len(queue)-maxPendingDirectPerDevice+1:]...)
+	}
+	s.pendingDirect[deviceID] = append(queue, event)
+	s.logger.Printf("设备 %s 不在线，私信 (ID: %d) 已加入待投递队列，当前待投递 %d 条", deviceID, event.Data.ID(), len(s.pendingDirect[deviceID]))
+}
 
-	// 第二步：在锁外进行网络操作
-	var failedConnections []*websocket.Conn
-	for _, client := range targetConnections {
-		if err := client.WriteJSON(message); err != nil {
-			s.logger.Printf("错误: 写入 WebSocketMessage (except) 到客户端 %s 失败: %v。", client.RemoteAddr(), err)
-			failedConnections = append(failedConnections, client)
+// takePendingDirect 取出并清空设备在指定房间的待投递私信
+func (s *ClipboardServer) takePendingDirect(deviceID string, room string) []PostEvent {
+	s.runMutex.Lock()
+	defer s.runMutex.Unlock()
+
+	var taken, remaining []PostEvent
+	for _, event := range s.pendingDirect[deviceID] {
+		if normalizeRoomName(event.Data.Room()) == room {
+			taken = append(taken, event)
+		} else {
+			remaining = append(remaining, event)
 		}
 	}
+	if len(remaining) > 0 {
+		s.pendingDirect[deviceID] = remaining
+	} else {
+		delete(s.pendingDirect, deviceID)
+	}
+	return taken
+}
 
-	// 第三步：清理失败的连接
-	if len(failedConnections) > 0 {
-		s.runMutex.Lock()
-		for _, client := range failedConnections {
-			client.Close()
-			delete(s.websockets, client)
-			delete(s.room_ws, client)
-			if deviceID, ok := s.connDeviceIDMap[client]; ok {
-				delete(s.connDeviceIDMap, client)
-				delete(s.deviceConnected, deviceID)
+// dropPendingDirect 在消息被撤销时从待投递队列中移除
+func (s *ClipboardServer) dropPendingDirect(shouldDrop func(PostEvent) bool) {
+	s.runMutex.Lock()
+	defer s.runMutex.Unlock()
+
+	for deviceID, events := range s.pendingDirect {
+		var kept []PostEvent
+		for _, event := range events {
+			if !shouldDrop(event) {
+				kept = append(kept, event)
 			}
 		}
-		s.runMutex.Unlock()
+		if len(kept) > 0 {
+			s.pendingDirect[deviceID] = kept
+		} else {
+			delete(s.pendingDirect, deviceID)
+		}
 	}
 }
@@ -28,15 +28,89 @@ type Config struct {
 		// 添加房间相关配置
 		RoomList    bool `json:"roomList"`    // 是否启用房间列表功能
 		RoomCleanup int  `json:"roomCleanup"` // 房间清理间隔（秒）
+
+		ReplyRevoke string `json:"replyRevoke"` // 父消息被撤销时回复的处理方式: "orphan"(保留回复) 或 "cascade"(一并撤销)
+		Dedup       int    `json:"dedup"`       // 连续重复消息的合并窗口（秒），0 表示不合并
+
+		// 反向代理相关配置
+		TrustedProxies []string `json:"trustedProxies"` // 可信代理的 CIDR / IP 列表（或 loopback、private），只有来自这些地址的转发头才会被采用
+		ProxyProtocol  bool     `json:"proxyProtocol"`  // 监听端口接受来自可信代理的 PROXY 协议 v1/v2 头
 	} `json:"server"`
 	Text struct {
-		Limit int `json:"limit"` //done
+		Limit    int  `json:"limit"`    //done
+		Overflow bool `json:"overflow"` // 超出 limit 的文本保存为文件消息，而不是返回 413
 	} `json:"text"`
 	File struct {
 		Expire int `json:"expire"` //done
 		Chunk  int `json:"chunk"`  //done, but no limit
 		Limit  int `json:"limit"`  //done
 	} `json:"file"`
+	Sensitive struct {
+		Enable   bool     `json:"enable"`   // 是否检测敏感内容（密码、密钥、验证码等）
+		TTL      int      `json:"ttl"`      // 敏感消息自动撤销时间（秒），0 表示不自动撤销
+		Persist  bool     `json:"persist"`  // 是否将敏感消息写入历史文件
+		Patterns []string `json:"patterns"` // 额外的自定义正则
+	} `json:"sensitive"`
+	Users struct {
+		Enable       bool   `json:"enable"`       // 是否启用用户账号（登录后按房间成员访问）
+		File         string `json:"file"`         // 用户存储文件，为空时使用历史文件所在目录的 users.json
+		SessionTTL   int    `json:"sessionTTL"`   // 登录会话有效期（秒）
+		RequireLogin bool   `json:"requireLogin"` // 没有房间密码的房间也需要登录才能访问
+	} `json:"users"`
+	OIDC struct {
+		Enable        bool                `json:"enable"`        // 是否启用 OpenID Connect 登录
+		Issuer        string              `json:"issuer"`        // IdP 地址，通过 /.well-known/openid-configuration 发现端点
+		ClientID      string              `json:"clientId"`      // 客户端 ID
+		ClientSecret  string              `json:"clientSecret"`  // 客户端密钥，公开客户端（只使用 PKCE）可以为空
+		RedirectURL   string              `json:"redirectUrl"`   // 回调地址，为空时按请求生成 {scheme}://{host}{prefix}/oidc/callback
+		Scopes        []string            `json:"scopes"`        // 请求的 scope
+		Audiences     []string            `json:"audiences"`     // API 调用的 Bearer JWT 可接受的 aud，为空时只接受 clientId
+		UsernameClaim string              `json:"usernameClaim"` // 用户名所在的 claim，缺失时依次使用 email、sub
+		GroupsClaim   string              `json:"groupsClaim"`   // 用户组所在的 claim，支持 a.b 形式的嵌套路径
+		RoomsClaim    string              `json:"roomsClaim"`    // 直接列出可访问房间的 claim，为空表示不使用
+		GroupRooms    map[string][]string `json:"groupRooms"`    // 用户组 -> 可以访问的房间，"*" 表示所有房间
+		DefaultRooms  []string            `json:"defaultRooms"`  // 所有登录用户都可以访问的房间
+		AdminGroups   []string            `json:"adminGroups"`   // 这些用户组的成员为管理员（可以访问所有房间）
+		SessionTTL    int                 `json:"sessionTTL"`    // 登录会话有效期（秒）
+		RequireLogin  bool                `json:"requireLogin"`  // 没有房间密码的房间也需要登录才能访问
+	} `json:"oidc"`
+	Session struct {
+		Enable      bool   `json:"enable"`      // 是否允许通过 POST /login 用房间密码换取会话 Cookie
+		TTL         int    `json:"ttl"`         // 会话最长有效期（秒）
+		IdleTimeout int    `json:"idleTimeout"` // 会话闲置多久后失效（秒），0 表示不限制
+		SameSite    string `json:"sameSite"`    // Cookie 的 SameSite 属性："strict" 或 "lax"
+	} `json:"session"`
+	Rooms struct {
+		Enable      bool   `json:"enable"`      // 是否允许通过 API 创建和管理房间
+		File        string `json:"file"`        // 房间存储文件，为空时使用历史文件所在目录的 rooms.json
+		AllowCreate string `json:"allowCreate"` // 谁可以创建房间："admin"（管理员）或 "users"（登录用户和 OIDC 用户）
+	} `json:"rooms"`
+	Pairing struct {
+		Enable   bool `json:"enable"`   // 是否允许已授权的设备生成配对码
+		CodeTTL  int  `json:"codeTTL"`  // 配对码有效期（秒）
+		TokenTTL int  `json:"tokenTTL"` // 配对设备令牌有效期（秒），0 表示永不过期
+	} `json:"pairing"`
+	Share struct {
+		Enable     bool   `json:"enable"`     // 是否允许创建分享链接
+		Secret     string `json:"secret"`     // 分享链接签名密钥，为空时自动生成并保存到 share.key
+		DefaultTTL int    `json:"defaultTTL"` // 分享链接默认有效期（秒）
+		MaxTTL     int    `json:"maxTTL"`     // 分享链接最长有效期（秒），0 表示不限制
+	} `json:"share"`
+	RateLimit struct {
+		Enable        bool                     `json:"enable"`        // 是否启用限流和认证失败锁定
+		Classes       map[string]RateLimitRule `json:"classes"`       // 各路由类别（auth、push、write、read）的令牌桶参数
+		MaxFailures   int                      `json:"maxFailures"`   // 认证失败多少次后锁定 IP
+		FailureWindow int                      `json:"failureWindow"` // 失败计数窗口（秒），超过后重新计数
+		LockoutBase   int                      `json:"lockoutBase"`   // 首次锁定时长（秒），之后每次翻倍
+		LockoutMax    int                      `json:"lockoutMax"`    // 最长锁定时长（秒）
+	} `json:"rateLimit"`
+	Audit struct {
+		Enable   bool   `json:"enable"`   // 是否记录审计日志
+		File     string `json:"file"`     // JSON lines 文件路径，默认与用户存储同目录的 audit.log
+		MaxSize  int    `json:"maxSize"`  // 单个日志文件的最大大小（MB），超过后轮转
+		MaxFiles int    `json:"maxFiles"` // 保留的轮转文件数量
+		SQLite   string `json:"sqlite"`   // 同时写入的 SQLite 数据库路径（需要使用 -tags sqlite 构建），为空表示不使用
+	} `json:"audit"`
 }
 
 // var config_path = "config.json"
@@ -99,6 +173,11 @@ func defaultConfig() *Config {
 			Key         string            `json:"key"`
 			RoomList    bool              `json:"roomList"`
 			RoomCleanup int               `json:"roomCleanup"`
+			ReplyRevoke string            `json:"replyRevoke"`
+			Dedup       int               `json:"dedup"`
+
+			TrustedProxies []string `json:"trustedProxies"`
+			ProxyProtocol  bool     `json:"proxyProtocol"`
 		}{
 			Host:        []string{"0.0.0.0"},
 			Port:        9501,
@@ -112,11 +191,18 @@ func defaultConfig() *Config {
 			Key:         "",
 			RoomList:    false, // 默认关闭房间列表功能
 			RoomCleanup: 3600,  // 默认1小时清理一次空房间
+			ReplyRevoke: replyRevokeOrphan,
+			Dedup:       0, // 默认不合并重复消息
+
+			TrustedProxies: []string{"loopback"}, // 默认只信任本机的反向代理
+			ProxyProtocol:  false,
 		},
 		Text: struct {
-			Limit int `json:"limit"`
+			Limit    int  `json:"limit"`
+			Overflow bool `json:"overflow"`
 		}{
-			Limit: 4096,
+			Limit:    4096,
+			Overflow: false, // 默认拒绝超长文本
 		},
 		File: struct {
 			Expire int `json:"expire"`
@@ -127,6 +213,124 @@ func defaultConfig() *Config {
 			Chunk:  1 * _MB,
 			Limit:  256 * _MB,
 		},
+		Sensitive: struct {
+			Enable   bool     `json:"enable"`
+			TTL      int      `json:"ttl"`
+			Persist  bool     `json:"persist"`
+			Patterns []string `json:"patterns"`
+		}{
+			Enable:   false, // 默认关闭敏感内容检测
+			TTL:      300,   // 默认 5 分钟后自动撤销
+			Persist:  false,
+			Patterns: []string{},
+		},
+		Users: struct {
+			Enable       bool   `json:"enable"`
+			File         string `json:"file"`
+			SessionTTL   int    `json:"sessionTTL"`
+			RequireLogin bool   `json:"requireLogin"`
+		}{
+			Enable:       false, // 默认只使用 auth / roomAuth 密码
+			File:         "",
+			SessionTTL:   defaultSessionTTL,
+			RequireLogin: false,
+		},
+		OIDC: struct {
+			Enable        bool                `json:"enable"`
+			Issuer        string              `json:"issuer"`
+			ClientID      string              `json:"clientId"`
+			ClientSecret  string              `json:"clientSecret"`
+			RedirectURL   string              `json:"redirectUrl"`
+			Scopes        []string            `json:"scopes"`
+			Audiences     []string            `json:"audiences"`
+			UsernameClaim string              `json:"usernameClaim"`
+			GroupsClaim   string              `json:"groupsClaim"`
+			RoomsClaim    string              `json:"roomsClaim"`
+			GroupRooms    map[string][]string `json:"groupRooms"`
+			DefaultRooms  []string            `json:"defaultRooms"`
+			AdminGroups   []string            `json:"adminGroups"`
+			SessionTTL    int                 `json:"sessionTTL"`
+			RequireLogin  bool                `json:"requireLogin"`
+		}{
+			Enable:        false,
+			Scopes:        []string{"openid", "profile", "email", "groups"},
+			Audiences:     []string{},
+			UsernameClaim: "preferred_username",
+			GroupsClaim:   "groups",
+			GroupRooms:    map[string][]string{},
+			DefaultRooms:  []string{},
+			AdminGroups:   []string{},
+			SessionTTL:    8 * 3600,
+			RequireLogin:  false,
+		},
+		Session: struct {
+			Enable      bool   `json:"enable"`
+			TTL         int    `json:"ttl"`
+			IdleTimeout int    `json:"idleTimeout"`
+			SameSite    string `json:"sameSite"`
+		}{
+			Enable:      true,
+			TTL:         7 * 24 * 3600,
+			IdleTimeout: 0,
+			SameSite:    "strict",
+		},
+		Rooms: struct {
+			Enable      bool   `json:"enable"`
+			File        string `json:"file"`
+			AllowCreate string `json:"allowCreate"`
+		}{
+			Enable:      true,
+			File:        "",
+			AllowCreate: "admin",
+		},
+		Pairing: struct {
+			Enable   bool `json:"enable"`
+			CodeTTL  int  `json:"codeTTL"`
+			TokenTTL int  `json:"tokenTTL"`
+		}{
+			Enable:   true,
+			CodeTTL:  defaultPairCodeTTL,
+			TokenTTL: 0,
+		},
+		Share: struct {
+			Enable     bool   `json:"enable"`
+			Secret     string `json:"secret"`
+			DefaultTTL int    `json:"defaultTTL"`
+			MaxTTL     int    `json:"maxTTL"`
+		}{
+			Enable:     true,
+			Secret:     "",
+			DefaultTTL: defaultShareTTL,
+			MaxTTL:     30 * 24 * 3600,
+		},
+		RateLimit: struct {
+			Enable        bool                     `json:"enable"`
+			Classes       map[string]RateLimitRule `json:"classes"`
+			MaxFailures   int                      `json:"maxFailures"`
+			FailureWindow int                      `json:"failureWindow"`
+			LockoutBase   int                      `json:"lockoutBase"`
+			LockoutMax    int                      `json:"lockoutMax"`
+		}{
+			Enable:        true,
+			Classes:       defaultRateLimitRules(),
+			MaxFailures:   5,
+			FailureWindow: 900,
+			LockoutBase:   60,
+			LockoutMax:    3600,
+		},
+		Audit: struct {
+			Enable   bool   `json:"enable"`
+			File     string `json:"file"`
+			MaxSize  int    `json:"maxSize"`
+			MaxFiles int    `json:"maxFiles"`
+			SQLite   string `json:"sqlite"`
+		}{
+			Enable:   true,
+			File:     "",
+			MaxSize:  10,
+			MaxFiles: 5,
+			SQLite:   "",
+		},
 	}
 }
 
@@ -0,0 +1,117 @@
+package lib
+
+/**
+*** FILE: dedup.go
+***   suppress consecutive duplicate posts within server.dedup seconds
+**/
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// bumpRecentDuplicate 检查房间中最新的一条消息，若在去重窗口内且 match 返回 true，
+// 则调用 bump 更新它并刷新时间戳，返回更新后的消息。
+func (s *ClipboardServer) bumpRecentDuplicate(room string, opts messageOptions, match func(*ReceiveHolder) bool, bump func(*ReceiveHolder)) (PostEvent, bool) {
+	window := int64(s.config.Server.Dedup)
+	if window <= 0 {
+		return PostEvent{}, false
+	}
+
+	normalizedRoom := normalizeRoomName(room)
+	now := time.Now().Unix()
+
+	s.messageQueue.Lock()
+	latest := s.messageQueue.Latest(normalizedRoom)
+	if latest == nil ||
+		now-latest.Data.Timestamp() > window ||
+		latest.Data.To() != opts.To ||
+		latest.Data.ReplyTo() != opts.ReplyTo ||
+		!match(&latest.Data) {
+		s.messageQueue.Unlock()
+		return PostEvent{}, false
+	}
+
+	if latest.Data.TextReceive != nil {
+		latest.Data.TextReceive.Timestamp = now
+	} else if latest.Data.FileReceive != nil {
+		latest.Data.FileReceive.Timestamp = now
+	}
+	if bump != nil {
+		bump(&latest.Data)
+	}
+	event := *latest
+	s.messageQueue.Unlock()
+
+	s.logger.Printf("房间 '%s' 中的重复消息已合并到最新消息 ID: %d", normalizedRoom, event.Data.ID())
+	s.updateRoomStats(normalizedRoom, 0)
+	s.broadcastMessageUpdate(event)
+	s.saveHistoryData()
+	return event, true
+}
+
+// dedupRecentText 文本与房间最新文本相同时合并
+func (s *ClipboardServer) dedupRecentText(room string, opts messageOptions, text string) (PostEvent, bool) {
+	return s.bumpRecentDuplicate(room, opts, func(rh *ReceiveHolder) bool {
+		return rh.TextReceive != nil && rh.TextReceive.Content == text
+	}, nil)
+}
+
+// dedupRecentFile 文件摘要与房间最新文件相同时合并，并将已有文件的过期时间延长到 expireTime
+func (s *ClipboardServer) dedupRecentFile(room string, opts messageOptions, digest string, expireTime int64) (PostEvent, bool) {
+	if digest == "" {
+		return PostEvent{}, false
+	}
+
+	var uuid string
+	event, ok := s.bumpRecentDuplicate(room, opts, func(rh *ReceiveHolder) bool {
+		return rh.FileReceive != nil && rh.FileReceive.Digest == digest
+	}, func(rh *ReceiveHolder) {
+		uuid = rh.FileReceive.Cache
+		if expireTime > rh.FileReceive.Expire {
+			rh.FileReceive.Expire = expireTime
+		}
+	})
+	if !ok {
+		return event, false
+	}
+
+	s.runMutex.Lock()
+	if fileInfo, exists := s.uploadFileMap[uuid]; exists && expireTime > fileInfo.ExpireTime {
+		fileInfo.ExpireTime = expireTime
+		s.uploadFileMap[uuid] = fileInfo
+	}
+	s.runMutex.Unlock()
+	return event, true
+}
+
+// discardUpload 删除因重复而不再需要的上传文件
+func (s *ClipboardServer) discardUpload(uuid string) {
+	s.runMutex.Lock()
+	delete(s.uploadFileMap, uuid)
+	s.runMutex.Unlock()
+
+	filePath := filepath.Join(s.storageFolder, uuid)
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		s.logger.Printf("警告: 删除重复上传的文件 %s 失败: %v", filePath, err)
+	}
+}
+
+// fileDigest 计算文件的 SHA-256 摘要
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
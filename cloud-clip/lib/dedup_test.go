@@ -0,0 +1,160 @@
+package lib
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newDedupTestServer(t *testing.T) *ClipboardServer {
+	t.Helper()
+	return newTestServer(t, func(cfg *Config) {
+		cfg.Server.Dedup = 30
+	})
+}
+
+// setMessageTimestamp 修改消息的时间戳，模拟消息在之前发送
+func setMessageTimestamp(t *testing.T, s *ClipboardServer, id string, timestamp int64) {
+	t.Helper()
+	n, _ := strconv.Atoi(id)
+	s.messageQueue.Lock()
+	defer s.messageQueue.Unlock()
+	msg := s.messageQueue.Get(n)
+	if msg == nil {
+		t.Fatalf("消息 %s 不存在", id)
+	}
+	if msg.Data.TextReceive != nil {
+		msg.Data.TextReceive.Timestamp = timestamp
+	} else {
+		msg.Data.FileReceive.Timestamp = timestamp
+	}
+}
+
+func messageTimestamp(s *ClipboardServer, id string) int64 {
+	n, _ := strconv.Atoi(id)
+	s.messageQueue.Lock()
+	defer s.messageQueue.Unlock()
+	return s.messageQueue.Get(n).Data.Timestamp()
+}
+
+// uploadTestFile 通过 multipart POST /upload 上传文件，返回消息 ID
+func uploadTestFile(t *testing.T, s *ClipboardServer, name string, content string) string {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("file", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte(content))
+	mw.Close()
+	rec := do(t, s, http.MethodPost, "/upload", body.String(), "Content-Type", mw.FormDataContentType())
+	expectStatus(t, rec, http.StatusOK)
+	var resp struct {
+		ID string `json:"id"`
+	}
+	decodeJSON(t, rec, &resp)
+	return resp.ID
+}
+
+func TestDedupMergesConsecutiveText(t *testing.T) {
+	s := newDedupTestServer(t)
+	first := postText(t, s, "/text", "same")
+	old := time.Now().Unix() - 10
+	setMessageTimestamp(t, s, first, old)
+
+	if again := postText(t, s, "/text", "same"); again != first {
+		t.Fatalf("重复文本返回 ID %s，期望合并到 %s", again, first)
+	}
+	if ts := messageTimestamp(s, first); ts <= old {
+		t.Fatalf("合并后时间戳 = %d，应刷新", ts)
+	}
+	s.messageQueue.Lock()
+	n := s.messageQueue.RoomLen("default")
+	s.messageQueue.Unlock()
+	if n != 1 {
+		t.Fatalf("房间中有 %d 条消息，期望 1 条", n)
+	}
+}
+
+func TestDedupOnlyMatchesRecentLatestItem(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, s *ClipboardServer, first string)
+		post  func(t *testing.T, s *ClipboardServer) string
+	}{
+		{"超出窗口", func(t *testing.T, s *ClipboardServer, first string) {
+			setMessageTimestamp(t, s, first, time.Now().Unix()-31)
+		}, func(t *testing.T, s *ClipboardServer) string { return postText(t, s, "/text", "same") }},
+		{"不是最新消息", func(t *testing.T, s *ClipboardServer, first string) {
+			postText(t, s, "/text", "other")
+		}, func(t *testing.T, s *ClipboardServer) string { return postText(t, s, "/text", "same") }},
+		{"其他房间", nil, func(t *testing.T, s *ClipboardServer) string { return postText(t, s, "/text?room=b", "same") }},
+		{"内容不同", nil, func(t *testing.T, s *ClipboardServer) string { return postText(t, s, "/text", "different") }},
+		{"回复不同", nil, func(t *testing.T, s *ClipboardServer) string { return postText(t, s, "/text?replyTo=1", "same") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newDedupTestServer(t)
+			first := postText(t, s, "/text", "same")
+			if tt.setup != nil {
+				tt.setup(t, s, first)
+			}
+			if id := tt.post(t, s); id == first {
+				t.Fatalf("不应合并到消息 %s", first)
+			}
+		})
+	}
+}
+
+func TestDedupDisabledByDefault(t *testing.T) {
+	s := newTestServer(t, nil)
+	if postText(t, s, "/text", "same") == postText(t, s, "/text", "same") {
+		t.Fatal("dedup 为 0 时不应合并")
+	}
+}
+
+func TestDedupMergesIdenticalFiles(t *testing.T) {
+	s := newDedupTestServer(t)
+	first := uploadTestFile(t, s, "a.bin", "payload")
+	if again := uploadTestFile(t, s, "b.bin", "payload"); again != first {
+		t.Fatalf("相同内容的文件返回 ID %s，期望合并到 %s", again, first)
+	}
+	// 重复上传的文件被删除，只保留第一份
+	s.runMutex.Lock()
+	files := len(s.uploadFileMap)
+	s.runMutex.Unlock()
+	entries, err := os.ReadDir(s.storageFolder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files != 1 || len(entries) != 1 {
+		t.Fatalf("文件记录 %d 个，磁盘文件 %d 个，期望各 1 个", files, len(entries))
+	}
+	if other := uploadTestFile(t, s, "a.bin", "changed"); other == first {
+		t.Fatal("内容不同的文件不应合并")
+	}
+}
+
+func TestDedupBroadcastsUpdate(t *testing.T) {
+	s := newDedupTestServer(t)
+	ts := startTestServer(t, s)
+	conn := dialPush(t, ts, "room=default", nil)
+	waitFor(t, "连接加入房间", func() bool { return len(s.hub.devicesInRoom("default", "")) == 1 })
+
+	first := postText(t, s, "/text", "same")
+	postText(t, s, "/text", "same")
+
+	events := readEvents(t, conn, 300*time.Millisecond)
+	if len(events["receive"]) != 1 || len(events["update"]) != 1 {
+		t.Fatalf("receive %d 个、update %d 个，期望各 1 个", len(events["receive"]), len(events["update"]))
+	}
+	if !strings.Contains(string(events["update"][0]), `"id":`+first) {
+		t.Fatalf("update 事件 = %s", events["update"][0])
+	}
+}
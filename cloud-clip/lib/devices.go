@@ -0,0 +1,687 @@
+package lib
+
+/**
+*** FILE: devices.go
+***   server-issued device IDs with secrets, nicknames, persisted device registry (incl. pairings), /devices endpoints
+**/
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	deviceNameMaxLen      = 64     // 设备昵称最大长度（字符数）
+	deviceSecretPrefix    = "ccd_" // 设备密钥前缀
+	deviceCookie          = "cc_device"
+	deviceCookieMaxAge    = 400 * 24 * 3600 // 浏览器允许的 Cookie 最长有效期
+	deviceCookieSeparator = "."
+
+	maxDeviceRecords = 10000                // 设备注册表最多保存的设备数量
+	deviceRecordTTL  = 180 * 24 * time.Hour // 超过这段时间没有连接（且没有有效配对）的设备被删除
+	unusedDeviceTTL  = 24 * time.Hour       // 注册后从未连接过的设备保留的时间
+	deviceSaveDelay  = 5 * time.Second      // 连接时更新的最近连接时间等信息延迟写入文件，合并多次写入
+)
+
+// 设备ID：8-64 个字母、数字、下划线或连字符（服务端生成的设备ID为 32 位十六进制）
+var deviceIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{8,64}$`)
+
+// DeviceRecord 是设备注册表中的一条记录
+type DeviceRecord struct {
+	ID        string `json:"id"`
+	Name      string `json:"name,omitempty"`
+	Type      string `json:"type"`
+	Device    string `json:"device"`
+	OS        string `json:"os"`
+	Browser   string `json:"browser"`
+	FirstSeen int64  `json:"firstSeen"`        // 注册时间（Unix时间戳）
+	LastSeen  int64  `json:"lastSeen"`         // 最近连接时间（Unix时间戳），0 表示注册后还没有连接过
+	LastIP    string `json:"lastIP,omitempty"` // 最近连接的 IP
+
+	SecretHash string `json:"-"` // 设备密钥的 SHA-256，只保存在 devices.json 中，不返回给客户端
+
+	Pairings []DevicePairing `json:"pairings,omitempty"` // 通过配对码获得的房间令牌
+}
+
+// DevicePairing 记录设备通过配对码获得的令牌（令牌本身保存在令牌存储中）
+type DevicePairing struct {
+	TokenID   string `json:"tokenId"`
+	Room      string `json:"room"`
+	Created   int64  `json:"created"`
+	Expires   int64  `json:"expires,omitempty"`
+	CreatedBy string `json:"createdBy,omitempty"`
+}
+
+// storedDevice 是 devices.json 中的一条记录，比 DeviceRecord 多保存设备密钥的哈希
+type storedDevice struct {
+	DeviceRecord
+	SecretHash string `json:"secretHash,omitempty"`
+}
+
+// DeviceRegistration 是 POST /devices 的响应，密钥只在注册时返回一次
+type DeviceRegistration struct {
+	ID     string `json:"id"`
+	Secret string `json:"secret"`
+	Name   string `json:"name,omitempty"`
+}
+
+// DeviceInfo 是 /devices 返回的设备信息
+type DeviceInfo struct {
+	DeviceRecord
+	Online   bool `json:"online"`
+	Sessions int  `json:"sessions"` // 该设备在房间中的会话数
+}
+
+// DeviceListResponse /devices 响应结构体
+type DeviceListResponse struct {
+	Room    string       `json:"room"`
+	Devices []DeviceInfo `json:"devices"`
+}
+
+// deviceRegistry 保存服务端注册的设备，持久化到 devices.json。
+// 长期不连接的设备会被删除，注册表已满时拒绝注册新设备；连接时的更新延迟合并写入
+type deviceRegistry struct {
+	mu         sync.Mutex
+	path       string
+	devices    map[string]*DeviceRecord
+	maxRecords int
+	saveTimer  *time.Timer // 延迟写入的定时器，没有待写入的修改时为 nil
+	logf       func(format string, v ...any)
+}
+
+var (
+	errDeviceNotFound     = errors.New("设备未找到")
+	errDeviceRegistryFull = errors.New("设备数量已达上限")
+)
+
+// newDeviceRegistry 从 path 加载设备注册表，文件不存在时返回空注册表
+func newDeviceRegistry(path string, logf func(format string, v ...any)) *deviceRegistry {
+	d := &deviceRegistry{
+		path:       path,
+		devices:    make(map[string]*DeviceRecord),
+		maxRecords: maxDeviceRecords,
+		logf:       logf,
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logf("警告: 读取设备注册表 %s 失败: %v", path, err)
+		}
+		return d
+	}
+
+	var records []storedDevice
+	if err := json.Unmarshal(data, &records); err != nil {
+		logf("警告: 解析设备注册表 %s 失败: %v", path, err)
+		return d
+	}
+	for i := range records {
+		if deviceIDPattern.MatchString(records[i].ID) {
+			rec := records[i].DeviceRecord
+			rec.SecretHash = records[i].SecretHash
+			d.devices[rec.ID] = &rec
+		}
+	}
+	if removed := d.pruneLocked(time.Now()); removed > 0 {
+		logf("已删除 %d 个长期未连接的设备记录", removed)
+		if err := d.saveLocked(); err != nil {
+			logf("警告: 保存设备注册表失败: %v", err)
+		}
+	}
+	logf("已加载 %d 个设备记录: %s", len(d.devices), path)
+	return d
+}
+
+// saveLocked 将注册表写入文件（同时取消待执行的延迟写入），必须在 d.mu 锁定时调用
+func (d *deviceRegistry) saveLocked() error {
+	if d.saveTimer != nil {
+		d.saveTimer.Stop()
+		d.saveTimer = nil
+	}
+	records := make([]storedDevice, 0, len(d.devices))
+	for _, rec := range d.devices {
+		records = append(records, storedDevice{DeviceRecord: *rec, SecretHash: rec.SecretHash})
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].FirstSeen < records[j].FirstSeen })
+
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	// 文件中包含设备密钥的哈希
+	return os.WriteFile(d.path, data, 0600)
+}
+
+// scheduleSaveLocked 在 deviceSaveDelay 后写入文件，期间的多次修改只写入一次，必须在 d.mu 锁定时调用
+func (d *deviceRegistry) scheduleSaveLocked() {
+	if d.saveTimer != nil {
+		return
+	}
+	d.saveTimer = time.AfterFunc(deviceSaveDelay, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.saveTimer = nil
+		if err := d.saveLocked(); err != nil {
+			d.logf("警告: 保存设备注册表失败: %v", err)
+		}
+	})
+}
+
+// flush 立即写入延迟的修改（服务器停止时调用）
+func (d *deviceRegistry) flush() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.saveTimer == nil {
+		return nil
+	}
+	return d.saveLocked()
+}
+
+// pruneLocked 删除超过 deviceRecordTTL 没有连接、或注册后超过 unusedDeviceTTL 仍未连接过的设备，
+// 有未过期配对的设备保留。返回删除的数量，必须在 d.mu 锁定时调用
+func (d *deviceRegistry) pruneLocked(now time.Time) int {
+	removed := 0
+	for id, rec := range d.devices {
+		if hasLivePairing(rec.Pairings, now.Unix()) {
+			continue
+		}
+		idleSince, ttl := rec.LastSeen, deviceRecordTTL
+		if rec.LastSeen == 0 {
+			idleSince, ttl = rec.FirstSeen, unusedDeviceTTL
+		}
+		if now.Sub(time.Unix(idleSince, 0)) > ttl {
+			delete(d.devices, id)
+			removed++
+		}
+	}
+	return removed
+}
+
+// hasLivePairing 判断是否有未过期的配对记录（令牌本身可能已被撤销，由令牌存储负责）
+func hasLivePairing(pairings []DevicePairing, now int64) bool {
+	for _, p := range pairings {
+		if p.Expires == 0 || p.Expires > now {
+			return true
+		}
+	}
+	return false
+}
+
+// register 注册新设备，返回服务端生成的设备ID和密钥（密钥只保存哈希）。注册表已满时先删除过期的设备，仍然已满时返回 errDeviceRegistryFull
+func (d *deviceRegistry) register(meta DeviceMeta, name string, ip string) (DeviceRecord, string, error) {
+	secret := deviceSecretPrefix + base64.RawURLEncoding.EncodeToString(random_bytes(sessionTokenBytes))
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.devices) >= d.maxRecords {
+		if removed := d.pruneLocked(time.Now()); removed > 0 {
+			d.logf("已删除 %d 个长期未连接的设备记录", removed)
+		}
+		if len(d.devices) >= d.maxRecords {
+			return DeviceRecord{}, "", errDeviceRegistryFull
+		}
+	}
+
+	meta.ID = hex.EncodeToString(random_bytes(16))
+	now := time.Now().Unix()
+	rec := &DeviceRecord{
+		ID:         meta.ID,
+		Name:       name,
+		Type:       meta.Type,
+		Device:     meta.Device,
+		OS:         meta.OS,
+		Browser:    meta.Browser,
+		FirstSeen:  now,
+		LastIP:     ip,
+		SecretHash: hashSessionToken(secret),
+	}
+	d.devices[rec.ID] = rec
+	return *rec, secret, d.saveLocked()
+}
+
+// verify 校验设备ID和密钥，没有密钥的旧记录（客户端自行生成的设备ID）一律无效
+func (d *deviceRegistry) verify(id string, secret string) (DeviceRecord, bool) {
+	if id == "" || !strings.HasPrefix(secret, deviceSecretPrefix) {
+		return DeviceRecord{}, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	rec, ok := d.devices[id]
+	if !ok || rec.SecretHash == "" {
+		return DeviceRecord{}, false
+	}
+	if subtle.ConstantTimeCompare([]byte(rec.SecretHash), []byte(hashSessionToken(secret))) != 1 {
+		return DeviceRecord{}, false
+	}
+	return *rec, true
+}
+
+// touch 记录已注册设备的连接：更新设备信息和最近连接时间；name 不为空时同时更新昵称。
+// 只有昵称变化时立即写入文件，其他信息延迟写入
+func (d *deviceRegistry) touch(meta DeviceMeta, name string, ip string) (DeviceRecord, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now().Unix()
+	rec, ok := d.devices[meta.ID]
+	if !ok {
+		return DeviceRecord{}, errDeviceNotFound
+	}
+	renamed := name != "" && name != rec.Name
+	if renamed {
+		rec.Name = name
+	}
+	rec.Type = meta.Type
+	rec.Device = meta.Device
+	rec.OS = meta.OS
+	rec.Browser = meta.Browser
+	rec.LastSeen = now
+	rec.LastIP = ip
+	if renamed {
+		return *rec, d.saveLocked()
+	}
+	d.scheduleSaveLocked()
+	return *rec, nil
+}
+
+// rename 修改设备昵称，设备不在注册表中时返回 errDeviceNotFound
+func (d *deviceRegistry) rename(id string, name string) (DeviceRecord, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	rec, ok := d.devices[id]
+	if !ok {
+		return DeviceRecord{}, errDeviceNotFound
+	}
+	rec.Name = name
+	return *rec, d.saveLocked()
+}
+
+func (d *deviceRegistry) get(id string) (DeviceRecord, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if rec, ok := d.devices[id]; ok {
+		return *rec, true
+	}
+	return DeviceRecord{}, false
+}
+
+// addPairing 记录设备的配对，同一房间已有的配对记录被替换
+func (d *deviceRegistry) addPairing(id string, pairing DevicePairing) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	rec, ok := d.devices[id]
+	if !ok {
+		return errDeviceNotFound
+	}
+	pairings := []DevicePairing{pairing}
+	for _, p := range rec.Pairings {
+		if p.Room != pairing.Room {
+			pairings = append(pairings, p)
+		}
+	}
+	rec.Pairings = pairings
+	return d.saveLocked()
+}
+
+// removePairings 删除设备在房间中的配对记录，返回被删除的记录
+func (d *deviceRegistry) removePairings(id string, room string) ([]DevicePairing, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	rec, ok := d.devices[id]
+	if !ok {
+		return nil, errDeviceNotFound
+	}
+	var kept, removed []DevicePairing
+	for _, p := range rec.Pairings {
+		if p.Room == room {
+			removed = append(removed, p)
+		} else {
+			kept = append(kept, p)
+		}
+	}
+	if len(removed) == 0 {
+		return nil, nil
+	}
+	rec.Pairings = kept
+	return removed, d.saveLocked()
+}
+
+// pairedInRoom 返回与房间配对过的设备，Pairings 只保留该房间的记录
+func (d *deviceRegistry) pairedInRoom(room string) []DeviceRecord {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var records []DeviceRecord
+	for _, rec := range d.devices {
+		for _, p := range rec.Pairings {
+			if p.Room == room {
+				copied := *rec
+				copied.Pairings = []DevicePairing{p}
+				records = append(records, copied)
+				break
+			}
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].ID < records[j].ID })
+	return records
+}
+
+// normalizeDeviceName 去除首尾空白和控制字符，最多保留 deviceNameMaxLen 个字符
+func normalizeDeviceName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	runes := []rune(strings.TrimSpace(name))
+	if len(runes) > deviceNameMaxLen {
+		runes = runes[:deviceNameMaxLen]
+	}
+	return strings.TrimSpace(string(runes))
+}
+
+// clientDeviceCredentials 返回请求携带的设备ID和密钥：X-Device-Id / X-Device-Secret 请求头，
+// 其次是 POST /devices 设置的 cc_device Cookie（WebSocket 和 EventSource 无法设置请求头）
+func clientDeviceCredentials(r *http.Request) (id string, secret string) {
+	id = strings.TrimSpace(r.Header.Get("X-Device-Id"))
+	secret = strings.TrimSpace(r.Header.Get("X-Device-Secret"))
+	if id == "" && secret == "" {
+		if c, err := r.Cookie(deviceCookie); err == nil {
+			id, secret, _ = strings.Cut(c.Value, deviceCookieSeparator)
+		}
+	}
+	if !deviceIDPattern.MatchString(id) {
+		return "", ""
+	}
+	return id, secret
+}
+
+// clientDeviceName 返回客户端在连接时设置的设备昵称：查询参数 deviceName，其次是 X-Device-Name 请求头（可以是 URL 编码的，以便传递非 ASCII 字符）
+func clientDeviceName(r *http.Request) string {
+	name := r.URL.Query().Get("deviceName")
+	if name == "" {
+		name = r.Header.Get("X-Device-Name")
+		if decoded, err := url.PathUnescape(name); err == nil {
+			name = decoded
+		}
+	}
+	return normalizeDeviceName(name)
+}
+
+// requestDevice 返回请求中经过密钥验证的设备，设备ID不存在或密钥错误时返回 false
+func (s *ClipboardServer) requestDevice(r *http.Request) (DeviceRecord, bool) {
+	id, secret := clientDeviceCredentials(r)
+	if id == "" {
+		return DeviceRecord{}, false
+	}
+	return s.devices.verify(id, secret)
+}
+
+// requestDeviceID 返回请求中经过验证的设备ID，没有时返回空字符串
+func (s *ClipboardServer) requestDeviceID(r *http.Request) string {
+	if rec, ok := s.requestDevice(r); ok {
+		return rec.ID
+	}
+	return ""
+}
+
+// deviceCookieFor 返回保存设备ID和密钥的 Cookie，maxAge 为负数时删除 Cookie
+func (s *ClipboardServer) deviceCookieFor(r *http.Request, id string, secret string, maxAge int) *http.Cookie {
+	value := ""
+	if id != "" {
+		value = id + deviceCookieSeparator + secret
+	}
+	return &http.Cookie{
+		Name:     deviceCookie,
+		Value:    value,
+		Path:     s.cookiePath(),
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   getScheme(r) == "https",
+		SameSite: s.cookieSameSite(),
+	}
+}
+
+// registerDevice 为请求注册新设备并设置 cc_device Cookie
+func (s *ClipboardServer) registerDevice(w http.ResponseWriter, r *http.Request, name string) (DeviceRecord, string, error) {
+	rec, secret, err := s.devices.register(s.parseDeviceMeta("", r.UserAgent()), name, get_remote_ip(r))
+	if err != nil {
+		return rec, secret, err
+	}
+	http.SetCookie(w, s.deviceCookieFor(r, rec.ID, secret, deviceCookieMaxAge))
+	return rec, secret, nil
+}
+
+// parseDeviceMeta 从 User-Agent 解析设备信息
+func (s *ClipboardServer) parseDeviceMeta(deviceID string, userAgent string) DeviceMeta {
+	clientUA := s.parser.Parse(userAgent)
+	return DeviceMeta{
+		ID:      deviceID,
+		Type:    clientUA.Device.Family,
+		Device:  strings.TrimSpace(fmt.Sprintf("%s %s %s", clientUA.Device.Brand, clientUA.Device.Model, clientUA.Os.Family)),
+		OS:      fmt.Sprintf("%s %s", clientUA.Os.Family, clientUA.Os.Major),
+		Browser: fmt.Sprintf("%s %s", clientUA.UserAgent.Family, clientUA.UserAgent.Major),
+	}
+}
+
+// identifyPushDevice 返回 /push 连接的设备信息。请求携带了有效的设备ID和密钥时更新设备注册表并使用注册的昵称，
+// 否则退回到按 RemoteAddr + User-Agent 生成的临时ID（每次重连都会变化，不记录到注册表，也收不到私信）。
+func (s *ClipboardServer) identifyPushDevice(r *http.Request) DeviceMeta {
+	userAgent := r.Header.Get("User-Agent")
+	deviceID := s.requestDeviceID(r)
+	if deviceID == "" {
+		deviceID = fmt.Sprintf("%d", hash_murmur3([]byte(fmt.Sprintf("%s %s", r.RemoteAddr, userAgent)), s.deviceHashSeed))
+		return s.parseDeviceMeta(deviceID, userAgent)
+	}
+
+	meta := s.parseDeviceMeta(deviceID, userAgent)
+	rec, err := s.devices.touch(meta, clientDeviceName(r), get_remote_ip(r))
+	if err != nil {
+		s.logger.Printf("警告: 保存设备注册表失败: %v", err)
+	}
+	meta.Name = rec.Name
+	return meta
+}
+
+// senderDevice 返回消息的发送者设备信息：User-Agent 解析结果，请求携带了有效的设备凭据时加上 id 和 name
+func (s *ClipboardServer) senderDevice(r *http.Request) map[string]string {
+	ua := s.parse_user_agent(r.UserAgent())
+	rec, ok := s.requestDevice(r)
+	if !ok {
+		return ua
+	}
+	ua["id"] = rec.ID
+	if rec.Name != "" {
+		ua["name"] = rec.Name
+	}
+	return ua
+}
+
+// handleDevices 处理 /devices 和 /devices/{id}：
+// GET /devices?room=xxx 返回房间中的在线设备和配对过的设备；POST /devices 注册新设备；PUT/POST /devices/{id} 修改设备昵称；
+// DELETE /devices/{id}/pairings?room=xxx 撤销设备在房间中的配对
+func (s *ClipboardServer) handleDevices(w http.ResponseWriter, r *http.Request) {
+	deviceID := strings.Trim(strings.TrimPrefix(r.URL.Path, s.config.Server.Prefix+"/devices"), "/")
+	if id, ok := strings.CutSuffix(deviceID, "/pairings"); ok {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "仅允许 DELETE 请求", http.StatusMethodNotAllowed)
+			return
+		}
+		s.handleDeviceUnpair(w, r, id)
+		return
+	}
+	if deviceID == "" {
+		switch r.Method {
+		case http.MethodGet:
+			s.handleDeviceList(w, r)
+		case http.MethodPost:
+			s.handleDeviceRegister(w, r)
+		default:
+			http.Error(w, "仅允许 GET 或 POST 请求", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		http.Error(w, "仅允许 PUT 或 POST 请求", http.StatusMethodNotAllowed)
+		return
+	}
+	// 只有设备自己（携带该设备的密钥）或管理员可以修改昵称
+	if s.requestDeviceID(r) != deviceID && !s.isAdminToken(extractAuthToken(r)) {
+		s.logger.Printf("拒绝修改设备 %s 的昵称: 请求不是该设备也不是管理员，来自 IP: %s", deviceID, get_remote_ip(r))
+		writeAuthJSONError(w, http.StatusForbidden, "只能修改本设备的昵称")
+		return
+	}
+	s.handleDeviceRename(w, r, deviceID)
+}
+
+func (s *ClipboardServer) handleDeviceList(w http.ResponseWriter, r *http.Request) {
+	room := normalizeRoomName(r.URL.Query().Get("room"))
+
+	s.runMutex.Lock()
+	var devices []DeviceInfo
+	for _, meta := range s.getRoomDevicesLocked(room, "") {
+		devices = append(devices, DeviceInfo{
+			DeviceRecord: DeviceRecord{ID: meta.ID, Name: meta.Name, Type: meta.Type, Device: meta.Device, OS: meta.OS, Browser: meta.Browser},
+			Online:       true,
+			Sessions:     meta.Sessions,
+		})
+	}
+	s.runMutex.Unlock()
+
+	// 注册过的设备补充首次/最近连接时间和配对信息
+	online := make(map[string]int, len(devices))
+	for i := range devices {
+		online[devices[i].ID] = i
+		if rec, ok := s.devices.get(devices[i].ID); ok {
+			devices[i].FirstSeen = rec.FirstSeen
+			devices[i].LastSeen = rec.LastSeen
+		}
+	}
+
+	// 配对过的设备即使不在线也列出，以便撤销
+	for _, rec := range s.devices.pairedInRoom(room) {
+		rec.Pairings = s.livePairings(rec.Pairings)
+		if len(rec.Pairings) == 0 {
+			continue
+		}
+		rec.LastIP = ""
+		if i, ok := online[rec.ID]; ok {
+			devices[i].Pairings = rec.Pairings
+			continue
+		}
+		devices = append(devices, DeviceInfo{DeviceRecord: rec})
+	}
+	if devices == nil {
+		devices = []DeviceInfo{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(DeviceListResponse{Room: room, Devices: devices}); err != nil {
+		s.logger.Printf("错误: 编码设备列表响应失败: %v", err)
+	}
+}
+
+// handleDeviceRegister 处理 POST /devices：为客户端生成设备ID和密钥，浏览器通过 cc_device Cookie 保存，
+// 其他客户端之后在 X-Device-Id / X-Device-Secret 请求头中携带
+func (s *ClipboardServer) handleDeviceRegister(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name string `json:"name"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&body); err != nil {
+			http.Error(w, "无效的请求体", http.StatusBadRequest)
+			return
+		}
+	}
+	name := normalizeDeviceName(body.Name)
+	if name == "" {
+		name = clientDeviceName(r)
+	}
+
+	rec, secret, err := s.registerDevice(w, r, name)
+	if errors.Is(err, errDeviceRegistryFull) {
+		s.logger.Printf("拒绝注册设备: 设备数量已达上限，来自 IP: %s", get_remote_ip(r))
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		s.logger.Printf("错误: 保存设备注册表失败: %v", err)
+		http.Error(w, "注册设备失败", http.StatusInternalServerError)
+		return
+	}
+	s.logger.Printf("注册设备 %s [%s]，来自 IP: %s", rec.ID, rec.Name, get_remote_ip(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(DeviceRegistration{ID: rec.ID, Secret: secret, Name: rec.Name})
+}
+
+func (s *ClipboardServer) handleDeviceRename(w http.ResponseWriter, r *http.Request, deviceID string) {
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&body); err != nil {
+		http.Error(w, "无效的请求体", http.StatusBadRequest)
+		return
+	}
+	name := normalizeDeviceName(body.Name)
+
+	rec, err := s.devices.rename(deviceID, name)
+	if err == errDeviceNotFound {
+		http.Error(w, "设备未找到", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.logger.Printf("警告: 保存设备注册表失败: %v", err)
+	}
+	s.logger.Printf("设备 %s 重命名为 [%s]，来自 IP: %s", deviceID, name, get_remote_ip(r))
+	s.recordAudit(r, auditDeviceRename, "", deviceID, map[string]any{"name": name})
+
+	// 第一步：在锁内更新在线设备的信息
+	var meta DeviceMeta
+	s.runMutex.Lock()
+	meta, online := s.deviceConnected[deviceID]
+	if online {
+		meta.Name = name
+		s.deviceConnected[deviceID] = meta
+	}
+	s.runMutex.Unlock()
+
+	// 第二步：向设备所在的房间广播 device 事件
+	if online {
+		for room, devices := range s.hub.roomDevices() {
+			if sessions := devices[deviceID]; sessions > 0 {
+				roomMeta := meta
+				roomMeta.Sessions = sessions
+				s.broadcastWebSocketMessage(WebSocketMessage{Event: "device", Data: roomMeta}, room)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rec)
+}
@@ -0,0 +1,399 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// registerTestDevice 通过 POST /devices 注册设备，返回设备ID和密钥
+func registerTestDevice(t *testing.T, s *ClipboardServer, name string) (string, string) {
+	t.Helper()
+	rec := do(t, s, http.MethodPost, "/devices", `{"name":"`+name+`"}`, "Content-Type", "application/json")
+	expectStatus(t, rec, http.StatusCreated)
+	var reg DeviceRegistration
+	decodeJSON(t, rec, &reg)
+	if !deviceIDPattern.MatchString(reg.ID) || !strings.HasPrefix(reg.Secret, deviceSecretPrefix) {
+		t.Fatalf("无效的注册结果: %+v", reg)
+	}
+	cookie, ok := cookieValue(rec, deviceCookie)
+	if !ok || cookie != reg.ID+deviceCookieSeparator+reg.Secret {
+		t.Fatalf("cc_device Cookie = %q", cookie)
+	}
+	return reg.ID, reg.Secret
+}
+
+func serverDeviceID(t *testing.T, s *ClipboardServer, headers ...string) string {
+	t.Helper()
+	rec := do(t, s, http.MethodGet, "/server", "", headers...)
+	expectStatus(t, rec, http.StatusOK)
+	var resp struct {
+		DeviceID string `json:"deviceId"`
+	}
+	decodeJSON(t, rec, &resp)
+	return resp.DeviceID
+}
+
+func TestDeviceCredentials(t *testing.T) {
+	s := newTestServer(t, nil)
+	id, secret := registerTestDevice(t, s, "笔记本")
+
+	tests := []struct {
+		name    string
+		headers []string
+		want    string
+	}{
+		{"请求头", []string{"X-Device-Id", id, "X-Device-Secret", secret}, id},
+		{"Cookie", []string{"Cookie", deviceCookie + "=" + id + deviceCookieSeparator + secret}, id},
+		{"只有设备ID", []string{"X-Device-Id", id}, ""},
+		{"密钥错误", []string{"X-Device-Id", id, "X-Device-Secret", deviceSecretPrefix + "wrong"}, ""},
+		{"其他设备的密钥", []string{"X-Device-Id", "0123456789abcdef", "X-Device-Secret", secret}, ""},
+		{"查询参数", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := serverDeviceID(t, s, tt.headers...); got != tt.want {
+				t.Fatalf("deviceId = %q，期望 %q", got, tt.want)
+			}
+		})
+	}
+
+	// 查询参数中的设备ID不是凭据
+	rec := do(t, s, http.MethodGet, "/server?deviceId="+id, "")
+	if strings.Contains(rec.Body.String(), id) {
+		t.Fatalf("查询参数中的设备ID不应被接受: %s", rec.Body.String())
+	}
+}
+
+func TestSenderDeviceRequiresSecret(t *testing.T) {
+	s := newTestServer(t, nil)
+	id, secret := registerTestDevice(t, s, "手机")
+
+	postText(t, s, "/text", "spoofed", "X-Device-Id", id)
+	postText(t, s, "/text", "verified", "X-Device-Id", id, "X-Device-Secret", secret)
+
+	s.messageQueue.Lock()
+	history := s.messageQueue.RoomHistory("default")
+	s.messageQueue.Unlock()
+	if len(history) != 2 {
+		t.Fatalf("消息数量 = %d", len(history))
+	}
+	if got := history[0].Data.TextReceive.SenderDevice["id"]; got != "" {
+		t.Fatalf("没有密钥的请求不应带有设备ID，得到 %q", got)
+	}
+	sender := history[1].Data.TextReceive.SenderDevice
+	if sender["id"] != id || sender["name"] != "手机" {
+		t.Fatalf("senderDevice = %v", sender)
+	}
+}
+
+func TestDeviceRegistryPersistsSecretHash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "devices.json")
+	reg := newDeviceRegistry(path, t.Logf)
+	rec, secret, err := reg.register(DeviceMeta{Type: "Desktop"}, "台式机", "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), secret) {
+		t.Fatal("devices.json 中不应保存设备密钥明文")
+	}
+	if !strings.Contains(string(data), hashSessionToken(secret)) {
+		t.Fatal("devices.json 中应保存设备密钥的哈希")
+	}
+
+	reloaded := newDeviceRegistry(path, t.Logf)
+	if _, ok := reloaded.verify(rec.ID, secret); !ok {
+		t.Fatal("重新加载后应能验证设备密钥")
+	}
+	if got, _ := reloaded.get(rec.ID); got.SecretHash == "" {
+		t.Fatal("重新加载后应保留密钥哈希")
+	}
+}
+
+func TestLegacyDeviceWithoutSecretIsRejected(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "devices.json")
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	legacy := `[{"id":"legacydevice01","name":"旧设备","type":"","device":"","os":"","browser":"","firstSeen":` + now + `,"lastSeen":` + now + `}]`
+	if err := os.WriteFile(path, []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	reg := newDeviceRegistry(path, t.Logf)
+	if _, ok := reg.get("legacydevice01"); !ok {
+		t.Fatal("旧记录应被加载")
+	}
+	for _, secret := range []string{"", deviceSecretPrefix, deviceSecretPrefix + "x"} {
+		if _, ok := reg.verify("legacydevice01", secret); ok {
+			t.Fatalf("没有密钥哈希的旧记录不应通过验证（密钥 %q）", secret)
+		}
+	}
+}
+
+func TestPushUsesVerifiedDevice(t *testing.T) {
+	s := newTestServer(t, nil)
+	ts := startTestServer(t, s)
+	id, secret := registerTestDevice(t, s, "平板")
+
+	connected := func(deviceID string) bool {
+		s.runMutex.Lock()
+		defer s.runMutex.Unlock()
+		_, ok := s.deviceConnected[deviceID]
+		return ok
+	}
+
+	// 只提供设备ID（冒充）时使用临时ID
+	dialPush(t, ts, "room=a", http.Header{"X-Device-Id": {id}})
+	waitFor(t, "临时设备连接", func() bool {
+		s.runMutex.Lock()
+		defer s.runMutex.Unlock()
+		return len(s.deviceConnected) == 1
+	})
+	if connected(id) {
+		t.Fatal("没有密钥的连接不应使用该设备ID")
+	}
+
+	dialPush(t, ts, "room=a", http.Header{"Cookie": {deviceCookie + "=" + id + deviceCookieSeparator + secret}})
+	waitFor(t, "已注册设备连接", func() bool { return connected(id) })
+}
+
+func TestDeviceRenameRequiresDeviceOrAdmin(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Server.RoomAuth = map[string]string{"team": "team-pw"}
+	})
+	id, secret := registerTestDevice(t, s, "旧名字")
+	otherID, otherSecret := registerTestDevice(t, s, "其他")
+	admin, err := s.tokens.create("admin", []string{scopeAdmin}, nil, 0, "test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		target  string
+		headers []string
+		want    int
+	}{
+		{"没有设备凭据", "/devices/" + id, nil, http.StatusForbidden},
+		{"只有设备ID", "/devices/" + id, []string{"X-Device-Id", id}, http.StatusForbidden},
+		{"其他设备", "/devices/" + id, []string{"X-Device-Id", otherID, "X-Device-Secret", otherSecret}, http.StatusForbidden},
+		{"房间密码不是管理员", "/devices/" + id + "?room=team", []string{"Authorization", "Bearer team-pw"}, http.StatusForbidden},
+		{"设备自己", "/devices/" + id, []string{"X-Device-Id", id, "X-Device-Secret", secret}, http.StatusOK},
+		{"管理员", "/devices/" + id, []string{"Authorization", "Bearer " + admin.Token}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := append([]string{"Content-Type", "application/json"}, tt.headers...)
+			rec := do(t, s, http.MethodPut, tt.target, `{"name":"`+tt.name+`"}`, headers...)
+			expectStatus(t, rec, tt.want)
+		})
+	}
+	if rec, _ := s.devices.get(id); rec.Name != "管理员" {
+		t.Fatalf("设备昵称 = %q", rec.Name)
+	}
+}
+
+func TestDeviceRegistryLimitsAndExpiry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "devices.json")
+	reg := newDeviceRegistry(path, t.Logf)
+	reg.maxRecords = 3
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		rec, _, err := reg.register(DeviceMeta{}, "", "192.0.2.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, rec.ID)
+	}
+	if _, _, err := reg.register(DeviceMeta{}, "", "192.0.2.1"); err != errDeviceRegistryFull {
+		t.Fatalf("注册表已满时应返回 errDeviceRegistryFull，得到 %v", err)
+	}
+
+	// ids[0] 注册后从未连接且已超过 unusedDeviceTTL，ids[1] 长期未连接但有配对，ids[2] 长期未连接
+	old := time.Now().Add(-deviceRecordTTL - time.Hour).Unix()
+	reg.mu.Lock()
+	reg.devices[ids[0]].FirstSeen = time.Now().Add(-unusedDeviceTTL - time.Hour).Unix()
+	reg.devices[ids[1]].LastSeen = old
+	reg.devices[ids[1]].Pairings = []DevicePairing{{TokenID: "t1", Room: "team"}}
+	reg.devices[ids[2]].LastSeen = old
+	reg.mu.Unlock()
+
+	if _, _, err := reg.register(DeviceMeta{}, "", "192.0.2.1"); err != nil {
+		t.Fatalf("删除过期设备后应能注册: %v", err)
+	}
+	for i, want := range []bool{false, true, false} {
+		if _, ok := reg.get(ids[i]); ok != want {
+			t.Fatalf("设备 %d 存在 = %t，期望 %t", i, ok, want)
+		}
+	}
+}
+
+func TestDeviceTouchIsDebounced(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "devices.json")
+	reg := newDeviceRegistry(path, t.Logf)
+	rec, _, err := reg.register(DeviceMeta{}, "手机", "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := reg.touch(DeviceMeta{ID: rec.ID}, "", "198.51.100.7"); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), "198.51.100.7") {
+		t.Fatal("连接时的更新不应立即写入文件")
+	}
+	if err := reg.flush(); err != nil {
+		t.Fatal(err)
+	}
+	data, _ = os.ReadFile(path)
+	if !strings.Contains(string(data), "198.51.100.7") {
+		t.Fatal("flush 后应写入文件")
+	}
+
+	// 昵称变化立即写入
+	if _, err := reg.touch(DeviceMeta{ID: rec.ID}, "平板", "198.51.100.7"); err != nil {
+		t.Fatal(err)
+	}
+	data, _ = os.ReadFile(path)
+	if !strings.Contains(string(data), "平板") {
+		t.Fatal("昵称变化应立即写入文件")
+	}
+}
+
+// deviceSessions 通过 GET /devices 返回设备在房间中的在线会话数，不在线时返回 0
+func deviceSessions(t *testing.T, s *ClipboardServer, room string, id string, headers ...string) int {
+	t.Helper()
+	rec := do(t, s, http.MethodGet, "/devices?room="+room, "", headers...)
+	expectStatus(t, rec, http.StatusOK)
+	var resp DeviceListResponse
+	decodeJSON(t, rec, &resp)
+	for _, device := range resp.Devices {
+		if device.ID == id && device.Online {
+			return device.Sessions
+		}
+	}
+	return 0
+}
+
+func TestDeviceSessionsAreReferenceCounted(t *testing.T) {
+	s := newTestServer(t, nil)
+	ts := startTestServer(t, s)
+	id, secret := registerTestDevice(t, s, "笔记本")
+	header := http.Header{"Cookie": {deviceCookie + "=" + id + deviceCookieSeparator + secret}}
+
+	observer := dialPush(t, ts, "room=a", nil)
+	waitFor(t, "观察者连接", func() bool { return len(s.hub.devicesInRoom("a", "")) == 1 })
+
+	first := dialPush(t, ts, "room=a", header)
+	waitFor(t, "第一个会话", func() bool { return deviceSessions(t, s, "a", id) == 1 })
+	second := dialPush(t, ts, "room=a", header)
+	waitFor(t, "第二个会话", func() bool { return deviceSessions(t, s, "a", id) == 2 })
+
+	// 关闭一个会话后设备仍然在线
+	first.Close()
+	waitFor(t, "关闭第一个会话", func() bool { return deviceSessions(t, s, "a", id) == 1 })
+	s.runMutex.Lock()
+	_, online := s.deviceConnected[id]
+	s.runMutex.Unlock()
+	if !online {
+		t.Fatal("设备还有会话在线时不应被移除")
+	}
+
+	second.Close()
+	waitFor(t, "关闭最后一个会话", func() bool { return deviceSessions(t, s, "a", id) == 0 })
+
+	// 只在第一个会话连接和最后一个会话断开时广播 connect / disconnect，中间只广播会话数变化
+	events := readEvents(t, observer, 300*time.Millisecond)
+	if len(events["connect"]) != 1 || len(events["device"]) != 2 || len(events["disconnect"]) != 1 {
+		t.Fatalf("connect %d 个、device %d 个、disconnect %d 个，期望 1、2、1",
+			len(events["connect"]), len(events["device"]), len(events["disconnect"]))
+	}
+	var sessions []int
+	for _, raw := range events["device"] {
+		var meta DeviceMeta
+		if err := json.Unmarshal(raw, &meta); err != nil {
+			t.Fatal(err)
+		}
+		if meta.ID != id {
+			t.Fatalf("device 事件的设备 = %s", meta.ID)
+		}
+		sessions = append(sessions, meta.Sessions)
+	}
+	if len(sessions) != 2 || sessions[0] != 2 || sessions[1] != 1 {
+		t.Fatalf("device 事件的会话数 = %v，期望 [2 1]", sessions)
+	}
+}
+
+// pairTestDevice 生成配对码并配对一个新设备，返回配对结果
+func pairTestDevice(t *testing.T, s *ClipboardServer, adminToken string) PairResponse {
+	t.Helper()
+	rec := do(t, s, http.MethodPost, "/pair/code", "", "Authorization", "Bearer "+adminToken)
+	expectStatus(t, rec, http.StatusCreated)
+	var code PairCodeResponse
+	decodeJSON(t, rec, &code)
+
+	rec = do(t, s, http.MethodPost, "/pair", `{"code":"`+code.Code+`","deviceName":"手机"}`, "Content-Type", "application/json")
+	expectStatus(t, rec, http.StatusCreated)
+	var paired PairResponse
+	decodeJSON(t, rec, &paired)
+	return paired
+}
+
+func TestDeviceUnpairRevokesAccess(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Server.Auth = testAdminPassword
+		cfg.Pairing.Enable = true
+	})
+	ts := startTestServer(t, s)
+	admin := []string{"Authorization", "Bearer " + testAdminPassword}
+	paired := pairTestDevice(t, s, testAdminPassword)
+	// 配对的令牌绑定到设备，需要同时携带设备凭据
+	deviceAuth := []string{"Authorization", "Bearer " + paired.Token, "X-Device-Id", paired.DeviceID, "X-Device-Secret", paired.Secret}
+
+	expectStatus(t, do(t, s, http.MethodGet, "/content/latest.json", "", deviceAuth...), http.StatusNotFound) // 房间为空，但令牌有效
+	conn := dialPush(t, ts, "room=default", http.Header{
+		"Authorization":   {"Bearer " + paired.Token},
+		"X-Device-Id":     {paired.DeviceID},
+		"X-Device-Secret": {paired.Secret},
+	})
+	waitFor(t, "配对设备连接", func() bool { return deviceSessions(t, s, "default", paired.DeviceID, admin...) == 1 })
+
+	// 配对的令牌不能撤销配对，只有管理员可以
+	target := "/devices/" + paired.DeviceID + "/pairings?room=default"
+	expectStatus(t, do(t, s, http.MethodDelete, target, "", deviceAuth...), http.StatusForbidden)
+	expectStatus(t, do(t, s, http.MethodDelete, target, "", admin...), http.StatusNoContent)
+
+	// 撤销后令牌失效，使用该令牌的连接被断开
+	expectStatus(t, do(t, s, http.MethodGet, "/content/latest.json", "", deviceAuth...), http.StatusUnauthorized)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if ne, ok := err.(interface{ Timeout() bool }); ok && ne.Timeout() {
+				t.Fatal("撤销配对后连接应被断开")
+			}
+			break
+		}
+	}
+	waitFor(t, "设备离线", func() bool { return deviceSessions(t, s, "default", paired.DeviceID, admin...) == 0 })
+
+	rec := do(t, s, http.MethodGet, "/devices?room=default", "", admin...)
+	expectStatus(t, rec, http.StatusOK)
+	var list DeviceListResponse
+	decodeJSON(t, rec, &list)
+	for _, device := range list.Devices {
+		if device.ID == paired.DeviceID {
+			t.Fatalf("撤销配对后设备不应再列出: %+v", device)
+		}
+	}
+	expectStatus(t, do(t, s, http.MethodDelete, target, "", admin...), http.StatusNotFound)
+}
@@ -0,0 +1,117 @@
+package lib
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestDirectMessageRequiresRegisteredTarget(t *testing.T) {
+	s := newTestServer(t, nil)
+	rec := do(t, s, http.MethodPost, "/text?to=0123456789abcdef", "hi", "Content-Type", "text/plain")
+	expectStatus(t, rec, http.StatusBadRequest)
+
+	s.messageQueue.Lock()
+	n := s.messageQueue.Len()
+	s.messageQueue.Unlock()
+	if n != 0 {
+		t.Fatalf("发给未知设备的私信不应被保存，消息数量 = %d", n)
+	}
+}
+
+func TestDirectMessageVisibility(t *testing.T) {
+	s := newTestServer(t, nil)
+	targetID, targetSecret := registerTestDevice(t, s, "目标")
+	otherID, otherSecret := registerTestDevice(t, s, "其他")
+	target := []string{"X-Device-Id", targetID, "X-Device-Secret", targetSecret}
+	other := []string{"X-Device-Id", otherID, "X-Device-Secret", otherSecret}
+
+	publicID := postText(t, s, "/text", "public")
+	directID := postText(t, s, "/text?to="+targetID, "direct secret")
+	postText(t, s, "/text?replyTo="+publicID+"&to="+targetID, "direct reply")
+
+	t.Run("内容", func(t *testing.T) {
+		for name, headers := range map[string][]string{"匿名": nil, "其他设备": other, "只有目标设备ID": {"X-Device-Id", targetID}} {
+			rec := do(t, s, http.MethodGet, "/content/"+directID, "", headers...)
+			if rec.Code != http.StatusNotFound {
+				t.Fatalf("%s: 状态码 = %d，响应: %s", name, rec.Code, rec.Body.String())
+			}
+		}
+		rec := do(t, s, http.MethodGet, "/content/"+directID, "", target...)
+		expectStatus(t, rec, http.StatusOK)
+		if rec.Body.String() != "direct secret\n" {
+			t.Fatalf("目标设备收到 %q", rec.Body.String())
+		}
+	})
+
+	t.Run("最新内容", func(t *testing.T) {
+		var latest struct {
+			ID      string `json:"id"`
+			Content string `json:"content"`
+		}
+		for name, headers := range map[string][]string{"匿名": nil, "其他设备": other} {
+			rec := do(t, s, http.MethodGet, "/content/latest.json", "", headers...)
+			expectStatus(t, rec, http.StatusOK)
+			decodeJSON(t, rec, &latest)
+			if latest.ID != publicID {
+				t.Fatalf("%s: 最新内容 = %+v，期望公开消息 %s", name, latest, publicID)
+			}
+		}
+		rec := do(t, s, http.MethodGet, "/content/latest.json", "", target...)
+		expectStatus(t, rec, http.StatusOK)
+		decodeJSON(t, rec, &latest)
+		if latest.Content != "direct reply" {
+			t.Fatalf("目标设备的最新内容 = %+v", latest)
+		}
+	})
+
+	t.Run("回复线程", func(t *testing.T) {
+		var thread struct {
+			ReplyCount int `json:"replyCount"`
+		}
+		rec := do(t, s, http.MethodGet, "/content/"+publicID+"/thread", "", other...)
+		expectStatus(t, rec, http.StatusOK)
+		decodeJSON(t, rec, &thread)
+		if thread.ReplyCount != 0 {
+			t.Fatalf("其他设备不应看到私信回复，replyCount = %d", thread.ReplyCount)
+		}
+		rec = do(t, s, http.MethodGet, "/content/"+publicID+"/thread", "", target...)
+		decodeJSON(t, rec, &thread)
+		if thread.ReplyCount != 1 {
+			t.Fatalf("目标设备应看到私信回复，replyCount = %d", thread.ReplyCount)
+		}
+		rec = do(t, s, http.MethodGet, "/content/"+directID+"/thread", "", other...)
+		expectStatus(t, rec, http.StatusNotFound)
+	})
+}
+
+func TestPendingDirectLimits(t *testing.T) {
+	s := newTestServer(t, nil)
+	event := func(id int) PostEvent {
+		return PostEvent{Event: "text", Data: ReceiveHolder{TextReceive: &TextReceive{ReceiveBase: ReceiveBase{ID: id, Room: "default"}}}}
+	}
+
+	for i := 1; i <= maxPendingDirectPerDevice+50; i++ {
+		s.queuePendingDirect("device-a", event(i))
+	}
+	queue := s.pendingDirect["device-a"]
+	if len(queue) != maxPendingDirectPerDevice {
+		t.Fatalf("单个设备的待投递私信 = %d，期望 %d", len(queue), maxPendingDirectPerDevice)
+	}
+	if first, last := queue[0].Data.ID(), queue[len(queue)-1].Data.ID(); first != 51 || last != maxPendingDirectPerDevice+50 {
+		t.Fatalf("应保留最新的私信，得到 %d..%d", first, last)
+	}
+
+	for i := len(s.pendingDirect); i < maxPendingDirectDevices; i++ {
+		s.queuePendingDirect("device-"+strconv.Itoa(i), event(i))
+	}
+	s.queuePendingDirect("device-overflow", event(1))
+	if _, ok := s.pendingDirect["device-overflow"]; ok || len(s.pendingDirect) != maxPendingDirectDevices {
+		t.Fatalf("待投递私信的设备数量 = %d，期望不超过 %d", len(s.pendingDirect), maxPendingDirectDevices)
+	}
+	// 已有队列的设备仍可继续暂存
+	s.queuePendingDirect("device-1", event(2))
+	if got := len(s.pendingDirect["device-1"]); got != 2 {
+		t.Fatalf("已有队列的设备应能继续暂存，得到 %d 条", got)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"testing"
 )
 
 // 定义所有命令行参数
@@ -26,6 +27,23 @@ var (
 	flg_key          = flag.String("key", "", "指定密钥文件，如果设置则覆盖配置文件")
 	flg_static_dir   = flag.String("static", "", "Path to external static files (overrides config, used if not in embed mode or useEmbeddedStr=false)")
 	flg_help         = flag.Bool("h", false, "显示帮助信息")
+
+	// 用户管理（执行后退出，不启动服务）
+	flg_useradd    = flag.String("useradd", "", "添加用户并退出，配合 -password、-rooms、-admin 使用")
+	flg_userdel    = flag.String("userdel", "", "删除用户并退出")
+	flg_userpasswd = flag.String("userpasswd", "", "修改用户密码并退出，配合 -password 使用")
+	flg_userrooms  = flag.String("userrooms", "", "修改用户可以访问的房间并退出，配合 -rooms 使用")
+	flg_userlist   = flag.Bool("userlist", false, "列出所有用户并退出")
+	flg_password   = flag.String("password", "", "用户密码，省略时从标准输入读取一行")
+	flg_rooms      = flag.String("rooms", "", "用户可以访问的房间，逗号分隔，* 表示所有房间")
+	flg_admin      = flag.Bool("admin", false, "添加的用户为管理员（可以访问所有房间）")
+
+	// API 令牌管理（执行后退出，不启动服务）
+	flg_tokenadd    = flag.String("tokenadd", "", "创建指定名称的 API 令牌并退出，配合 -scopes、-rooms、-expire 使用")
+	flg_tokenrevoke = flag.String("tokenrevoke", "", "按 ID 撤销 API 令牌并退出")
+	flg_tokenlist   = flag.Bool("tokenlist", false, "列出所有 API 令牌并退出")
+	flg_scopes      = flag.String("scopes", "read", "API 令牌的权限，逗号分隔: read, post-text, upload, revoke, admin")
+	flg_expire      = flag.String("expire", "", "API 令牌的有效期，如 12h、30d，省略表示永不过期")
 )
 
 // 自定义帮助信息，格式更美观
@@ -40,10 +58,17 @@ func printHelp() {
 	fmt.Printf("  %s -host 127.0.0.1 -port 9502  # 在127.0.0.1:9502上启动服务\n", appName)
 	fmt.Printf("  %s -config myconfig.json       # 使用指定的配置文件\n", appName)
 	fmt.Printf("  %s -auth abcdefg      		 # 使用指定的字符串作为网站访问密码\n", appName)
+	fmt.Printf("  %s -useradd alice -rooms work,home  # 添加用户 alice（从标准输入读取密码）\n", appName)
+	fmt.Printf("  %s -tokenadd ci -scopes post-text -rooms builds -expire 90d  # 创建只能向 builds 房间发送文本的 API 令牌\n", appName)
 
 }
 
 func init() {
+	// go test 生成的测试程序有自己的参数，由 testing 包解析
+	if testing.Testing() {
+		return
+	}
+
 	// 自定义帮助信息
 	flag.Usage = printHelp
 
@@ -1,7 +1,10 @@
 package lib
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
@@ -31,8 +34,13 @@ func (s *ClipboardServer) handle_server(w http.ResponseWriter, r *http.Request)
 		authorized = s.canAccessRoom("default", extractAuthToken(r))
 	}
 
+	// /server 会返回 token 是否有效，同样计入认证失败
+	if authNeeded && !authorized && extractAuthToken(r) != "" {
+		s.authFailed(r)
+	}
+
 	wsProtocol := "ws"
-	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+	if getScheme(r) == "https" {
 		wsProtocol = "wss"
 	}
 
@@ -48,6 +56,18 @@ func (s *ClipboardServer) handle_server(w http.ResponseWriter, r *http.Request)
 			},
 		},
 	}
+	if oidcInfo := s.oidcInfo(r); oidcInfo != nil {
+		response["oidc"] = oidcInfo
+	}
+	// 请求携带的有效设备凭据（cc_device Cookie 或请求头），客户端据此判断是否需要注册设备
+	if deviceID := s.requestDeviceID(r); deviceID != "" {
+		response["deviceId"] = deviceID
+	}
+	// 会话 Cookie（POST /login 或 OIDC 登录）已经可以访问该房间时，客户端不需要再发送密码
+	if authNeeded {
+		room := r.URL.Query().Get("room")
+		response["session"] = s.tokenMatchesRoom(room, roomSessionCookieToken(r, room)) || s.tokenMatchesRoom(room, sessionCookieToken(r))
+	}
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(response); err != nil {
 		s.logger.Printf("错误: 编码 /server 响应失败: %v", err)
@@ -57,24 +77,34 @@ func (s *ClipboardServer) handle_server(w http.ResponseWriter, r *http.Request)
 
 func (s *ClipboardServer) handle_push(w http.ResponseWriter, r *http.Request) {
 	ip := get_remote_ip(r)
-	room := normalizeRoomName(r.URL.Query().Get("room"))
-	s.logger.Printf("处理 /push WebSocket 连接请求，来自: %s, 房间: %s", ip, room)
+	rooms := parsePushRooms(r) // 支持 ?room=a&room=b 同时加入多个房间
+	room := rooms[0]
+	s.logger.Printf("处理 /push WebSocket 连接请求，来自: %s, 房间: %s", ip, strings.Join(rooms, ","))
 
-	requirement := s.resolveRoomAuth(room)
-	authNeeded := requirement.Required
-	if authNeeded {
-		token := extractAuthToken(r)
-		if token == "" {
-			s.logger.Printf("WebSocket 认证失败: 未提供 token。来自 IP: %s, 房间: %s", ip, room)
+	// 每个房间分别认证，Authorization / ?auth= 或 X-Room-Auth-Tokens 中任一 token 匹配即可
+	tokens := extractAuthTokens(r)
+	roomTokens := make(map[string]string, len(rooms))
+	authNeeded := false
+	for _, joinRoom := range rooms {
+		if !s.resolveRoomAuth(joinRoom).Required {
+			continue
+		}
+		authNeeded = true
+		if len(tokens) == 0 {
+			s.logger.Printf("WebSocket 认证失败: 未提供 token。来自 IP: %s, 房间: %s", ip, joinRoom)
 			http.Error(w, "Unauthorized: Missing token", http.StatusUnauthorized)
 			return
 		}
-		if !s.canAccessRoom(room, token) {
-			s.logger.Printf("WebSocket 认证失败: 提供的 token 与房间 '%s' 的认证配置不匹配。来自 IP: %s", room, ip)
+		token, ok := s.roomAccessToken(joinRoom, tokens)
+		if !ok {
+			s.logger.Printf("WebSocket 认证失败: 提供的 token 与房间 '%s' 的认证配置不匹配。来自 IP: %s", joinRoom, ip)
 			http.Error(w, "Unauthorized: Invalid token", http.StatusUnauthorized)
 			return
 		}
-		s.logger.Printf("WebSocket 认证成功。来自 IP: %s, 房间: %s", ip, room)
+		roomTokens[joinRoom] = token
+	}
+	if authNeeded {
+		s.logger.Printf("WebSocket 认证成功。来自 IP: %s, 房间: %s", ip, strings.Join(rooms, ","))
 	}
 
 	conn, err := upgrader.Upgrade(w, r, nil)
@@ -83,93 +113,35 @@ func (s *ClipboardServer) handle_push(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 生成设备 ID 和元数据
-	userAgent := r.Header.Get("User-Agent")
-	deviceID := fmt.Sprintf("%d", hash_murmur3([]byte(fmt.Sprintf("%s %s", r.RemoteAddr, userAgent)), s.deviceHashSeed))
-
-	clientUA := s.parser.Parse(userAgent)
-	deviceMeta := DeviceMeta{
-		ID:      deviceID,
-		Type:    clientUA.Device.Family,
-		Device:  strings.TrimSpace(fmt.Sprintf("%s %s %s", clientUA.Device.Brand, clientUA.Device.Model, clientUA.Os.Family)),
-		OS:      fmt.Sprintf("%s %s", clientUA.Os.Family, clientUA.Os.Major),
-		Browser: fmt.Sprintf("%s %s", clientUA.UserAgent.Family, clientUA.UserAgent.Major),
-	}
+	// 设备 ID 和元数据：优先使用客户端提供的稳定设备ID和昵称
+	deviceMeta := s.identifyPushDevice(r)
+	deviceID := deviceMeta.ID
 
-	// 第一次加锁：注册连接和获取当前房间内的设备列表
-	var devicesInRoom []DeviceMeta
+	// 注册连接，房间在 joinRoom 中逐个加入
 	s.runMutex.Lock()
 	s.websockets[conn] = true
-	s.room_ws[conn] = room
+	s.room_ws[conn] = make(map[string]string, len(rooms))
 	s.deviceConnected[deviceID] = deviceMeta
+	s.deviceSessions[deviceID]++
 	s.connDeviceIDMap[conn] = deviceID
-	s.updateRoomDeviceCount(room, deviceID, true)
+	sub := newHubSubscriber(deviceID)
+	s.wsSubscribers[conn] = sub
+	go s.writeWebSocketLoop(conn, sub)
 
 	s.logger.Printf("新 WebSocket 客户端连接: %s (ID: %s), 房间: %s. 当前连接数: %d, 设备数: %d",
-		conn.RemoteAddr(), deviceID, room, len(s.websockets), len(s.deviceConnected))
-
-	// 获取房间内现有设备列表（排除当前设备）
-	for _, existingDeviceID := range s.getDeviceIDsInRoomLocked(room, deviceID) {
-		if devMeta, ok := s.deviceConnected[existingDeviceID]; ok {
-			devicesInRoom = append(devicesInRoom, devMeta)
-		}
-	}
-	s.runMutex.Unlock() // 尽早释放锁
+		conn.RemoteAddr(), deviceID, strings.Join(rooms, ","), len(s.websockets), len(s.deviceConnected))
+	s.runMutex.Unlock()
 
-	// 向新客户端发送房间内当前连接的设备列表（在锁外执行）
-	for _, devMeta := range devicesInRoom {
-		wsMsg := WebSocketMessage{
-			Event: "connect",
-			Data:  devMeta,
-		}
-		if err := conn.WriteJSON(wsMsg); err != nil {
-			s.logger.Printf("错误: 发送现有设备 %s 信息到新客户端 %s 失败: %v", devMeta.ID, conn.RemoteAddr(), err)
+	// 加入每个房间：发送在线设备和历史消息，并通知房间内的其他客户端
+	client := &pushClient{conn: conn, r: r, sub: sub, deviceID: deviceID, meta: deviceMeta, room: room}
+	for _, joinRoom := range rooms {
+		if !s.joinRoom(client, joinRoom, roomTokens[joinRoom]) {
 			// 如果发送失败，清理连接并返回
-			s.cleanupWebSocketConnection(conn, deviceID, room)
+			s.cleanupWebSocketConnection(conn, deviceID)
 			return
 		}
 	}
 
-	// 向房间内的其他客户端广播新设备连接（此函数内部会处理锁）
-	newDeviceClientMsg := WebSocketMessage{
-		Event: "connect",
-		Data:  deviceMeta,
-	}
-	s.broadcastWebSocketMessageToRoomExcept(newDeviceClientMsg, room, conn)
-
-	// 第二次加锁：获取历史消息（短时间持锁）
-	var historyMessages []PostEvent
-	s.messageQueue.Lock()
-	for _, msg := range s.messageQueue.List {
-		if msg.Data.Room() == "" || msg.Data.Room() == room {
-			historyMessages = append(historyMessages, msg)
-		}
-	}
-	s.messageQueue.Unlock() // 立即释放消息队列锁
-
-	// 发送历史消息（在锁外执行）
-	for _, msg := range historyMessages {
-		var clientPayload interface{}
-		if msg.Data.TextReceive != nil {
-			clientPayload = msg.Data.TextReceive
-		} else if msg.Data.FileReceive != nil {
-			clientPayload = msg.Data.FileReceive
-		} else {
-			continue
-		}
-
-		wsMsg := WebSocketMessage{
-			Event: "receive",
-			Data:  clientPayload,
-		}
-		if err := conn.WriteJSON(wsMsg); err != nil {
-			s.logger.Printf("错误: 发送历史消息到客户端 %s 失败: %v", conn.RemoteAddr(), err)
-			s.cleanupWebSocketConnection(conn, deviceID, room)
-			return
-		}
-	}
-	s.logger.Printf("已发送 %d 条历史消息到客户端 %s (房间: %s)", len(historyMessages), conn.RemoteAddr(), room)
-
 	// 发送配置信息给新连接的客户端
 	clientConfigData := struct {
 		Version string `json:"version"`
@@ -179,7 +151,8 @@ func (s *ClipboardServer) handle_push(w http.ResponseWriter, r *http.Request) {
 			RoomList bool   `json:"roomList"`
 		} `json:"server"`
 		Text struct {
-			Limit int `json:"limit"`
+			Limit    int  `json:"limit"`
+			Overflow bool `json:"overflow"`
 		} `json:"text"`
 		File struct {
 			Expire int `json:"expire"`
@@ -207,15 +180,15 @@ func (s *ClipboardServer) handle_push(w http.ResponseWriter, r *http.Request) {
 		Event: "config",
 		Data:  clientConfigData,
 	}
-	if err := conn.WriteJSON(configWsMsg); err != nil {
-		s.logger.Printf("错误: 发送配置信息到客户端 %s 失败: %v", conn.RemoteAddr(), err)
+	if !sub.send(configWsMsg) {
+		s.logger.Printf("错误: 发送配置信息到客户端 %s 失败: 连接已关闭", conn.RemoteAddr())
 	} else {
 		s.logger.Printf("已发送配置信息到客户端 %s", conn.RemoteAddr())
 	}
 
 	// 启动 WebSocket 消息读取 goroutine
 	go func() {
-		defer s.cleanupWebSocketConnection(conn, deviceID, room)
+		defer s.cleanupWebSocketConnection(conn, deviceID)
 
 		for {
 			messageType, p, err := conn.ReadMessage()
@@ -227,6 +200,10 @@ func (s *ClipboardServer) handle_push(w http.ResponseWriter, r *http.Request) {
 				}
 				break
 			}
+			if frame, ok := parseClientFrame(p); ok {
+				s.handleClientFrame(client, frame)
+				continue
+			}
 			if len(p) > 0 {
 				s.logger.Printf("收到来自 %s (ID: %s) 的 WebSocket 心跳消息: 类型 %d, 内容: %s",
 					conn.RemoteAddr(), deviceID, messageType, string(p))
@@ -265,10 +242,20 @@ func (s *ClipboardServer) handle_file(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 认证按文件的实际房间进行，room 参数与之不符时拒绝，避免误以为可以跨房间访问
+	if _, hasRoom := r.URL.Query()["room"]; hasRoom && normalizeRoomName(r.URL.Query().Get("room")) != normalizeRoomName(fileInfo.Room) {
+		s.logger.Printf("拒绝文件请求: %s 不属于房间 %q", uuid, r.URL.Query().Get("room"))
+		http.Error(w, "文件不属于该房间", http.StatusForbidden)
+		return
+	}
+
 	filePath := filepath.Join(s.storageFolder, uuid)
 
 	switch r.Method {
 	case http.MethodGet:
+		if !s.allowSensitiveFile(w, r, fileInfo.Sensitive, fileInfo.Name) {
+			return
+		}
 		s.logger.Printf("提供文件下载: %s (UUID: %s), 路径: %s", fileInfo.Name, uuid, filePath)
 
 		file, err := os.Open(filePath) // 打开文件以供 ServeContent 使用
@@ -338,16 +325,23 @@ func (s *ClipboardServer) handle_text(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	text := string(body)
-	if s.config.Text.Limit > 0 && len(text) > s.config.Text.Limit {
-		s.logger.Printf("错误: 文本内容超出限制 (%d > %d)", len(text), s.config.Text.Limit)
-		http.Error(w, fmt.Sprintf("文本内容超出限制 (最大 %d 字符)", s.config.Text.Limit), http.StatusRequestEntityTooLarge)
+	opts, err := s.parseMessageOptions(r, room)
+	if err != nil {
+		s.logger.Printf("错误: 无效的消息参数: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	text := string(body)
 	// 检查是否有 ID 参数用于覆盖
 	idStr := r.URL.Query().Get("id")
 	if idStr != "" {
+		// 覆盖已有消息时不支持转存为文件
+		if s.config.Text.Limit > 0 && len(text) > s.config.Text.Limit {
+			s.logger.Printf("错误: 文本内容超出限制 (%d > %d)", len(text), s.config.Text.Limit)
+			http.Error(w, fmt.Sprintf("文本内容超出限制 (最大 %d 字符)", s.config.Text.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
 		// 尝试覆盖现有消息
 		id, err := strconv.Atoi(idStr)
 		if err != nil {
@@ -358,6 +352,7 @@ func (s *ClipboardServer) handle_text(w http.ResponseWriter, r *http.Request) {
 
 		// 查找并更新消息
 		if updated := s.updateTextMessage(id, text, room, r); updated {
+			s.recordAudit(r, auditMessageEdit, room, idStr, nil)
 			w.Header().Set("Content-Type", "application/json")
 			// 构建内容 URL
 			scheme := getScheme(r)
@@ -378,8 +373,21 @@ func (s *ClipboardServer) handle_text(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	s.logger.Printf("收到文本消息 (房间: %s): %s", room, text)
-	event := s.addMessageToQueueAndBroadcast("text", text, room, r)
+	event, err := s.postText(text, room, opts, r)
+	if err != nil {
+		if errors.Is(err, errTextTooLarge) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		} else {
+			s.logger.Printf("错误: 超长文本转存为文件失败: %v", err)
+			http.Error(w, "无法保存文件", http.StatusInternalServerError)
+		}
+		return
+	}
+	// 启用 text.overflow 时超长文本被转存为文件，返回与上传相同的响应
+	if event.Data.FileReceive != nil {
+		s.writeUploadResponse(w, r, room, event, event.Data.FileReceive.Name)
+		return
+	}
 
 	// 响应 (可以效仿 auth.go 中的 enhanceHandleText 返回内容 URL)
 	scheme := getScheme(r)
@@ -401,8 +409,8 @@ func (s *ClipboardServer) updateTextMessage(id int, newContent string, room stri
 	s.messageQueue.Lock()
 	defer s.messageQueue.Unlock()
 
-	for i, msg := range s.messageQueue.List {
-		if msg.Data.ID() == id && msg.Data.Type() == "text" && msg.Data.Room() == room {
+	if msg := s.messageQueue.Get(id); msg != nil {
+		if msg.Data.Type() == "text" && msg.Data.Room() == room {
 			if msg.Data.TextReceive != nil {
 				// 检查更新内容是否与原内容相同
 				if msg.Data.TextReceive.Content == newContent {
@@ -412,23 +420,24 @@ func (s *ClipboardServer) updateTextMessage(id int, newContent string, room stri
 
 				// 获取原内容用于日志
 				originalContent := msg.Data.TextReceive.Content
-				// 更新内容和时间戳（使用索引 i 修改原数组）
-				s.messageQueue.List[i].Data.TextReceive.Content = newContent
-				s.messageQueue.List[i].Data.TextReceive.Timestamp = time.Now().Unix()
-				s.messageQueue.List[i].Data.TextReceive.SenderIP = get_remote_ip(r)
-				s.messageQueue.List[i].Data.TextReceive.SenderDevice = s.parse_user_agent(r.UserAgent())
+				// 更新内容和时间戳（msg 指向队列中的消息，直接修改）
+				msg.Data.TextReceive.Content = newContent
+				msg.Data.TextReceive.Timestamp = time.Now().Unix()
+				msg.Data.TextReceive.SenderIP = get_remote_ip(r)
+				msg.Data.TextReceive.SenderDevice = s.senderDevice(r)
+				s.markSensitive(msg.Data.TextReceive)
 
 				// 广播更新事件
 				wsMsg := WebSocketMessage{
 					Event: "update",
-					Data:  s.messageQueue.List[i].Data.TextReceive,
+					Data:  msg.Data.Payload(),
 				}
 				go s.broadcastWebSocketMessage(wsMsg, room)
 
 				// 保存历史数据
 				go s.saveHistoryData()
 
-				s.logger.Printf("文本消息 ID %d 已更新 (房间: %s) - 原内容: '%s', 新内容: '%s'", id, room, originalContent, newContent)
+				s.logger.Printf("文本消息 ID %d 已更新 (房间: %s) - 原内容: '%s', 新内容: '%s'", id, room, s.logText(originalContent), s.logText(newContent))
 				return true
 			}
 		}
@@ -485,6 +494,13 @@ func (s *ClipboardServer) handle_upload(w http.ResponseWriter, r *http.Request)
 	}
 
 	// 处理常规文件上传 (/upload 路径)
+	opts, err := s.parseMessageOptions(r, room)
+	if err != nil {
+		s.logger.Printf("错误: 无效的消息参数: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// 检查文件大小限制
 	if s.config.File.Limit > 0 && r.ContentLength > int64(s.config.File.Limit) {
 		s.logger.Printf("错误: 文件大小 (%d) 超出限制 (%d)", r.ContentLength, s.config.File.Limit)
@@ -492,7 +508,7 @@ func (s *ClipboardServer) handle_upload(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	err := r.ParseMultipartForm(int64(s.config.File.Limit)) // 使用文件大小限制作为 maxMemory
+	err = r.ParseMultipartForm(int64(s.config.File.Limit)) // 使用文件大小限制作为 maxMemory
 	if err != nil {
 		s.logger.Printf("错误: 解析 multipart form 失败: %v", err)
 		http.Error(w, "无法解析表单数据", http.StatusBadRequest)
@@ -524,15 +540,24 @@ func (s *ClipboardServer) handle_upload(w http.ResponseWriter, r *http.Request)
 	}
 	defer dst.Close()
 
-	if _, err := io.Copy(dst, file); err != nil {
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(dst, hasher), file); err != nil {
 		s.logger.Printf("错误: 写入文件 %s 失败: %v", filePath, err)
 		http.Error(w, "无法写入文件", http.StatusInternalServerError)
 		return
 	}
+	digest := hex.EncodeToString(hasher.Sum(nil))
 
 	timestamp := time.Now().Unix()
 	expireTime := timestamp + int64(s.config.File.Expire)
 
+	// 与房间最新文件内容相同时合并，不再保存新文件
+	if event, deduped := s.dedupRecentFile(room, opts, digest, expireTime); deduped {
+		s.discardUpload(uuid)
+		s.writeUploadResponse(w, r, room, event, fileName)
+		return
+	}
+
 	// 创建文件信息
 	fileInfo := File{
 		Name:       fileName,
@@ -553,6 +578,7 @@ func (s *ClipboardServer) handle_upload(w http.ResponseWriter, r *http.Request)
 		Expire: expireTime,
 		Cache:  uuid,
 		URL:    fmt.Sprintf("%s://%s%s/file/%s", getScheme(r), r.Host, s.config.Server.Prefix, uuid),
+		Digest: digest,
 	}
 
 	// 如果文件不太大，创建缩略图
@@ -566,15 +592,20 @@ func (s *ClipboardServer) handle_upload(w http.ResponseWriter, r *http.Request)
 		}
 	}
 
-	event := s.addMessageToQueueAndBroadcast("file", fileReceiveData, room, r)
+	event := s.addMessageToQueueAndBroadcast("file", fileReceiveData, room, opts, r)
 
 	// 响应
+	s.writeUploadResponse(w, r, room, event, fileInfo.Name)
+}
+
+// writeUploadResponse 返回文件消息的内容 URL、ID 和类型
+func (s *ClipboardServer) writeUploadResponse(w http.ResponseWriter, r *http.Request, room string, event PostEvent, fileName string) {
 	scheme := getScheme(r)
 	contentURL := fmt.Sprintf("%s://%s%s/content/%d", scheme, r.Host, s.config.Server.Prefix, event.Data.ID())
 	if room != "default" {
 		contentURL += fmt.Sprintf("?room=%s", room)
 	}
-	responseType := DetermineResponseType(fileInfo.Name)
+	responseType := DetermineResponseType(fileName)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
 		"url":  contentURL,
@@ -676,24 +707,44 @@ func (s *ClipboardServer) handle_finish(w http.ResponseWriter, r *http.Request)
 		room = normalizeRoomName(fileInfo.Room)
 	}
 
+	opts, err := s.parseMessageOptions(r, room)
+	if err != nil {
+		s.logger.Printf("错误: 无效的消息参数: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// 生成消息相关信息
 	timestamp := time.Now().Unix()
 
 	filePath := filepath.Join(s.storageFolder, uuid)
 
+	digest, err := fileDigest(filePath)
+	if err != nil {
+		s.logger.Printf("警告: 计算文件 %s 摘要失败: %v", filePath, err)
+	}
+
+	// 与房间最新文件内容相同时合并，不再保存新文件
+	if event, deduped := s.dedupRecentFile(room, opts, digest, fileInfo.ExpireTime); deduped {
+		s.discardUpload(uuid)
+		s.writeUploadResponse(w, r, room, event, fileInfo.Name)
+		return
+	}
+
 	fileReceiveData := &FileReceive{
 		ReceiveBase: ReceiveBase{
 			Type:         "file",
 			Room:         room,
 			Timestamp:    timestamp,
 			SenderIP:     get_remote_ip(r),
-			SenderDevice: s.parse_user_agent(r.UserAgent()),
+			SenderDevice: s.senderDevice(r),
 		},
 		Name:   fileInfo.Name,
 		Size:   fileInfo.Size,
 		Cache:  uuid,
 		Expire: fileInfo.ExpireTime,
 		URL:    fmt.Sprintf("%s://%s%s/file/%s", getScheme(r), r.Host, s.config.Server.Prefix, uuid),
+		Digest: digest,
 	}
 
 	// 如果文件不太大，创建缩略图
@@ -708,22 +759,11 @@ func (s *ClipboardServer) handle_finish(w http.ResponseWriter, r *http.Request)
 	}
 
 	// 添加消息到队列并广播
-	event := s.addMessageToQueueAndBroadcast("file", fileReceiveData, room, r)
+	event := s.addMessageToQueueAndBroadcast("file", fileReceiveData, room, opts, r)
 	s.logger.Printf("文件 %s (UUID: %s) 上传完成, 大小: %d, 房间: %s", fileInfo.Name, uuid, fileInfo.Size, room)
 
 	// 构建响应
-	scheme := getScheme(r)
-	contentURL := fmt.Sprintf("%s://%s%s/content/%d", scheme, r.Host, s.config.Server.Prefix, event.Data.ID())
-	if room != "default" {
-		contentURL += fmt.Sprintf("?room=%s", room)
-	}
-	responseType := DetermineResponseType(fileInfo.Name)
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"url":  contentURL,
-		"id":   strconv.Itoa(event.Data.ID()),
-		"type": responseType,
-	})
+	s.writeUploadResponse(w, r, room, event, fileInfo.Name)
 }
 
 func (s *ClipboardServer) handle_revoke(w http.ResponseWriter, r *http.Request) {
@@ -739,48 +779,74 @@ func (s *ClipboardServer) handle_revoke(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	token := extractAuthToken(r)
-	requestedRoom, hasRequestedRoom := r.URL.Query()["room"]
-	_ = requestedRoom
+	_, hasRequestedRoom := r.URL.Query()["room"]
+	// 按消息实际所在的房间选择令牌（该房间的会话 Cookie），未指定 ?room 时也能使用对应房间的登录状态
+	tokenFor := func(room string) string { return requestRoomToken(r, room) }
+	msg, err := s.revokeMessage(id, r.URL.Query().Get("room"), hasRequestedRoom, tokenFor)
+	if err != nil {
+		switch err {
+		case errRoomUnauthorized:
+			writeAuthJSONError(w, http.StatusUnauthorized, "无权访问该房间")
+		default:
+			s.logger.Printf("尝试撤销未找到的消息 ID: %d", id)
+			http.Error(w, "消息未找到", http.StatusNotFound)
+		}
+		return
+	}
+	s.recordAudit(r, auditMessageRevoke, normalizeRoomName(msg.Data.Room()), idStr, map[string]any{"type": msg.Data.Type()})
+}
 
+// revokeMessage 撤销指定 ID 的消息，并按 replyRevoke 策略处理其回复。
+// hasRequestedRoom 为 true 时只在 requestedRoom 中查找；tokenFor 返回访问消息所在房间时使用的令牌，无权访问时返回 errRoomUnauthorized。
+func (s *ClipboardServer) revokeMessage(id int, requestedRoom string, hasRequestedRoom bool, tokenFor func(room string) string) (PostEvent, error) {
 	s.messageQueue.Lock()
 	var foundMsg PostEvent
-	foundIndex := -1
+	found := false
 	unauthorized := false
 
-	for i := range s.messageQueue.List { // 使用大写 L
-		if s.messageQueue.List[i].Data.ID() == id {
-			messageRoom := normalizeRoomName(s.messageQueue.List[i].Data.Room())
-			if hasRequestedRoom && messageRoom != normalizeRoomName(r.URL.Query().Get("room")) {
-				continue
-			}
-			if !s.canAccessRoom(messageRoom, token) {
+	if msg := s.messageQueue.Get(id); msg != nil {
+		messageRoom := normalizeRoomName(msg.Data.Room())
+		if !hasRequestedRoom || messageRoom == normalizeRoomName(requestedRoom) {
+			if s.canAccessRoom(messageRoom, tokenFor(messageRoom)) {
+				found = true
+			} else {
 				unauthorized = true
-				continue
 			}
-			foundMsg = s.messageQueue.List[i]
-			foundIndex = i
-			break
 		}
 	}
-	if foundIndex != -1 {
+	var cascaded, orphaned []PostEvent
+	if found {
 		// 从消息队列中移除
-		s.messageQueue.List = append(s.messageQueue.List[:foundIndex], s.messageQueue.List[foundIndex+1:]...) // 使用大写 L
+		foundMsg, _ = s.messageQueue.Delete(id)
+		cascaded, orphaned = s.applyReplyRevokePolicyLocked(foundMsg)
 	}
 	s.messageQueue.Unlock()
-	if foundIndex == -1 {
+	if !found {
 		if unauthorized {
-			writeAuthJSONError(w, http.StatusUnauthorized, "无权访问该房间")
-			return
+			return PostEvent{}, errRoomUnauthorized
 		}
-		s.logger.Printf("尝试撤销未找到的消息 ID: %d", id)
-		http.Error(w, "消息未找到", http.StatusNotFound)
-		return
+		return PostEvent{}, errMessageNotFound
+	}
+
+	s.cleanupRevokedMessage(foundMsg)
+	for _, reply := range cascaded {
+		s.logger.Printf("级联撤销回复消息 ID: %d (父消息 ID: %d)", reply.Data.ID(), reply.Data.ReplyTo())
+		s.cleanupRevokedMessage(reply)
 	}
+	for _, reply := range orphaned {
+		s.broadcastMessageUpdate(reply)
+	}
+	s.saveHistoryData()
+	return foundMsg, nil
+}
+
+// cleanupRevokedMessage 清理已从队列移除的消息：删除关联文件、回执和待投递私信，并广播撤销事件
+func (s *ClipboardServer) cleanupRevokedMessage(msg PostEvent) {
+	id := msg.Data.ID()
 
 	// 如果是文件消息，则删除文件并从 uploadFileMap 中移除
-	if foundMsg.Data.Type() == "file" && foundMsg.Data.FileReceive != nil {
-		uuid := foundMsg.Data.FileReceive.Cache
+	if msg.Data.Type() == "file" && msg.Data.FileReceive != nil {
+		uuid := msg.Data.FileReceive.Cache
 		s.runMutex.Lock() // 保护 uploadFileMap
 		delete(s.uploadFileMap, uuid)
 		s.runMutex.Unlock()
@@ -795,38 +861,46 @@ func (s *ClipboardServer) handle_revoke(w http.ResponseWriter, r *http.Request)
 		}
 	}
 
+	s.forgetReceipts(id)
+	s.dropPendingDirect(func(event PostEvent) bool { return event.Data.ID() == id })
+	s.shares.removeMessages(normalizeRoomName(msg.Data.Room()), id)
+
 	// 广播撤销事件
 	revokeWsMsg := WebSocketMessage{
 		Event: "revoke",
 		Data:  map[string]int{"id": id}, // 前端期望的载荷
 	}
-	s.broadcastWebSocketMessage(revokeWsMsg, foundMsg.Data.Room()) // 使用新的广播函数
-	s.saveHistoryData()
+	s.broadcastWebSocketMessage(revokeWsMsg, msg.Data.Room()) // 使用新的广播函数
 }
 
 func (s *ClipboardServer) handleClearAll(w http.ResponseWriter, r *http.Request) {
 	normalizedRoom := normalizeRoomName(r.URL.Query().Get("room"))
-	if !s.canAccessRoom(normalizedRoom, extractAuthToken(r)) {
+	if !s.requestCanAccessRoom(r, normalizedRoom) {
 		writeAuthJSONError(w, http.StatusUnauthorized, "无权访问该房间")
 		return
 	}
 
 	s.logger.Printf("处理 /revoke/all 请求 (规范化后: '%s')", normalizedRoom)
+	count := s.clearRoom(normalizedRoom)
+	s.recordAudit(r, auditRoomClear, normalizedRoom, "", map[string]any{"count": count})
 
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "所有消息已清除")
+}
+
+// clearRoom 清空房间中的所有消息和文件，并广播 clearAll 事件，返回清除的消息数量
+func (s *ClipboardServer) clearRoom(normalizedRoom string) int {
 	s.messageQueue.Lock()
-	var newMsgList []PostEvent
 	var revokedIDs []int
 
 	// 始终只清空指定房间（规范化后的房间名），不再支持通过空字符串清空所有
-	for _, msg := range s.messageQueue.List {
-		if normalizeRoomName(msg.Data.Room()) != normalizedRoom {
-			newMsgList = append(newMsgList, msg)
-		} else {
-			revokedIDs = append(revokedIDs, msg.Data.ID())
-		}
+	for _, msg := range s.messageQueue.DeleteInRoom(normalizedRoom, func(*PostEvent) bool { return true }) {
+		revokedIDs = append(revokedIDs, msg.Data.ID())
 	}
-	s.messageQueue.List = newMsgList
 	s.messageQueue.Unlock()
+	s.forgetReceipts(revokedIDs...)
+	s.dropPendingDirect(func(event PostEvent) bool { return normalizeRoomName(event.Data.Room()) == normalizedRoom })
+	s.shares.removeRoom(normalizedRoom)
 
 	// 删除关联的文件
 	s.runMutex.Lock() // 保护 uploadFileMap
@@ -848,6 +922,9 @@ func (s *ClipboardServer) handleClearAll(w http.ResponseWriter, r *http.Request)
 		}
 	}
 
+	// 丢弃 hub 中记录的房间事件，已清除的消息不能再通过 SSE 续传获取
+	s.hub.purgeRoom(normalizedRoom, false)
+
 	// 广播 clearAll 事件
 	clearWsMsg := WebSocketMessage{
 		Event: "clearAll",
@@ -855,9 +932,7 @@ func (s *ClipboardServer) handleClearAll(w http.ResponseWriter, r *http.Request)
 	}
 	s.broadcastWebSocketMessage(clearWsMsg, normalizedRoom) // 使用新的广播函数
 	s.saveHistoryData()
-
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintln(w, "所有消息已清除")
+	return len(revokedIDs)
 }
 
 func (s *ClipboardServer) handleContent(w http.ResponseWriter, r *http.Request) {
@@ -869,11 +944,22 @@ func (s *ClipboardServer) handleContent(w http.ResponseWriter, r *http.Request)
 
 	idStr := parts[len(parts)-1]
 
+	// /content/{id}/thread 返回回复线程
+	if idStr == "thread" && len(parts) >= 3 {
+		s.handleThread(w, r, parts[len(parts)-2])
+		return
+	}
+
 	// 检查是否是访问 "latest"，如果是，让专用处理函数处理
 	if idStr == "latest" || idStr == "latest.json" {
 		s.handleLatestContent(w, r)
 		return
 	}
+	// "next" 阻塞等待房间中的下一条消息
+	if idStr == "next" || idStr == "next.json" {
+		s.handleNextContent(w, r)
+		return
+	}
 	// 检查是否请求 JSON 格式的响应
 	// 1. 通过 URL 后缀判断
 	isJSONRequest := strings.HasSuffix(idStr, ".json")
@@ -894,105 +980,138 @@ func (s *ClipboardServer) handleContent(w http.ResponseWriter, r *http.Request)
 		http.Error(w, "无效的内容 ID", http.StatusBadRequest)
 		return
 	}
-	token := extractAuthToken(r)
 	_, hasRequestedRoom := r.URL.Query()["room"]
 	requestedRoom := normalizeRoomName(r.URL.Query().Get("room"))
 	s.logger.Printf("处理内容请求, ID: %d, 房间参数存在: %t, JSON请求: %t", id, hasRequestedRoom, isJSONRequest)
+	deviceID := s.requestDeviceID(r)
 
+	// 在锁内通过 ID 索引查找并复制消息，释放锁后再输出，避免慢客户端（尤其是文件下载）阻塞消息队列
 	s.messageQueue.Lock()
-	defer s.messageQueue.Unlock()
 	unauthorized := false
+	var msg PostEvent
+	var messageRoom string
+	var replyCount int
+	found := s.messageQueue.Get(id)
+	if found != nil {
+		messageRoom = normalizeRoomName(found.Data.Room())
+		if hasRequestedRoom && messageRoom != requestedRoom {
+			found = nil // 不在请求的房间中，按未找到处理
+		} else if !s.requestCanAccessRoom(r, messageRoom) {
+			unauthorized = true
+			found = nil
+		} else if !found.Data.VisibleTo(deviceID) {
+			found = nil // 发给其他设备的私信，按未找到处理
+		}
+	}
+	if found != nil {
+		msg = PostEvent{Event: found.Event, Data: found.Data.Clone()}
+		replyCount = s.countRepliesLocked(id, deviceID)
+	}
+	s.messageQueue.Unlock()
 
-	// 遍历消息列表寻找匹配的消息
-	for _, msg := range s.messageQueue.List {
-		// 检查ID是否匹配
-		if msg.Data.ID() == id {
-			messageRoom := normalizeRoomName(msg.Data.Room())
-			if hasRequestedRoom && messageRoom != requestedRoom {
-				continue
-			}
-			if !s.canAccessRoom(messageRoom, token) {
-				unauthorized = true
-				continue
-			}
-
-			// 根据消息类型处理
-			switch msg.Data.Type() {
-			case "file":
-				if msg.Data.FileReceive != nil {
-					if isJSONRequest {
-						// 返回JSON格式的文件信息
-						fileReceive := msg.Data.FileReceive
-						responseType := DetermineResponseType(fileReceive.Name)
-
-						responseData := map[string]interface{}{
-							"type":      responseType,
-							"name":      fileReceive.Name,
-							"size":      fileReceive.Size,
-							"uuid":      fileReceive.Cache,
-							"url":       fileReceive.URL,
-							"id":        strconv.Itoa(msg.Data.ID()),
-							"timestamp": fileReceive.Timestamp,
-						}
-
-						w.Header().Set("Content-Type", "application/json")
-						json.NewEncoder(w).Encode(responseData)
-						s.logger.Printf("以JSON格式返回文件信息, ID: %d", id)
-						return
+	if found != nil {
+		// 根据消息类型处理
+		switch msg.Data.Type() {
+		case "file":
+			if msg.Data.FileReceive != nil {
+				if isJSONRequest {
+					// 返回JSON格式的文件信息
+					fileReceive := msg.Data.FileReceive
+					responseType := DetermineResponseType(fileReceive.Name)
+
+					responseData := map[string]interface{}{
+						"type":      responseType,
+						"name":      fileReceive.Name,
+						"size":      fileReceive.Size,
+						"uuid":      fileReceive.Cache,
+						"url":       fileReceive.URL,
+						"id":        strconv.Itoa(msg.Data.ID()),
+						"timestamp": fileReceive.Timestamp,
+						"receipts":  s.getReceipt(msg.Data.ID(), messageRoom),
 					}
-
-					filePath := filepath.Join(s.storageFolder, msg.Data.FileReceive.Cache)
-					file, openErr := os.Open(filePath)
-					if openErr != nil {
-						s.logger.Printf("错误: 打开文件失败: %v", openErr)
-						http.Error(w, "文件在磁盘上未找到", http.StatusNotFound)
-						return
+					if fileReceive.Preview != "" {
+						responseData["preview"] = fileReceive.Preview
 					}
-					defer file.Close()
+					addReplyFields(responseData, msg, replyCount)
+					addSensitiveFileFields(responseData, fileReceive)
 
-					stat, statErr := file.Stat()
-					if statErr != nil {
-						s.logger.Printf("错误: 获取文件状态失败: %v", statErr)
-						http.Error(w, "无法获取文件状态", http.StatusInternalServerError)
-						return
-					}
+					w.Header().Set("Content-Type", "application/json")
+					json.NewEncoder(w).Encode(responseData)
+					s.logger.Printf("以JSON格式返回文件信息, ID: %d", id)
+					return
+				}
+
+				if !s.allowSensitiveFile(w, r, msg.Data.FileReceive.Sensitive, msg.Data.FileReceive.Name) {
+					return
+				}
+				filePath := filepath.Join(s.storageFolder, msg.Data.FileReceive.Cache)
+				file, openErr := os.Open(filePath)
+				if openErr != nil {
+					s.logger.Printf("错误: 打开文件失败: %v", openErr)
+					http.Error(w, "文件在磁盘上未找到", http.StatusNotFound)
+					return
+				}
+				defer file.Close()
 
-					dispositionType := "inline"
-					if r.URL.Query().Get("download") == "true" {
-						dispositionType = "attachment"
+				stat, statErr := file.Stat()
+				if statErr != nil {
+					s.logger.Printf("错误: 获取文件状态失败: %v", statErr)
+					http.Error(w, "无法获取文件状态", http.StatusInternalServerError)
+					return
+				}
+
+				dispositionType := "inline"
+				if r.URL.Query().Get("download") == "true" {
+					dispositionType = "attachment"
+				}
+				w.Header().Set("Content-Disposition", fmt.Sprintf("%s; filename=%q", dispositionType, msg.Data.FileReceive.Name))
+				http.ServeContent(w, r, msg.Data.FileReceive.Name, stat.ModTime(), file)
+				return
+			}
+		case "text":
+			if msg.Data.TextReceive != nil {
+				// 敏感内容需要显式 reveal 才返回原文
+				textReceive := msg.Data.TextReceive
+				if textReceive.Sensitive {
+					if isRevealRequest(r) {
+						s.logger.Printf("敏感文本内容已按请求显示原文, ID: %d, 来源: %s", id, get_remote_ip(r))
+					} else {
+						textReceive = msg.Data.Masked().TextReceive
 					}
-					w.Header().Set("Content-Disposition", fmt.Sprintf("%s; filename=%q", dispositionType, msg.Data.FileReceive.Name))
-					http.ServeContent(w, r, msg.Data.FileReceive.Name, stat.ModTime(), file)
+				}
+				// format=html 渲染 Markdown 页面，format=md 下载 Markdown 文件
+				if format := r.URL.Query().Get("format"); isMarkdownFormat(format) {
+					s.writeMarkdownContent(w, textReceive, format)
 					return
 				}
-			case "text":
-				if msg.Data.TextReceive != nil {
-					// 返回格式判断优先级：1. isJSONRequest参数 2. Accept头
-					if isJSONRequest || strings.Contains(r.Header.Get("Accept"), "application/json") {
-						// JSON格式响应
-						responseData := map[string]interface{}{
-							"type":      "text",
-							"content":   msg.Data.TextReceive.Content,
-							"id":        strconv.Itoa(msg.Data.ID()),
-							"timestamp": msg.Data.TextReceive.Timestamp,
-						}
-
-						w.Header().Set("Content-Type", "application/json")
-						json.NewEncoder(w).Encode(responseData)
-						s.logger.Printf("以JSON格式返回文本内容, ID: %d", id)
-						return
+				// 返回格式判断优先级：1. isJSONRequest参数 2. Accept头
+				if isJSONRequest || strings.Contains(r.Header.Get("Accept"), "application/json") {
+					// JSON格式响应
+					responseData := map[string]interface{}{
+						"type":      "text",
+						"content":   textReceive.Content,
+						"id":        strconv.Itoa(msg.Data.ID()),
+						"timestamp": textReceive.Timestamp,
+						"receipts":  s.getReceipt(msg.Data.ID(), messageRoom),
 					}
+					addReplyFields(responseData, msg, replyCount)
+					addSensitiveFields(responseData, textReceive)
 
-					// 默认返回纯文本
-					w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-					content := msg.Data.TextReceive.Content
-					if !strings.HasSuffix(content, "\n") {
-						content += "\n"
-					}
-					w.Write([]byte(content))
-					s.logger.Printf("以纯文本格式返回文本内容, ID: %d", id)
+					w.Header().Set("Content-Type", "application/json")
+					json.NewEncoder(w).Encode(responseData)
+					s.logger.Printf("以JSON格式返回文本内容, ID: %d", id)
 					return
 				}
+
+				// 默认返回纯文本
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				content := textReceive.Content
+				if !strings.HasSuffix(content, "\n") {
+					content += "\n"
+				}
+				w.Write([]byte(content))
+				s.logger.Printf("以纯文本格式返回文本内容, ID: %d", id)
+				return
 			}
 		}
 	}
@@ -1013,7 +1132,6 @@ func (s *ClipboardServer) handleContent(w http.ResponseWriter, r *http.Request)
 }
 
 func (s *ClipboardServer) handleLatestContent(w http.ResponseWriter, r *http.Request) {
-	token := extractAuthToken(r)
 	_, hasRequestedRoom := r.URL.Query()["room"]
 	requestedRoom := normalizeRoomName(r.URL.Query().Get("room"))
 
@@ -1025,12 +1143,44 @@ func (s *ClipboardServer) handleLatestContent(w http.ResponseWriter, r *http.Req
 	}
 
 	s.logger.Printf("处理最新内容请求 (房间参数存在: %t, JSON请求: %t)", hasRequestedRoom, isJSONRequest)
+	deviceID := s.requestDeviceID(r)
 
+	// 在锁内找到最新的消息并复制，释放锁后再输出
 	s.messageQueue.Lock()
-	defer s.messageQueue.Unlock()
+	empty := s.messageQueue.Len() == 0
+	unauthorized := false
+	var latest *PostEvent
+	var messageRoom string
+	var replyCount int
+	visit := func(found *PostEvent) bool {
+		if !found.Data.VisibleTo(deviceID) {
+			return true // 跳过发给其他设备的私信
+		}
+		room := normalizeRoomName(found.Data.Room())
+		if !s.requestCanAccessRoom(r, room) {
+			unauthorized = true
+			return true
+		}
+		if !latestItemSupported(*found, isJSONRequest) {
+			return true
+		}
+		// 最新内容只返回遮盖后的敏感文本，原文需通过 /content/{id}?reveal=1 获取
+		msg := PostEvent{Event: found.Event, Data: found.Data.Masked()}
+		msg.Data = msg.Data.Clone()
+		latest, messageRoom, replyCount = &msg, room, s.countRepliesLocked(msg.Data.ID(), deviceID)
+		return false
+	}
+	if !empty {
+		if hasRequestedRoom {
+			s.messageQueue.RangeRoomReverse(requestedRoom, visit)
+		} else {
+			s.messageQueue.RangeReverse(visit)
+		}
+	}
+	s.messageQueue.Unlock()
 
 	// 检查消息队列是否为空
-	if len(s.messageQueue.List) == 0 {
+	if empty {
 		s.logger.Printf("没有可用的内容")
 		if isJSONRequest {
 			// 如果是JSON请求，返回JSON格式的404响应
@@ -1044,131 +1194,10 @@ func (s *ClipboardServer) handleLatestContent(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	// 从后向前查找匹配房间的最新消息
-	unauthorized := false
-	for i := len(s.messageQueue.List) - 1; i >= 0; i-- {
-		msg := s.messageQueue.List[i]
-		messageRoom := normalizeRoomName(msg.Data.Room())
-
-		// 检查房间匹配 (空房间参数表示匹配任何房间)
-		if hasRequestedRoom && messageRoom != requestedRoom {
-			continue
-		}
-		if !s.canAccessRoom(messageRoom, token) {
-			unauthorized = true
-			continue
-		}
-
-		// 如果是JSON请求，始终以JSON格式返回
-		if isJSONRequest {
-			w.Header().Set("Content-Type", "application/json")
-
-			var responseType string
-			var responseData map[string]interface{}
-
-			if msg.Data.Type() == "file" && msg.Data.FileReceive != nil {
-				// 确定文件类型
-				fileReceive := msg.Data.FileReceive
-				responseType = DetermineResponseType(fileReceive.Name)
-
-				// 构建JSON响应
-				responseData = map[string]interface{}{
-					"type":      responseType,
-					"name":      fileReceive.Name,
-					"size":      fileReceive.Size,
-					"uuid":      fileReceive.Cache,
-					"url":       filepath.Join(fileReceive.URL, fileReceive.Name),
-					"id":        strconv.Itoa(msg.Data.ID()),
-					"timestamp": fileReceive.Timestamp,
-				}
-			} else if msg.Data.Type() == "text" && msg.Data.TextReceive != nil {
-				responseType = "text"
-				responseData = map[string]interface{}{
-					"type":      responseType,
-					"content":   msg.Data.TextReceive.Content,
-					"id":        strconv.Itoa(msg.Data.ID()),
-					"timestamp": msg.Data.TextReceive.Timestamp,
-				}
-			} else {
-				// 未知类型，提供基本信息
-				responseType = "unknown"
-				responseData = map[string]interface{}{
-					"type":  responseType,
-					"id":    strconv.Itoa(msg.Data.ID()),
-					"error": "不支持的内容类型",
-				}
-			}
-
-			json.NewEncoder(w).Encode(responseData)
-			s.logger.Printf("以JSON格式返回最新内容 (类型: %s, 房间: '%s')", responseType, messageRoom)
-			return
-		}
-
-		// 非JSON请求，按原有逻辑处理
-		if msg.Data.Type() == "file" && msg.Data.FileReceive != nil {
-			// 文件类型，直接提供文件内容而不是重定向
-			cacheUUID := msg.Data.FileReceive.Cache
-			filename := msg.Data.FileReceive.Name
-
-			// 构建文件路径
-			filePath := filepath.Join(s.storageFolder, cacheUUID)
-
-			file, err := os.Open(filePath)
-			if err != nil {
-				s.logger.Printf("错误: 打开文件失败: %v", err)
-				http.Error(w, "文件在磁盘上未找到", http.StatusNotFound)
-				return
-			}
-			defer file.Close()
-
-			stat, err := file.Stat()
-			if err != nil {
-				s.logger.Printf("错误: 获取文件状态失败: %v", err)
-				http.Error(w, "无法获取文件状态", http.StatusInternalServerError)
-				return
-			}
-
-			// 设置响应头，根据文件类型确定内容类型
-			contentType := mime.TypeByExtension(filepath.Ext(filename))
-			if contentType == "" {
-				contentType = "application/octet-stream"
-			}
-			w.Header().Set("Content-Type", contentType)
-
-			// 根据查询参数决定是否作为附件下载
-			dispositionType := "inline" // 默认内联显示
-			if r.URL.Query().Get("download") == "true" {
-				dispositionType = "attachment"
-			}
-			disposition := fmt.Sprintf("%s; filename=%q", dispositionType, filename)
-			w.Header().Set("Content-Disposition", disposition)
-
-			// 提供文件内容
-			s.logger.Printf("直接提供最新文件内容: %s", filename)
-			http.ServeContent(w, r, filename, stat.ModTime(), file)
-			return
-
-		} else if msg.Data.Type() == "text" && msg.Data.TextReceive != nil {
-			// 文本类型，检查Accept头决定是否返回JSON
-			acceptHeader := r.Header.Get("Accept")
-			if strings.Contains(acceptHeader, "application/json") {
-				// 客户端请求JSON格式
-				w.Header().Set("Content-Type", "application/json")
-				json.NewEncoder(w).Encode(msg)
-				s.logger.Printf("以JSON格式返回最新文本内容")
-				return
-			} else {
-				// 默认返回纯文本
-				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-				content := msg.Data.TextReceive.Content
-				if !strings.HasSuffix(content, "\n") {
-					content += "\n"
-				}
-				w.Write([]byte(content))
-				s.logger.Printf("以纯文本格式返回最新文本内容")
-				return
-			}
-		}
+	// 从后向前找到的匹配房间的最新消息 (空房间参数表示匹配任何房间)
+	if latest != nil {
+		s.writeLatestItem(w, r, *latest, messageRoom, replyCount, isJSONRequest)
+		return
 	}
 
 	if unauthorized && hasRequestedRoom {
@@ -1189,7 +1218,7 @@ func (s *ClipboardServer) handleLatestContent(w http.ResponseWriter, r *http.Req
 func (s *ClipboardServer) handleRooms(w http.ResponseWriter, r *http.Request) {
 	// 添加 CORS 头
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Room-Auth-Tokens")
 
 	// 处理预检请求
@@ -1198,8 +1227,14 @@ func (s *ClipboardServer) handleRooms(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// POST /rooms 创建房间（见 rooms.go）
+	if r.Method == http.MethodPost {
+		s.handleRoomCreate(w, r)
+		return
+	}
+
 	if r.Method != http.MethodGet {
-		http.Error(w, "仅允许 GET 请求", http.StatusMethodNotAllowed)
+		http.Error(w, "仅允许 GET 或 POST 请求", http.StatusMethodNotAllowed)
 		return
 	}
 
@@ -1216,7 +1251,7 @@ func (s *ClipboardServer) handleRooms(w http.ResponseWriter, r *http.Request) {
 
 	s.logger.Printf("处理房间列表请求，来自: %s", get_remote_ip(r))
 
-	roomList := s.getRoomList(extractAuthTokens(r))
+	roomList := s.getRoomList(extractAuthTokens(r), r.URL.Query()["room"])
 
 	response := RoomListResponse{
 		Rooms: roomList,
@@ -1231,3 +1266,138 @@ func (s *ClipboardServer) handleRooms(w http.ResponseWriter, r *http.Request) {
 
 	s.logger.Printf("返回房间列表，包含 %d 个房间", len(roomList))
 }
+
+// latestItemSupported 返回 writeLatestItem 能否输出该消息：JSON 请求总是可以，其他请求只支持文件和文本
+func latestItemSupported(msg PostEvent, isJSONRequest bool) bool {
+	return isJSONRequest ||
+		(msg.Data.Type() == "file" && msg.Data.FileReceive != nil) ||
+		(msg.Data.Type() == "text" && msg.Data.TextReceive != nil)
+}
+
+// writeLatestItem 按 handleLatestContent 的格式输出单条消息（JSON、原始文件或纯文本）。
+// msg 必须是在 messageQueue 锁内复制的副本（见 ReceiveHolder.Clone），调用时不能持有该锁，避免慢客户端阻塞消息队列
+func (s *ClipboardServer) writeLatestItem(w http.ResponseWriter, r *http.Request, msg PostEvent, messageRoom string, replyCount int, isJSONRequest bool) {
+	// 如果是JSON请求，始终以JSON格式返回
+	if isJSONRequest {
+		w.Header().Set("Content-Type", "application/json")
+
+		var responseType string
+		var responseData map[string]interface{}
+
+		if msg.Data.Type() == "file" && msg.Data.FileReceive != nil {
+			// 确定文件类型
+			fileReceive := msg.Data.FileReceive
+			responseType = DetermineResponseType(fileReceive.Name)
+
+			// 构建JSON响应
+			responseData = map[string]interface{}{
+				"type":      responseType,
+				"name":      fileReceive.Name,
+				"size":      fileReceive.Size,
+				"uuid":      fileReceive.Cache,
+				"url":       filepath.Join(fileReceive.URL, fileReceive.Name),
+				"id":        strconv.Itoa(msg.Data.ID()),
+				"timestamp": fileReceive.Timestamp,
+			}
+			if fileReceive.Preview != "" {
+				responseData["preview"] = fileReceive.Preview
+			}
+			addSensitiveFileFields(responseData, fileReceive)
+		} else if msg.Data.Type() == "text" && msg.Data.TextReceive != nil {
+			responseType = "text"
+			responseData = map[string]interface{}{
+				"type":      responseType,
+				"content":   msg.Data.TextReceive.Content,
+				"id":        strconv.Itoa(msg.Data.ID()),
+				"timestamp": msg.Data.TextReceive.Timestamp,
+			}
+			addSensitiveFields(responseData, msg.Data.TextReceive)
+		} else {
+			// 未知类型，提供基本信息
+			responseType = "unknown"
+			responseData = map[string]interface{}{
+				"type":  responseType,
+				"id":    strconv.Itoa(msg.Data.ID()),
+				"error": "不支持的内容类型",
+			}
+		}
+
+		addReplyFields(responseData, msg, replyCount)
+		json.NewEncoder(w).Encode(responseData)
+		s.logger.Printf("以JSON格式返回最新内容 (类型: %s, 房间: '%s')", responseType, messageRoom)
+		return
+	}
+
+	// 非JSON请求，按原有逻辑处理
+	if msg.Data.Type() == "file" && msg.Data.FileReceive != nil {
+		// 文件类型，直接提供文件内容而不是重定向
+		cacheUUID := msg.Data.FileReceive.Cache
+		filename := msg.Data.FileReceive.Name
+		if !s.allowSensitiveFile(w, r, msg.Data.FileReceive.Sensitive, filename) {
+			return
+		}
+
+		// 构建文件路径
+		filePath := filepath.Join(s.storageFolder, cacheUUID)
+
+		file, err := os.Open(filePath)
+		if err != nil {
+			s.logger.Printf("错误: 打开文件失败: %v", err)
+			http.Error(w, "文件在磁盘上未找到", http.StatusNotFound)
+			return
+		}
+		defer file.Close()
+
+		stat, err := file.Stat()
+		if err != nil {
+			s.logger.Printf("错误: 获取文件状态失败: %v", err)
+			http.Error(w, "无法获取文件状态", http.StatusInternalServerError)
+			return
+		}
+
+		// 设置响应头，根据文件类型确定内容类型
+		contentType := mime.TypeByExtension(filepath.Ext(filename))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		w.Header().Set("Content-Type", contentType)
+
+		// 根据查询参数决定是否作为附件下载
+		dispositionType := "inline" // 默认内联显示
+		if r.URL.Query().Get("download") == "true" {
+			dispositionType = "attachment"
+		}
+		disposition := fmt.Sprintf("%s; filename=%q", dispositionType, filename)
+		w.Header().Set("Content-Disposition", disposition)
+
+		// 提供文件内容
+		s.logger.Printf("直接提供最新文件内容: %s", filename)
+		http.ServeContent(w, r, filename, stat.ModTime(), file)
+		return
+
+	} else if msg.Data.Type() == "text" && msg.Data.TextReceive != nil {
+		if format := r.URL.Query().Get("format"); isMarkdownFormat(format) {
+			s.writeMarkdownContent(w, msg.Data.TextReceive, format)
+			return
+		}
+		// 文本类型，检查Accept头决定是否返回JSON
+		acceptHeader := r.Header.Get("Accept")
+		if strings.Contains(acceptHeader, "application/json") {
+			// 客户端请求JSON格式
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(msg)
+			s.logger.Printf("以JSON格式返回最新文本内容")
+			return
+		} else {
+			// 默认返回纯文本
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			content := msg.Data.TextReceive.Content
+			if !strings.HasSuffix(content, "\n") {
+				content += "\n"
+			}
+			w.Write([]byte(content))
+			s.logger.Printf("以纯文本格式返回最新文本内容")
+			return
+		}
+	}
+}
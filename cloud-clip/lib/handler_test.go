@@ -0,0 +1,73 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// blockingWriter 在第一次写入响应体时阻塞，模拟读取很慢的客户端
+type blockingWriter struct {
+	*httptest.ResponseRecorder
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (bw *blockingWriter) Write(p []byte) (int, error) {
+	select {
+	case <-bw.writing:
+	default:
+		close(bw.writing)
+		<-bw.release
+	}
+	return bw.ResponseRecorder.Write(p)
+}
+
+func TestContentIsServedWithoutQueueLock(t *testing.T) {
+	s := newTestServer(t, nil)
+	addTestFile(t, s, "file-a", "default")
+	req := httptest.NewRequest(http.MethodPost, "/upload", nil)
+	msg := s.addMessageToQueueAndBroadcast("file", &FileReceive{Name: "file-a.txt", Size: 17, Cache: "file-a"}, "default", messageOptions{}, req)
+	id := strconv.Itoa(msg.Data.ID())
+
+	for _, target := range []string{"/content/" + id, "/content/latest", "/content/next?after=0&room=default"} {
+		t.Run(target, func(t *testing.T) {
+			bw := &blockingWriter{ResponseRecorder: httptest.NewRecorder(), writing: make(chan struct{}), release: make(chan struct{})}
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				s.httpServer.Handler.ServeHTTP(bw, httptest.NewRequest(http.MethodGet, target, nil))
+			}()
+
+			select {
+			case <-bw.writing:
+			case <-done:
+				t.Fatalf("响应没有写入内容，状态码 = %d", bw.Code)
+			case <-time.After(2 * time.Second):
+				t.Fatal("等待写入响应超时")
+			}
+			// 客户端读取期间消息队列应可以被其他请求使用
+			locked := make(chan struct{})
+			go func() {
+				s.messageQueue.Lock()
+				s.messageQueue.Unlock()
+				close(locked)
+			}()
+			select {
+			case <-locked:
+			case <-time.After(time.Second):
+				close(bw.release)
+				t.Fatal("输出响应时仍持有 messageQueue 锁")
+			}
+
+			close(bw.release)
+			<-done
+			expectStatus(t, bw.ResponseRecorder, http.StatusOK)
+			if body := bw.Body.String(); body != "secret of default" {
+				t.Fatalf("响应 = %q", body)
+			}
+		})
+	}
+}
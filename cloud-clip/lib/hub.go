@@ -0,0 +1,414 @@
+package lib
+
+/**
+*** FILE: hub.go
+***   internal pub/sub hub shared by /push (WebSocket) and /events (SSE)
+**/
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	hubRecentEvents     = 256  // 每个房间保留的最近事件数量，用于 SSE 的 Last-Event-ID 续传
+	hubSubscriberBuffer = 256  // 每个订阅者的事件缓冲，写满视为慢消费者并断开
+	hubMaxIdleRooms     = 1024 // 没有订阅者的房间最多保留的数量（只为续传保留最近事件）
+)
+
+// hubEvent 是通过 hub 分发的一条事件
+type hubEvent struct {
+	Seq     int64  // 全局递增序号，SSE 用作事件 ID；直接发送给单个订阅者的事件为 0
+	Room    string // 目标房间，空字符串表示所有房间；投递时为订阅者所在的房间
+	To      string // 目标设备ID，为空表示房间内所有订阅者
+	Except  *hubSubscriber
+	Message WebSocketMessage
+}
+
+// hubSubscriber 是 hub 的一个订阅者（一个 WebSocket 连接或一个 SSE 流），一个订阅者可以加入多个房间
+type hubSubscriber struct {
+	deviceID string // SSE 订阅者为空，只接收非私信事件
+	startSeq int64  // 订阅时最近一条事件的序号
+	events   chan hubEvent
+	done     chan struct{}
+	once     sync.Once
+
+	mu    sync.Mutex
+	rooms map[string]bool // 已加入的房间
+}
+
+// hubRoom 是一个房间的订阅者、在线设备和最近事件，由自己的锁保护，不同房间的分发互不阻塞
+type hubRoom struct {
+	mu          sync.Mutex
+	subscribers map[*hubSubscriber]bool
+	devices     map[string]int // 设备ID -> 该设备在房间中的连接数
+	recent      []hubEvent
+	lastSeq     int64 // 房间最近一条事件的序号
+	evictedSeq  int64 // 已移出 recent 的最大序号，续传点早于它时无法完整续传
+	pruned      bool  // 已作为空闲房间从 hub 中移除
+}
+
+// eventHub 按房间分发事件。h.mu 只保护 rooms 映射，事件在房间锁内分配序号并投递，
+// 保证同一房间的订阅者按序号顺序收到事件；锁顺序为 h.mu -> hubRoom.mu。
+type eventHub struct {
+	mu    sync.RWMutex
+	rooms map[string]*hubRoom
+	seq   atomic.Int64
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{
+		rooms: make(map[string]*hubRoom),
+	}
+}
+
+// matches 判断事件是否应该投递给订阅者（房间已在分发时匹配）
+func (sub *hubSubscriber) matches(ev hubEvent) bool {
+	if ev.Except == sub {
+		return false
+	}
+	return ev.To == "" || ev.To == sub.deviceID
+}
+
+// send 直接向订阅者发送一条事件（不记录、不分配序号），订阅者已关闭时返回 false
+func (sub *hubSubscriber) send(message WebSocketMessage) bool {
+	select {
+	case sub.events <- hubEvent{Room: message.Room, Message: message}:
+		return true
+	case <-sub.done:
+		return false
+	}
+}
+
+// drain 取出订阅者缓冲中尚未处理的事件，用于断开前把已投递的事件（如 clearAll）写给客户端
+func (sub *hubSubscriber) drain() []hubEvent {
+	var pending []hubEvent
+	for {
+		select {
+		case ev := <-sub.events:
+			pending = append(pending, ev)
+		default:
+			return pending
+		}
+	}
+}
+
+func (sub *hubSubscriber) close() {
+	sub.once.Do(func() { close(sub.done) })
+}
+
+// getRoom 返回房间，create 为 true 时不存在则创建
+func (h *eventHub) getRoom(room string, create bool) *hubRoom {
+	h.mu.RLock()
+	hr := h.rooms[room]
+	h.mu.RUnlock()
+	if hr != nil || !create {
+		return hr
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if hr = h.rooms[room]; hr == nil {
+		h.pruneIdleRoomsLocked()
+		// 新建（或被清理后重建）的房间没有之前的事件，早于当前序号的续传点都需要重新同步
+		seq := h.seq.Load()
+		hr = &hubRoom{
+			subscribers: make(map[*hubSubscriber]bool),
+			devices:     make(map[string]int),
+			lastSeq:     seq,
+			evictedSeq:  seq,
+		}
+		h.rooms[room] = hr
+	}
+	return hr
+}
+
+// lockRoom 返回已锁定的房间，不存在则创建。调用方负责解锁
+func (h *eventHub) lockRoom(room string) *hubRoom {
+	for {
+		hr := h.getRoom(room, true)
+		hr.mu.Lock()
+		if !hr.pruned {
+			return hr
+		}
+		// 在获取锁之前房间已被清理，重新获取
+		hr.mu.Unlock()
+	}
+}
+
+// pruneIdleRoomsLocked 没有订阅者的房间超过 hubMaxIdleRooms 时，移除最久没有事件的空闲房间。必须在 h.mu 写锁定时调用
+func (h *eventHub) pruneIdleRoomsLocked() {
+	idle := make(map[string]int64)
+	for name, hr := range h.rooms {
+		hr.mu.Lock()
+		if len(hr.subscribers) == 0 {
+			idle[name] = hr.lastSeq
+		}
+		hr.mu.Unlock()
+	}
+
+	for len(idle) >= hubMaxIdleRooms {
+		oldest := ""
+		for name, lastSeq := range idle {
+			if oldest == "" || lastSeq < idle[oldest] {
+				oldest = name
+			}
+		}
+		delete(idle, oldest)
+
+		hr := h.rooms[oldest]
+		hr.mu.Lock()
+		if len(hr.subscribers) == 0 {
+			hr.pruned = true
+			delete(h.rooms, oldest)
+		}
+		hr.mu.Unlock()
+	}
+}
+
+func newHubSubscriber(deviceID string) *hubSubscriber {
+	return &hubSubscriber{
+		deviceID: deviceID,
+		events:   make(chan hubEvent, hubSubscriberBuffer),
+		done:     make(chan struct{}),
+		rooms:    make(map[string]bool),
+	}
+}
+
+// subscribe 注册订阅者并加入一个房间
+func (h *eventHub) subscribe(room string, deviceID string) *hubSubscriber {
+	sub, _, _ := h.subscribeFrom(room, deviceID, -1)
+	return sub
+}
+
+// join 将订阅者加入房间（已加入时不做任何操作），返回加入后订阅者的设备在房间中的会话数，
+// 为 1 表示这是该设备在房间中的第一个会话
+func (h *eventHub) join(sub *hubSubscriber, room string) int {
+	sub.mu.Lock()
+	sub.rooms[room] = true
+	sub.mu.Unlock()
+
+	hr := h.lockRoom(room)
+	defer hr.mu.Unlock()
+	hr.addLocked(sub)
+	return hr.devices[sub.deviceID]
+}
+
+// leave 将订阅者移出房间，订阅者本身保持打开。返回离开后订阅者的设备在房间中剩余的会话数，
+// 为 0 表示该设备的最后一个会话已离开房间
+func (h *eventHub) leave(sub *hubSubscriber, room string) int {
+	sub.mu.Lock()
+	delete(sub.rooms, room)
+	sub.mu.Unlock()
+
+	hr := h.getRoom(room, false)
+	if hr == nil {
+		return 0
+	}
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	hr.removeLocked(sub)
+	return hr.devices[sub.deviceID]
+}
+
+// subscribeFrom 注册订阅者，并在房间锁内取出序号大于 lastSeq 的最近事件，保证续传不丢不重。
+// lastSeq < 0 表示不需要续传；返回的 ok 为 false 表示 lastSeq 之后的事件已不完整（或服务端已重启），需要重新同步。
+func (h *eventHub) subscribeFrom(room string, deviceID string, lastSeq int64) (sub *hubSubscriber, missed []hubEvent, ok bool) {
+	sub = newHubSubscriber(deviceID)
+	sub.rooms[room] = true
+
+	hr := h.lockRoom(room)
+	defer hr.mu.Unlock()
+
+	hr.addLocked(sub)
+	sub.startSeq = h.seq.Load()
+	if lastSeq < 0 {
+		return sub, nil, true
+	}
+	if lastSeq > sub.startSeq || lastSeq < hr.evictedSeq {
+		return sub, nil, false
+	}
+	for _, ev := range hr.recent {
+		if ev.Seq > lastSeq && sub.matches(ev) {
+			missed = append(missed, ev)
+		}
+	}
+	return sub, missed, true
+}
+
+// unsubscribe 将订阅者移出所有房间并关闭其 done 通道，返回每个房间中订阅者的设备剩余的会话数
+func (h *eventHub) unsubscribe(sub *hubSubscriber) map[string]int {
+	if sub == nil {
+		return nil
+	}
+	sub.mu.Lock()
+	rooms := make([]string, 0, len(sub.rooms))
+	for room := range sub.rooms {
+		rooms = append(rooms, room)
+	}
+	sub.mu.Unlock()
+
+	remaining := make(map[string]int, len(rooms))
+	for _, room := range rooms {
+		remaining[room] = h.leave(sub, room)
+	}
+	sub.close()
+	return remaining
+}
+
+// purgeRoom 丢弃房间的最近事件，之后的续传都需要重新同步，避免已清空、删除或改名的房间的事件被重放。
+// disconnect 为 true 时同时从 hub 中移除房间并断开其所有订阅者（由其自行重连并重新认证），返回断开的订阅者数量
+func (h *eventHub) purgeRoom(room string, disconnect bool) int {
+	if !disconnect {
+		hr := h.getRoom(room, false)
+		if hr == nil {
+			return 0
+		}
+		hr.mu.Lock()
+		defer hr.mu.Unlock()
+		hr.evictedSeq = hr.lastSeq
+		hr.recent = nil
+		return 0
+	}
+
+	h.mu.Lock()
+	hr := h.rooms[room]
+	delete(h.rooms, room)
+	h.mu.Unlock()
+	if hr == nil {
+		return 0
+	}
+
+	hr.mu.Lock()
+	hr.pruned = true
+	hr.recent = nil
+	subscribers := hr.subscribers
+	hr.subscribers = make(map[*hubSubscriber]bool)
+	hr.devices = make(map[string]int)
+	hr.mu.Unlock()
+
+	for sub := range subscribers {
+		sub.close()
+	}
+	return len(subscribers)
+}
+
+// addLocked 将订阅者加入房间并更新在线设备计数，必须在 hr.mu 锁定时调用
+func (hr *hubRoom) addLocked(sub *hubSubscriber) {
+	if hr.subscribers[sub] {
+		return
+	}
+	hr.subscribers[sub] = true
+	if sub.deviceID != "" {
+		hr.devices[sub.deviceID]++
+	}
+}
+
+// removeLocked 从房间移除订阅者并更新在线设备计数，必须在 hr.mu 锁定时调用
+func (hr *hubRoom) removeLocked(sub *hubSubscriber) {
+	if !hr.subscribers[sub] {
+		return
+	}
+	delete(hr.subscribers, sub)
+	if sub.deviceID == "" {
+		return
+	}
+	if hr.devices[sub.deviceID] <= 1 {
+		delete(hr.devices, sub.deviceID)
+	} else {
+		hr.devices[sub.deviceID]--
+	}
+}
+
+// publish 分配序号、记录并分发事件，返回接收到事件的订阅者中带设备ID的数量（即 WebSocket 连接数）。
+// Room 为空时分发到所有房间（每个房间各自分配序号，加入多个房间的订阅者会收到多次）。缓冲已满的订阅者会被断开，由其自行重连（SSE 可以通过 Last-Event-ID 续传）。
+func (h *eventHub) publish(ev hubEvent) int {
+	if ev.Room != "" {
+		hr := h.lockRoom(ev.Room)
+		defer hr.mu.Unlock()
+		return hr.publishLocked(&h.seq, ev)
+	}
+
+	h.mu.RLock()
+	rooms := make(map[string]*hubRoom, len(h.rooms))
+	for name, hr := range h.rooms {
+		rooms[name] = hr
+	}
+	h.mu.RUnlock()
+
+	delivered := 0
+	for name, hr := range rooms {
+		roomEvent := ev
+		roomEvent.Room = name
+		hr.mu.Lock()
+		delivered += hr.publishLocked(&h.seq, roomEvent)
+		hr.mu.Unlock()
+	}
+	return delivered
+}
+
+// publishLocked 在房间内分配序号、记录并投递事件，必须在 hr.mu 锁定时调用
+func (hr *hubRoom) publishLocked(seq *atomic.Int64, ev hubEvent) int {
+	ev.Seq = seq.Add(1)
+	hr.lastSeq = ev.Seq
+	hr.recent = append(hr.recent, ev)
+	if n := len(hr.recent) - hubRecentEvents; n > 0 {
+		hr.evictedSeq = hr.recent[n-1].Seq
+		hr.recent = append(hr.recent[:0], hr.recent[n:]...)
+	}
+
+	delivered := 0
+	for sub := range hr.subscribers {
+		if !sub.matches(ev) {
+			continue
+		}
+		select {
+		case sub.events <- ev:
+			if sub.deviceID != "" {
+				delivered++
+			}
+		default:
+			hr.removeLocked(sub)
+			sub.close()
+		}
+	}
+	return delivered
+}
+
+// devicesInRoom 返回房间中在线的设备ID及其会话数，排除 excludeDeviceID
+func (h *eventHub) devicesInRoom(room string, excludeDeviceID string) map[string]int {
+	hr := h.getRoom(room, false)
+	if hr == nil {
+		return nil
+	}
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+
+	devices := make(map[string]int, len(hr.devices))
+	for deviceID, sessions := range hr.devices {
+		if deviceID != excludeDeviceID {
+			devices[deviceID] = sessions
+		}
+	}
+	return devices
+}
+
+// roomDevices 返回有在线设备的房间及其设备ID -> 会话数
+func (h *eventHub) roomDevices() map[string]map[string]int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	result := make(map[string]map[string]int)
+	for name, hr := range h.rooms {
+		hr.mu.Lock()
+		if len(hr.devices) > 0 {
+			devices := make(map[string]int, len(hr.devices))
+			for deviceID, sessions := range hr.devices {
+				devices[deviceID] = sessions
+			}
+			result[name] = devices
+		}
+		hr.mu.Unlock()
+	}
+	return result
+}
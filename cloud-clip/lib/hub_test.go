@@ -0,0 +1,132 @@
+package lib
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// benchSubscribers 是基准测试中的订阅者，由测试自己定期清空缓冲，避免写满后被 hub 当作慢消费者断开
+type benchSubscribers []*hubSubscriber
+
+func subscribeBench(b *testing.B, h *eventHub, room string, n int) benchSubscribers {
+	b.Helper()
+	subs := make(benchSubscribers, n)
+	for i := range subs {
+		subs[i] = h.subscribe(room, "device-"+strconv.Itoa(i))
+	}
+	return subs
+}
+
+// drain 清空所有订阅者的缓冲，有订阅者已被断开时返回 false
+func (subs benchSubscribers) drain() bool {
+	for _, sub := range subs {
+		select {
+		case <-sub.done:
+			return false
+		default:
+		}
+		for len(sub.events) > 0 {
+			<-sub.events
+		}
+	}
+	return true
+}
+
+// publishN 发布 b.N 个事件，每 hubSubscriberBuffer 个事件暂停计时清空一次缓冲
+func publishN(b *testing.B, subs benchSubscribers, publish func(i int)) {
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		publish(i)
+		if (i+1)%hubSubscriberBuffer == 0 {
+			b.StopTimer()
+			if !subs.drain() {
+				b.Fatal("订阅者被断开")
+			}
+			b.StartTimer()
+		}
+	}
+	b.StopTimer()
+	if !subs.drain() {
+		b.Fatal("订阅者被断开")
+	}
+}
+
+func benchmarkEvent(id int, room string) PostEvent {
+	return PostEvent{Event: "receive", Data: ReceiveHolder{TextReceive: &TextReceive{
+		ReceiveBase: ReceiveBase{ID: id, Type: "text", Room: room},
+		Content:     "benchmark message " + strconv.Itoa(id),
+	}}}
+}
+
+// BenchmarkHubPublish 测量向一个房间中不同数量的订阅者分发事件的开销
+func BenchmarkHubPublish(b *testing.B) {
+	for _, n := range []int{1, 100, 1000} {
+		b.Run(fmt.Sprintf("subscribers=%d", n), func(b *testing.B) {
+			h := newEventHub()
+			subs := subscribeBench(b, h, "bench", n)
+			message := WebSocketMessage{Event: "receive", Data: map[string]any{"id": 1}}
+			publishN(b, subs, func(int) {
+				h.publish(hubEvent{Room: "bench", Message: message})
+			})
+		})
+	}
+}
+
+// BenchmarkHubPublishParallelRooms 测量多个房间同时分发事件的开销，各房间的锁互不阻塞。
+// 每个 goroutine 只向自己的房间发布，并自己清空该房间订阅者的缓冲（清空的开销计入结果）
+func BenchmarkHubPublishParallelRooms(b *testing.B) {
+	h := newEventHub()
+	var next atomic.Int32
+	message := WebSocketMessage{Event: "receive", Data: map[string]any{"id": 1}}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		room := "room-" + strconv.Itoa(int(next.Add(1)))
+		subs := subscribeBench(b, h, room, 10)
+		for i := 1; pb.Next(); i++ {
+			h.publish(hubEvent{Room: room, Message: message})
+			if i%hubSubscriberBuffer == 0 && !subs.drain() {
+				b.Error("订阅者被断开")
+				return
+			}
+		}
+	})
+}
+
+// BenchmarkBroadcastMessage 测量服务端广播一条文本消息（转换为客户端载荷并分发）的开销
+func BenchmarkBroadcastMessage(b *testing.B) {
+	s := newTestServer(b, nil)
+	subs := subscribeBench(b, s.hub, "default", 100)
+	event := benchmarkEvent(1, "default")
+	publishN(b, subs, func(int) {
+		s.broadcastMessage(event, "default")
+	})
+}
+
+// BenchmarkHubPresence 测量设备加入、离开房间以及查询在线设备的开销
+func BenchmarkHubPresence(b *testing.B) {
+	h := newEventHub()
+	for i := 0; i < 50; i++ {
+		subscribeBench(b, h, "room-"+strconv.Itoa(i), 20)
+	}
+	sub := h.subscribe("home", "bench-device")
+
+	b.Run("join-leave", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			room := "room-" + strconv.Itoa(i%50)
+			h.join(sub, room)
+			h.leave(sub, room)
+		}
+	})
+	b.Run("devicesInRoom", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			h.devicesInRoom("room-"+strconv.Itoa(i%50), "bench-device")
+		}
+	})
+	b.Run("roomDevices", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			h.roomDevices()
+		}
+	})
+}
@@ -0,0 +1,131 @@
+package lib
+
+/**
+*** FILE: longpoll.go
+***   GET /content/next: long-poll until a new item arrives in a room
+**/
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	nextContentDefaultTimeout = 60  // 默认等待时间（秒）
+	nextContentMaxTimeout     = 300 // 最长等待时间（秒）
+)
+
+// handleNextContent 处理 /content/next?room=&after=<id>&timeout=60：
+// 返回房间中 ID 大于 after 的第一条消息，没有时阻塞等待，超时返回 204。输出格式与 /content/latest 相同。
+func (s *ClipboardServer) handleNextContent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "仅允许 GET 请求", http.StatusMethodNotAllowed)
+		return
+	}
+
+	room := normalizeRoomName(r.URL.Query().Get("room"))
+	isJSONRequest := strings.HasSuffix(r.URL.Path, "next.json")
+	if jsonParam := r.URL.Query().Get("json"); jsonParam == "true" || jsonParam == "1" {
+		isJSONRequest = true
+	}
+	if !s.requestCanAccessRoom(r, room) {
+		writeAuthJSONError(w, http.StatusUnauthorized, "无权访问该房间")
+		return
+	}
+
+	after := -1
+	if afterStr := strings.TrimSpace(r.URL.Query().Get("after")); afterStr != "" {
+		id, err := strconv.Atoi(afterStr)
+		if err != nil || id < 0 {
+			http.Error(w, "无效的 after 参数", http.StatusBadRequest)
+			return
+		}
+		after = id
+	}
+
+	timeout := nextContentDefaultTimeout
+	if timeoutStr := strings.TrimSpace(r.URL.Query().Get("timeout")); timeoutStr != "" {
+		seconds, err := strconv.Atoi(timeoutStr)
+		if err != nil || seconds < 0 {
+			http.Error(w, "无效的 timeout 参数", http.StatusBadRequest)
+			return
+		}
+		timeout = min(seconds, nextContentMaxTimeout)
+	}
+
+	// 先订阅再检查队列，避免检查与等待之间到达的消息被漏掉
+	sub := s.hub.subscribe(room, "")
+	defer s.hub.unsubscribe(sub)
+
+	if after < 0 {
+		after = s.latestIDInRoom(room) // 未指定 after 时等待下一条新消息
+	}
+	s.logger.Printf("处理等待下一条内容请求 (房间: '%s', after: %d, timeout: %ds, JSON请求: %t)", room, after, timeout, isJSONRequest)
+
+	if s.writeNextItem(w, r, room, after, isJSONRequest) {
+		return
+	}
+
+	timer := time.NewTimer(time.Duration(timeout) * time.Second)
+	defer timer.Stop()
+
+	for {
+		select {
+		case ev := <-sub.events:
+			if ev.Message.Event == "receive" && s.writeNextItem(w, r, room, after, isJSONRequest) {
+				return
+			}
+		case <-sub.done:
+			// 被 hub 断开时最后检查一次队列
+			if !s.writeNextItem(w, r, room, after, isJSONRequest) {
+				w.WriteHeader(http.StatusNoContent)
+			}
+			return
+		case <-timer.C:
+			s.logger.Printf("等待下一条内容超时 (房间: '%s', after: %d)", room, after)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// latestIDInRoom 返回房间中最新消息的 ID，房间为空时返回 0
+func (s *ClipboardServer) latestIDInRoom(room string) int {
+	s.messageQueue.Lock()
+	defer s.messageQueue.Unlock()
+
+	if latest := s.messageQueue.Latest(room); latest != nil {
+		return latest.Data.ID()
+	}
+	return 0
+}
+
+// writeNextItem 输出房间中 ID 大于 after 的第一条可以输出的非私信消息，并通过 X-Content-Id 头返回其 ID
+func (s *ClipboardServer) writeNextItem(w http.ResponseWriter, r *http.Request, room string, after int, isJSONRequest bool) bool {
+	// 在锁内复制消息，释放锁后再输出
+	s.messageQueue.Lock()
+	var next *PostEvent
+	var replyCount int
+	s.messageQueue.RangeRoom(room, func(found *PostEvent) bool {
+		// 跳过私信和无法按请求格式输出的消息，继续查找之后的消息
+		if found.Data.ID() <= after || !found.Data.VisibleTo("") || !latestItemSupported(*found, isJSONRequest) {
+			return true
+		}
+		msg := PostEvent{Event: found.Event, Data: found.Data.Masked()}
+		msg.Data = msg.Data.Clone()
+		next, replyCount = &msg, s.countRepliesLocked(msg.Data.ID(), "")
+		return false
+	})
+	s.messageQueue.Unlock()
+
+	if next == nil {
+		return false
+	}
+	w.Header().Set("X-Content-Id", strconv.Itoa(next.Data.ID()))
+	s.writeLatestItem(w, r, *next, room, replyCount, isJSONRequest)
+	return true
+}
@@ -0,0 +1,71 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNextContentSkipsUnsupportedItems(t *testing.T) {
+	s := newTestServer(t, nil)
+	// 类型与内容不符、无法按原始格式输出的消息，以及发给其他设备的私信
+	s.messageQueue.Append(&PostEvent{Event: "receive", Data: ReceiveHolder{TextReceive: &TextReceive{
+		ReceiveBase: ReceiveBase{Type: "file", Room: "default", Timestamp: time.Now().Unix()},
+	}}})
+	s.messageQueue.Append(&PostEvent{Event: "receive", Data: ReceiveHolder{TextReceive: &TextReceive{
+		ReceiveBase: ReceiveBase{Type: "text", Room: "default", To: "other-device", Timestamp: time.Now().Unix()},
+		Content:     "private",
+	}}})
+	id := postText(t, s, "/text", "deliverable")
+
+	rec := do(t, s, http.MethodGet, "/content/next?after=0&timeout=1", "")
+	expectStatus(t, rec, http.StatusOK)
+	if got := rec.Header().Get("X-Content-Id"); got != id {
+		t.Fatalf("X-Content-Id = %s，期望 %s", got, id)
+	}
+	if body := strings.TrimSpace(rec.Body.String()); body != "deliverable" {
+		t.Fatalf("响应 = %q", body)
+	}
+
+	// JSON 格式可以输出任何消息，从第一条开始
+	rec = do(t, s, http.MethodGet, "/content/next.json?after=0&timeout=0", "")
+	expectStatus(t, rec, http.StatusOK)
+	if got := rec.Header().Get("X-Content-Id"); got != "1" {
+		t.Fatalf("JSON 请求的 X-Content-Id = %s，期望 1", got)
+	}
+}
+
+func TestNextContentWaitsForNewItem(t *testing.T) {
+	s := newTestServer(t, nil)
+	postText(t, s, "/text", "old")
+	expectStatus(t, do(t, s, http.MethodGet, "/content/next?timeout=0", ""), http.StatusNoContent)
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rec := httptest.NewRecorder()
+		s.httpServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/content/next?timeout=5", nil))
+		done <- rec
+	}()
+	waitFor(t, "等待请求订阅房间", func() bool {
+		hr := s.hub.getRoom("default", false)
+		if hr == nil {
+			return false
+		}
+		hr.mu.Lock()
+		defer hr.mu.Unlock()
+		return len(hr.subscribers) == 1
+	})
+	id := postText(t, s, "/text", "new")
+
+	select {
+	case rec := <-done:
+		expectStatus(t, rec, http.StatusOK)
+		if got := rec.Header().Get("X-Content-Id"); got != id || strings.TrimSpace(rec.Body.String()) != "new" {
+			t.Fatalf("X-Content-Id = %s，响应 = %q", got, rec.Body.String())
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("新消息到达后请求没有返回")
+	}
+}
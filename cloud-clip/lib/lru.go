@@ -0,0 +1,84 @@
+package lib
+
+/**
+*** FILE: lru.go
+***   small fixed-size LRU cache with optional per-entry expiry (not safe for concurrent use; callers hold their own lock)
+**/
+
+import (
+	"container/list"
+	"time"
+)
+
+type lruEntry[K comparable, V any] struct {
+	key     K
+	value   V
+	expires time.Time // 零值表示不过期
+}
+
+// lruCache 是容量固定的 LRU 缓存，写满时淘汰最久未使用的条目。调用方负责加锁
+type lruCache[K comparable, V any] struct {
+	capacity int
+	order    *list.List // 最近使用的在前
+	items    map[K]*list.Element
+}
+
+func newLRUCache[K comparable, V any](capacity int) *lruCache[K, V] {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &lruCache[K, V]{
+		capacity: capacity,
+		order:    list.New(),
+		items:    make(map[K]*list.Element),
+	}
+}
+
+// get 返回未过期的条目并将其标记为最近使用
+func (c *lruCache[K, V]) get(key K) (V, bool) {
+	var zero V
+	el, ok := c.items[key]
+	if !ok {
+		return zero, false
+	}
+	entry := el.Value.(*lruEntry[K, V])
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		c.order.Remove(el)
+		delete(c.items, key)
+		return zero, false
+	}
+	c.order.MoveToFront(el)
+	return entry.value, true
+}
+
+// add 添加或更新条目，ttl 为 0 表示不过期
+func (c *lruCache[K, V]) add(key K, value V, ttl time.Duration) {
+	var expires time.Time
+	if ttl > 0 {
+		expires = time.Now().Add(ttl)
+	}
+	if el, ok := c.items[key]; ok {
+		entry := el.Value.(*lruEntry[K, V])
+		entry.value, entry.expires = value, expires
+		c.order.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.order.PushFront(&lruEntry[K, V]{key: key, value: value, expires: expires})
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry[K, V]).key)
+	}
+}
+
+// remove 删除条目
+func (c *lruCache[K, V]) remove(key K) {
+	if el, ok := c.items[key]; ok {
+		c.order.Remove(el)
+		delete(c.items, key)
+	}
+}
+
+func (c *lruCache[K, V]) len() int {
+	return c.order.Len()
+}
@@ -0,0 +1,42 @@
+package lib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRUCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newLRUCache[string, int](2)
+	c.add("a", 1, 0)
+	c.add("b", 2, 0)
+	if _, ok := c.get("a"); !ok { // a 成为最近使用
+		t.Fatal("a 应在缓存中")
+	}
+	c.add("c", 3, 0)
+	if _, ok := c.get("b"); ok {
+		t.Fatal("b 是最久未使用的，应被淘汰")
+	}
+	if v, ok := c.get("a"); !ok || v != 1 {
+		t.Fatalf("a = %d, %t", v, ok)
+	}
+	if c.len() != 2 {
+		t.Fatalf("len = %d", c.len())
+	}
+}
+
+func TestLRUCacheExpiry(t *testing.T) {
+	c := newLRUCache[string, bool](4)
+	c.add("short", true, time.Millisecond)
+	c.add("forever", true, 0)
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := c.get("short"); ok {
+		t.Fatal("过期的条目不应返回")
+	}
+	if _, ok := c.get("forever"); !ok {
+		t.Fatal("没有过期时间的条目应保留")
+	}
+	c.remove("forever")
+	if c.len() != 0 {
+		t.Fatalf("len = %d", c.len())
+	}
+}
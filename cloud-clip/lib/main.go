@@ -14,6 +14,7 @@ import (
 	"os" // 确保导入 os 包
 	"path/filepath"
 	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -119,23 +120,80 @@ func NewClipboardServer(cfg *Config) (*ClipboardServer, error) {
 	}
 	cfg.Server.RoomAuth = normalizeRoomAuthConfig(cfg.Server.RoomAuth)
 
+	switch cfg.Server.ReplyRevoke = strings.ToLower(strings.TrimSpace(cfg.Server.ReplyRevoke)); cfg.Server.ReplyRevoke {
+	case replyRevokeOrphan, replyRevokeCascade:
+	case "":
+		cfg.Server.ReplyRevoke = replyRevokeOrphan
+	default:
+		logger.Printf("警告: 无效的 replyRevoke 配置 '%s'，将使用 '%s'", cfg.Server.ReplyRevoke, replyRevokeOrphan)
+		cfg.Server.ReplyRevoke = replyRevokeOrphan
+	}
+
 	s := &ClipboardServer{
 		config:          cfg,
 		logger:          logger,
 		messageQueue:    mq,
 		websockets:      make(map[*websocket.Conn]bool),
-		room_ws:         make(map[*websocket.Conn]string),
+		room_ws:         make(map[*websocket.Conn]map[string]string),
 		uploadFileMap:   make(map[string]File),
 		deviceConnected: make(map[string]DeviceMeta),
 		storageFolder:   storageFolder,
 		historyFilePath: historyFilePath,
 		parser:          uaParser,
 		connDeviceIDMap: make(map[*websocket.Conn]string),
+		deviceSessions:  make(map[string]int),
 		deviceHashSeed:  murmur3.Sum32(random_bytes(32)) & 0xffffffff, // 在此处初始化种子
 
 		// 初始化房间管理相关字段
 		roomStats:      make(map[string]*RoomStat),
 		roomStatsMutex: sync.RWMutex{},
+
+		receipts:      make(map[int]*receiptState),
+		pendingDirect: make(map[string][]PostEvent),
+
+		hub:           newEventHub(),
+		wsSubscribers: make(map[*websocket.Conn]*hubSubscriber),
+	}
+	s.sensitiveDetectors = compileSensitiveDetectors(cfg.Sensitive.Patterns, s.logger.Printf)
+	s.devices = newDeviceRegistry(filepath.Join(filepath.Dir(historyFilePath), "devices.json"), s.logger.Printf)
+	s.tokens = newTokenStore(tokensFilePath(cfg), s.logger.Printf)
+	s.pairings = newPairingStore()
+	s.shares = newShareStore(cfg, s.logger.Printf)
+	if proxies, err := newProxyResolver(cfg.Server.TrustedProxies); err != nil {
+		s.logger.Printf("警告: trustedProxies 配置无效: %v，只信任本机代理", err)
+		s.proxies, _ = newProxyResolver([]string{"loopback"})
+	} else {
+		s.proxies = proxies
+	}
+	if cfg.RateLimit.Enable {
+		s.limiter = newRateLimiter(cfg)
+	}
+	if cfg.Users.Enable {
+		s.users = newUserStore(usersFilePath(cfg), cfg.Users.SessionTTL, s.logger.Printf)
+		s.logger.Printf("用户账号已启用，用户存储: %s", s.users.path)
+	}
+	if cfg.Rooms.Enable {
+		s.rooms = newRoomRegistry(roomsFilePath(cfg), s.logger.Printf)
+	}
+	if cfg.Session.Enable {
+		s.roomSessions = newRoomSessionStore(cfg.Session.TTL, cfg.Session.IdleTimeout)
+	}
+	if cfg.OIDC.Enable {
+		if cfg.OIDC.Issuer == "" || cfg.OIDC.ClientID == "" {
+			s.logger.Printf("警告: oidc.issuer 和 oidc.clientId 不能为空，OIDC 登录未启用")
+		} else {
+			s.oidc = newOIDCStore(cfg, s.logger.Printf)
+			s.logger.Printf("OIDC 登录已启用，IdP: %s", cfg.OIDC.Issuer)
+		}
+	}
+	if cfg.Audit.Enable {
+		if audit, err := newAuditLog(cfg, s.logger.Printf); err != nil {
+			s.logger.Printf("警告: 审计日志不可用: %v", err)
+		} else {
+			s.audit = audit
+			s.logger.Printf("审计日志: %s", audit.path)
+			s.auditConfig()
+		}
 	}
 
 	if err := s.loadHistoryData(); err != nil {
@@ -172,8 +230,8 @@ func (s *ClipboardServer) loadHistoryData() error {
 		return fmt.Errorf("无法解析历史数据 %s: %w", s.historyFilePath, err)
 	}
 
+	s.messageQueue.ClearAll()
 	s.messageQueue.Lock()
-	s.messageQueue.List = make([]PostEvent, 0, len(loadedHist.Receive))
 	s.messageQueue.nextid = 1
 	for _, rh := range loadedHist.Receive {
 		s.messageQueue.appendLocked(PostEvent{
@@ -203,7 +261,7 @@ func (s *ClipboardServer) loadHistoryData() error {
 	}
 	s.filterHistoryMessages()
 
-	s.logger.Printf("成功从历史记录加载 %d 条消息和 %d 个文件条目。", len(s.messageQueue.List), len(s.uploadFileMap))
+	s.logger.Printf("成功从历史记录加载 %d 条消息和 %d 个文件条目。", s.messageQueue.Len(), len(s.uploadFileMap))
 	return nil
 }
 
@@ -213,10 +271,15 @@ func (s *ClipboardServer) saveHistoryData() {
 	s.messageQueue.Lock()
 	// s.filterHistoryMessagesLocked() // 需要在锁内部调用
 
-	// 将 s.messageQueue.List ([]PostEvent) 转换为 []ReceiveHolder 以匹配 History 结构
-	receiveHolders := make([]ReceiveHolder, len(s.messageQueue.List))
-	for i, pe := range s.messageQueue.List {
-		receiveHolders[i] = pe.Data // PostEvent.Data 是 ReceiveHolder
+	// 将消息队列 ([]PostEvent，按加入顺序) 转换为 []ReceiveHolder 以匹配 History 结构
+	receiveHolders := make([]ReceiveHolder, 0, s.messageQueue.Len())
+	for _, pe := range s.messageQueue.Items() {
+		// 敏感消息默认只保留在内存中，不写入历史文件
+		if !s.config.Sensitive.Persist && ((pe.Data.TextReceive != nil && pe.Data.TextReceive.Sensitive) ||
+			(pe.Data.FileReceive != nil && pe.Data.FileReceive.Sensitive)) {
+			continue
+		}
+		receiveHolders = append(receiveHolders, pe.Data) // PostEvent.Data 是 ReceiveHolder
 	}
 
 	histToSave := History{
@@ -251,12 +314,8 @@ func (s *ClipboardServer) saveHistoryData() {
 // filterHistoryMessagesLocked 过滤消息队列中的消息，移除无效或过期的文件消息
 // 这个方法应该在 messageQueue 被锁定时调用
 func (s *ClipboardServer) filterHistoryMessagesLocked() {
-	if s.messageQueue.List == nil { // 确保使用大写 L
-		return
-	}
-	var validMessages []PostEvent
 	now := time.Now().Unix()
-	for _, msg := range s.messageQueue.List { // 确保使用大写 L
+	s.messageQueue.DeleteWhere(func(msg *PostEvent) bool {
 		if msg.Data.FileReceive != nil {
 			fileRec := msg.Data.FileReceive
 			fileInfo, existsInMap := s.uploadFileMap[fileRec.Cache]
@@ -265,12 +324,11 @@ func (s *ClipboardServer) filterHistoryMessagesLocked() {
 				if existsInMap && fileInfo.ExpireTime < now {
 					delete(s.uploadFileMap, fileRec.Cache)
 				}
-				continue
+				return true
 			}
 		}
-		validMessages = append(validMessages, msg)
-	}
-	s.messageQueue.List = validMessages // 确保使用大写 L
+		return false
+	})
 }
 
 // filterHistoryMessages 是一个包装器，用于在需要时获取锁
@@ -310,22 +368,50 @@ func (s *ClipboardServer) setupRoutes() {
 		s.logger.Println("警告: 未使用嵌入式静态文件，也未配置外部静态目录。将不提供前端服务。")
 	}
 
-	// HTTP 路由
-	mux.HandleFunc(prefix+"/server", s.handle_server)
-	mux.HandleFunc(prefix+"/push", s.handle_push)
-	mux.HandleFunc(prefix+"/rooms", s.handleRooms)
-	mux.HandleFunc(prefix+"/file/", s.authMiddleware(s.handle_file))
-	mux.HandleFunc(prefix+"/text", s.authMiddleware(s.handle_text))
-	mux.HandleFunc(prefix+"/upload", s.authMiddleware(s.handle_upload))
-	mux.HandleFunc(prefix+"/upload/chunk", s.authMiddleware(s.handle_upload))
-	mux.HandleFunc(prefix+"/upload/chunk/", s.authMiddleware(s.handle_chunk))
-	mux.HandleFunc(prefix+"/upload/finish/", s.authMiddleware(s.handle_finish))
-	mux.HandleFunc(prefix+"/revoke/", s.handle_revoke)
-	mux.HandleFunc(prefix+"/revoke/all", s.handleClearAll)
-	mux.HandleFunc(prefix+"/content/", s.handleContent)
+	// HTTP 路由（按类别限流，见 ratelimit.go）
+	mux.HandleFunc(prefix+"/server", s.withRateLimit(rateClassRead, s.handle_server))
+	// API 令牌按路由限制权限（见 apitokens.go），房间密码和登录会话不受影响
+	mux.HandleFunc(prefix+"/push", s.withRateLimit(rateClassPush, s.withScope(fixedScope(scopeRead), s.handle_push)))
+	mux.HandleFunc(prefix+"/events", s.withRateLimit(rateClassPush, s.withScope(fixedScope(scopeRead), s.handleEvents)))
+	mux.HandleFunc(prefix+"/rooms", s.withRateLimit(rateClassRead, s.withScopeAnyRoom(fixedScope(scopeRead), s.handleRooms)))
+	mux.HandleFunc(prefix+"/rooms/", s.withRateLimit(rateClassWrite, s.handleRoomConfig))
+	mux.HandleFunc(prefix+"/auth/", s.withRateLimit(rateClassAuth, s.handleAuth))
+	mux.HandleFunc(prefix+"/oidc/", s.withRateLimit(rateClassAuth, s.handleOIDC))
+	mux.HandleFunc(prefix+"/login", s.withRateLimit(rateClassAuth, s.handleRoomLogin))
+	mux.HandleFunc(prefix+"/logout", s.withRateLimit(rateClassAuth, s.handleRoomLogout))
+	mux.HandleFunc(prefix+"/admin/tokens", s.withRateLimit(rateClassAuth, s.handleAdminTokens))
+	mux.HandleFunc(prefix+"/admin/tokens/", s.withRateLimit(rateClassAuth, s.handleAdminTokens))
+	mux.HandleFunc(prefix+"/admin/ratelimit", s.withRateLimit(rateClassAuth, s.handleAdminRateLimit))
+	mux.HandleFunc(prefix+"/admin/audit", s.withRateLimit(rateClassAuth, s.handleAdminAudit))
+	// GET /devices 按读取限流，POST /devices（注册设备）按写入限流
+	listDevices := s.withRateLimit(rateClassRead, s.withScope(fixedScope(scopeRead), s.authMiddleware(s.handleDevices)))
+	registerDevice := s.withRateLimit(rateClassWrite, s.withScope(fixedScope(scopeRead), s.authMiddleware(s.handleDevices)))
+	mux.HandleFunc(prefix+"/devices", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			registerDevice(w, r)
+			return
+		}
+		listDevices(w, r)
+	})
+	mux.HandleFunc(prefix+"/devices/", s.withRateLimit(rateClassWrite, s.withScope(methodScope(scopePostText, scopeAdmin), s.authMiddleware(s.handleDevices))))
+	mux.HandleFunc(prefix+"/pair", s.withRateLimit(rateClassAuth, s.handlePair))
+	mux.HandleFunc(prefix+"/pair/code", s.withRateLimit(rateClassWrite, s.withScope(fixedScope(scopeAdmin), s.authMiddleware(s.handlePairCode))))
+	mux.HandleFunc(prefix+"/pair/qr/", s.withRateLimit(rateClassRead, s.handlePairQR))
+	mux.HandleFunc(prefix+"/share", s.withRateLimit(rateClassWrite, s.withScope(methodScope(scopeRead, scopeRevoke), s.authMiddleware(s.handleShares))))
+	mux.HandleFunc(prefix+"/share/", s.withRateLimit(rateClassWrite, s.withScope(methodScope(scopeRead, scopeRevoke), s.authMiddleware(s.handleShares))))
+	mux.HandleFunc(prefix+"/s/", s.withRateLimit(rateClassAuth, s.handleShareAccess))
+	mux.HandleFunc(prefix+"/file/", s.withRateLimit(rateClassRead, s.withScope(methodScope(scopeRead, scopeRevoke), s.authMiddleware(s.handle_file))))
+	mux.HandleFunc(prefix+"/text", s.withRateLimit(rateClassWrite, s.withScope(fixedScope(scopePostText), s.authMiddleware(s.handle_text))))
+	mux.HandleFunc(prefix+"/upload", s.withRateLimit(rateClassWrite, s.withScope(fixedScope(scopeUpload), s.authMiddleware(s.handle_upload))))
+	mux.HandleFunc(prefix+"/upload/chunk", s.withRateLimit(rateClassWrite, s.withScope(fixedScope(scopeUpload), s.authMiddleware(s.handle_upload))))
+	mux.HandleFunc(prefix+"/upload/chunk/", s.withRateLimit(rateClassWrite, s.withScope(fixedScope(scopeUpload), s.authMiddleware(s.handle_chunk))))
+	mux.HandleFunc(prefix+"/upload/finish/", s.withRateLimit(rateClassWrite, s.withScope(fixedScope(scopeUpload), s.authMiddleware(s.handle_finish))))
+	mux.HandleFunc(prefix+"/revoke/", s.withRateLimit(rateClassWrite, s.withScope(fixedScope(scopeRevoke), s.handle_revoke)))
+	mux.HandleFunc(prefix+"/revoke/all", s.withRateLimit(rateClassWrite, s.withScope(fixedScope(scopeRevoke), s.handleClearAll)))
+	mux.HandleFunc(prefix+"/content/", s.withRateLimit(rateClassRead, s.withScope(fixedScope(scopeRead), s.handleContent)))
 
 	s.httpServer = &http.Server{
-		Handler: mux,
+		Handler: s.withClientAddr(mux),
 	}
 }
 
@@ -396,6 +482,10 @@ func (s *ClipboardServer) Start() error {
 			continue
 		}
 
+		if s.config.Server.ProxyProtocol {
+			ln = &proxyProtoListener{Listener: ln, proxies: s.proxies, logf: s.logger.Printf}
+		}
+
 		listeners = append(listeners, ln)
 		s.logger.Printf("--- 监听地址: %s%s", listenAddr, s.config.Server.Prefix)
 	}
@@ -409,6 +499,7 @@ func (s *ClipboardServer) Start() error {
 	s.runMutex.Unlock()
 
 	go s.cleanExpiredFilesLoop()
+	go s.expireSensitiveLoop()
 
 	// 为每个监听器创建一个单独的HTTP服务器并启动goroutine
 	errChan := make(chan error, len(listeners))
@@ -470,6 +561,13 @@ func (s *ClipboardServer) Stop() error {
 	}
 	// 停止房间清理任务
 	s.stopRoomCleanup()
+	// 写入延迟保存的设备信息和分享链接下载次数
+	if err := s.devices.flush(); err != nil {
+		s.logger.Printf("警告: 保存设备注册表失败: %v", err)
+	}
+	if err := s.shares.flush(); err != nil {
+		s.logger.Printf("警告: 保存分享链接存储失败: %v", err)
+	}
 	s.logger.Println("正在停止服务器...")
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -562,6 +660,11 @@ func Main() {
 
 	applyCommandLineArgs(initialCfg) // applyCommandLineArgs 来自 flags.go
 
+	// 用户和 API 令牌管理命令执行后直接退出
+	if runUserCommand(initialCfg) || runTokenCommand(initialCfg) {
+		return
+	}
+
 	server, err := NewClipboardServer(initialCfg)
 	if err != nil {
 		log.Fatalf("创建剪贴板服务器失败: %v", err)
@@ -595,53 +698,83 @@ func show_bin_info() string {
 	return gitHash
 }
 
-// 辅助函数：获取特定房间内的设备ID，排除某个设备
-// 必须在 s.runMutex 锁定时调用
-func (s *ClipboardServer) getDeviceIDsInRoomLocked(room string, excludeDeviceID string) []string {
-	var deviceIDs []string
-	for conn, clientRoom := range s.room_ws { // Iterate through connections and their rooms
-		if clientRoom == room { // If the connection is in the target room
-			if devID, ok := s.connDeviceIDMap[conn]; ok { // Get the deviceID for this connection
-				if devID != excludeDeviceID { // Don't include the excluded device itself
-					deviceIDs = append(deviceIDs, devID)
-				}
-			}
+// 辅助函数：获取特定房间内的设备及其会话数，排除某个设备
+// 在线设备由 hub 按房间维护，调用方通常持有 s.runMutex 以便同时读取 deviceConnected
+func (s *ClipboardServer) getRoomDevicesLocked(room string, excludeDeviceID string) []DeviceMeta {
+	var devices []DeviceMeta
+	for deviceID, sessions := range s.hub.devicesInRoom(room, excludeDeviceID) {
+		if devMeta, ok := s.deviceConnected[deviceID]; ok {
+			devMeta.Sessions = sessions
+			devices = append(devices, devMeta)
 		}
 	}
-	return deviceIDs
+	sort.Slice(devices, func(i, j int) bool { return devices[i].ID < devices[j].ID })
+	return devices
 }
 
-// 辅助函数：清理 WebSocket 连接并通知其他人
-func (s *ClipboardServer) cleanupWebSocketConnection(conn *websocket.Conn, deviceID string, room string) {
+// broadcastDeviceLeft 设备的一个会话离开房间后通知房间：最后一个会话离开时广播 disconnect，
+// 否则广播会话数变化的 device 事件
+func (s *ClipboardServer) broadcastDeviceLeft(deviceID string, room string, remaining int) {
+	if remaining > 0 {
+		s.runMutex.Lock()
+		devMeta, ok := s.deviceConnected[deviceID]
+		s.runMutex.Unlock()
+		if ok {
+			devMeta.Sessions = remaining
+			s.broadcastWebSocketMessage(WebSocketMessage{Event: "device", Data: devMeta}, room)
+		}
+		return
+	}
+	s.broadcastWebSocketMessage(WebSocketMessage{
+		Event: "disconnect",
+		Data:  map[string]string{"id": deviceID},
+	}, room)
+}
+
+// 辅助函数：清理 WebSocket 连接并通知其他人（连接加入的每个房间都会收到 disconnect 事件）
+func (s *ClipboardServer) cleanupWebSocketConnection(conn *websocket.Conn, deviceID string) {
 	// 第一步：在锁内进行状态清理，但不关闭连接
 	var shouldBroadcast bool
+	var rooms []string
 	s.runMutex.Lock()
+	for room := range s.room_ws[conn] {
+		rooms = append(rooms, room)
+	}
 	delete(s.websockets, conn)
 	delete(s.room_ws, conn)
 	delete(s.connDeviceIDMap, conn)
+	sub := s.wsSubscribers[conn]
+	delete(s.wsSubscribers, conn)
 
 	if deviceID != "" {
-		delete(s.deviceConnected, deviceID)
-		s.updateRoomDeviceCount(room, deviceID, false)
+		// 同一设备的其他连接仍在线时保留设备信息
+		if s.deviceSessions[deviceID] > 1 {
+			s.deviceSessions[deviceID]--
+		} else {
+			delete(s.deviceSessions, deviceID)
+			delete(s.deviceConnected, deviceID)
+		}
+		for _, room := range rooms {
+			s.updateRoomDeviceCount(room, deviceID, false)
+		}
 		shouldBroadcast = true
 		s.logger.Printf("WebSocket 客户端断开连接: %s (ID: %s), 房间: %s. 当前连接数: %d, 设备数: %d",
-			conn.RemoteAddr(), deviceID, room, len(s.websockets), len(s.deviceConnected))
+			conn.RemoteAddr(), deviceID, strings.Join(rooms, ","), len(s.websockets), len(s.deviceConnected))
 	} else {
 		s.logger.Printf("WebSocket 客户端断开连接 (无有效DeviceID): %s, 房间: %s. 当前连接数: %d",
-			conn.RemoteAddr(), room, len(s.websockets))
+			conn.RemoteAddr(), strings.Join(rooms, ","), len(s.websockets))
 	}
 	s.runMutex.Unlock()
 
-	// 第二步：在锁外关闭连接
+	// 第二步：在锁外取消订阅并关闭连接
+	remaining := s.hub.unsubscribe(sub)
 	conn.Close()
 
-	// 第三步：广播断开连接事件
+	// 第三步：广播断开连接事件，设备在房间中还有其他会话时只广播会话数变化
 	if shouldBroadcast {
-		disconnectWsMsg := WebSocketMessage{
-			Event: "disconnect",
-			Data:  map[string]string{"id": deviceID},
+		for _, room := range rooms {
+			s.broadcastDeviceLeft(deviceID, room, remaining[room])
 		}
-		s.broadcastWebSocketMessage(disconnectWsMsg, room)
 	}
 }
 
@@ -658,7 +791,7 @@ func (s *ClipboardServer) authMiddleware(next http.HandlerFunc) http.HandlerFunc
 		// 添加 CORS 头，允许跨域请求
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Room-Auth-Tokens")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Room-Auth-Tokens, X-Device-Id, X-Device-Secret, X-Device-Name")
 
 		// 处理预检请求
 		if r.Method == "OPTIONS" {
@@ -672,7 +805,7 @@ func (s *ClipboardServer) authMiddleware(next http.HandlerFunc) http.HandlerFunc
 			return
 		}
 
-		token := extractAuthToken(r)
+		token := requestRoomToken(r, requirement.Room)
 
 		clientIP := get_remote_ip(r)
 
@@ -683,13 +816,16 @@ func (s *ClipboardServer) authMiddleware(next http.HandlerFunc) http.HandlerFunc
 			return
 		}
 
-		if requirement.Password == "" {
+		if requirement.Password == "" && requirement.PasswordHash == "" && s.users == nil && s.oidc == nil {
 			s.logger.Printf("认证失败: 服务器认证配置错误。来自 IP: %s", clientIP)
 			writeAuthJSONError(w, http.StatusInternalServerError, "服务器认证配置错误")
 			return
 		}
 
-		if token != requirement.Password {
+		// 房间密码（配置文件或房间存储）、房间成员的登录会话令牌或可以访问该房间的 API 令牌
+		passwordOK := (requirement.Password != "" && token == requirement.Password) ||
+			(requirement.PasswordHash != "" && s.rooms.checkPassword(requirement.Room, token))
+		if !passwordOK && !s.issuedTokenCanAccessRoom(requirement.Room, token) {
 			s.logger.Printf("认证失败: 无效令牌。来自 IP: %s, 路径: %s, 房间: %s", clientIP, r.URL.Path, requirement.Room)
 			writeAuthJSONError(w, http.StatusUnauthorized, "无效的认证令牌")
 			return
@@ -733,7 +869,7 @@ func (s *ClipboardServer) updateRoomStats(room string, messageCount int) {
 		s.roomStats[normalizedRoom] = &RoomStat{
 			MessageCount: 0,
 			LastActive:   time.Now().Unix(),
-			DeviceIDs:    make(map[string]bool),
+			DeviceIDs:    make(map[string]int),
 		}
 	}
 
@@ -760,13 +896,16 @@ func (s *ClipboardServer) updateRoomDeviceCount(room string, deviceID string, co
 		s.roomStats[normalizedRoom] = &RoomStat{
 			MessageCount: 0,
 			LastActive:   time.Now().Unix(),
-			DeviceIDs:    make(map[string]bool),
+			DeviceIDs:    make(map[string]int),
 		}
 	}
 
 	stat := s.roomStats[normalizedRoom]
+	// 同一设备可以有多个会话，最后一个会话离开时才移除
 	if connected {
-		stat.DeviceIDs[deviceID] = true
+		stat.DeviceIDs[deviceID]++
+	} else if stat.DeviceIDs[deviceID] > 1 {
+		stat.DeviceIDs[deviceID]--
 	} else {
 		delete(stat.DeviceIDs, deviceID)
 	}
@@ -774,32 +913,19 @@ func (s *ClipboardServer) updateRoomDeviceCount(room string, deviceID string, co
 }
 
 // getRoomList 获取房间列表
-func (s *ClipboardServer) getRoomList(tokens []string) []RoomInfo {
+// getRoomList 返回 tokens 可以访问的房间和公开的房间。named 中的房间（请求中的 room 参数）完整校验房间密码，
+// 其他房间只使用已缓存的密码校验结果
+func (s *ClipboardServer) getRoomList(tokens []string, named []string) []RoomInfo {
 	if !s.config.Server.RoomList {
 		return []RoomInfo{}
 	}
 
 	// 第一步：快速收集当前连接信息
-	currentRooms := make(map[string]map[string]bool)
-	s.runMutex.Lock()
-	for conn, room := range s.room_ws {
-		if deviceID, ok := s.connDeviceIDMap[conn]; ok {
-			normalizedRoom := normalizeRoomName(room)
-			if currentRooms[normalizedRoom] == nil {
-				currentRooms[normalizedRoom] = make(map[string]bool)
-			}
-			currentRooms[normalizedRoom][deviceID] = true
-		}
-	}
-	s.runMutex.Unlock()
+	currentRooms := s.hub.roomDevices()
 
 	// 第二步：快速收集消息信息
-	roomMessageCounts := make(map[string]int)
 	s.messageQueue.Lock()
-	for _, msg := range s.messageQueue.List {
-		normalizedRoom := normalizeRoomName(msg.Data.Room())
-		roomMessageCounts[normalizedRoom]++
-	}
+	roomMessageCounts := s.messageQueue.RoomCounts()
 	s.messageQueue.Unlock()
 
 	// 第三步：快速收集房间统计信息
@@ -810,11 +936,11 @@ func (s *ClipboardServer) getRoomList(tokens []string) []RoomInfo {
 		roomStatsSnapshot[room] = RoomStat{
 			MessageCount: stat.MessageCount,
 			LastActive:   stat.LastActive,
-			DeviceIDs:    make(map[string]bool),
+			DeviceIDs:    make(map[string]int),
 		}
 		// 复制 DeviceIDs
-		for deviceID, active := range stat.DeviceIDs {
-			roomStatsSnapshot[room].DeviceIDs[deviceID] = active
+		for deviceID, sessions := range stat.DeviceIDs {
+			roomStatsSnapshot[room].DeviceIDs[deviceID] = sessions
 		}
 	}
 	s.roomStatsMutex.RUnlock()
@@ -837,18 +963,33 @@ func (s *ClipboardServer) getRoomList(tokens []string) []RoomInfo {
 		allRooms[room] = true
 	}
 
+	// 添加房间存储中的房间
+	var registered map[string]RoomConfig
+	if s.rooms != nil {
+		registered = s.rooms.snapshot()
+		for room := range registered {
+			allRooms[room] = true
+		}
+	}
+
+	if len(named) > maxAuthTokens {
+		named = named[:maxAuthTokens]
+	}
+	namedRooms := make(map[string]bool, len(named))
+	for _, room := range named {
+		namedRooms[normalizeRoomName(room)] = true
+	}
+
 	var roomList []RoomInfo
 	for room := range allRooms {
-		accessible := s.canAccessRoom(room, "")
-		if !accessible {
-			for _, token := range tokens {
-				if s.canAccessRoom(room, token) {
-					accessible = true
-					break
-				}
-			}
+		// 公开的房间即使无权访问也会列出（进入时仍需密码），但不显示消息和设备数量
+		var accessible bool
+		if namedRooms[room] {
+			_, accessible = s.roomAccessToken(room, tokens)
+		} else {
+			_, accessible = s.roomListAccessToken(room, tokens)
 		}
-		if !accessible {
+		if !accessible && registered[room].Visibility != roomVisibilityPublic {
 			continue
 		}
 
@@ -875,6 +1016,10 @@ func (s *ClipboardServer) getRoomList(tokens []string) []RoomInfo {
 			lastActive = time.Now().Unix()
 		}
 
+		if !accessible {
+			messageCount, deviceCount, lastActive = 0, 0, 0
+		}
+
 		roomInfo := RoomInfo{
 			Name:         displayRoom,
 			MessageCount: messageCount,
@@ -882,6 +1027,7 @@ func (s *ClipboardServer) getRoomList(tokens []string) []RoomInfo {
 			LastActive:   lastActive,
 			IsActive:     deviceCount > 0,
 			IsProtected:  s.hasRoomAuthEntry(room),
+			Description:  registered[room].Description,
 		}
 
 		roomList = append(roomList, roomInfo)
@@ -942,19 +1088,15 @@ func (s *ClipboardServer) cleanupEmptyRooms() {
 
 	// 第一步：快速收集活跃房间信息
 	activeRooms := make(map[string]bool)
-	s.runMutex.Lock()
-	for _, room := range s.room_ws {
-		normalizedRoom := normalizeRoomName(room)
-		activeRooms[normalizedRoom] = true
+	for room := range s.hub.roomDevices() {
+		activeRooms[room] = true
 	}
-	s.runMutex.Unlock()
 
 	// 第二步：快速收集有消息的房间
 	roomsWithMessages := make(map[string]bool)
 	s.messageQueue.Lock()
-	for _, msg := range s.messageQueue.List {
-		normalizedRoom := normalizeRoomName(msg.Data.Room())
-		roomsWithMessages[normalizedRoom] = true
+	for room := range s.messageQueue.RoomCounts() {
+		roomsWithMessages[room] = true
 	}
 	s.messageQueue.Unlock()
 
@@ -0,0 +1,182 @@
+package lib
+
+/**
+*** FILE: markdown.go
+***   render text messages as markdown (?format=html / ?format=md)
+**/
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// markdownRenderer 不启用 html.WithUnsafe，原始 HTML 会被丢弃，危险链接由 safeLinkTransformer 处理
+var markdownRenderer = goldmark.New(
+	goldmark.WithExtensions(extension.GFM),
+	goldmark.WithParserOptions(
+		parser.WithASTTransformers(util.Prioritized(&safeLinkTransformer{}, 100)),
+	),
+)
+
+// markdownPageTemplate 渲染页面的最小模板
+var markdownPageTemplate = template.Must(template.New("markdown").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="referrer" content="no-referrer">
+<title>{{.Title}}</title>
+<style>
+body{max-width:860px;margin:2em auto;padding:0 1em;font:16px/1.6 -apple-system,"Segoe UI",Roboto,"Helvetica Neue",Arial,sans-serif;color:#24292f}
+pre{background:#f6f8fa;padding:1em;overflow:auto;border-radius:6px}
+code{background:#f6f8fa;padding:.1em .3em;border-radius:4px}
+pre code{padding:0}
+table{border-collapse:collapse}
+th,td{border:1px solid #d0d7de;padding:.3em .8em}
+blockquote{margin:0;padding:0 1em;color:#57606a;border-left:.25em solid #d0d7de}
+img{max-width:100%}
+footer{margin-top:3em;color:#8c959f;font-size:.85em}
+</style>
+</head>
+<body>
+<article>
+{{.Body}}
+</article>
+<footer>#{{.ID}} · {{.Time}}</footer>
+</body>
+</html>
+`))
+
+// safeLinkTransformer 只保留安全协议的链接，并为链接添加 rel/target 属性
+type safeLinkTransformer struct{}
+
+func (t *safeLinkTransformer) Transform(node *ast.Document, reader text.Reader, pc parser.Context) {
+	source := reader.Source()
+	var unsafeAutoLinks []*ast.AutoLink
+	ast.Walk(node, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch link := n.(type) {
+		case *ast.Link:
+			if !isSafeMarkdownURL(link.Destination, false) {
+				link.Destination = []byte("#")
+			}
+			link.SetAttributeString("rel", []byte("nofollow noopener noreferrer"))
+			link.SetAttributeString("target", []byte("_blank"))
+		case *ast.AutoLink:
+			if !isSafeMarkdownURL(link.URL(source), false) {
+				unsafeAutoLinks = append(unsafeAutoLinks, link)
+				return ast.WalkSkipChildren, nil
+			}
+			link.SetAttributeString("rel", []byte("nofollow noopener noreferrer"))
+			link.SetAttributeString("target", []byte("_blank"))
+		case *ast.Image:
+			if !isSafeMarkdownURL(link.Destination, true) {
+				link.Destination = []byte("")
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+	// 遍历时替换节点会中断遍历，遍历结束后再把不安全的自动链接替换为纯文本
+	for _, link := range unsafeAutoLinks {
+		link.Parent().ReplaceChild(link.Parent(), link, ast.NewString(link.Label(source)))
+	}
+}
+
+// isSafeMarkdownURL 判断链接是否为允许的协议（相对链接、http(s)、mailto，图片额外允许 data:image）
+func isSafeMarkdownURL(dest []byte, image bool) bool {
+	url := strings.ToLower(strings.TrimSpace(string(dest)))
+	schemeEnd := strings.IndexAny(url, ":/?#")
+	if schemeEnd == -1 || url[schemeEnd] != ':' {
+		return true // 没有协议，视为相对链接
+	}
+	switch url[:schemeEnd] {
+	case "http", "https":
+		return true
+	case "mailto":
+		return !image
+	case "data":
+		return image && strings.HasPrefix(url, "data:image/") && !strings.HasPrefix(url, "data:image/svg")
+	}
+	return false
+}
+
+// renderMarkdown 将 markdown 文本渲染为经过过滤的 HTML 片段
+func renderMarkdown(source string) (template.HTML, error) {
+	var buf bytes.Buffer
+	if err := markdownRenderer.Convert([]byte(source), &buf); err != nil {
+		return "", err
+	}
+	return template.HTML(buf.String()), nil
+}
+
+// isMarkdownFormat 判断请求的 format 参数是否为 markdown 相关格式
+func isMarkdownFormat(format string) bool {
+	return format == "html" || format == "md"
+}
+
+// writeMarkdownContent 按 format 参数输出文本消息：html 渲染为页面，md 作为附件下载
+func (s *ClipboardServer) writeMarkdownContent(w http.ResponseWriter, textReceive *TextReceive, format string) {
+	switch format {
+	case "md":
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("clip-%d.md", textReceive.ID)))
+		w.Write([]byte(textReceive.Content))
+		s.logger.Printf("以 Markdown 文件形式返回文本内容, ID: %d", textReceive.ID)
+	case "html":
+		body, err := renderMarkdown(textReceive.Content)
+		if err != nil {
+			s.logger.Printf("错误: 渲染 Markdown 失败 (ID: %d): %v", textReceive.ID, err)
+			http.Error(w, "渲染 Markdown 失败", http.StatusInternalServerError)
+			return
+		}
+
+		var page bytes.Buffer
+		err = markdownPageTemplate.Execute(&page, map[string]interface{}{
+			"Title": markdownTitle(textReceive),
+			"Body":  body,
+			"ID":    textReceive.ID,
+			"Time":  time.Unix(textReceive.Timestamp, 0).Format("2006-01-02 15:04:05"),
+		})
+		if err != nil {
+			s.logger.Printf("错误: 渲染 Markdown 页面模板失败 (ID: %d): %v", textReceive.ID, err)
+			http.Error(w, "渲染 Markdown 失败", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		// 即使渲染结果已过滤，仍然禁止脚本执行作为额外保护
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; img-src http: https: data:; style-src 'unsafe-inline'; base-uri 'none'; form-action 'none'")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Write(page.Bytes())
+		s.logger.Printf("以 HTML 格式返回渲染后的 Markdown 文本, ID: %d", textReceive.ID)
+	}
+}
+
+// markdownTitle 取第一行非空文本（去掉标题标记）作为页面标题
+func markdownTitle(textReceive *TextReceive) string {
+	for _, line := range strings.Split(textReceive.Content, "\n") {
+		line = strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(line), "#"))
+		if line == "" {
+			continue
+		}
+		runes := []rune(line)
+		if len(runes) > 60 {
+			line = string(runes[:60]) + "..."
+		}
+		return line
+	}
+	return fmt.Sprintf("Clip #%d", textReceive.ID)
+}
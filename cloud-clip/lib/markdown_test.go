@@ -0,0 +1,50 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderMarkdownFiltersUnsafeURLs(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  string
+		want    string // 渲染结果必须包含
+		notWant string // 渲染结果不能包含
+	}{
+		{"javascript 链接", "[x](javascript:alert(1))", `href="#"`, "javascript:"},
+		{"大小写混合的 javascript 链接", "[x](JaVaScRiPt:alert(1))", `href="#"`, "alert"},
+		{"vbscript 链接", "[x](vbscript:msgbox(1))", `href="#"`, "vbscript:"},
+		{"data 链接", "[x](data:text/html,hi)", `href="#"`, "data:"},
+		{"javascript 图片", "![x](javascript:alert(1))", `src=""`, "javascript:"},
+		{"vbscript 图片", "![x](vbscript:msgbox(1))", `src=""`, "vbscript:"},
+		{"data:text/html 图片", "![x](data:text/html,hi)", `src=""`, "data:"},
+		{"SVG 图片", "![x](data:image/svg+xml,hi)", `src=""`, "data:"},
+		{"javascript 自动链接", "<javascript:alert(1)>", "javascript:alert(1)", "<a"},
+		{"vbscript 自动链接", "<vbscript:msgbox(1)>", "vbscript:msgbox(1)", "<a"},
+		{"data 自动链接", "<data:text/html,hi>", "data:text/html,hi", "<a"},
+		{"段落中的不安全自动链接", "a <javascript:alert(1)> b <https://example.com>", `href="https://example.com"`, `href="javascript`},
+		{"http 链接", "[x](https://example.com)", `href="https://example.com" rel="nofollow noopener noreferrer" target="_blank"`, ""},
+		{"相对链接", "[x](/content/1)", `href="/content/1"`, ""},
+		{"mailto 链接", "[x](mailto:a@example.com)", `href="mailto:a@example.com"`, ""},
+		{"http 自动链接", "<https://example.com>", `href="https://example.com" rel="nofollow noopener noreferrer" target="_blank"`, ""},
+		{"邮件自动链接", "<a@example.com>", `href="mailto:a@example.com"`, ""},
+		{"data:image 图片", "![x](data:image/png;base64,AAAA)", `src="data:image/png;base64,AAAA"`, ""},
+		{"原始 HTML 被丢弃", "<script>alert(1)</script>", "", "<script>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderMarkdown(tt.source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			html := string(got)
+			if tt.want != "" && !strings.Contains(html, tt.want) {
+				t.Fatalf("渲染结果 %q 应包含 %q", html, tt.want)
+			}
+			if tt.notWant != "" && strings.Contains(html, tt.notWant) {
+				t.Fatalf("渲染结果 %q 不应包含 %q", html, tt.notWant)
+			}
+		})
+	}
+}
@@ -1,22 +1,82 @@
 package lib
 
-import "log" // 新增：导入 log 包
+import (
+	"container/list"
+	"log" // 新增：导入 log 包
+)
 
 /**
 *** FILE: msg.go
 ***   handle messageQueue
 **/
 
+// postEntry 是队列中的一条消息
+type postEntry struct {
+	event PostEvent
+	room  string        // 规范化后的房间名
+	elem  *list.Element // 在全局顺序链表中的位置
+}
+
+// roomRing 是一个房间的消息环形缓冲区，按加入顺序保存，容量为 history_len，按需扩容
+type roomRing struct {
+	buf  []*postEntry
+	head int
+	size int
+}
+
 // 修改：增加 logger 参数
 func NewMessageQueue(historyLen int, logger *log.Logger) *PostList {
 	return &PostList{
 		nextid:      1, // Start IDs from 1
 		history_len: historyLen,
-		List:        make([]PostEvent, 0, historyLen),
+		rooms:       make(map[string]*roomRing),
+		index:       make(map[int]*postEntry),
+		order:       list.New(),
 		logger:      logger, // 新增：赋值 logger
 	}
 }
 
+func (q *roomRing) at(i int) *postEntry {
+	return q.buf[(q.head+i)%len(q.buf)]
+}
+
+// push 在末尾加入消息，缓冲区已达 capacity 时淘汰并返回最旧的消息
+func (q *roomRing) push(e *postEntry, capacity int) (evicted *postEntry) {
+	if q.size == len(q.buf) && len(q.buf) < capacity {
+		grown := make([]*postEntry, min(max(len(q.buf)*2, 8), capacity))
+		for i := 0; i < q.size; i++ {
+			grown[i] = q.at(i)
+		}
+		q.buf = grown
+		q.head = 0
+	}
+	if q.size == len(q.buf) {
+		evicted = q.buf[q.head]
+		q.buf[q.head] = e
+		q.head = (q.head + 1) % len(q.buf)
+		return evicted
+	}
+	q.buf[(q.head+q.size)%len(q.buf)] = e
+	q.size++
+	return nil
+}
+
+// remove 移除指定消息，后面的消息前移一位
+func (q *roomRing) remove(e *postEntry) bool {
+	for i := 0; i < q.size; i++ {
+		if q.at(i) != e {
+			continue
+		}
+		for j := i; j < q.size-1; j++ {
+			q.buf[(q.head+j)%len(q.buf)] = q.at(j + 1)
+		}
+		q.buf[(q.head+q.size-1)%len(q.buf)] = nil
+		q.size--
+		return true
+	}
+	return false
+}
+
 func (m *PostList) Append(item *PostEvent) {
 	m.Lock()
 	defer m.Unlock()
@@ -27,47 +87,57 @@ func (m *PostList) Append(item *PostEvent) {
 func (m *PostList) appendLocked(item PostEvent) {
 	if item.Data.ID() <= 0 { //fill uniq id, thread-safe way
 		item.Data.SetID(m.nextid)
+	} else if _, exists := m.index[item.Data.ID()]; exists {
+		// 历史文件中的重复 ID 重新分配，保证索引唯一
+		if m.logger != nil {
+			m.logger.Printf("消息ID %d 重复，重新分配为 %d", item.Data.ID(), m.nextid)
+		}
+		item.Data.SetID(m.nextid)
 	}
-	m.List = append(m.List, item)
-	m.trimRoomHistoryLocked(item.Data.Room())
 
 	itemID := item.Data.ID()
 	if m.nextid <= itemID {
 		m.nextid = itemID + 1
 	}
-}
-
-func (m *PostList) trimRoomHistoryLocked(room string) {
 	if m.history_len <= 0 {
-		m.List = []PostEvent{}
 		return
 	}
 
-	normalizedRoom := normalizeRoomName(room)
-	roomCount := 0
-	for _, msg := range m.List {
-		if normalizeRoomName(msg.Data.Room()) == normalizedRoom {
-			roomCount++
-		}
+	e := &postEntry{event: item, room: normalizeRoomName(item.Data.Room())}
+	q := m.rooms[e.room]
+	if q == nil {
+		q = &roomRing{}
+		m.rooms[e.room] = q
 	}
+	if evicted := q.push(e, m.history_len); evicted != nil {
+		m.logEvictedMessage(evicted.event)
+		m.unlinkLocked(evicted)
+	}
+	e.elem = m.order.PushBack(e)
+	m.index[itemID] = e
+	if item.Data.Room() == "" {
+		m.unscoped++
+	}
+}
 
-	for roomCount > m.history_len {
-		evictedIndex := -1
-		for i, msg := range m.List {
-			if normalizeRoomName(msg.Data.Room()) == normalizedRoom {
-				m.logEvictedMessage(msg)
-				evictedIndex = i
-				break
-			}
-		}
+// unlinkLocked 从索引和全局顺序中移除消息（不处理房间缓冲区）
+func (m *PostList) unlinkLocked(e *postEntry) {
+	m.order.Remove(e.elem)
+	delete(m.index, e.event.Data.ID())
+	if e.event.Data.Room() == "" {
+		m.unscoped--
+	}
+}
 
-		if evictedIndex == -1 {
-			return
+// deleteEntryLocked 从房间缓冲区、索引和全局顺序中移除消息
+func (m *PostList) deleteEntryLocked(e *postEntry) {
+	if q := m.rooms[e.room]; q != nil {
+		q.remove(e)
+		if q.size == 0 {
+			delete(m.rooms, e.room)
 		}
-
-		m.List = append(m.List[:evictedIndex], m.List[evictedIndex+1:]...)
-		roomCount--
 	}
+	m.unlinkLocked(e)
 }
 
 func (m *PostList) logEvictedMessage(evicted PostEvent) {
@@ -77,7 +147,7 @@ func (m *PostList) logEvictedMessage(evicted PostEvent) {
 
 	var content string
 	if evicted.Data.TextReceive != nil {
-		content = evicted.Data.TextReceive.Content
+		content = evicted.Data.Masked().TextReceive.Content
 	} else if evicted.Data.FileReceive != nil {
 		content = "[文件] " + evicted.Data.FileReceive.Name
 	}
@@ -96,40 +166,206 @@ func (m *PostList) ClearAll() {
 	defer m.Unlock()
 
 	// 清空列表
-	m.List = []PostEvent{}
+	m.rooms = make(map[string]*roomRing)
+	m.index = make(map[int]*postEntry)
+	m.order.Init()
+	m.unscoped = 0
+}
+
+// find item by id and remove it, returns its former position in the global order (-1 if not found)
+func (m *PostList) RemoveById(msgId int) int {
+	m.Lock()
+	defer m.Unlock()
+
+	e, ok := m.index[msgId]
+	if !ok {
+		return -1
+	}
+	index := 0
+	for el := m.order.Front(); el != e.elem; el = el.Next() {
+		index++
+	}
+	m.deleteEntryLocked(e)
+	return index
+}
+
+// Len 返回队列中的消息总数
+func (m *PostList) Len() int {
+	return m.order.Len()
+}
+
+// Get 按 ID 查找消息，返回的指针可以用于原地修改消息，未找到时返回 nil
+func (m *PostList) Get(msgId int) *PostEvent {
+	if e, ok := m.index[msgId]; ok {
+		return &e.event
+	}
+	return nil
+}
+
+// Delete 按 ID 移除消息并返回被移除的消息
+func (m *PostList) Delete(msgId int) (PostEvent, bool) {
+	e, ok := m.index[msgId]
+	if !ok {
+		return PostEvent{}, false
+	}
+	m.deleteEntryLocked(e)
+	return e.event, true
 }
 
-// remove array item by index
-func (m *PostList) Remove(index int) {
-	// m.Lock()
-	// defer m.Unlock()
-	if index < 0 || index >= len(m.List) {
+// DeleteWhere 按全局顺序移除所有满足条件的消息，返回被移除的消息
+func (m *PostList) DeleteWhere(match func(msg *PostEvent) bool) []PostEvent {
+	var removed []PostEvent
+	for el := m.order.Front(); el != nil; {
+		next := el.Next()
+		if e := el.Value.(*postEntry); match(&e.event) {
+			m.deleteEntryLocked(e)
+			removed = append(removed, e.event)
+		}
+		el = next
+	}
+	return removed
+}
+
+// DeleteInRoom 按加入顺序移除房间中所有满足条件的消息，返回被移除的消息
+func (m *PostList) DeleteInRoom(room string, match func(msg *PostEvent) bool) []PostEvent {
+	q := m.rooms[normalizeRoomName(room)]
+	if q == nil {
+		return nil
+	}
+	var matched []*postEntry
+	for i := 0; i < q.size; i++ {
+		if e := q.at(i); match(&e.event) {
+			matched = append(matched, e)
+		}
+	}
+	removed := make([]PostEvent, 0, len(matched))
+	for _, e := range matched {
+		m.deleteEntryLocked(e)
+		removed = append(removed, e.event)
+	}
+	return removed
+}
+
+// RenameRoom 把 from 房间的所有消息移动到 to 房间，返回移动的消息数量；to 房间已有消息时返回 errRoomNotEmpty
+func (m *PostList) RenameRoom(from string, to string) (int, error) {
+	from, to = normalizeRoomName(from), normalizeRoomName(to)
+	if from == to {
+		return 0, nil
+	}
+	if m.RoomLen(to) > 0 {
+		return 0, errRoomNotEmpty
+	}
+	q := m.rooms[from]
+	if q == nil {
+		return 0, nil
+	}
+	delete(m.rooms, from)
+	m.rooms[to] = q
+	for i := 0; i < q.size; i++ {
+		e := q.at(i)
+		e.room = to
+		e.event.Data.SetRoom(to)
+	}
+	return q.size, nil
+}
+
+// Range 按加入顺序遍历所有消息，fn 返回 false 时停止
+func (m *PostList) Range(fn func(msg *PostEvent) bool) {
+	for el := m.order.Front(); el != nil; el = el.Next() {
+		if !fn(&el.Value.(*postEntry).event) {
+			return
+		}
+	}
+}
+
+// RangeReverse 从最新到最旧遍历所有消息，fn 返回 false 时停止
+func (m *PostList) RangeReverse(fn func(msg *PostEvent) bool) {
+	for el := m.order.Back(); el != nil; el = el.Prev() {
+		if !fn(&el.Value.(*postEntry).event) {
+			return
+		}
+	}
+}
+
+// RangeRoom 按加入顺序遍历房间中的消息，fn 返回 false 时停止
+func (m *PostList) RangeRoom(room string, fn func(msg *PostEvent) bool) {
+	q := m.rooms[normalizeRoomName(room)]
+	if q == nil {
 		return
 	}
-	m.List = append(m.List[:index], m.List[index+1:]...)
+	for i := 0; i < q.size; i++ {
+		if !fn(&q.at(i).event) {
+			return
+		}
+	}
 }
 
-// find item index which m.Data[index].Data.ID() == msgId
-func (m *PostList) FindId(msgId int) int {
-	// m.Lock()
-	// defer m.Unlock()
-	for i, msg := range m.List {
-		if msg.Data.ID() == msgId {
-			return i
+// RangeRoomReverse 从最新到最旧遍历房间中的消息，fn 返回 false 时停止
+func (m *PostList) RangeRoomReverse(room string, fn func(msg *PostEvent) bool) {
+	q := m.rooms[normalizeRoomName(room)]
+	if q == nil {
+		return
+	}
+	for i := q.size - 1; i >= 0; i-- {
+		if !fn(&q.at(i).event) {
+			return
 		}
 	}
-	return -1 // Return -1 if the message ID is not found
 }
 
-// find item by id and remove it from array
-func (m *PostList) RemoveById(msgId int) int {
-	m.Lock()
-	defer m.Unlock()
+// Latest 返回房间中最新的消息，房间为空时返回 nil
+func (m *PostList) Latest(room string) *PostEvent {
+	q := m.rooms[normalizeRoomName(room)]
+	if q == nil || q.size == 0 {
+		return nil
+	}
+	return &q.at(q.size - 1).event
+}
 
-	index := m.FindId(msgId)
-	if index != -1 {
-		m.Remove(index)
+// RoomLen 返回房间中的消息数量
+func (m *PostList) RoomLen(room string) int {
+	if q := m.rooms[normalizeRoomName(room)]; q != nil {
+		return q.size
 	}
+	return 0
+}
 
-	return index
+// RoomCounts 返回每个有消息的房间的消息数量
+func (m *PostList) RoomCounts() map[string]int {
+	counts := make(map[string]int, len(m.rooms))
+	for room, q := range m.rooms {
+		counts[room] = q.size
+	}
+	return counts
+}
+
+// Items 按加入顺序返回所有消息的副本
+func (m *PostList) Items() []PostEvent {
+	items := make([]PostEvent, 0, m.order.Len())
+	m.Range(func(msg *PostEvent) bool {
+		items = append(items, *msg)
+		return true
+	})
+	return items
+}
+
+// RoomHistory 按加入顺序返回房间中的消息，并包含旧版本历史中未指定房间、对所有房间可见的消息
+func (m *PostList) RoomHistory(room string) []PostEvent {
+	var items []PostEvent
+	if m.unscoped > 0 && normalizeRoomName(room) != "default" {
+		m.Range(func(msg *PostEvent) bool {
+			if msg.Data.Room() == "" || normalizeRoomName(msg.Data.Room()) == normalizeRoomName(room) {
+				items = append(items, *msg)
+			}
+			return true
+		})
+		return items
+	}
+
+	items = make([]PostEvent, 0, m.RoomLen(room))
+	m.RangeRoom(room, func(msg *PostEvent) bool {
+		items = append(items, *msg)
+		return true
+	})
+	return items
 }
@@ -0,0 +1,203 @@
+package lib
+
+import (
+	"reflect"
+	"testing"
+)
+
+func appendText(q *PostList, room string, content string) int {
+	q.Append(&PostEvent{Event: "receive", Data: ReceiveHolder{TextReceive: &TextReceive{
+		ReceiveBase: ReceiveBase{Type: "text", Room: room},
+		Content:     content,
+	}}})
+	q.Lock()
+	defer q.Unlock()
+	return q.Latest(room).Data.ID()
+}
+
+func roomIDs(q *PostList, room string) []int {
+	ids := []int{}
+	q.RangeRoom(room, func(msg *PostEvent) bool {
+		ids = append(ids, msg.Data.ID())
+		return true
+	})
+	return ids
+}
+
+func roomIDsReverse(q *PostList, room string) []int {
+	ids := []int{}
+	q.RangeRoomReverse(room, func(msg *PostEvent) bool {
+		ids = append(ids, msg.Data.ID())
+		return true
+	})
+	return ids
+}
+
+func globalIDs(q *PostList) []int {
+	ids := []int{}
+	q.Range(func(msg *PostEvent) bool {
+		ids = append(ids, msg.Data.ID())
+		return true
+	})
+	return ids
+}
+
+// checkQueueConsistent 检查全局顺序、ID 索引和各房间缓冲区一致：
+// 每条消息都能按 ID 找到，各房间的消息数之和等于总数，房间内的顺序与全局顺序一致
+func checkQueueConsistent(t *testing.T, q *PostList) {
+	t.Helper()
+	q.Lock()
+	defer q.Unlock()
+	global := globalIDs(q)
+	if len(global) != q.Len() || len(q.index) != q.Len() {
+		t.Fatalf("全局顺序 %d 条，Len = %d，索引 %d 条", len(global), q.Len(), len(q.index))
+	}
+	position := make(map[int]int, len(global))
+	for i, id := range global {
+		position[id] = i
+		if msg := q.Get(id); msg == nil || msg.Data.ID() != id {
+			t.Fatalf("Get(%d) = %v", id, msg)
+		}
+	}
+	total := 0
+	for room, n := range q.RoomCounts() {
+		ids := roomIDs(q, room)
+		if len(ids) != n || n != q.RoomLen(room) {
+			t.Fatalf("房间 %s: RangeRoom %d 条，RoomCounts %d，RoomLen %d", room, len(ids), n, q.RoomLen(room))
+		}
+		for i := 1; i < len(ids); i++ {
+			if position[ids[i-1]] >= position[ids[i]] {
+				t.Fatalf("房间 %s 的顺序 %v 与全局顺序 %v 不一致", room, ids, global)
+			}
+		}
+		total += n
+	}
+	if total != len(global) {
+		t.Fatalf("各房间合计 %d 条，全局 %d 条", total, len(global))
+	}
+}
+
+func TestMessageQueueRoomWraparound(t *testing.T) {
+	q := NewMessageQueue(3, nil)
+	var a, b []int
+	for i := 0; i < 7; i++ {
+		a = append(a, appendText(q, "a", "a"))
+		if i%3 == 0 {
+			b = append(b, appendText(q, "b", "b"))
+		}
+	}
+	checkQueueConsistent(t, q)
+
+	q.Lock()
+	defer q.Unlock()
+	// a 只保留最新的 3 条，b 的消息不受 a 淘汰的影响
+	if got, want := roomIDs(q, "a"), a[len(a)-3:]; !reflect.DeepEqual(got, want) {
+		t.Fatalf("房间 a = %v，期望 %v", got, want)
+	}
+	if got := roomIDs(q, "b"); !reflect.DeepEqual(got, b) {
+		t.Fatalf("房间 b = %v，期望 %v", got, b)
+	}
+	if got, want := roomIDsReverse(q, "a"), []int{a[6], a[5], a[4]}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("反向遍历房间 a = %v，期望 %v", got, want)
+	}
+	if latest := q.Latest("a"); latest == nil || latest.Data.ID() != a[6] {
+		t.Fatalf("Latest(a) = %v", latest)
+	}
+	// 被淘汰的消息从索引中移除
+	for _, id := range a[:4] {
+		if q.Get(id) != nil {
+			t.Fatalf("被淘汰的消息 %d 仍然可以找到", id)
+		}
+	}
+	want := []int{b[0], b[1], a[4], a[5], a[6], b[2]}
+	if got := globalIDs(q); !reflect.DeepEqual(got, want) {
+		t.Fatalf("全局顺序 = %v，期望 %v", got, want)
+	}
+}
+
+func TestMessageQueueDeleteAfterWrap(t *testing.T) {
+	q := NewMessageQueue(4, nil)
+	var ids []int
+	for i := 0; i < 6; i++ {
+		ids = append(ids, appendText(q, "a", "a"))
+	}
+	// 环形缓冲区的起点已经移动，删除中间的消息后顺序不变
+	q.Lock()
+	if _, ok := q.Delete(ids[3]); !ok {
+		t.Fatal("Delete 应找到消息")
+	}
+	if _, ok := q.Delete(ids[0]); ok {
+		t.Fatal("被淘汰的消息不应能删除")
+	}
+	q.Unlock()
+	checkQueueConsistent(t, q)
+
+	// 删除后空出的位置被新消息使用，再次写满时淘汰最旧的消息
+	ids = append(ids, appendText(q, "a", "a"), appendText(q, "a", "a"))
+	checkQueueConsistent(t, q)
+	q.Lock()
+	defer q.Unlock()
+	if got, want := roomIDs(q, "a"), []int{ids[4], ids[5], ids[6], ids[7]}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("房间 a = %v，期望 %v", got, want)
+	}
+	if q.Get(ids[2]) != nil {
+		t.Fatalf("被淘汰的消息 %d 仍然可以找到", ids[2])
+	}
+}
+
+func TestMessageQueueGrowsBeforeEvicting(t *testing.T) {
+	q := NewMessageQueue(20, nil)
+	var ids []int
+	for i := 0; i < 25; i++ {
+		ids = append(ids, appendText(q, "a", "a"))
+		if i == 9 {
+			// 扩容前后顺序不变
+			q.Lock()
+			got := roomIDs(q, "a")
+			q.Unlock()
+			if !reflect.DeepEqual(got, ids) {
+				t.Fatalf("扩容后房间 a = %v，期望 %v", got, ids)
+			}
+		}
+	}
+	checkQueueConsistent(t, q)
+	q.Lock()
+	defer q.Unlock()
+	if got := roomIDs(q, "a"); !reflect.DeepEqual(got, ids[5:]) {
+		t.Fatalf("房间 a = %v，期望 %v", got, ids[5:])
+	}
+}
+
+func TestMessageQueueDeleteInRoomAndRename(t *testing.T) {
+	q := NewMessageQueue(3, nil)
+	for i := 0; i < 5; i++ {
+		appendText(q, "a", "keep")
+		appendText(q, "a", "drop")
+		appendText(q, "b", "b")
+	}
+	q.Lock()
+	removed := q.DeleteInRoom("a", func(msg *PostEvent) bool { return msg.Data.TextReceive.Content == "drop" })
+	q.Unlock()
+	if len(removed) != 2 {
+		t.Fatalf("删除 %d 条，期望 2 条（房间 a 中保留的 3 条里有 2 条 drop）", len(removed))
+	}
+	checkQueueConsistent(t, q)
+
+	q.Lock()
+	moved, err := q.RenameRoom("a", "c")
+	q.Unlock()
+	if err != nil || moved != 1 {
+		t.Fatalf("RenameRoom = %d, %v", moved, err)
+	}
+	checkQueueConsistent(t, q)
+	// 移动后的房间继续按容量淘汰
+	for i := 0; i < 3; i++ {
+		appendText(q, "c", "c")
+	}
+	checkQueueConsistent(t, q)
+	q.Lock()
+	defer q.Unlock()
+	if q.RoomLen("c") != 3 || q.RoomLen("a") != 0 {
+		t.Fatalf("RoomLen(c) = %d, RoomLen(a) = %d", q.RoomLen("c"), q.RoomLen("a"))
+	}
+}
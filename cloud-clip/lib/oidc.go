@@ -0,0 +1,656 @@
+package lib
+
+/**
+*** FILE: oidc.go
+***   OpenID Connect login: authorization code flow with PKCE, claims/groups mapped to rooms, session cookie, bearer JWT validation
+**/
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	jose "github.com/go-jose/go-jose/v4"
+	"golang.org/x/oauth2"
+)
+
+const (
+	oidcSessionPrefix     = "cco_"
+	oidcSessionCookie     = "cc_session"
+	oidcStateCookie       = "cc_oidc_state"
+	oidcLoginTTL          = 10 * time.Minute // 从跳转到 IdP 到回调的最长时间
+	oidcRequestTimeout    = 10 * time.Second
+	maxOIDCJWTCache       = 1024
+	defaultOIDCSessionTTL = 8 * 3600
+	oidcDiscoveryBackoff  = 30 * time.Second // 发现失败后多久再重试
+	oidcJWKSRefetch       = 30 * time.Second // 遇到未知的 kid 时两次重新获取 JWKS 的最短间隔
+	oidcRejectedJWTTTL    = time.Minute      // 校验失败的 JWT 在这段时间内直接拒绝，不再校验签名
+	maxOIDCJWKSBytes      = 1 << 20
+)
+
+var (
+	errOIDCDisabled = errors.New("OIDC 登录未启用")
+	errOIDCState    = errors.New("登录请求无效或已过期，请重新登录")
+	errOIDCNoRooms  = errors.New("该账号没有可以访问的房间")
+)
+
+// OIDCIdentity 是通过 IdP 认证的用户，Rooms 由 claims 和用户组映射得到，"*" 表示所有房间
+type OIDCIdentity struct {
+	Subject string   `json:"subject"`
+	Name    string   `json:"name"`
+	Email   string   `json:"email,omitempty"`
+	Groups  []string `json:"groups,omitempty"`
+	Rooms   []string `json:"rooms"`
+	Admin   bool     `json:"admin,omitempty"`
+	Expires int64    `json:"expiresAt"`
+}
+
+func (id *OIDCIdentity) canAccessRoom(room string) bool {
+	if id.Admin {
+		return true
+	}
+	room = normalizeRoomName(room)
+	for _, member := range id.Rooms {
+		if member == "*" || member == room {
+			return true
+		}
+	}
+	return false
+}
+
+// oidcPending 是一个进行中的登录：PKCE verifier、nonce 和登录后返回的房间
+type oidcPending struct {
+	verifier string
+	nonce    string
+	room     string
+	redirect string
+	expires  time.Time
+}
+
+// oidcStore 保存 IdP 的发现结果、进行中的登录、登录会话（只保存在内存中）和已校验的 Bearer JWT
+type oidcStore struct {
+	cfg    *Config
+	client *http.Client
+	logf   func(format string, v ...any)
+
+	mu         sync.Mutex
+	provider   *oidc.Provider
+	issuer     string      // 发现文档中的 issuer
+	algorithms []string    // 发现文档中 IdP 支持的签名算法
+	keySet     *jwksKeySet // IdP 的签名公钥
+	lastFailed time.Time
+	pending    map[string]*oidcPending          // state -> 登录
+	sessions   map[string]*OIDCIdentity         // 会话令牌的 SHA-256 -> 用户
+	jwtCache   *lruCache[string, *OIDCIdentity] // JWT 的 SHA-256 -> 用户，缓存到 JWT 的 exp
+	rejected   *lruCache[string, struct{}]      // 校验失败的 JWT 的 SHA-256，缓存 oidcRejectedJWTTTL
+}
+
+func newOIDCStore(cfg *Config, logf func(format string, v ...any)) *oidcStore {
+	return &oidcStore{
+		cfg:      cfg,
+		client:   &http.Client{Timeout: oidcRequestTimeout},
+		logf:     logf,
+		pending:  make(map[string]*oidcPending),
+		sessions: make(map[string]*OIDCIdentity),
+		jwtCache: newLRUCache[string, *OIDCIdentity](maxOIDCJWTCache),
+		rejected: newLRUCache[string, struct{}](maxOIDCJWTCache),
+	}
+}
+
+// context 返回使用 oidcStore 自己的 HTTP 客户端访问 IdP 的上下文
+func (st *oidcStore) context() context.Context {
+	return oidc.ClientContext(context.Background(), st.client)
+}
+
+// getProvider 在第一次使用时访问 IdP 的发现端点，失败后 oidcDiscoveryBackoff 内不再重试
+func (st *oidcStore) getProvider() (*oidc.Provider, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.provider != nil {
+		return st.provider, nil
+	}
+	if time.Since(st.lastFailed) < oidcDiscoveryBackoff {
+		return nil, fmt.Errorf("无法访问 IdP %s，请稍后再试", st.cfg.OIDC.Issuer)
+	}
+	provider, err := oidc.NewProvider(st.context(), st.cfg.OIDC.Issuer)
+	var discovery struct {
+		Issuer     string   `json:"issuer"`
+		JWKSURL    string   `json:"jwks_uri"`
+		Algorithms []string `json:"id_token_signing_alg_values_supported"`
+	}
+	if err == nil {
+		if err = provider.Claims(&discovery); err == nil && discovery.JWKSURL == "" {
+			err = errors.New("发现文档中没有 jwks_uri")
+		}
+	}
+	if err != nil {
+		st.lastFailed = time.Now()
+		st.logf("错误: OIDC 发现失败 (%s): %v", st.cfg.OIDC.Issuer, err)
+		return nil, fmt.Errorf("无法访问 IdP %s", st.cfg.OIDC.Issuer)
+	}
+	st.provider = provider
+	st.issuer = discovery.Issuer
+	st.algorithms = discovery.Algorithms
+	st.keySet = &jwksKeySet{url: discovery.JWKSURL, client: st.client, logf: st.logf}
+	return provider, nil
+}
+
+// verifier 返回使用 st.keySet 校验签名的 ID Token 校验器，必须在 getProvider 成功后调用。
+// 不使用 provider.Verifier：它的 RemoteKeySet 在每次签名校验失败时都会重新获取 JWKS
+func (st *oidcStore) verifier(config oidc.Config) *oidc.IDTokenVerifier {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if len(config.SupportedSigningAlgs) == 0 {
+		config.SupportedSigningAlgs = st.algorithms
+	}
+	return oidc.NewVerifier(st.issuer, st.keySet, &config)
+}
+
+func (st *oidcStore) oauth2Config(provider *oidc.Provider, redirectURL string) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     st.cfg.OIDC.ClientID,
+		ClientSecret: st.cfg.OIDC.ClientSecret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  redirectURL,
+		Scopes:       st.cfg.OIDC.Scopes,
+	}
+}
+
+// begin 创建一个进行中的登录，返回 state 和 IdP 的授权地址
+func (st *oidcStore) begin(redirectURL string, room string) (string, string, error) {
+	provider, err := st.getProvider()
+	if err != nil {
+		return "", "", err
+	}
+	state := base64.RawURLEncoding.EncodeToString(random_bytes(24))
+	p := &oidcPending{
+		verifier: oauth2.GenerateVerifier(),
+		nonce:    base64.RawURLEncoding.EncodeToString(random_bytes(24)),
+		room:     room,
+		redirect: redirectURL,
+		expires:  time.Now().Add(oidcLoginTTL),
+	}
+
+	st.mu.Lock()
+	now := time.Now()
+	for key, old := range st.pending {
+		if now.After(old.expires) {
+			delete(st.pending, key)
+		}
+	}
+	st.pending[state] = p
+	st.mu.Unlock()
+
+	authURL := st.oauth2Config(provider, redirectURL).AuthCodeURL(state, oauth2.S256ChallengeOption(p.verifier), oidc.Nonce(p.nonce))
+	return state, authURL, nil
+}
+
+// finish 用授权码换取 ID Token，校验签名、aud 和 nonce 后创建登录会话，返回会话令牌、用户和登录前的房间
+func (st *oidcStore) finish(state string, code string) (string, *OIDCIdentity, string, error) {
+	st.mu.Lock()
+	p, ok := st.pending[state]
+	delete(st.pending, state)
+	st.mu.Unlock()
+	if !ok || time.Now().After(p.expires) {
+		return "", nil, "", errOIDCState
+	}
+
+	provider, err := st.getProvider()
+	if err != nil {
+		return "", nil, "", err
+	}
+	ctx, cancel := context.WithTimeout(st.context(), oidcRequestTimeout)
+	defer cancel()
+	token, err := st.oauth2Config(provider, p.redirect).Exchange(ctx, code, oauth2.VerifierOption(p.verifier))
+	if err != nil {
+		return "", nil, "", fmt.Errorf("授权码兑换失败: %w", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok || rawIDToken == "" {
+		return "", nil, "", errors.New("IdP 没有返回 id_token")
+	}
+	idToken, err := st.verifier(oidc.Config{ClientID: st.cfg.OIDC.ClientID}).Verify(ctx, rawIDToken)
+	if err != nil {
+		return "", nil, "", fmt.Errorf("id_token 校验失败: %w", err)
+	}
+	if idToken.Nonce != p.nonce {
+		return "", nil, "", errors.New("id_token 的 nonce 不匹配")
+	}
+
+	var claims map[string]any
+	if err := idToken.Claims(&claims); err != nil {
+		return "", nil, "", fmt.Errorf("无法解析 id_token: %w", err)
+	}
+	id := st.identity(claims)
+	if !id.Admin && len(id.Rooms) == 0 {
+		return "", nil, "", errOIDCNoRooms
+	}
+
+	ttl := st.cfg.OIDC.SessionTTL
+	if ttl <= 0 {
+		ttl = defaultOIDCSessionTTL
+	}
+	id.Expires = time.Now().Add(time.Duration(ttl) * time.Second).Unix()
+	session := oidcSessionPrefix + base64.RawURLEncoding.EncodeToString(random_bytes(sessionTokenBytes))
+
+	st.mu.Lock()
+	now := time.Now().Unix()
+	for key, sess := range st.sessions {
+		if now >= sess.Expires {
+			delete(st.sessions, key)
+		}
+	}
+	st.sessions[hashSessionToken(session)] = id
+	st.mu.Unlock()
+	return session, id, p.room, nil
+}
+
+func (st *oidcStore) logout(token string) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	key := hashSessionToken(token)
+	if _, ok := st.sessions[key]; !ok {
+		return false
+	}
+	delete(st.sessions, key)
+	return true
+}
+
+// authenticate 返回登录会话令牌或 Bearer JWT 对应的用户
+func (st *oidcStore) authenticate(token string) (*OIDCIdentity, bool) {
+	if strings.HasPrefix(token, oidcSessionPrefix) {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		key := hashSessionToken(token)
+		id, ok := st.sessions[key]
+		if !ok {
+			return nil, false
+		}
+		if time.Now().Unix() >= id.Expires {
+			delete(st.sessions, key)
+			return nil, false
+		}
+		copied := *id
+		return &copied, true
+	}
+	if strings.Count(token, ".") == 2 {
+		return st.verifyJWT(token)
+	}
+	return nil, false
+}
+
+// verifyJWT 校验 API 调用携带的 JWT（IdP 签发的 ID Token 或 JWT 格式的 Access Token）：签名、issuer、过期时间和 aud。
+// 校验结果缓存到 JWT 过期，同一个请求中多次检查权限不会重复校验签名；校验失败的 JWT 缓存 oidcRejectedJWTTTL，期间直接拒绝
+func (st *oidcStore) verifyJWT(raw string) (*OIDCIdentity, bool) {
+	key := hashSessionToken(raw)
+	st.mu.Lock()
+	if id, ok := st.jwtCache.get(key); ok {
+		st.mu.Unlock()
+		copied := *id
+		return &copied, true
+	}
+	if _, ok := st.rejected.get(key); ok {
+		st.mu.Unlock()
+		return nil, false
+	}
+	st.mu.Unlock()
+
+	if _, err := st.getProvider(); err != nil {
+		return nil, false
+	}
+	ctx, cancel := context.WithTimeout(st.context(), oidcRequestTimeout)
+	defer cancel()
+	id, err := st.verifyJWTClaims(ctx, raw)
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if err != nil {
+		st.rejected.add(key, struct{}{}, oidcRejectedJWTTTL)
+		return nil, false
+	}
+	st.jwtCache.add(key, id, time.Until(time.Unix(id.Expires, 0)))
+	copied := *id
+	return &copied, true
+}
+
+// verifyJWTClaims 校验 JWT 的签名、issuer、过期时间和 aud，返回映射后的用户
+func (st *oidcStore) verifyJWTClaims(ctx context.Context, raw string) (*OIDCIdentity, error) {
+	token, err := st.verifier(oidc.Config{SkipClientIDCheck: true}).Verify(ctx, raw)
+	if err != nil {
+		return nil, err
+	}
+	audiences := st.cfg.OIDC.Audiences
+	if len(audiences) == 0 {
+		audiences = []string{st.cfg.OIDC.ClientID}
+	}
+	if !containsAny(token.Audience, audiences) {
+		return nil, errors.New("JWT 的 aud 不匹配")
+	}
+	var claims map[string]any
+	if err := token.Claims(&claims); err != nil {
+		return nil, err
+	}
+	id := st.identity(claims)
+	id.Expires = token.Expiry.Unix()
+	return id, nil
+}
+
+// oidcSigningAlgs 是 JWKS 中可以使用的签名算法（不接受 HMAC 和 none）
+var oidcSigningAlgs = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512, jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512, jose.EdDSA,
+}
+
+// jwksKeySet 缓存 IdP 的签名公钥。只有 JWT 的 kid 不在缓存中时才重新获取 jwks_uri，且两次获取至少间隔
+// oidcJWKSRefetch，伪造的 JWT 不能让服务端反复请求 IdP
+type jwksKeySet struct {
+	url    string
+	client *http.Client
+	logf   func(format string, v ...any)
+
+	mu        sync.Mutex
+	keys      []jose.JSONWebKey
+	lastFetch time.Time
+}
+
+// VerifySignature 实现 oidc.KeySet
+func (ks *jwksKeySet) VerifySignature(ctx context.Context, raw string) ([]byte, error) {
+	jws, err := jose.ParseSigned(raw, oidcSigningAlgs)
+	if err != nil {
+		return nil, fmt.Errorf("无法解析 JWT: %w", err)
+	}
+	keys := ks.keysFor(ctx, jws.Signatures[0].Header.KeyID)
+	for i := range keys {
+		if payload, err := jws.Verify(&keys[i]); err == nil {
+			return payload, nil
+		}
+	}
+	return nil, errors.New("JWT 签名无效")
+}
+
+// keysFor 返回 kid 对应的公钥（kid 为空时返回全部公钥）。缓存中没有时重新获取，距上次获取不足 oidcJWKSRefetch 时返回空
+func (ks *jwksKeySet) keysFor(ctx context.Context, kid string) []jose.JSONWebKey {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if keys := matchingJWKs(ks.keys, kid); len(keys) > 0 || time.Since(ks.lastFetch) < oidcJWKSRefetch {
+		return keys
+	}
+	ks.lastFetch = time.Now()
+	keys, err := ks.fetch(ctx)
+	if err != nil {
+		ks.logf("错误: 获取 OIDC 签名公钥失败 (%s): %v", ks.url, err)
+		return nil
+	}
+	ks.keys = keys
+	return matchingJWKs(keys, kid)
+}
+
+func (ks *jwksKeySet) fetch(ctx context.Context) ([]jose.JSONWebKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ks.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := ks.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %s", resp.Status)
+	}
+	var set jose.JSONWebKeySet
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxOIDCJWKSBytes)).Decode(&set); err != nil {
+		return nil, err
+	}
+	return set.Keys, nil
+}
+
+func matchingJWKs(keys []jose.JSONWebKey, kid string) []jose.JSONWebKey {
+	if kid == "" {
+		return keys
+	}
+	var matched []jose.JSONWebKey
+	for _, key := range keys {
+		if key.KeyID == kid {
+			matched = append(matched, key)
+		}
+	}
+	return matched
+}
+
+// identity 按配置把 claims 映射为用户名、用户组和可以访问的房间
+func (st *oidcStore) identity(claims map[string]any) *OIDCIdentity {
+	cfg := st.cfg.OIDC
+	id := &OIDCIdentity{}
+	id.Subject, _ = claims["sub"].(string)
+	id.Email, _ = claims["email"].(string)
+	for _, name := range []string{cfg.UsernameClaim, "email", "sub"} {
+		if values := claimStrings(claims, name); name != "" && len(values) > 0 && values[0] != "" {
+			id.Name = values[0]
+			break
+		}
+	}
+	if cfg.GroupsClaim != "" {
+		id.Groups = claimStrings(claims, cfg.GroupsClaim)
+	}
+
+	rooms := append([]string{}, cfg.DefaultRooms...)
+	if cfg.RoomsClaim != "" {
+		rooms = append(rooms, claimStrings(claims, cfg.RoomsClaim)...)
+	}
+	for _, group := range id.Groups {
+		rooms = append(rooms, cfg.GroupRooms[group]...)
+	}
+	id.Rooms = normalizeUserRooms(rooms)
+	id.Admin = containsAny(id.Groups, cfg.AdminGroups)
+	return id
+}
+
+// claimStrings 读取 claim 的值（字符串、字符串数组或空格分隔的字符串），path 可以是 realm_access.roles 这样的嵌套路径
+func claimStrings(claims map[string]any, path string) []string {
+	var value any = claims
+	for _, part := range strings.Split(path, ".") {
+		m, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		if value, ok = m[part]; !ok {
+			return nil
+		}
+	}
+	switch v := value.(type) {
+	case string:
+		return strings.Fields(v)
+	case []any:
+		var values []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func containsAny(values []string, candidates []string) bool {
+	for _, v := range values {
+		for _, c := range candidates {
+			if v == c {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// oidcUser 返回 token 对应的 OIDC 用户，未启用 OIDC 或 token 无效时返回 false
+func (s *ClipboardServer) oidcUser(token string) (*OIDCIdentity, bool) {
+	if s.oidc == nil || token == "" {
+		return nil, false
+	}
+	return s.oidc.authenticate(token)
+}
+
+// sessionCookieToken 返回请求携带的登录会话 Cookie
+func sessionCookieToken(r *http.Request) string {
+	if c, err := r.Cookie(oidcSessionCookie); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+// oidcRedirectURL 返回回调地址：配置的 redirectUrl，或按请求（经过 trustedProxies 解析）生成
+func (s *ClipboardServer) oidcRedirectURL(r *http.Request) string {
+	if s.config.OIDC.RedirectURL != "" {
+		return s.config.OIDC.RedirectURL
+	}
+	return fmt.Sprintf("%s://%s%s/oidc/callback", getScheme(r), r.Host, s.config.Server.Prefix)
+}
+
+func (s *ClipboardServer) cookiePath() string {
+	if s.config.Server.Prefix == "" {
+		return "/"
+	}
+	return s.config.Server.Prefix + "/"
+}
+
+// handleOIDC 处理 /oidc/login、/oidc/callback、/oidc/logout 和 /oidc/me
+func (s *ClipboardServer) handleOIDC(w http.ResponseWriter, r *http.Request) {
+	if s.oidc == nil {
+		writeAuthJSONError(w, http.StatusNotFound, errOIDCDisabled.Error())
+		return
+	}
+
+	switch strings.TrimPrefix(r.URL.Path, s.config.Server.Prefix+"/oidc/") {
+	case "login":
+		s.handleOIDCLogin(w, r)
+	case "callback":
+		s.handleOIDCCallback(w, r)
+	case "logout":
+		if r.Method != http.MethodPost {
+			http.Error(w, "仅允许 POST 请求", http.StatusMethodNotAllowed)
+			return
+		}
+		for _, token := range []string{extractAuthToken(r), sessionCookieToken(r)} {
+			if strings.HasPrefix(token, oidcSessionPrefix) {
+				s.oidc.logout(token)
+			}
+		}
+		http.SetCookie(w, &http.Cookie{Name: oidcSessionCookie, Value: "", Path: s.cookiePath(), MaxAge: -1, HttpOnly: true, SameSite: http.SameSiteStrictMode})
+		w.WriteHeader(http.StatusNoContent)
+	case "me":
+		id, ok := s.oidcUser(extractAuthToken(r))
+		if !ok {
+			id, ok = s.oidcUser(sessionCookieToken(r))
+		}
+		if !ok {
+			writeAuthJSONError(w, http.StatusUnauthorized, "未登录")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(id)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleOIDCLogin 处理 GET /oidc/login?room=xxx：生成 state、nonce 和 PKCE verifier，跳转到 IdP 的授权页面。
+// state 同时写入只在回调路径上发送的 Cookie，回调时必须一致，防止把别人的登录结果注入当前浏览器
+func (s *ClipboardServer) handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "仅允许 GET 请求", http.StatusMethodNotAllowed)
+		return
+	}
+	room := normalizeRoomName(r.URL.Query().Get("room"))
+	state, authURL, err := s.oidc.begin(s.oidcRedirectURL(r), room)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     s.config.Server.Prefix + "/oidc/",
+		MaxAge:   int(oidcLoginTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   getScheme(r) == "https",
+		SameSite: http.SameSiteLaxMode, // IdP 跳转回来是跨站的顶级导航
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// handleOIDCCallback 处理 IdP 的回调：兑换授权码、校验 id_token，设置会话 Cookie 后返回登录前的房间
+func (s *ClipboardServer) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	clientIP := get_remote_ip(r)
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Value: "", Path: s.config.Server.Prefix + "/oidc/", MaxAge: -1, HttpOnly: true})
+
+	if errCode := query.Get("error"); errCode != "" {
+		s.logger.Printf("OIDC 登录失败: IdP 返回错误 %s (%s)，来自 IP: %s", errCode, query.Get("error_description"), clientIP)
+		http.Error(w, "登录失败: "+errCode, http.StatusUnauthorized)
+		return
+	}
+	state := query.Get("state")
+	if c, err := r.Cookie(oidcStateCookie); err != nil || state == "" || c.Value != state {
+		s.logger.Printf("OIDC 登录失败: state 不匹配，来自 IP: %s", clientIP)
+		http.Error(w, errOIDCState.Error(), http.StatusBadRequest)
+		return
+	}
+
+	session, id, room, err := s.oidc.finish(state, query.Get("code"))
+	if err != nil {
+		s.logger.Printf("OIDC 登录失败: %v，来自 IP: %s", err, clientIP)
+		status := http.StatusUnauthorized
+		if errors.Is(err, errOIDCState) {
+			status = http.StatusBadRequest
+		} else if errors.Is(err, errOIDCNoRooms) {
+			status = http.StatusForbidden
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	s.logger.Printf("OIDC 登录成功: 用户 [%s] (sub: %s)，房间: %s，来自 IP: %s", id.Name, id.Subject, strings.Join(id.Rooms, ","), clientIP)
+	s.recordAuditToken(r, session, auditAuthLogin, "", id.Name, map[string]any{"method": "oidc", "subject": id.Subject, "rooms": id.Rooms, "admin": id.Admin})
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcSessionCookie,
+		Value:    session,
+		Path:     s.cookiePath(),
+		Expires:  time.Unix(id.Expires, 0),
+		HttpOnly: true,
+		Secure:   getScheme(r) == "https",
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	target := s.cookiePath() + "#/"
+	if room != "" && id.canAccessRoom(room) {
+		target += "?room=" + url.QueryEscape(room)
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// oidcInfo 返回 /server 中的 OIDC 登录信息，未启用时返回 nil
+func (s *ClipboardServer) oidcInfo(r *http.Request) map[string]interface{} {
+	if s.oidc == nil {
+		return nil
+	}
+	info := map[string]interface{}{"login": s.config.Server.Prefix + "/oidc/login"}
+	if id, ok := s.oidcUser(sessionCookieToken(r)); ok {
+		rooms := append([]string{}, id.Rooms...)
+		sort.Strings(rooms)
+		info["user"] = map[string]interface{}{"name": id.Name, "rooms": rooms, "admin": id.Admin}
+	}
+	return info
+}
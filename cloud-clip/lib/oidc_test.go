@@ -0,0 +1,183 @@
+package lib
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+)
+
+// mockOIDCProvider 是只提供发现文档和 JWKS 的 IdP，记录 JWKS 被请求的次数
+type mockOIDCProvider struct {
+	*httptest.Server
+	jwksFetches atomic.Int32
+
+	mu   sync.Mutex
+	keys map[string]*rsa.PrivateKey // kid -> 私钥，全部发布在 JWKS 中
+}
+
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	t.Helper()
+	p := &mockOIDCProvider{keys: make(map[string]*rsa.PrivateKey)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                p.URL,
+			"authorization_endpoint":                p.URL + "/authorize",
+			"token_endpoint":                        p.URL + "/token",
+			"jwks_uri":                              p.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		p.jwksFetches.Add(1)
+		p.mu.Lock()
+		set := jose.JSONWebKeySet{}
+		for kid, key := range p.keys {
+			set.Keys = append(set.Keys, jose.JSONWebKey{Key: &key.PublicKey, KeyID: kid, Algorithm: "RS256", Use: "sig"})
+		}
+		p.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(set)
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+func newTestRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("生成 RSA 密钥: %v", err)
+	}
+	return key
+}
+
+// publish 在 JWKS 中发布 kid 对应的公钥
+func (p *mockOIDCProvider) publish(kid string, key *rsa.PrivateKey) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys[kid] = key
+}
+
+// sign 用 key 签发 JWT，header 中的 kid 为 kid
+func (p *mockOIDCProvider) sign(t *testing.T, kid string, key *rsa.PrivateKey, claims map[string]any) string {
+	t.Helper()
+	base := map[string]any{
+		"iss": p.URL,
+		"sub": "alice-id",
+		"aud": "cloud-clip",
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"iat": time.Now().Unix(),
+	}
+	for k, v := range claims {
+		base[k] = v
+	}
+	payload, _ := json.Marshal(base)
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: jose.JSONWebKey{Key: key, KeyID: kid}}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		t.Fatalf("创建签名器: %v", err)
+	}
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		t.Fatalf("签名: %v", err)
+	}
+	raw, err := jws.CompactSerialize()
+	if err != nil {
+		t.Fatalf("序列化 JWT: %v", err)
+	}
+	return raw
+}
+
+func TestOIDCBearerJWT(t *testing.T) {
+	idp := newMockOIDCProvider(t)
+	key := newTestRSAKey(t)
+	idp.publish("k1", key)
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.OIDC.Enable = true
+		cfg.OIDC.Issuer = idp.URL
+		cfg.OIDC.ClientID = "cloud-clip"
+		cfg.OIDC.GroupsClaim = "groups"
+		cfg.OIDC.GroupRooms = map[string][]string{"dev": {"work"}}
+	})
+	me := func(token string) int {
+		return do(t, s, http.MethodGet, "/oidc/me", "", "Authorization", "Bearer "+token).Code
+	}
+	expectFetches := func(want int32) {
+		t.Helper()
+		if got := idp.jwksFetches.Load(); got != want {
+			t.Fatalf("JWKS 请求次数 = %d，期望 %d", got, want)
+		}
+	}
+
+	valid := idp.sign(t, "k1", key, map[string]any{"groups": []string{"dev"}})
+	rec := do(t, s, http.MethodGet, "/oidc/me", "", "Authorization", "Bearer "+valid)
+	expectStatus(t, rec, http.StatusOK)
+	var id OIDCIdentity
+	decodeJSON(t, rec, &id)
+	if id.Subject != "alice-id" || len(id.Rooms) != 1 || id.Rooms[0] != "work" {
+		t.Fatalf("用户 = %+v", id)
+	}
+	if code := me(valid); code != http.StatusOK {
+		t.Fatalf("缓存的 JWT，状态码 = %d", code)
+	}
+	expectFetches(1)
+
+	t.Run("伪造签名不会重新获取公钥", func(t *testing.T) {
+		forged := idp.sign(t, "k1", newTestRSAKey(t), nil)
+		for i := 0; i < 3; i++ {
+			if code := me(forged); code != http.StatusUnauthorized {
+				t.Fatalf("伪造的 JWT，状态码 = %d", code)
+			}
+		}
+		expectFetches(1)
+		s.oidc.mu.Lock()
+		_, cached := s.oidc.rejected.get(hashSessionToken(forged))
+		s.oidc.mu.Unlock()
+		if !cached {
+			t.Fatal("校验失败的 JWT 应被缓存")
+		}
+	})
+
+	t.Run("aud 不匹配", func(t *testing.T) {
+		if code := me(idp.sign(t, "k1", key, map[string]any{"aud": "other"})); code != http.StatusUnauthorized {
+			t.Fatalf("aud 不匹配，状态码 = %d", code)
+		}
+	})
+
+	t.Run("未知 kid 限制重新获取的频率", func(t *testing.T) {
+		stranger := newTestRSAKey(t)
+		for i := 0; i < 5; i++ {
+			if code := me(idp.sign(t, "unknown", stranger, map[string]any{"jti": i})); code != http.StatusUnauthorized {
+				t.Fatalf("未知 kid，状态码 = %d", code)
+			}
+		}
+		expectFetches(1)
+	})
+
+	t.Run("密钥轮换", func(t *testing.T) {
+		rotated := newTestRSAKey(t)
+		idp.publish("k2", rotated)
+		s.oidc.keySet.mu.Lock()
+		s.oidc.keySet.lastFetch = time.Now().Add(-oidcJWKSRefetch)
+		s.oidc.keySet.mu.Unlock()
+
+		if code := me(idp.sign(t, "k2", rotated, nil)); code != http.StatusOK {
+			t.Fatalf("新密钥签发的 JWT，状态码 = %d", code)
+		}
+		expectFetches(2)
+		if code := me(idp.sign(t, "k3", newTestRSAKey(t), nil)); code != http.StatusUnauthorized {
+			t.Fatalf("未知 kid，状态码 = %d", code)
+		}
+		expectFetches(2)
+	})
+}
@@ -0,0 +1,113 @@
+package lib
+
+/**
+*** FILE: overflow.go
+***   store text over text.limit as a file message (text.overflow)
+**/
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var errTextTooLarge = errors.New("文本内容超出限制")
+
+// overflowPreviewRunes 文件消息中保留的文本预览长度（字符数）
+const overflowPreviewRunes = 200
+
+// overflowFileName 生成转存文件的文件名。始终使用 .txt：文件按扩展名推断 Content-Type 并内联显示，
+// 按内容推断为 .html 等扩展名会让发送的文本在应用的源下作为页面执行
+func overflowFileName(timestamp int64) string {
+	return fmt.Sprintf("text-%s.txt", time.Unix(timestamp, 0).Format("20060102-150405"))
+}
+
+// textPreview 截取文本开头作为预览，敏感内容会被遮盖
+func (s *ClipboardServer) textPreview(text string) string {
+	runes := []rune(text)
+	if len(runes) > overflowPreviewRunes {
+		text = string(runes[:overflowPreviewRunes]) + "..."
+	}
+	return s.logText(text)
+}
+
+// postText 发送文本消息：超出 text.limit 时按 text.overflow 转存为文件，否则与最近的重复消息合并或新增消息
+func (s *ClipboardServer) postText(text string, room string, opts messageOptions, r *http.Request) (PostEvent, error) {
+	if limit := s.config.Text.Limit; limit > 0 && len(text) > limit {
+		fitsFile := s.config.File.Limit <= 0 || len(text) <= s.config.File.Limit
+		if !s.config.Text.Overflow || !fitsFile {
+			s.logger.Printf("错误: 文本内容超出限制 (%d > %d)", len(text), limit)
+			return PostEvent{}, fmt.Errorf("%w (最大 %d 字符)", errTextTooLarge, limit)
+		}
+		return s.storeTextAsFile(text, room, opts, r)
+	}
+
+	if opts.To != "" {
+		s.logger.Printf("收到私信文本消息 (房间: %s, 目标设备: %s): %s", room, opts.To, s.logText(text))
+	} else {
+		s.logger.Printf("收到文本消息 (房间: %s): %s", room, s.logText(text))
+	}
+	event, deduped := s.dedupRecentText(room, opts, text)
+	if !deduped {
+		event = s.addMessageToQueueAndBroadcast("text", text, room, opts, r)
+	}
+	return event, nil
+}
+
+// storeTextAsFile 将超长文本按上传文件的流程保存为文件消息
+func (s *ClipboardServer) storeTextAsFile(text string, room string, opts messageOptions, r *http.Request) (PostEvent, error) {
+	timestamp := time.Now().Unix()
+	expireTime := timestamp + int64(s.config.File.Expire)
+	fileName := overflowFileName(timestamp)
+
+	sum := sha256.Sum256([]byte(text))
+	digest := hex.EncodeToString(sum[:])
+
+	// 与房间最新文件内容相同时合并
+	if event, deduped := s.dedupRecentFile(room, opts, digest, expireTime); deduped {
+		return event, nil
+	}
+
+	// 敏感内容检测使用完整文本，命中的文件与敏感文本一样需要 reveal 才能获取原文，并按 sensitive.ttl 自动撤销
+	fileReceiveData := &FileReceive{
+		Name:    fileName,
+		Size:    int64(len(text)),
+		Expire:  expireTime,
+		Digest:  digest,
+		Preview: s.textPreview(text),
+	}
+	s.markSensitiveFile(fileReceiveData, text)
+	if fileReceiveData.ExpireAt > 0 && fileReceiveData.ExpireAt < expireTime {
+		expireTime = fileReceiveData.ExpireAt
+		fileReceiveData.Expire = expireTime
+	}
+
+	uuid := gen_UUID()
+	filePath := filepath.Join(s.storageFolder, uuid)
+	if err := os.WriteFile(filePath, []byte(text), 0644); err != nil {
+		return PostEvent{}, fmt.Errorf("写入文件 %s 失败: %w", filePath, err)
+	}
+
+	s.runMutex.Lock() // 保护 uploadFileMap
+	s.uploadFileMap[uuid] = File{
+		Name:       fileName,
+		UUID:       uuid,
+		Size:       int64(len(text)),
+		UploadTime: timestamp,
+		ExpireTime: expireTime,
+		Room:       room,
+		Sensitive:  fileReceiveData.Sensitive,
+	}
+	s.runMutex.Unlock()
+
+	fileReceiveData.Cache = uuid
+	fileReceiveData.URL = fmt.Sprintf("%s://%s%s/file/%s", getScheme(r), r.Host, s.config.Server.Prefix, uuid)
+
+	s.logger.Printf("文本超出长度限制 (%d > %d)，已转存为文件: %s (UUID: %s, 房间: %s)", len(text), s.config.Text.Limit, fileName, uuid, room)
+	return s.addMessageToQueueAndBroadcast("file", fileReceiveData, room, opts, r), nil
+}
@@ -0,0 +1,443 @@
+package lib
+
+/**
+*** FILE: pairing.go
+***   device pairing: short-lived one-time codes (+ server-rendered QR PNG), /pair redeem issues a device-bound token
+**/
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+const (
+	defaultPairCodeTTL = 300 // 默认配对码有效期（秒）
+	pairCodeLen        = 8
+	pairQRSize         = 256 // 二维码图片边长（像素）
+
+	maxPairCodesPerCreator = 5    // 每个创建者最多同时持有的待兑换配对码
+	maxPairCodes           = 1000 // 内存中最多保存的待兑换配对码
+)
+
+var (
+	errTooManyPairCodes = errors.New("待兑换的配对码过多，请先使用或等待已生成的配对码过期")
+	errPairCodesFull    = errors.New("配对码数量已达上限，请稍后再试")
+)
+
+// 配对码字符集：去掉容易混淆的 0/O、1/I，正好 32 个字符
+const pairCodeAlphabet = "23456789ABCDEFGHJKLMNPQRSTUVWXYZ"
+
+// 配对设备获得的权限：除 admin 外的全部权限（不能再生成配对码或管理令牌）
+var pairedDeviceScopes = []string{scopeRead, scopePostText, scopeUpload, scopeRevoke}
+
+// pairCode 是一个待兑换的配对码
+type pairCode struct {
+	Room      string
+	URL       string // 新设备打开的配对链接（二维码内容）
+	Expires   int64
+	CreatedBy string
+}
+
+// pairingStore 在内存中保存待兑换的配对码，配对码兑换一次或过期后删除
+type pairingStore struct {
+	mu    sync.Mutex
+	codes map[string]*pairCode
+}
+
+func newPairingStore() *pairingStore {
+	return &pairingStore{codes: make(map[string]*pairCode)}
+}
+
+// PairCodeResponse POST /pair/code 响应结构体
+type PairCodeResponse struct {
+	Code      string `json:"code"`
+	Room      string `json:"room"`
+	ExpiresAt int64  `json:"expiresAt"`
+	URL       string `json:"url"` // 配对链接，新设备打开后自动兑换
+	QR        string `json:"qr"`  // 配对链接的二维码 PNG 地址
+}
+
+// PairResponse POST /pair 响应结构体
+type PairResponse struct {
+	Token     string `json:"token"`
+	TokenID   string `json:"tokenId"`
+	Room      string `json:"room"`
+	DeviceID  string `json:"deviceId"`
+	Secret    string `json:"deviceSecret,omitempty"` // 为新设备注册时返回设备密钥（只返回一次）
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+// newPairCode 生成随机配对码（256 是 32 的倍数，取模没有偏差）
+func newPairCode() string {
+	code := random_bytes(pairCodeLen)
+	for i, b := range code {
+		code[i] = pairCodeAlphabet[int(b)%len(pairCodeAlphabet)]
+	}
+	return string(code)
+}
+
+// add 保存待兑换的配对码，同一创建者或全部的待兑换配对码超过上限时返回错误
+func (p *pairingStore) add(code string, pc pairCode) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pruneLocked(time.Now().Unix())
+	if len(p.codes) >= maxPairCodes {
+		return errPairCodesFull
+	}
+	outstanding := 0
+	for _, existing := range p.codes {
+		if existing.CreatedBy == pc.CreatedBy {
+			outstanding++
+		}
+	}
+	if outstanding >= maxPairCodesPerCreator {
+		return errTooManyPairCodes
+	}
+	p.codes[code] = &pc
+	return nil
+}
+
+// get 返回未过期的配对码，不消耗配对码
+func (p *pairingStore) get(code string) (pairCode, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pruneLocked(time.Now().Unix())
+	pc, ok := p.codes[code]
+	if !ok {
+		return pairCode{}, false
+	}
+	return *pc, true
+}
+
+// redeem 兑换配对码，配对码只能使用一次
+func (p *pairingStore) redeem(code string) (pairCode, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pruneLocked(time.Now().Unix())
+	pc, ok := p.codes[code]
+	if !ok {
+		return pairCode{}, false
+	}
+	delete(p.codes, code)
+	return *pc, true
+}
+
+func (p *pairingStore) pruneLocked(now int64) {
+	for code, pc := range p.codes {
+		if now >= pc.Expires {
+			delete(p.codes, code)
+		}
+	}
+}
+
+// normalizePairCode 去掉分隔符和空白并转换为大写，"abcd-efgh" 和 "ABCDEFGH" 是同一个配对码
+func normalizePairCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(strings.TrimSpace(code)))
+}
+
+// formatPairCode 将配对码格式化为 ABCD-EFGH，方便手动输入
+func formatPairCode(code string) string {
+	if len(code) != pairCodeLen {
+		return code
+	}
+	return code[:pairCodeLen/2] + "-" + code[pairCodeLen/2:]
+}
+
+// requester 返回请求者的描述：登录用户名、API 令牌 ID、设备ID，都没有时为 IP
+func (s *ClipboardServer) requester(r *http.Request) string {
+	token := extractAuthToken(r)
+	if u, ok := s.sessionUser(token); ok {
+		return u.Name
+	}
+	if id, ok := s.oidcUser(token); ok {
+		return id.Name
+	}
+	if t, ok := s.apiToken(token); ok {
+		return "token:" + t.ID
+	}
+	if deviceID := s.requestDeviceID(r); deviceID != "" {
+		return "device:" + deviceID
+	}
+	return get_remote_ip(r)
+}
+
+// livePairings 过滤掉令牌已被撤销或已过期的配对记录
+func (s *ClipboardServer) livePairings(pairings []DevicePairing) []DevicePairing {
+	var live []DevicePairing
+	for _, p := range pairings {
+		if s.tokens.has(p.TokenID) {
+			live = append(live, p)
+		}
+	}
+	return live
+}
+
+// handlePairCode 处理 POST /pair/code?room=xxx：已授权的设备为房间生成一次性配对码。
+// 受保护房间的认证由 authMiddleware 完成；不受保护的房间也需要登录会话、API 令牌或全局密码，否则任何人都能签发绑定设备的令牌
+func (s *ClipboardServer) handlePairCode(w http.ResponseWriter, r *http.Request) {
+	if !s.config.Pairing.Enable {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "仅允许 POST 请求", http.StatusMethodNotAllowed)
+		return
+	}
+
+	room := normalizeRoomName(r.URL.Query().Get("room"))
+	if !s.resolveRoomAuth(room).Required && !s.tokenMatchesRoom(room, requestRoomToken(r, room)) {
+		s.logger.Printf("认证失败: 生成配对码需要认证。来自 IP: %s, 房间: %s", get_remote_ip(r), room)
+		s.authFailed(r)
+		writeAuthJSONError(w, http.StatusUnauthorized, "生成配对码需要登录、API 令牌或全局密码")
+		return
+	}
+	ttl := s.config.Pairing.CodeTTL
+	if ttl <= 0 {
+		ttl = defaultPairCodeTTL
+	}
+
+	// 配对链接在生成时确定，二维码接口直接使用
+	code := newPairCode()
+	base := fmt.Sprintf("%s://%s%s", getScheme(r), r.Host, s.config.Server.Prefix)
+	query := url.Values{}
+	if room != "default" {
+		query.Set("room", room)
+	}
+	query.Set("pair", code)
+	pc := pairCode{
+		Room:      room,
+		URL:       fmt.Sprintf("%s/#/?%s", base, query.Encode()),
+		Expires:   time.Now().Add(time.Duration(ttl) * time.Second).Unix(),
+		CreatedBy: s.requester(r),
+	}
+	if err := s.pairings.add(code, pc); errors.Is(err, errTooManyPairCodes) {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	s.logger.Printf("生成配对码，房间: %s，创建者: %s，来自 IP: %s", room, pc.CreatedBy, get_remote_ip(r))
+	s.recordAudit(r, auditPairCode, room, "", map[string]any{"expiresAt": pc.Expires})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(PairCodeResponse{
+		Code:      formatPairCode(code),
+		Room:      room,
+		ExpiresAt: pc.Expires,
+		URL:       pc.URL,
+		QR:        fmt.Sprintf("%s/pair/qr/%s.png", base, code),
+	})
+}
+
+// handlePairQR 处理 GET /pair/qr/{code}.png：返回配对链接的二维码。配对码本身就是凭据，不需要额外认证
+func (s *ClipboardServer) handlePairQR(w http.ResponseWriter, r *http.Request) {
+	if !s.config.Pairing.Enable {
+		http.NotFound(w, r)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, s.config.Server.Prefix+"/pair/qr/")
+	pc, ok := s.pairings.get(normalizePairCode(strings.TrimSuffix(name, ".png")))
+	if !ok {
+		http.Error(w, "配对码无效或已过期", http.StatusNotFound)
+		return
+	}
+
+	png, err := qrcode.Encode(pc.URL, qrcode.Medium, pairQRSize)
+	if err != nil {
+		s.logger.Printf("错误: 生成配对二维码失败: %v", err)
+		http.Error(w, "生成二维码失败", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(png)
+}
+
+// handlePair 处理 POST /pair：新设备兑换配对码，获得绑定到该设备、只能访问该房间的令牌。
+// 令牌绑定到请求携带的已注册设备，没有时为新设备注册设备ID和密钥（通过 cc_device Cookie 和响应返回）
+func (s *ClipboardServer) handlePair(w http.ResponseWriter, r *http.Request) {
+	if !s.config.Pairing.Enable {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Device-Id, X-Device-Secret, X-Device-Name")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "仅允许 POST 请求", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		Code       string `json:"code"`
+		DeviceName string `json:"deviceName"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&body); err != nil {
+		http.Error(w, "无效的请求体", http.StatusBadRequest)
+		return
+	}
+
+	clientIP := get_remote_ip(r)
+	pc, ok := s.pairings.redeem(normalizePairCode(body.Code))
+	if !ok {
+		s.logger.Printf("配对失败: 配对码无效或已过期。来自 IP: %s", clientIP)
+		s.authFailed(r)
+		http.Error(w, "配对码无效或已过期", http.StatusBadRequest)
+		return
+	}
+	deviceName := normalizeDeviceName(body.DeviceName)
+	if deviceName == "" {
+		deviceName = clientDeviceName(r)
+	}
+
+	// 设备ID只能由服务端签发：已注册的设备使用原来的ID，否则注册新设备
+	var deviceSecret string
+	rec, registered := s.requestDevice(r)
+	if registered {
+		var err error
+		if rec, err = s.devices.touch(s.parseDeviceMeta(rec.ID, r.UserAgent()), deviceName, clientIP); err != nil {
+			s.logger.Printf("警告: 保存设备注册表失败: %v", err)
+		}
+	} else {
+		var err error
+		if rec, deviceSecret, err = s.registerDevice(w, r, deviceName); errors.Is(err, errDeviceRegistryFull) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		} else if err != nil {
+			s.logger.Printf("错误: 保存设备注册表失败: %v", err)
+			http.Error(w, "注册设备失败", http.StatusInternalServerError)
+			return
+		}
+	}
+	deviceID := rec.ID
+
+	var expires int64
+	if s.config.Pairing.TokenTTL > 0 {
+		expires = time.Now().Add(time.Duration(s.config.Pairing.TokenTTL) * time.Second).Unix()
+	}
+	label := rec.Name
+	if label == "" {
+		label = deviceID
+	}
+
+	// 重新配对时替换该设备在房间中原有的令牌
+	if _, err := s.tokens.revokeDevice(deviceID, pc.Room); err != nil {
+		s.logger.Printf("警告: 保存 API 令牌存储失败: %v", err)
+	}
+	info, err := s.tokens.create("配对设备 "+label, pairedDeviceScopes, []string{pc.Room}, expires, pc.CreatedBy, deviceID)
+	if err != nil {
+		s.logger.Printf("错误: 保存 API 令牌存储失败: %v", err)
+		http.Error(w, "保存令牌失败", http.StatusInternalServerError)
+		return
+	}
+	if err := s.devices.addPairing(deviceID, DevicePairing{
+		TokenID:   info.ID,
+		Room:      pc.Room,
+		Created:   info.Created,
+		Expires:   info.Expires,
+		CreatedBy: pc.CreatedBy,
+	}); err != nil {
+		s.logger.Printf("警告: 保存设备注册表失败: %v", err)
+	}
+	s.logger.Printf("设备 %s [%s] 配对成功，房间: %s，令牌: %s，来自 IP: %s", deviceID, rec.Name, pc.Room, info.ID, clientIP)
+	s.recordAuditToken(r, info.Token, auditDevicePair, pc.Room, deviceID, map[string]any{"codeCreatedBy": pc.CreatedBy})
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(PairResponse{
+		Token:     info.Token,
+		TokenID:   info.ID,
+		Room:      pc.Room,
+		DeviceID:  deviceID,
+		Secret:    deviceSecret,
+		ExpiresAt: info.Expires,
+	})
+}
+
+// handleDeviceUnpair 处理 DELETE /devices/{id}/pairings?room=xxx：撤销设备在房间中的配对令牌，并断开该设备使用这些令牌的连接
+func (s *ClipboardServer) handleDeviceUnpair(w http.ResponseWriter, r *http.Request, deviceID string) {
+	room := normalizeRoomName(r.URL.Query().Get("room"))
+
+	removed, err := s.devices.removePairings(deviceID, room)
+	if err == errDeviceNotFound {
+		http.Error(w, "设备未找到", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.logger.Printf("警告: 保存设备注册表失败: %v", err)
+	}
+	revoked, err := s.tokens.revokeDevice(deviceID, room)
+	if err != nil {
+		s.logger.Printf("错误: 保存 API 令牌存储失败: %v", err)
+		http.Error(w, "撤销令牌失败", http.StatusInternalServerError)
+		return
+	}
+	if len(removed) == 0 && len(revoked) == 0 {
+		http.Error(w, "设备没有与该房间配对", http.StatusNotFound)
+		return
+	}
+	s.logger.Printf("撤销设备 %s 在房间 %s 的配对，令牌: %s，操作者: %s", deviceID, room, strings.Join(revoked, ","), s.requester(r))
+	s.recordAudit(r, auditDeviceUnpair, room, deviceID, map[string]any{"tokens": revoked})
+
+	s.closeRevokedConnections(deviceID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// closeRevokedConnections 关闭设备使用已失效 API 令牌加入房间的 WebSocket 连接，连接的清理由读循环完成
+func (s *ClipboardServer) closeRevokedConnections(deviceID string) {
+	// 第一步：在锁内收集设备的连接和使用的 API 令牌
+	candidates := make(map[*websocket.Conn][]string)
+	s.runMutex.Lock()
+	for conn, id := range s.connDeviceIDMap {
+		if id != deviceID {
+			continue
+		}
+		for _, token := range s.room_ws[conn] {
+			if strings.HasPrefix(token, apiTokenPrefix) {
+				candidates[conn] = append(candidates[conn], token)
+			}
+		}
+	}
+	s.runMutex.Unlock()
+
+	// 第二步：在锁外检查令牌（令牌存储有自己的锁）
+	var stale []*websocket.Conn
+	for conn, tokens := range candidates {
+		for _, token := range tokens {
+			if _, ok := s.apiToken(token); !ok {
+				stale = append(stale, conn)
+				break
+			}
+		}
+	}
+
+	// 第三步：关闭连接
+	for _, conn := range stale {
+		conn.Close()
+	}
+}
@@ -0,0 +1,71 @@
+package lib
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newPairingTestServer(t *testing.T) *ClipboardServer {
+	t.Helper()
+	return newTestServer(t, func(cfg *Config) {
+		cfg.Pairing.Enable = true
+	})
+}
+
+func TestPairCodeRequiresAuthInUnprotectedRoom(t *testing.T) {
+	s := newPairingTestServer(t)
+	expectStatus(t, do(t, s, http.MethodPost, "/pair/code", ""), http.StatusUnauthorized)
+	expectStatus(t, do(t, s, http.MethodPost, "/pair/code", "", "Authorization", "Bearer wrong"), http.StatusUnauthorized)
+
+	created, err := s.tokens.create("pairing", []string{scopeAdmin}, nil, 0, "test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := do(t, s, http.MethodPost, "/pair/code", "", "Authorization", "Bearer "+created.Token)
+	expectStatus(t, rec, http.StatusCreated)
+	var resp PairCodeResponse
+	decodeJSON(t, rec, &resp)
+	if resp.Room != "default" || resp.Code == "" {
+		t.Fatalf("响应 = %+v", resp)
+	}
+}
+
+func TestPairCodeLimits(t *testing.T) {
+	s := newPairingTestServer(t)
+	tokenFor := func(name string) string {
+		created, err := s.tokens.create(name, []string{scopeAdmin}, nil, 0, "test", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return created.Token
+	}
+	first, second := tokenFor("first"), tokenFor("second")
+	generate := func(token string) int {
+		return do(t, s, http.MethodPost, "/pair/code", "", "Authorization", "Bearer "+token).Code
+	}
+
+	for i := 0; i < maxPairCodesPerCreator; i++ {
+		if code := generate(first); code != http.StatusCreated {
+			t.Fatalf("第 %d 个配对码，状态码 = %d", i+1, code)
+		}
+	}
+	if code := generate(first); code != http.StatusTooManyRequests {
+		t.Fatalf("超过每个创建者的上限，状态码 = %d", code)
+	}
+	if code := generate(second); code != http.StatusCreated {
+		t.Fatalf("其他创建者，状态码 = %d", code)
+	}
+
+	// 填满全部配对码
+	expires := time.Now().Add(time.Minute).Unix()
+	for i := 0; len(s.pairings.codes) < maxPairCodes; i++ {
+		if err := s.pairings.add("filler-"+strconv.Itoa(i), pairCode{Room: "default", Expires: expires, CreatedBy: "filler-" + strconv.Itoa(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if code := generate(second); code != http.StatusServiceUnavailable {
+		t.Fatalf("配对码已满，状态码 = %d", code)
+	}
+}
@@ -0,0 +1,408 @@
+package lib
+
+/**
+*** FILE: proxy.go
+***   trusted reverse proxies: client IP / scheme / host from X-Forwarded-* and Forwarded, PROXY protocol v1/v2 listeners
+**/
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// trustedProxies 配置中的关键字
+var proxyKeywords = map[string][]string{
+	"loopback": {"127.0.0.0/8", "::1/128"},
+	"private":  {"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"},
+}
+
+// proxyHeaderTimeout 读取 PROXY 协议头的超时时间
+const proxyHeaderTimeout = 5 * time.Second
+
+// schemeContextKey 是请求上下文中由可信代理提供的协议（http / https）
+type schemeContextKey struct{}
+
+// proxyResolver 按可信代理列表解析请求的真实客户端地址
+type proxyResolver struct {
+	trusted []*net.IPNet
+}
+
+// newProxyResolver 解析 trustedProxies：CIDR、单个 IP，或关键字 loopback / private
+func newProxyResolver(entries []string) (*proxyResolver, error) {
+	p := &proxyResolver{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		cidrs, ok := proxyKeywords[strings.ToLower(entry)]
+		if !ok {
+			cidrs = []string{entry}
+		}
+		for _, cidr := range cidrs {
+			if !strings.Contains(cidr, "/") {
+				ip := net.ParseIP(cidr)
+				if ip == nil {
+					return nil, fmt.Errorf("无效的可信代理地址: %s", cidr)
+				}
+				if ip.To4() != nil {
+					cidr += "/32"
+				} else {
+					cidr += "/128"
+				}
+			}
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("无效的可信代理地址: %s", cidr)
+			}
+			p.trusted = append(p.trusted, network)
+		}
+	}
+	return p, nil
+}
+
+func (p *proxyResolver) isTrusted(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range p.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedHop 是转发链中的一跳：For 为该跳的客户端地址，Proto 和 Host 为该跳收到的请求的协议和 Host
+type forwardedHop struct {
+	For   string
+	Proto string
+	Host  string
+}
+
+// parseForwardedHeader 解析 RFC 7239 Forwarded 头，按从左到右（离客户端由近到远）返回每一跳
+func parseForwardedHeader(values []string) []forwardedHop {
+	var hops []forwardedHop
+	for _, value := range values {
+		for _, element := range splitQuoted(value, ',') {
+			var hop forwardedHop
+			for _, pair := range splitQuoted(element, ';') {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok {
+					continue
+				}
+				val = strings.Trim(strings.TrimSpace(val), `"`)
+				switch strings.ToLower(key) {
+				case "for":
+					hop.For = val
+				case "proto":
+					hop.Proto = strings.ToLower(val)
+				case "host":
+					hop.Host = val
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// splitQuoted 按 sep 分割字符串，忽略双引号中的分隔符
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case sep:
+			if !quoted {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseHopIP 解析转发头中的地址：1.2.3.4、1.2.3.4:5678、[2001:db8::1]:443、2001:db8::1，无法解析（如 unknown、_hidden）时返回 nil
+func parseHopIP(addr string) net.IP {
+	addr = strings.TrimSpace(addr)
+	if ip := net.ParseIP(strings.Trim(addr, "[]")); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return net.ParseIP(host)
+	}
+	return nil
+}
+
+// splitHeaderList 合并同名头并按逗号分割
+func splitHeaderList(values []string) []string {
+	var list []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			list = append(list, strings.TrimSpace(item))
+		}
+	}
+	return list
+}
+
+// resolve 返回请求的真实客户端 IP、协议和 Host。只有直接连接的对端是可信代理时才读取转发头：
+// 优先使用 Forwarded，其次是 X-Forwarded-For（配合 X-Forwarded-Proto / X-Forwarded-Host）和 X-Real-IP。
+// 转发链从右向左逐跳检查，遇到第一个不可信的地址即为客户端，客户端自己伪造的更左侧的地址会被忽略。
+func (p *proxyResolver) resolve(r *http.Request) (clientIP string, scheme string, host string) {
+	scheme = "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host = r.Host
+
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+	clientIP = peer
+	if !p.isTrusted(net.ParseIP(peer)) {
+		return clientIP, scheme, host
+	}
+
+	var hops []forwardedHop
+	if values := r.Header.Values("Forwarded"); len(values) > 0 {
+		hops = parseForwardedHeader(values)
+	} else if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+		addrs := splitHeaderList(values)
+		protos := splitHeaderList(r.Header.Values("X-Forwarded-Proto"))
+		hosts := splitHeaderList(r.Header.Values("X-Forwarded-Host"))
+		hops = make([]forwardedHop, len(addrs))
+		for i, addr := range addrs {
+			hops[i].For = addr
+		}
+		// 协议和 Host 列表与地址一一对应时按跳取值，否则只信任最后一个（由离我们最近的可信代理设置）
+		for _, list := range []struct {
+			values []string
+			set    func(hop *forwardedHop, v string)
+		}{
+			{protos, func(hop *forwardedHop, v string) { hop.Proto = strings.ToLower(v) }},
+			{hosts, func(hop *forwardedHop, v string) { hop.Host = v }},
+		} {
+			if len(list.values) == len(hops) {
+				for i, v := range list.values {
+					list.set(&hops[i], v)
+				}
+			} else if len(list.values) > 0 && len(hops) > 0 {
+				list.set(&hops[len(hops)-1], list.values[len(list.values)-1])
+			}
+		}
+	} else if realIP := parseHopIP(r.Header.Get("X-Real-IP")); realIP != nil {
+		hops = []forwardedHop{{For: realIP.String()}}
+	}
+	if len(r.Header.Values("Forwarded")) == 0 && len(r.Header.Values("X-Forwarded-For")) == 0 {
+		// 只有 X-Real-IP 或者根本没有客户端地址时，协议和 Host 仍然可以来自直接连接的可信代理
+		if protos := splitHeaderList(r.Header.Values("X-Forwarded-Proto")); len(protos) > 0 {
+			if proto := strings.ToLower(protos[len(protos)-1]); proto == "http" || proto == "https" {
+				scheme = proto
+			}
+		}
+		if hosts := splitHeaderList(r.Header.Values("X-Forwarded-Host")); len(hosts) > 0 && hosts[len(hosts)-1] != "" {
+			host = hosts[len(hosts)-1]
+		}
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseHopIP(hops[i].For)
+		if ip == nil {
+			break
+		}
+		clientIP = ip.String()
+		if hops[i].Proto == "http" || hops[i].Proto == "https" {
+			scheme = hops[i].Proto
+		}
+		if hops[i].Host != "" {
+			host = hops[i].Host
+		}
+		if !p.isTrusted(ip) {
+			break
+		}
+	}
+	return clientIP, scheme, host
+}
+
+// withClientAddr 在所有路由之前解析真实客户端地址：改写 r.RemoteAddr 和 r.Host，协议保存在请求上下文中，
+// 之后 get_remote_ip 和 getScheme 不再直接读取转发头
+func (s *ClipboardServer) withClientAddr(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientIP, scheme, host := s.proxies.resolve(r)
+		r2 := r.WithContext(context.WithValue(r.Context(), schemeContextKey{}, scheme))
+		if _, port, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			r2.RemoteAddr = net.JoinHostPort(clientIP, port)
+		} else {
+			r2.RemoteAddr = clientIP
+		}
+		r2.Host = host
+		next.ServeHTTP(w, r2)
+	})
+}
+
+// ---------- PROXY 协议 ----------
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+	errProxyHeader   = errors.New("无效的 PROXY 协议头")
+)
+
+// proxyProtoListener 接受来自可信代理的 PROXY 协议 v1/v2 连接，连接的 RemoteAddr 为协议头中的客户端地址。
+// 来自不可信地址的连接按普通连接处理（不解析协议头，伪造的协议头会被当作无效的 HTTP 请求）
+type proxyProtoListener struct {
+	net.Listener
+	proxies *proxyResolver
+	logf    func(format string, v ...any)
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok || !l.proxies.isTrusted(tcpAddr.IP) {
+		return conn, nil
+	}
+	return &proxyProtoConn{Conn: conn, logf: l.logf}, nil
+}
+
+// proxyProtoConn 在第一次读取或获取地址时解析 PROXY 协议头（在连接自己的 goroutine 中，不阻塞 Accept）
+type proxyProtoConn struct {
+	net.Conn
+	logf       func(format string, v ...any)
+	once       sync.Once
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *proxyProtoConn) readHeader() {
+	c.once.Do(func() {
+		c.reader = bufio.NewReader(c.Conn)
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+
+		addr, err := readProxyHeader(c.reader)
+		if err != nil {
+			c.err = err
+			c.logf("警告: 来自 %s 的 PROXY 协议头无效: %v", c.Conn.RemoteAddr(), err)
+			return
+		}
+		c.remoteAddr = addr
+	})
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader 读取 PROXY 协议 v1 或 v2 头，返回客户端地址。没有协议头（如本机直接访问）、
+// LOCAL / UNKNOWN（如代理的健康检查）时返回 nil，连接按普通连接处理
+func readProxyHeader(br *bufio.Reader) (net.Addr, error) {
+	if peek, _ := br.Peek(len(proxyV1Prefix)); bytes.Equal(peek, proxyV1Prefix) {
+		return readProxyV1(br)
+	}
+	if peek, _ := br.Peek(len(proxyV2Signature)); bytes.Equal(peek, proxyV2Signature) {
+		return readProxyV2(br)
+	}
+	return nil, nil
+}
+
+// readProxyV1 解析文本格式：PROXY TCP4 源地址 目的地址 源端口 目的端口\r\n（最长 107 字节）
+func readProxyV1(br *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errProxyHeader
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, errProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyV2 解析二进制格式：12 字节签名、版本/命令、地址族/协议、2 字节长度、地址（以及忽略的 TLV）
+func readProxyV2(br *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, errProxyHeader
+	}
+	command := header[12] & 0x0f
+	family := header[13]
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, err
+	}
+	if command == 0x0 { // LOCAL
+		return nil, nil
+	}
+	if command != 0x1 {
+		return nil, errProxyHeader
+	}
+
+	switch family >> 4 {
+	case 0x1: // AF_INET
+		if len(body) < 12 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x2: // AF_INET6
+		if len(body) < 36 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	default: // AF_UNSPEC / AF_UNIX
+		return nil, nil
+	}
+}
@@ -0,0 +1,242 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewProxyResolver(t *testing.T) {
+	p, err := newProxyResolver([]string{"loopback", " 10.1.0.0/16 ", "203.0.113.9", "2001:db8::1", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]bool{
+		"127.0.0.1":   true,
+		"::1":         true,
+		"10.1.2.3":    true,
+		"10.2.0.1":    false,
+		"203.0.113.9": true,
+		"203.0.113.8": false,
+		"2001:db8::1": true,
+		"2001:db8::2": false,
+		"192.168.1.1": false,
+	} {
+		if got := p.isTrusted(net.ParseIP(ip)); got != want {
+			t.Errorf("isTrusted(%s) = %v，期望 %v", ip, got, want)
+		}
+	}
+	for _, entry := range []string{"not-an-ip", "10.0.0.0/33", "localhost"} {
+		if _, err := newProxyResolver([]string{entry}); err == nil {
+			t.Errorf("%q 应返回错误", entry)
+		}
+	}
+}
+
+func TestProxyResolve(t *testing.T) {
+	p, err := newProxyResolver([]string{"loopback", "10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string][]string
+		wantIP     string
+		wantScheme string
+		wantHost   string
+	}{
+		{"不可信的对端忽略转发头", "198.51.100.7:4000",
+			map[string][]string{"X-Forwarded-For": {"1.2.3.4"}, "X-Forwarded-Proto": {"https"}, "X-Forwarded-Host": {"evil.example"}, "X-Real-IP": {"1.2.3.4"}},
+			"198.51.100.7", "http", "clip.example"},
+		{"可信代理的 X-Forwarded-For", "127.0.0.1:4000",
+			map[string][]string{"X-Forwarded-For": {"198.51.100.7"}, "X-Forwarded-Proto": {"https"}, "X-Forwarded-Host": {"public.example"}},
+			"198.51.100.7", "https", "public.example"},
+		{"客户端伪造的更左侧地址被忽略", "127.0.0.1:4000",
+			map[string][]string{"X-Forwarded-For": {"6.6.6.6, 198.51.100.7"}},
+			"198.51.100.7", "http", "clip.example"},
+		{"多级可信代理", "127.0.0.1:4000",
+			map[string][]string{"X-Forwarded-For": {"6.6.6.6, 198.51.100.7, 10.0.0.2"}},
+			"198.51.100.7", "http", "clip.example"},
+		{"多个同名头合并", "127.0.0.1:4000",
+			map[string][]string{"X-Forwarded-For": {"6.6.6.6", "198.51.100.7"}},
+			"198.51.100.7", "http", "clip.example"},
+		{"协议列表与地址不对应时只信任最后一个", "127.0.0.1:4000",
+			map[string][]string{"X-Forwarded-For": {"6.6.6.6, 198.51.100.7"}, "X-Forwarded-Proto": {"http, http, https"}},
+			"198.51.100.7", "https", "clip.example"},
+		{"无效的协议被忽略", "127.0.0.1:4000",
+			map[string][]string{"X-Forwarded-For": {"198.51.100.7"}, "X-Forwarded-Proto": {"javascript"}},
+			"198.51.100.7", "http", "clip.example"},
+		{"Forwarded 优先于 X-Forwarded-For", "127.0.0.1:4000",
+			map[string][]string{"Forwarded": {`for="[2001:db8::7]:443";proto=https;host=public.example`}, "X-Forwarded-For": {"6.6.6.6"}},
+			"2001:db8::7", "https", "public.example"},
+		{"Forwarded 中伪造的跳被忽略", "127.0.0.1:4000",
+			map[string][]string{"Forwarded": {"for=6.6.6.6;host=evil.example, for=198.51.100.7;proto=https"}},
+			"198.51.100.7", "https", "clip.example"},
+		{"Forwarded 中无法解析的地址", "127.0.0.1:4000",
+			map[string][]string{"Forwarded": {"for=unknown, for=10.0.0.2"}},
+			"10.0.0.2", "http", "clip.example"},
+		{"X-Real-IP", "127.0.0.1:4000",
+			map[string][]string{"X-Real-IP": {"198.51.100.7"}, "X-Forwarded-Proto": {"https"}},
+			"198.51.100.7", "https", "clip.example"},
+		{"只有协议和 Host", "127.0.0.1:4000",
+			map[string][]string{"X-Forwarded-Proto": {"https"}, "X-Forwarded-Host": {"public.example"}},
+			"127.0.0.1", "https", "public.example"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://clip.example/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for k, values := range tt.headers {
+				for _, v := range values {
+					r.Header.Add(k, v)
+				}
+			}
+			ip, scheme, host := p.resolve(r)
+			if ip != tt.wantIP || scheme != tt.wantScheme || host != tt.wantHost {
+				t.Fatalf("resolve = (%s, %s, %s)，期望 (%s, %s, %s)", ip, scheme, host, tt.wantIP, tt.wantScheme, tt.wantHost)
+			}
+		})
+	}
+}
+
+func TestClientAddrMiddleware(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Server.TrustedProxies = []string{"127.0.0.1"}
+	})
+	var gotIP, gotScheme, gotHost string
+	handler := s.withClientAddr(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotIP, gotScheme, gotHost = get_remote_ip(r), getScheme(r), r.Host
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "http://clip.example/", nil)
+	r.RemoteAddr = "127.0.0.1:4000"
+	r.Header.Set("X-Forwarded-For", "198.51.100.7")
+	r.Header.Set("X-Forwarded-Proto", "https")
+	r.Header.Set("X-Forwarded-Host", "public.example")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if gotIP != "198.51.100.7" || gotScheme != "https" || gotHost != "public.example" {
+		t.Fatalf("可信代理: (%s, %s, %s)", gotIP, gotScheme, gotHost)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "http://clip.example/", nil)
+	r.RemoteAddr = "198.51.100.7:4000"
+	r.Header.Set("X-Forwarded-For", "1.2.3.4")
+	r.Header.Set("X-Forwarded-Proto", "https")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if gotIP != "198.51.100.7" || gotScheme != "http" || gotHost != "clip.example" {
+		t.Fatalf("不可信的对端: (%s, %s, %s)", gotIP, gotScheme, gotHost)
+	}
+}
+
+// proxyV2Header 构造 PROXY 协议 v2 的 PROXY 命令头（IPv4）
+func proxyV2Header(src net.IP, srcPort uint16) []byte {
+	var buf bytes.Buffer
+	buf.Write(proxyV2Signature)
+	buf.WriteByte(0x21) // 版本 2，PROXY 命令
+	buf.WriteByte(0x11) // AF_INET，STREAM
+	binary.Write(&buf, binary.BigEndian, uint16(12))
+	buf.Write(src.To4())
+	buf.Write(net.ParseIP("127.0.0.1").To4())
+	binary.Write(&buf, binary.BigEndian, srcPort)
+	binary.Write(&buf, binary.BigEndian, uint16(80))
+	return buf.Bytes()
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    []byte
+		wantAddr string // 空字符串表示没有客户端地址
+		wantErr  bool
+	}{
+		{"v1 TCP4", []byte("PROXY TCP4 198.51.100.7 127.0.0.1 4000 80\r\nGET /"), "198.51.100.7:4000", false},
+		{"v1 TCP6", []byte("PROXY TCP6 2001:db8::7 ::1 4000 80\r\nGET /"), "[2001:db8::7]:4000", false},
+		{"v1 UNKNOWN", []byte("PROXY UNKNOWN\r\nGET /"), "", false},
+		{"v1 缺少字段", []byte("PROXY TCP4 198.51.100.7\r\n"), "", true},
+		{"v1 无效端口", []byte("PROXY TCP4 198.51.100.7 127.0.0.1 99999 80\r\n"), "", true},
+		{"v1 没有换行", append([]byte("PROXY TCP4 "), bytes.Repeat([]byte("1"), 200)...), "", true},
+		{"v2 PROXY", append(proxyV2Header(net.ParseIP("198.51.100.7"), 4000), "GET /"...), "198.51.100.7:4000", false},
+		{"v2 LOCAL", append(append([]byte{}, proxyV2Signature...), 0x20, 0x00, 0x00, 0x00), "", false},
+		{"v2 错误版本", append(append([]byte{}, proxyV2Signature...), 0x11, 0x11, 0x00, 0x00), "", true},
+		{"没有协议头", []byte("GET / HTTP/1.1\r\n"), "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, err := readProxyHeader(bufio.NewReader(bytes.NewReader(tt.input)))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v", err)
+			}
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tt.wantAddr {
+				t.Fatalf("地址 = %q，期望 %q", got, tt.wantAddr)
+			}
+		})
+	}
+}
+
+// serveProxyListener 在 proxyProtoListener 上接受一个连接，返回连接的 RemoteAddr 和读取到的数据
+func serveProxyListener(t *testing.T, trusted []string, payload []byte) (string, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	proxies, err := newProxyResolver(trusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := &proxyProtoListener{Listener: ln, proxies: proxies, logf: t.Logf}
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	client.(*net.TCPConn).CloseWrite()
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	remote := conn.RemoteAddr().String()
+	data, _ := io.ReadAll(conn)
+	return remote, string(data)
+}
+
+func TestProxyProtoListener(t *testing.T) {
+	header := []byte("PROXY TCP4 198.51.100.7 127.0.0.1 4000 80\r\n")
+	payload := append(append([]byte{}, header...), "hello"...)
+
+	remote, data := serveProxyListener(t, []string{"loopback"}, payload)
+	if remote != "198.51.100.7:4000" || data != "hello" {
+		t.Fatalf("可信代理: RemoteAddr = %s，数据 = %q", remote, data)
+	}
+
+	// 来自不可信地址的协议头不被解析
+	remote, data = serveProxyListener(t, []string{"10.0.0.0/8"}, payload)
+	if host, _, _ := net.SplitHostPort(remote); host != "127.0.0.1" || data != string(payload) {
+		t.Fatalf("不可信的对端: RemoteAddr = %s，数据 = %q", remote, data)
+	}
+
+	// 可信代理的连接没有协议头时按普通连接处理
+	remote, data = serveProxyListener(t, []string{"loopback"}, []byte("hello"))
+	if host, _, _ := net.SplitHostPort(remote); host != "127.0.0.1" || data != "hello" {
+		t.Fatalf("没有协议头: RemoteAddr = %s，数据 = %q", remote, data)
+	}
+}
@@ -0,0 +1,465 @@
+package lib
+
+/**
+*** FILE: ratelimit.go
+***   token-bucket rate limiting per route class (keyed by client IP and auth token), exponential lockout after auth failures
+**/
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 路由类别
+const (
+	rateClassAuth  = "auth"  // 登录、配对、分享口令等可以猜测凭据的接口
+	rateClassPush  = "push"  // 建立 /push、/events 长连接
+	rateClassWrite = "write" // 发送文本、上传、撤销等写操作
+	rateClassRead  = "read"  // 其他读取接口
+)
+
+var rateClasses = []string{rateClassAuth, rateClassPush, rateClassWrite, rateClassRead}
+
+const rateLimitPruneInterval = time.Minute
+
+var (
+	errAuthLocked  = errors.New("认证失败次数过多，请稍后再试")
+	errRateLimited = errors.New("请求过于频繁，请稍后再试")
+)
+
+// RateLimitRule 是一个路由类别的令牌桶参数：每秒补充 Rate 个令牌，最多积累 Burst 个
+type RateLimitRule struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+func defaultRateLimitRules() map[string]RateLimitRule {
+	return map[string]RateLimitRule{
+		rateClassAuth:  {Rate: 0.5, Burst: 10},
+		rateClassPush:  {Rate: 2, Burst: 20},
+		rateClassWrite: {Rate: 20, Burst: 100},
+		rateClassRead:  {Rate: 30, Burst: 200},
+	}
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// authFailure 记录一个 IP 的认证失败和锁定状态
+type authFailure struct {
+	failures    int // 当前窗口内的失败次数
+	level       int // 已锁定的次数，锁定时长按 2^level 增长
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// RateLimitStats 是 /admin/ratelimit 返回的计数
+type RateLimitStats struct {
+	Enabled        bool             `json:"enabled"`
+	Allowed        map[string]int64 `json:"allowed"`        // 各类别放行的请求数
+	Limited        map[string]int64 `json:"limited"`        // 各类别因超过速率返回 429 的请求数
+	LockedRequests int64            `json:"lockedRequests"` // 因 IP 被锁定返回 429 的请求数
+	AuthFailures   int64            `json:"authFailures"`   // 认证失败次数
+	Lockouts       int64            `json:"lockouts"`       // 触发锁定的次数
+	Buckets        int              `json:"buckets"`        // 当前的令牌桶数量
+	LockedIPs      []LockedIP       `json:"lockedIPs"`      // 当前被锁定的 IP
+}
+
+// LockedIP 是一个当前被锁定的 IP
+type LockedIP struct {
+	IP       string `json:"ip"`
+	Until    int64  `json:"until"`
+	Lockouts int    `json:"lockouts"` // 连续锁定的次数
+}
+
+// rateLimiter 按路由类别和键（IP、令牌）维护令牌桶，并按 IP 记录认证失败
+type rateLimiter struct {
+	mu        sync.Mutex
+	rules     map[string]RateLimitRule
+	buckets   map[string]*tokenBucket // 类别|键 -> 令牌桶
+	failures  map[string]*authFailure // IP -> 认证失败记录
+	lastPrune time.Time
+
+	maxFailures   int
+	failureWindow time.Duration
+	lockoutBase   time.Duration
+	lockoutMax    time.Duration
+
+	allowed        map[string]int64
+	limited        map[string]int64
+	lockedRequests int64
+	authFailures   int64
+	lockouts       int64
+}
+
+func newRateLimiter(cfg *Config) *rateLimiter {
+	rules := defaultRateLimitRules()
+	for class, rule := range cfg.RateLimit.Classes {
+		if rule.Burst <= 0 {
+			rule.Burst = int(math.Max(1, math.Ceil(rule.Rate)))
+		}
+		rules[class] = rule
+	}
+	l := &rateLimiter{
+		rules:         rules,
+		buckets:       make(map[string]*tokenBucket),
+		failures:      make(map[string]*authFailure),
+		lastPrune:     time.Now(),
+		maxFailures:   cfg.RateLimit.MaxFailures,
+		failureWindow: time.Duration(cfg.RateLimit.FailureWindow) * time.Second,
+		lockoutBase:   time.Duration(cfg.RateLimit.LockoutBase) * time.Second,
+		lockoutMax:    time.Duration(cfg.RateLimit.LockoutMax) * time.Second,
+		allowed:       make(map[string]int64),
+		limited:       make(map[string]int64),
+	}
+	if l.maxFailures <= 0 {
+		l.maxFailures = 5
+	}
+	if l.failureWindow <= 0 {
+		l.failureWindow = 15 * time.Minute
+	}
+	if l.lockoutBase <= 0 {
+		l.lockoutBase = time.Minute
+	}
+	if l.lockoutMax < l.lockoutBase {
+		l.lockoutMax = l.lockoutBase
+	}
+	return l
+}
+
+// takeLocked 从令牌桶中取一个令牌，令牌不足时返回需要等待的时间，必须在 l.mu 锁定时调用
+func (l *rateLimiter) takeLocked(class string, key string, now time.Time) time.Duration {
+	rule, ok := l.rules[class]
+	if !ok || rule.Rate <= 0 {
+		return 0
+	}
+	b, ok := l.buckets[class+"|"+key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(rule.Burst), last: now}
+		l.buckets[class+"|"+key] = b
+	}
+	b.tokens = math.Min(float64(rule.Burst), b.tokens+now.Sub(b.last).Seconds()*rule.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / rule.Rate * float64(time.Second))
+}
+
+// allow 检查 IP 是否被锁定，并从 IP 和令牌（如果有）的令牌桶中各取一个令牌。
+// 返回 0 表示放行，否则为建议的重试等待时间；locked 表示是因为 IP 被锁定
+func (l *rateLimiter) allow(class string, ip string, token string) (wait time.Duration, locked bool) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pruneLocked(now)
+
+	if f, ok := l.failures[ip]; ok && now.Before(f.lockedUntil) {
+		l.lockedRequests++
+		return f.lockedUntil.Sub(now), true
+	}
+
+	wait = l.takeLocked(class, "ip:"+ip, now)
+	if token != "" && wait == 0 {
+		wait = l.takeLocked(class, "token:"+hashSessionToken(token), now)
+	}
+	if wait > 0 {
+		l.limited[class]++
+		return wait, false
+	}
+	l.allowed[class]++
+	return 0, false
+}
+
+// lockedFor 返回 IP 剩余的锁定时间，未锁定时返回 0
+func (l *rateLimiter) lockedFor(ip string) time.Duration {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if f, ok := l.failures[ip]; ok && now.Before(f.lockedUntil) {
+		return f.lockedUntil.Sub(now)
+	}
+	return 0
+}
+
+// recordFailure 记录一次认证失败。窗口内失败 maxFailures 次后锁定 IP，锁定时长从 lockoutBase 开始每次翻倍，最长 lockoutMax；
+// 距离上次失败（或上次锁定结束）超过 failureWindow 后重新计数。返回本次触发的锁定时长，未触发时返回 0
+func (l *rateLimiter) recordFailure(ip string) time.Duration {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.authFailures++
+
+	f, ok := l.failures[ip]
+	if !ok {
+		f = &authFailure{}
+		l.failures[ip] = f
+	}
+	quietSince := f.lastFailure
+	if f.lockedUntil.After(quietSince) {
+		quietSince = f.lockedUntil
+	}
+	if now.Sub(quietSince) > l.failureWindow {
+		f.failures = 0
+		f.level = 0
+	}
+	f.failures++
+	f.lastFailure = now
+	if f.failures < l.maxFailures {
+		return 0
+	}
+
+	lockout := l.lockoutMax
+	if f.level < 30 {
+		lockout = time.Duration(math.Min(float64(l.lockoutBase)*math.Pow(2, float64(f.level)), float64(l.lockoutMax)))
+	}
+	f.failures = 0
+	f.level++
+	f.lockedUntil = now.Add(lockout)
+	l.lockouts++
+	return lockout
+}
+
+// unlock 解除 IP 的锁定并清除失败记录
+func (l *rateLimiter) unlock(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.failures[ip]
+	delete(l.failures, ip)
+	return ok
+}
+
+// pruneLocked 定期删除已补满的令牌桶和过期的失败记录，必须在 l.mu 锁定时调用
+func (l *rateLimiter) pruneLocked(now time.Time) {
+	if now.Sub(l.lastPrune) < rateLimitPruneInterval {
+		return
+	}
+	l.lastPrune = now
+	for key, b := range l.buckets {
+		class, _, _ := strings.Cut(key, "|")
+		rule := l.rules[class]
+		if rule.Rate <= 0 || b.tokens+now.Sub(b.last).Seconds()*rule.Rate >= float64(rule.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+	for ip, f := range l.failures {
+		if now.After(f.lockedUntil) && now.Sub(f.lastFailure) > l.failureWindow && now.Sub(f.lockedUntil) > l.failureWindow {
+			delete(l.failures, ip)
+		}
+	}
+}
+
+func (l *rateLimiter) stats() RateLimitStats {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	st := RateLimitStats{
+		Enabled:        true,
+		Allowed:        make(map[string]int64, len(l.allowed)),
+		Limited:        make(map[string]int64, len(l.limited)),
+		LockedRequests: l.lockedRequests,
+		AuthFailures:   l.authFailures,
+		Lockouts:       l.lockouts,
+		Buckets:        len(l.buckets),
+		LockedIPs:      []LockedIP{},
+	}
+	for _, class := range rateClasses {
+		st.Allowed[class] = l.allowed[class]
+		st.Limited[class] = l.limited[class]
+	}
+	for ip, f := range l.failures {
+		if now.Before(f.lockedUntil) {
+			st.LockedIPs = append(st.LockedIPs, LockedIP{IP: ip, Until: f.lockedUntil.Unix(), Lockouts: f.level})
+		}
+	}
+	sort.Slice(st.LockedIPs, func(i, j int) bool { return st.LockedIPs[i].IP < st.LockedIPs[j].IP })
+	return st
+}
+
+// statusRecorder 记录响应状态码，用于统计认证失败。实现 Hijacker 和 Flusher，WebSocket 升级和 SSE 不受影响
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(b)
+}
+
+func (sr *statusRecorder) Flush() {
+	if flusher, ok := sr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (sr *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := sr.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("响应不支持 Hijack")
+	}
+	return hijacker.Hijack()
+}
+
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// writeRateLimited 返回 429 和 Retry-After（向上取整到秒）
+func writeRateLimited(w http.ResponseWriter, wait time.Duration, message string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(math.Max(wait.Seconds(), 1)))))
+	writeAuthJSONError(w, http.StatusTooManyRequests, message)
+}
+
+// withRateLimit 按路由类别限制请求速率，被锁定的 IP 直接返回 429；响应为 401 时记录一次认证失败
+// （限流关闭时仍然检查 401，以便写入审计日志）
+func (s *ClipboardServer) withRateLimit(class string, next http.HandlerFunc) http.HandlerFunc {
+	if s.limiter == nil && s.audit == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if s.limiter != nil {
+			if wait, locked := s.limiter.allow(class, get_remote_ip(r), extractAuthToken(r)); wait > 0 {
+				if locked {
+					writeRateLimited(w, wait, "认证失败次数过多，请稍后再试")
+				} else {
+					writeRateLimited(w, wait, "请求过于频繁，请稍后再试")
+				}
+				return
+			}
+		}
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == http.StatusUnauthorized {
+			s.authFailed(r)
+		}
+	}
+}
+
+// authFailed 记录一次认证失败（写入审计日志），达到次数后锁定 IP
+func (s *ClipboardServer) authFailed(r *http.Request) {
+	s.recordAudit(r, auditAuthFailure, s.inferRequestRoom(r), "", map[string]any{"method": r.Method, "path": r.URL.Path})
+	if s.limiter == nil {
+		return
+	}
+	ip := get_remote_ip(r)
+	if lockout := s.limiter.recordFailure(ip); lockout > 0 {
+		s.logger.Printf("IP %s 认证失败次数过多，锁定 %s", ip, lockout)
+	}
+}
+
+// authLocked 返回请求的 IP 是否因认证失败被锁定（用于不经过 withRateLimit 的 WebSocket 帧）
+func (s *ClipboardServer) authLocked(r *http.Request) bool {
+	return s.limiter != nil && s.limiter.lockedFor(get_remote_ip(r)) > 0
+}
+
+// frameRateClass 返回 /push 客户端帧的限流类别：写操作与对应的 HTTP 接口相同，subscribe 可以携带房间密码，按 auth 计算
+func frameRateClass(event string) string {
+	switch event {
+	case "send_text", "update", "revoke", "clear":
+		return rateClassWrite
+	case "subscribe":
+		return rateClassAuth
+	default:
+		return rateClassRead
+	}
+}
+
+// allowFrame 对 /push 连接上的客户端帧限流，与 HTTP 请求共用建立连接时的 IP 和令牌的令牌桶。
+// 返回 0 表示放行，否则为建议的重试等待时间；locked 表示是因为 IP 被锁定
+func (s *ClipboardServer) allowFrame(r *http.Request, event string) (wait time.Duration, locked bool) {
+	if s.limiter == nil {
+		return 0, false
+	}
+	return s.limiter.allow(frameRateClass(event), get_remote_ip(r), extractAuthToken(r))
+}
+
+// handleAdminRateLimit 处理 /admin/ratelimit：GET 返回计数（?format=prometheus 返回 Prometheus 文本格式），DELETE ?ip=x 解除锁定
+func (s *ClipboardServer) handleAdminRateLimit(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdminToken(extractAuthToken(r)) {
+		writeAuthJSONError(w, http.StatusUnauthorized, "需要管理员权限")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		st := RateLimitStats{Allowed: map[string]int64{}, Limited: map[string]int64{}, LockedIPs: []LockedIP{}}
+		if s.limiter != nil {
+			st = s.limiter.stats()
+		}
+		if r.URL.Query().Get("format") == "prometheus" {
+			writeRateLimitMetrics(w, st)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(st)
+	case http.MethodDelete:
+		ip := strings.TrimSpace(r.URL.Query().Get("ip"))
+		if s.limiter == nil || ip == "" || !s.limiter.unlock(ip) {
+			http.Error(w, "该 IP 没有失败记录", http.StatusNotFound)
+			return
+		}
+		s.logger.Printf("解除 IP %s 的锁定，操作者: %s", ip, s.requester(r))
+		s.recordAudit(r, auditUnlock, "", ip, nil)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "不支持的请求方法", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeRateLimitMetrics(w http.ResponseWriter, st RateLimitStats) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	fmt.Fprintln(w, "# HELP cloudclip_ratelimit_allowed_total Requests allowed by the rate limiter.")
+	fmt.Fprintln(w, "# TYPE cloudclip_ratelimit_allowed_total counter")
+	for _, class := range rateClasses {
+		fmt.Fprintf(w, "cloudclip_ratelimit_allowed_total{class=%q} %d\n", class, st.Allowed[class])
+	}
+	fmt.Fprintln(w, "# HELP cloudclip_ratelimit_limited_total Requests rejected with 429 because the rate was exceeded.")
+	fmt.Fprintln(w, "# TYPE cloudclip_ratelimit_limited_total counter")
+	for _, class := range rateClasses {
+		fmt.Fprintf(w, "cloudclip_ratelimit_limited_total{class=%q} %d\n", class, st.Limited[class])
+	}
+	fmt.Fprintln(w, "# HELP cloudclip_ratelimit_locked_requests_total Requests rejected with 429 because the client IP is locked out.")
+	fmt.Fprintln(w, "# TYPE cloudclip_ratelimit_locked_requests_total counter")
+	fmt.Fprintf(w, "cloudclip_ratelimit_locked_requests_total %d\n", st.LockedRequests)
+	fmt.Fprintln(w, "# HELP cloudclip_auth_failures_total Failed authentication attempts.")
+	fmt.Fprintln(w, "# TYPE cloudclip_auth_failures_total counter")
+	fmt.Fprintf(w, "cloudclip_auth_failures_total %d\n", st.AuthFailures)
+	fmt.Fprintln(w, "# HELP cloudclip_auth_lockouts_total Client IP lockouts triggered by repeated authentication failures.")
+	fmt.Fprintln(w, "# TYPE cloudclip_auth_lockouts_total counter")
+	fmt.Fprintf(w, "cloudclip_auth_lockouts_total %d\n", st.Lockouts)
+	fmt.Fprintln(w, "# HELP cloudclip_auth_locked_ips Client IPs currently locked out.")
+	fmt.Fprintln(w, "# TYPE cloudclip_auth_locked_ips gauge")
+	fmt.Fprintf(w, "cloudclip_auth_locked_ips %d\n", len(st.LockedIPs))
+	fmt.Fprintln(w, "# HELP cloudclip_ratelimit_buckets Active token buckets.")
+	fmt.Fprintln(w, "# TYPE cloudclip_ratelimit_buckets gauge")
+	fmt.Fprintf(w, "cloudclip_ratelimit_buckets %d\n", st.Buckets)
+}
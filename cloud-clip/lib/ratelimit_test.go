@@ -0,0 +1,60 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPushFramesAreRateLimited(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.RateLimit.Enable = true
+		cfg.RateLimit.Classes = map[string]RateLimitRule{rateClassWrite: {Rate: 0.01, Burst: 3}}
+	})
+	ts := startTestServer(t, s)
+	conn := dialPush(t, ts, "room=default", nil)
+
+	for i := 0; i < 5; i++ {
+		frame := map[string]any{"event": "send_text", "requestId": strconv.Itoa(i), "data": map[string]any{"content": "hi"}}
+		if err := conn.WriteJSON(frame); err != nil {
+			t.Fatalf("发送帧: %v", err)
+		}
+	}
+	ok, limited := 0, 0
+	for _, raw := range readEvents(t, conn, 300*time.Millisecond)["result"] {
+		var result FrameResult
+		if err := json.Unmarshal(raw, &result); err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case result.OK:
+			ok++
+		case result.Error == errRateLimited.Error() && result.RetryAfter > 0:
+			limited++
+		default:
+			t.Fatalf("意外的 result: %+v", result)
+		}
+	}
+	if ok != 3 || limited != 2 {
+		t.Fatalf("成功 %d 个、被限流 %d 个，期望 3 和 2", ok, limited)
+	}
+	s.messageQueue.Lock()
+	n := s.messageQueue.Len()
+	s.messageQueue.Unlock()
+	if n != 3 {
+		t.Fatalf("消息数量 = %d，被限流的帧不应被处理", n)
+	}
+
+	// 帧与 HTTP 接口共用同一个 IP 的令牌桶
+	resp, err := http.Post(ts.URL+"/text", "text/plain", strings.NewReader("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("POST /text 状态码 = %d，期望 429", resp.StatusCode)
+	}
+}
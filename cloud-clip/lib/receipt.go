@@ -0,0 +1,178 @@
+package lib
+
+/**
+*** FILE: receipt.go
+***   handle delivery / read receipts reported by clients over /push
+**/
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// ackFrameData 是 ack 帧的载荷，id/ids 二选一，status 为 "delivered"（默认）或 "opened"
+type ackFrameData struct {
+	ID     int    `json:"id"`
+	IDs    []int  `json:"ids"`
+	Status string `json:"status"`
+}
+
+// MessageReceipt 是发送给客户端的回执信息
+type MessageReceipt struct {
+	ID        int      `json:"id"`
+	Room      string   `json:"room"`
+	Delivered []string `json:"delivered"` // 已送达的设备ID
+	Opened    []string `json:"opened"`    // 已打开的设备ID
+}
+
+// receiptState 记录单条消息的回执（设备ID -> 时间戳）
+type receiptState struct {
+	room      string
+	delivered map[string]int64
+	opened    map[string]int64
+}
+
+const (
+	receiptStatusDelivered = "delivered"
+	receiptStatusOpened    = "opened"
+
+	receiptPruneMinimum = 256 // 回执数量低于该值时不清理
+)
+
+// handleAckFrame 处理 ack 帧，记录消息回执
+func (s *ClipboardServer) handleAckFrame(deviceID string, room string, raw json.RawMessage) error {
+	var data ackFrameData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return err
+	}
+	ids := data.IDs
+	if data.ID > 0 {
+		ids = append(ids, data.ID)
+	}
+	for _, id := range ids {
+		s.recordReceipt(id, deviceID, room, data.Status)
+	}
+	return nil
+}
+
+// recordReceipt 记录设备对消息的回执，状态有变化时向房间广播 receipt 事件
+func (s *ClipboardServer) recordReceipt(id int, deviceID string, room string, status string) {
+	if deviceID == "" || id <= 0 {
+		return
+	}
+	if status == "" {
+		status = receiptStatusDelivered
+	}
+	if status != receiptStatusDelivered && status != receiptStatusOpened {
+		s.logger.Printf("警告: 设备 %s 上报了未知的回执状态: %s", deviceID, status)
+		return
+	}
+
+	// 只接受与连接处于同一房间的消息的回执
+	s.messageQueue.Lock()
+	msg := s.messageQueue.Get(id)
+	found := msg != nil && normalizeRoomName(msg.Data.Room()) == normalizeRoomName(room)
+	s.messageQueue.Unlock()
+	if !found {
+		return
+	}
+
+	now := time.Now().Unix()
+	s.receiptsMutex.Lock()
+	state, ok := s.receipts[id]
+	if !ok {
+		state = &receiptState{
+			room:      normalizeRoomName(room),
+			delivered: make(map[string]int64),
+			opened:    make(map[string]int64),
+		}
+		s.receipts[id] = state
+	}
+
+	changed := false
+	if _, seen := state.delivered[deviceID]; !seen {
+		state.delivered[deviceID] = now // 已打开意味着已送达
+		changed = true
+	}
+	if status == receiptStatusOpened {
+		if _, seen := state.opened[deviceID]; !seen {
+			state.opened[deviceID] = now
+			changed = true
+		}
+	}
+	receipt := state.snapshot(id)
+	s.receiptsMutex.Unlock()
+
+	if changed {
+		s.broadcastWebSocketMessage(WebSocketMessage{Event: "receipt", Data: receipt}, room)
+	}
+}
+
+// getReceipt 返回消息当前的回执，没有任何回执时返回空列表
+func (s *ClipboardServer) getReceipt(id int, room string) MessageReceipt {
+	s.receiptsMutex.Lock()
+	defer s.receiptsMutex.Unlock()
+
+	if state, ok := s.receipts[id]; ok {
+		return state.snapshot(id)
+	}
+	return MessageReceipt{ID: id, Room: normalizeRoomName(room), Delivered: []string{}, Opened: []string{}}
+}
+
+// forgetReceipts 在消息被撤销或清空时删除对应回执
+func (s *ClipboardServer) forgetReceipts(ids ...int) {
+	s.receiptsMutex.Lock()
+	defer s.receiptsMutex.Unlock()
+
+	for _, id := range ids {
+		delete(s.receipts, id)
+	}
+}
+
+// pruneReceipts 删除已不在消息队列中（例如被淘汰）的消息回执。每条新消息都会调用，
+// 为避免每次遍历全部回执，只在回执数量达到上次清理后剩余数量的两倍时才清理
+func (s *ClipboardServer) pruneReceipts() {
+	s.receiptsMutex.Lock()
+	due := len(s.receipts) >= max(s.receiptsPruneAt, receiptPruneMinimum)
+	s.receiptsMutex.Unlock()
+	if !due {
+		return
+	}
+
+	s.messageQueue.Lock()
+	defer s.messageQueue.Unlock()
+
+	s.receiptsMutex.Lock()
+	for id := range s.receipts {
+		if s.messageQueue.Get(id) == nil {
+			delete(s.receipts, id)
+		}
+	}
+	s.receiptsPruneAt = 2 * len(s.receipts)
+	s.receiptsMutex.Unlock()
+}
+
+func (st *receiptState) snapshot(id int) MessageReceipt {
+	return MessageReceipt{
+		ID:        id,
+		Room:      st.room,
+		Delivered: sortedDeviceIDs(st.delivered),
+		Opened:    sortedDeviceIDs(st.opened),
+	}
+}
+
+// sortedDeviceIDs 按回执时间排序返回设备ID
+func sortedDeviceIDs(devices map[string]int64) []string {
+	ids := make([]string, 0, len(devices))
+	for id := range devices {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if devices[ids[i]] != devices[ids[j]] {
+			return devices[ids[i]] < devices[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+	return ids
+}
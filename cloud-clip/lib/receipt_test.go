@@ -0,0 +1,168 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// contentReceipts 返回 /content/{id}.json?room= 中的 receipts 字段
+func contentReceipts(t *testing.T, s *ClipboardServer, id string, room string, headers ...string) MessageReceipt {
+	t.Helper()
+	rec := do(t, s, http.MethodGet, "/content/"+id+".json?room="+room, "", headers...)
+	expectStatus(t, rec, http.StatusOK)
+	var resp struct {
+		Receipts MessageReceipt `json:"receipts"`
+	}
+	decodeJSON(t, rec, &resp)
+	return resp.Receipts
+}
+
+// waitReceipt 读取连接上的消息直到收到 receipt 事件
+func waitReceipt(t *testing.T, conn *websocket.Conn) MessageReceipt {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		var msg struct {
+			Event string         `json:"event"`
+			Data  MessageReceipt `json:"data"`
+		}
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("等待 receipt 事件: %v", err)
+		}
+		if json.Unmarshal(data, &msg) == nil && msg.Event == "receipt" {
+			return msg.Data
+		}
+	}
+}
+
+func TestAckRecordsReceipts(t *testing.T) {
+	s := newTestServer(t, nil)
+	ts := startTestServer(t, s)
+	deviceID, secret := registerTestDevice(t, s, "手机")
+	device := dialPush(t, ts, "room=default", http.Header{"Cookie": {deviceCookie + "=" + deviceID + deviceCookieSeparator + secret}})
+	observer := dialPush(t, ts, "room=default", nil)
+	id := postText(t, s, "/text", "hello")
+	n, _ := strconv.Atoi(id)
+
+	if got := contentReceipts(t, s, id, "default"); len(got.Delivered) != 0 || len(got.Opened) != 0 {
+		t.Fatalf("没有回执时 receipts = %+v", got)
+	}
+
+	if result := frameResult(t, device, "ack", "", map[string]any{"id": n}); !result.OK {
+		t.Fatalf("ack result = %+v", result)
+	}
+	receipt := waitReceipt(t, observer)
+	if receipt.ID != n || receipt.Room != "default" || len(receipt.Delivered) != 1 || receipt.Delivered[0] != deviceID || len(receipt.Opened) != 0 {
+		t.Fatalf("送达回执 = %+v", receipt)
+	}
+
+	// 重复的送达回执不再广播，下一个 receipt 事件是已打开
+	frameResult(t, device, "ack", "", map[string]any{"id": n})
+	frameResult(t, device, "ack", "", map[string]any{"ids": []int{n}, "status": "opened"})
+	receipt = waitReceipt(t, observer)
+	if len(receipt.Opened) != 1 || receipt.Opened[0] != deviceID {
+		t.Fatalf("已打开回执 = %+v", receipt)
+	}
+	if got := contentReceipts(t, s, id, "default"); len(got.Delivered) != 1 || len(got.Opened) != 1 {
+		t.Fatalf("/content 中的 receipts = %+v", got)
+	}
+
+	// 其他房间的消息和未知状态不记录回执
+	other := postText(t, s, "/text?room=other", "elsewhere")
+	otherID, _ := strconv.Atoi(other)
+	frameResult(t, device, "ack", "", map[string]any{"id": otherID})
+	frameResult(t, device, "ack", "", map[string]any{"id": n, "status": "bogus"})
+	if got := contentReceipts(t, s, other, "other"); len(got.Delivered) != 0 {
+		t.Fatalf("其他房间消息的 receipts = %+v", got)
+	}
+
+	// 撤销消息时删除回执
+	expectStatus(t, do(t, s, http.MethodDelete, "/revoke/"+id, ""), http.StatusOK)
+	s.receiptsMutex.Lock()
+	_, kept := s.receipts[n]
+	s.receiptsMutex.Unlock()
+	if kept {
+		t.Fatal("撤销的消息的回执应被删除")
+	}
+}
+
+func TestAckRequiresRoomAccess(t *testing.T) {
+	s := newUsersTestServer(t, 0)
+	ts := startTestServer(t, s)
+	login := loginUser(t, s, "alice", "alice-pw")
+	conn := dialPush(t, ts, "room=team", http.Header{"Authorization": {"Bearer " + login.Token}})
+	id := postText(t, s, "/text?room=team", "hello", "Authorization", "Bearer team-pw")
+	n, _ := strconv.Atoi(id)
+
+	// 登录会话在连接期间过期后，ack 帧与其他帧一样被拒绝
+	expireUserSessions(s)
+	if result := frameResult(t, conn, "ack", "", map[string]any{"id": n}); result.OK || result.Error != errRoomUnauthorized.Error() {
+		t.Fatalf("ack result = %+v", result)
+	}
+	if got := contentReceipts(t, s, id, "team", "Authorization", "Bearer team-pw"); len(got.Delivered) != 0 {
+		t.Fatalf("receipts = %+v", got)
+	}
+}
+
+func TestStaleReceiptsArePrunedInBatches(t *testing.T) {
+	s := newTestServer(t, nil)
+	id := postText(t, s, "/text", "live")
+	n, _ := strconv.Atoi(id)
+	s.recordReceipt(n, "device-a", "default", "")
+
+	addStale := func(count int) {
+		s.receiptsMutex.Lock()
+		defer s.receiptsMutex.Unlock()
+		for i := 0; i < count; i++ {
+			s.receipts[100000+len(s.receipts)] = &receiptState{room: "default"}
+		}
+	}
+	receiptCount := func() int {
+		s.receiptsMutex.Lock()
+		defer s.receiptsMutex.Unlock()
+		return len(s.receipts)
+	}
+
+	// 回执数量较少时不遍历清理
+	addStale(10)
+	postText(t, s, "/text", "one")
+	if got := receiptCount(); got != 11 {
+		t.Fatalf("回执数量 = %d，未达到清理阈值时不应清理", got)
+	}
+
+	// 达到阈值后一次清理所有已不在队列中的消息回执，保留仍在队列中的
+	addStale(receiptPruneMinimum)
+	postText(t, s, "/text", "two")
+	if got := receiptCount(); got != 1 {
+		t.Fatalf("回执数量 = %d，期望只保留 1 条", got)
+	}
+	if got := contentReceipts(t, s, id, "default"); len(got.Delivered) != 1 {
+		t.Fatalf("仍在队列中的消息的 receipts = %+v", got)
+	}
+}
+
+func TestEvictedMessageReceiptsArePruned(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Server.History = 1
+	})
+	for i := 0; i < receiptPruneMinimum+1; i++ {
+		id := postText(t, s, "/text", "message "+strconv.Itoa(i))
+		n, _ := strconv.Atoi(id)
+		s.recordReceipt(n, "device-a", "default", "")
+	}
+	postText(t, s, "/text", "last")
+
+	s.receiptsMutex.Lock()
+	remaining := len(s.receipts)
+	s.receiptsMutex.Unlock()
+	if remaining >= receiptPruneMinimum {
+		t.Fatalf("被淘汰的消息仍有 %d 条回执", remaining)
+	}
+}
@@ -0,0 +1,631 @@
+package lib
+
+/**
+*** FILE: rooms.go
+***   room registry: rooms created at runtime with hashed passwords, owners, visibility and descriptions, persisted to rooms.json
+**/
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	roomVisibilityPrivate = "private" // 只有可以访问的人能在房间列表中看到
+	roomVisibilityPublic  = "public"  // 所有人都能在房间列表中看到（进入仍然需要密码）
+
+	maxRoomNameLength        = 64
+	maxRoomDescriptionLength = 200
+	maxRoomPasswordCache     = 4096
+
+	// 同时计算的 argon2 数量上限，超过时排队等待。错误密码不会使正确的密码被拒绝，
+	// 每个 IP 的失败次数由 withRateLimit / authFailed 的认证失败锁定限制
+	roomPasswordHashConcurrency = 4
+)
+
+var (
+	errRoomExists      = errors.New("房间已存在")
+	errRoomNotFound    = errors.New("房间不存在")
+	errInvalidRoomName = errors.New("无效的房间名")
+	errRoomInConfig    = errors.New("该房间的密码在配置文件中设置，请修改配置文件")
+	errRoomNotEmpty    = errors.New("房间中已有消息或在线设备")
+	errRoomsDisabled   = errors.New("房间管理未启用")
+)
+
+// RoomConfig 是房间存储中的一个房间，密码保存为 argon2id 哈希，为空表示不需要房间密码
+type RoomConfig struct {
+	Name         string `json:"name"`
+	PasswordHash string `json:"passwordHash,omitempty"`
+	Owner        string `json:"owner,omitempty"` // user:名称 或 oidc:名称，为空表示只有管理员可以管理
+	Visibility   string `json:"visibility"`
+	Description  string `json:"description,omitempty"`
+	Created      int64  `json:"created"`
+	Updated      int64  `json:"updated"`
+}
+
+// RoomDetail 是返回给客户端的房间信息（不含密码哈希）
+type RoomDetail struct {
+	Name        string `json:"name"`
+	Owner       string `json:"owner,omitempty"`
+	Visibility  string `json:"visibility"`
+	Description string `json:"description,omitempty"`
+	Protected   bool   `json:"protected"`
+	Created     int64  `json:"created"`
+	Updated     int64  `json:"updated"`
+}
+
+func (c *RoomConfig) detail() RoomDetail {
+	return RoomDetail{
+		Name:        c.Name,
+		Owner:       c.Owner,
+		Visibility:  c.Visibility,
+		Description: c.Description,
+		Protected:   c.PasswordHash != "",
+		Created:     c.Created,
+		Updated:     c.Updated,
+	}
+}
+
+// roomRegistry 保存通过 API 创建的房间（持久化到 rooms.json）。
+// 校验密码的结果按密码哈希缓存在 LRU 中，避免每次请求（以及遍历每条消息时）都计算 argon2；
+// 同时进行的校验数量有上限，防止用大量错误密码耗尽 CPU 和内存
+type roomRegistry struct {
+	mu       sync.Mutex
+	path     string
+	rooms    map[string]*RoomConfig
+	verified *lruCache[string, bool] // 密码哈希 + 令牌的 SHA-256 -> 校验结果
+	hashing  chan struct{}           // 正在计算 argon2 的校验，容量为 roomPasswordHashConcurrency
+	logf     func(format string, v ...any)
+}
+
+// roomsFilePath 返回房间存储文件路径，未配置时为历史文件所在目录的 rooms.json
+func roomsFilePath(cfg *Config) string {
+	if cfg.Rooms.File != "" {
+		return cfg.Rooms.File
+	}
+	historyFile := cfg.Server.HistoryFile
+	if historyFile == "" {
+		historyFile = filepath.Join(cfg.Server.StorageDir, "history.json")
+	}
+	return filepath.Join(filepath.Dir(historyFile), "rooms.json")
+}
+
+func newRoomRegistry(path string, logf func(format string, v ...any)) *roomRegistry {
+	rr := &roomRegistry{
+		path:     path,
+		rooms:    make(map[string]*RoomConfig),
+		verified: newLRUCache[string, bool](maxRoomPasswordCache),
+		hashing:  make(chan struct{}, roomPasswordHashConcurrency),
+		logf:     logf,
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logf("警告: 加载房间存储 %s 失败: %v", path, err)
+		}
+		return rr
+	}
+	var rooms []RoomConfig
+	if err := json.Unmarshal(data, &rooms); err != nil {
+		logf("警告: 解析房间存储 %s 失败: %v", path, err)
+		return rr
+	}
+	for i := range rooms {
+		rooms[i].Name = normalizeRoomName(rooms[i].Name)
+		rr.rooms[rooms[i].Name] = &rooms[i]
+	}
+	return rr
+}
+
+// saveLocked 将房间写入文件，必须在 rr.mu 锁定时调用
+func (rr *roomRegistry) saveLocked() error {
+	rooms := make([]RoomConfig, 0, len(rr.rooms))
+	for _, room := range rr.rooms {
+		rooms = append(rooms, *room)
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].Name < rooms[j].Name })
+
+	data, err := json.MarshalIndent(rooms, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(rr.path, data, 0600)
+}
+
+func (rr *roomRegistry) get(name string) (RoomConfig, bool) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	room, ok := rr.rooms[normalizeRoomName(name)]
+	if !ok {
+		return RoomConfig{}, false
+	}
+	return *room, true
+}
+
+// snapshot 返回所有房间的副本
+func (rr *roomRegistry) snapshot() map[string]RoomConfig {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	rooms := make(map[string]RoomConfig, len(rr.rooms))
+	for name, room := range rr.rooms {
+		rooms[name] = *room
+	}
+	return rooms
+}
+
+func (rr *roomRegistry) create(room RoomConfig) error {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	if _, exists := rr.rooms[room.Name]; exists {
+		return errRoomExists
+	}
+	room.Created = time.Now().Unix()
+	room.Updated = room.Created
+	rr.rooms[room.Name] = &room
+	if err := rr.saveLocked(); err != nil {
+		delete(rr.rooms, room.Name)
+		return err
+	}
+	return nil
+}
+
+// modify 修改房间，apply 可以修改房间名（改名），返回修改后的房间
+func (rr *roomRegistry) modify(name string, apply func(room *RoomConfig) error) (RoomConfig, error) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	current, ok := rr.rooms[name]
+	if !ok {
+		return RoomConfig{}, errRoomNotFound
+	}
+	updated := *current
+	if err := apply(&updated); err != nil {
+		return RoomConfig{}, err
+	}
+	if updated.Name != name {
+		if _, exists := rr.rooms[updated.Name]; exists {
+			return RoomConfig{}, errRoomExists
+		}
+	}
+	updated.Updated = time.Now().Unix()
+
+	delete(rr.rooms, name)
+	rr.rooms[updated.Name] = &updated
+	if err := rr.saveLocked(); err != nil {
+		delete(rr.rooms, updated.Name)
+		rr.rooms[name] = current
+		return RoomConfig{}, err
+	}
+	return updated, nil
+}
+
+func (rr *roomRegistry) remove(name string) (RoomConfig, error) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	room, ok := rr.rooms[name]
+	if !ok {
+		return RoomConfig{}, errRoomNotFound
+	}
+	delete(rr.rooms, name)
+	if err := rr.saveLocked(); err != nil {
+		rr.rooms[name] = room
+		return RoomConfig{}, err
+	}
+	return *room, nil
+}
+
+// checkPassword 判断 password 是否是房间的密码，没有缓存结果时计算 argon2
+func (rr *roomRegistry) checkPassword(name string, password string) bool {
+	return rr.verifyPassword(name, password, true)
+}
+
+// checkPasswordCached 只使用缓存的校验结果判断 password 是否是房间的密码，不计算 argon2。
+// 用于调用方没有指定的房间（如房间列表），避免一个请求对所有房间逐一计算哈希
+func (rr *roomRegistry) checkPasswordCached(name string, password string) bool {
+	return rr.verifyPassword(name, password, false)
+}
+
+func (rr *roomRegistry) verifyPassword(name string, password string, compute bool) bool {
+	if password == "" {
+		return false
+	}
+	name = normalizeRoomName(name)
+	rr.mu.Lock()
+	room, ok := rr.rooms[name]
+	if !ok || room.PasswordHash == "" {
+		rr.mu.Unlock()
+		return false
+	}
+	passwordHash := room.PasswordHash
+	key := passwordHash + "\x00" + hashSessionToken(password)
+	if result, cached := rr.verified.get(key); cached {
+		rr.mu.Unlock()
+		return result
+	}
+	if !compute {
+		rr.mu.Unlock()
+		return false
+	}
+	rr.mu.Unlock()
+
+	// 在锁外计算哈希，不阻塞其他请求；并发数受 hashing 限制，超过时排队而不是拒绝
+	rr.hashing <- struct{}{}
+	result := verifyPassword(passwordHash, password)
+	<-rr.hashing
+
+	rr.mu.Lock()
+	rr.verified.add(key, result, 0)
+	rr.mu.Unlock()
+	return result
+}
+
+// passwordHash 返回房间的密码哈希，房间不存在或没有密码时返回空字符串
+func (rr *roomRegistry) passwordHash(name string) string {
+	room, ok := rr.get(name)
+	if !ok {
+		return ""
+	}
+	return room.PasswordHash
+}
+
+// validRoomName 检查房间名：不能是 default，不能包含 / 和控制字符，最长 maxRoomNameLength 个字符
+func validRoomName(name string) bool {
+	if name == "" || name == "default" || utf8.RuneCountInString(name) > maxRoomNameLength || strings.Contains(name, "/") {
+		return false
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// roomOwnerID 返回令牌对应的房间所有者标识（user:名称 或 oidc:名称），其他令牌返回空字符串
+func (s *ClipboardServer) roomOwnerID(token string) string {
+	if u, ok := s.sessionUser(token); ok {
+		return "user:" + u.Name
+	}
+	if id, ok := s.oidcUser(token); ok {
+		return "oidc:" + id.Name
+	}
+	return ""
+}
+
+// isRoomOwner 判断 owner 是否是房间存储中该房间的所有者
+func (s *ClipboardServer) isRoomOwner(room string, owner string) bool {
+	if s.rooms == nil {
+		return false
+	}
+	entry, ok := s.rooms.get(room)
+	return ok && entry.Owner != "" && entry.Owner == owner
+}
+
+// canManageRoom 判断令牌能否修改房间：管理员或房间的所有者
+func (s *ClipboardServer) canManageRoom(token string, room RoomConfig) bool {
+	if s.isAdminToken(token) {
+		return true
+	}
+	owner := s.roomOwnerID(token)
+	return owner != "" && owner == room.Owner
+}
+
+// canCreateRoom 判断令牌能否创建房间，由 rooms.allowCreate 决定
+func (s *ClipboardServer) canCreateRoom(token string) bool {
+	if s.isAdminToken(token) {
+		return true
+	}
+	return s.config.Rooms.AllowCreate == "users" && s.roomOwnerID(token) != ""
+}
+
+// roomInUse 判断房间中是否已有消息或在线设备
+func (s *ClipboardServer) roomInUse(room string) bool {
+	s.messageQueue.Lock()
+	count := s.messageQueue.RoomLen(room)
+	s.messageQueue.Unlock()
+	if count > 0 {
+		return true
+	}
+	_, online := s.hub.roomDevices()[room]
+	return online
+}
+
+// roomRequest 是创建和修改房间的请求体，未提供的字段保持不变
+type roomRequest struct {
+	Name        *string `json:"name"`
+	Password    *string `json:"password"` // 空字符串表示取消房间密码
+	Owner       *string `json:"owner"`    // 只有管理员可以修改
+	Visibility  *string `json:"visibility"`
+	Description *string `json:"description"`
+}
+
+func decodeRoomRequest(r *http.Request) (roomRequest, error) {
+	var req roomRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 8192)).Decode(&req); err != nil {
+		return req, errors.New("无效的请求体")
+	}
+	return req, nil
+}
+
+// applyRoomRequest 把请求中的密码、可见性和描述写入房间
+func applyRoomRequest(room *RoomConfig, req roomRequest) error {
+	if req.Password != nil {
+		if *req.Password == "" {
+			room.PasswordHash = ""
+		} else {
+			hash, err := hashPassword(*req.Password)
+			if err != nil {
+				return err
+			}
+			room.PasswordHash = hash
+		}
+	}
+	if req.Visibility != nil {
+		switch *req.Visibility {
+		case roomVisibilityPrivate, roomVisibilityPublic:
+			room.Visibility = *req.Visibility
+		default:
+			return errors.New("visibility 只能是 private 或 public")
+		}
+	}
+	if req.Description != nil {
+		description := strings.TrimSpace(*req.Description)
+		if utf8.RuneCountInString(description) > maxRoomDescriptionLength {
+			return errors.New("房间描述过长")
+		}
+		room.Description = description
+	}
+	return nil
+}
+
+// checkRoomNameAvailable 检查房间名可以用于新建或改名：格式有效、没有在配置文件中设置密码、没有被使用
+func (s *ClipboardServer) checkRoomNameAvailable(name string, token string) error {
+	if !validRoomName(name) {
+		return errInvalidRoomName
+	}
+	if _, inConfig := s.config.Server.RoomAuth[name]; inConfig {
+		return errRoomInConfig
+	}
+	if _, exists := s.rooms.get(name); exists {
+		return errRoomExists
+	}
+	// 非管理员不能把别人正在使用的临时房间据为己有
+	if !s.isAdminToken(token) && s.roomInUse(name) {
+		return errRoomNotEmpty
+	}
+	return nil
+}
+
+func writeRoomError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	switch {
+	case errors.Is(err, errRoomNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, errRoomExists), errors.Is(err, errRoomInConfig), errors.Is(err, errRoomNotEmpty):
+		status = http.StatusConflict
+	}
+	writeAuthJSONError(w, status, err.Error())
+}
+
+func writeRoomDetail(w http.ResponseWriter, status int, room RoomConfig) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(room.detail())
+}
+
+// handleRoomCreate 处理 POST /rooms：创建房间，创建者成为所有者（管理员可以指定 owner）
+func (s *ClipboardServer) handleRoomCreate(w http.ResponseWriter, r *http.Request) {
+	if s.rooms == nil {
+		writeAuthJSONError(w, http.StatusNotFound, errRoomsDisabled.Error())
+		return
+	}
+	token := extractAuthToken(r)
+	if !s.canCreateRoom(token) {
+		writeAuthJSONError(w, http.StatusUnauthorized, "没有创建房间的权限")
+		return
+	}
+	req, err := decodeRoomRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Name == nil {
+		writeRoomError(w, errInvalidRoomName)
+		return
+	}
+
+	room := RoomConfig{Name: strings.TrimSpace(*req.Name), Owner: s.roomOwnerID(token), Visibility: roomVisibilityPrivate}
+	if err := s.checkRoomNameAvailable(room.Name, token); err != nil {
+		writeRoomError(w, err)
+		return
+	}
+	if req.Owner != nil {
+		if !s.isAdminToken(token) {
+			writeAuthJSONError(w, http.StatusForbidden, "只有管理员可以指定房间所有者")
+			return
+		}
+		room.Owner = strings.TrimSpace(*req.Owner)
+	}
+	if err := applyRoomRequest(&room, req); err != nil {
+		writeRoomError(w, err)
+		return
+	}
+	if err := s.rooms.create(room); err != nil {
+		if !errors.Is(err, errRoomExists) {
+			s.logger.Printf("错误: 保存房间存储失败: %v", err)
+		}
+		writeRoomError(w, err)
+		return
+	}
+
+	room, _ = s.rooms.get(room.Name)
+	s.logger.Printf("已创建房间 %s，所有者: %s，来自 IP: %s", room.Name, room.Owner, get_remote_ip(r))
+	s.recordAudit(r, auditRoomCreate, room.Name, room.Name, map[string]any{"owner": room.Owner, "visibility": room.Visibility, "protected": room.PasswordHash != ""})
+	writeRoomDetail(w, http.StatusCreated, room)
+}
+
+// handleRoomConfig 处理 /rooms/{name}：GET 查看房间，PATCH 修改密码、所有者、可见性、描述或改名，DELETE 删除房间及其消息
+func (s *ClipboardServer) handleRoomConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, PATCH, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if s.rooms == nil {
+		writeAuthJSONError(w, http.StatusNotFound, errRoomsDisabled.Error())
+		return
+	}
+
+	name := normalizeRoomName(strings.TrimPrefix(r.URL.Path, s.config.Server.Prefix+"/rooms/"))
+	room, ok := s.rooms.get(name)
+	if !ok {
+		writeRoomError(w, errRoomNotFound)
+		return
+	}
+	token := extractAuthToken(r)
+
+	switch r.Method {
+	case http.MethodGet:
+		if !s.canManageRoom(token, room) && !s.requestCanAccessRoom(r, name) {
+			writeAuthJSONError(w, http.StatusUnauthorized, "无权访问该房间")
+			return
+		}
+		writeRoomDetail(w, http.StatusOK, room)
+	case http.MethodPatch:
+		if !s.canManageRoom(token, room) {
+			writeAuthJSONError(w, http.StatusUnauthorized, "只有房间所有者或管理员可以修改房间")
+			return
+		}
+		s.handleRoomUpdate(w, r, room, token)
+	case http.MethodDelete:
+		if !s.canManageRoom(token, room) {
+			writeAuthJSONError(w, http.StatusUnauthorized, "只有房间所有者或管理员可以删除房间")
+			return
+		}
+		if _, err := s.rooms.remove(name); err != nil {
+			s.logger.Printf("错误: 删除房间 %s 失败: %v", name, err)
+			writeRoomError(w, err)
+			return
+		}
+		// 删除房间时清空其中的消息，避免受保护的内容变成公开的；已连接的订阅者被断开，重连时按新的认证要求检查
+		count := s.clearRoom(name)
+		s.hub.purgeRoom(name, true)
+		s.logger.Printf("已删除房间 %s，清除 %d 条消息，来自 IP: %s", name, count, get_remote_ip(r))
+		s.recordAudit(r, auditRoomDelete, name, name, map[string]any{"count": count})
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "仅允许 GET、PATCH 或 DELETE 请求", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *ClipboardServer) handleRoomUpdate(w http.ResponseWriter, r *http.Request, room RoomConfig, token string) {
+	req, err := decodeRoomRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Owner != nil && !s.isAdminToken(token) {
+		writeAuthJSONError(w, http.StatusForbidden, "只有管理员可以修改房间所有者")
+		return
+	}
+	newName := room.Name
+	if req.Name != nil && strings.TrimSpace(*req.Name) != room.Name {
+		newName = strings.TrimSpace(*req.Name)
+		if err := s.checkRoomNameAvailable(newName, token); err != nil {
+			writeRoomError(w, err)
+			return
+		}
+	}
+
+	modify := func() (RoomConfig, error) {
+		return s.rooms.modify(room.Name, func(c *RoomConfig) error {
+			if err := applyRoomRequest(c, req); err != nil {
+				return err
+			}
+			if req.Owner != nil {
+				c.Owner = strings.TrimSpace(*req.Owner)
+			}
+			c.Name = newName
+			return nil
+		})
+	}
+
+	var updated RoomConfig
+	moved := 0
+	if newName != room.Name {
+		// 改名时消息移动到新房间：检查目标房间为空、移动消息和修改房间存储在同一次加锁中完成，
+		// 期间不会有消息写入目标房间；修改房间存储失败时把消息移回原房间
+		s.messageQueue.Lock()
+		moved, err = s.messageQueue.RenameRoom(room.Name, newName)
+		if err == nil {
+			if updated, err = modify(); err != nil {
+				s.messageQueue.RenameRoom(newName, room.Name)
+			}
+		}
+		s.messageQueue.Unlock()
+	} else {
+		updated, err = modify()
+	}
+	if err != nil {
+		writeRoomError(w, err)
+		return
+	}
+
+	changed := []string{}
+	for field, set := range map[string]bool{"password": req.Password != nil, "owner": req.Owner != nil, "visibility": req.Visibility != nil, "description": req.Description != nil} {
+		if set {
+			changed = append(changed, field)
+		}
+	}
+	sort.Strings(changed)
+	if len(changed) > 0 {
+		s.recordAudit(r, auditRoomUpdate, updated.Name, updated.Name, map[string]any{"changed": changed})
+	}
+	if newName != room.Name {
+		s.renameRoomData(room.Name, newName)
+		s.logger.Printf("房间 %s 已改名为 %s，移动 %d 条消息，来自 IP: %s", room.Name, newName, moved, get_remote_ip(r))
+		s.recordAudit(r, auditRoomRename, newName, room.Name, map[string]any{"to": newName, "count": moved})
+	}
+	writeRoomDetail(w, http.StatusOK, updated)
+}
+
+// renameRoomData 在消息移动到新房间（见 handleRoomUpdate）后移动文件和统计信息，旧房间中的连接收到 clearAll 事件后被断开
+func (s *ClipboardServer) renameRoomData(from string, to string) {
+	// 第一步：丢弃旧房间的待投递私信和分享链接（分享链接绑定到房间名）
+	s.dropPendingDirect(func(event PostEvent) bool { return normalizeRoomName(event.Data.Room()) == from })
+	s.shares.removeRoom(from)
+
+	// 第二步：移动文件
+	s.runMutex.Lock()
+	for uuid, fileInfo := range s.uploadFileMap {
+		if normalizeRoomName(fileInfo.Room) == from {
+			fileInfo.Room = to
+			s.uploadFileMap[uuid] = fileInfo
+		}
+	}
+	s.runMutex.Unlock()
+
+	// 第三步：移动房间统计
+	s.roomStatsMutex.Lock()
+	if stat, ok := s.roomStats[from]; ok {
+		delete(s.roomStats, from)
+		s.roomStats[to] = stat
+	}
+	s.roomStatsMutex.Unlock()
+
+	// 旧房间的连接收到 clearAll 后被断开，hub 中记录的事件也一并丢弃，不能再通过旧房间名续传
+	s.broadcastWebSocketMessage(WebSocketMessage{Event: "clearAll", Data: map[string]string{"room": from}}, from)
+	s.hub.purgeRoom(from, true)
+	s.saveHistoryData()
+}
@@ -0,0 +1,239 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testAdminPassword = "admin-pw"
+
+// newRoomsTestServer 创建启用全局密码（管理员）的服务器，并创建受密码保护的 team 房间
+func newRoomsTestServer(t *testing.T) *ClipboardServer {
+	t.Helper()
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Server.Auth = testAdminPassword
+	})
+	rec := do(t, s, http.MethodPost, "/rooms", `{"name":"team","password":"team-pw"}`,
+		"Content-Type", "application/json", "Authorization", "Bearer "+testAdminPassword)
+	expectStatus(t, rec, http.StatusCreated)
+	return s
+}
+
+func TestPurgedRoomIsNotReplayed(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		body       string
+		oldRoom    string
+		disconnect bool
+	}{
+		{"删除房间", http.MethodDelete, "/rooms/team", "", "team", true},
+		{"房间改名", http.MethodPatch, "/rooms/team", `{"name":"crew"}`, "team", true},
+		{"清空房间", http.MethodDelete, "/revoke/all?room=team", "", "team", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newRoomsTestServer(t)
+			ts := startTestServer(t, s)
+			postText(t, s, "/text?room=team", "protected message", "Authorization", "Bearer team-pw")
+
+			sub := s.hub.subscribe(tt.oldRoom, "")
+			defer s.hub.unsubscribe(sub)
+
+			rec := do(t, s, tt.method, tt.target, tt.body, "Content-Type", "application/json", "Authorization", "Bearer "+testAdminPassword)
+			if rec.Code >= 300 {
+				t.Fatalf("状态码 = %d，响应: %s", rec.Code, rec.Body.String())
+			}
+
+			select {
+			case <-sub.done:
+				if !tt.disconnect {
+					t.Fatal("清空房间不应断开订阅者")
+				}
+			default:
+				if tt.disconnect {
+					t.Fatal("房间的订阅者应被断开")
+				}
+			}
+
+			_, missed, ok := s.hub.subscribeFrom(tt.oldRoom, "", 0)
+			if ok || len(missed) > 0 {
+				t.Fatalf("旧房间不应能续传: ok=%t, missed=%d", ok, len(missed))
+			}
+
+			body, status := readSSE(t, ts, "/events?room="+tt.oldRoom+"&lastEventId=0&auth="+testAdminPassword, 300*time.Millisecond)
+			if status != http.StatusOK {
+				t.Fatalf("SSE 状态码 = %d", status)
+			}
+			if strings.Contains(body, "protected message") {
+				t.Fatalf("已清除的消息被重放: %s", body)
+			}
+		})
+	}
+}
+
+func TestRoomRenameRequiresEmptyTarget(t *testing.T) {
+	s := newRoomsTestServer(t)
+	postText(t, s, "/text?room=team", "team message", "Authorization", "Bearer team-pw")
+	postText(t, s, "/text?room=crew", "crew message", "Authorization", "Bearer "+testAdminPassword)
+
+	rec := do(t, s, http.MethodPatch, "/rooms/team", `{"name":"crew"}`, "Content-Type", "application/json", "Authorization", "Bearer "+testAdminPassword)
+	expectStatus(t, rec, http.StatusConflict)
+
+	if _, ok := s.rooms.get("team"); !ok {
+		t.Fatal("改名失败时房间存储不应被修改")
+	}
+	s.messageQueue.Lock()
+	teamLen, crewLen := s.messageQueue.RoomLen("team"), s.messageQueue.RoomLen("crew")
+	s.messageQueue.Unlock()
+	if teamLen != 1 || crewLen != 1 {
+		t.Fatalf("改名失败时消息不应移动: team=%d, crew=%d", teamLen, crewLen)
+	}
+}
+
+func TestPostListRenameRoom(t *testing.T) {
+	s := newTestServer(t, nil)
+	postText(t, s, "/text?room=a", "first")
+	postText(t, s, "/text?room=b", "second")
+
+	s.messageQueue.Lock()
+	defer s.messageQueue.Unlock()
+	if _, err := s.messageQueue.RenameRoom("a", "b"); err != errRoomNotEmpty {
+		t.Fatalf("目标房间已有消息时应返回 errRoomNotEmpty，得到 %v", err)
+	}
+	moved, err := s.messageQueue.RenameRoom("a", "c")
+	if err != nil || moved != 1 {
+		t.Fatalf("RenameRoom = %d, %v", moved, err)
+	}
+	history := s.messageQueue.RoomHistory("c")
+	if len(history) != 1 || history[0].Data.Room() != "c" || s.messageQueue.RoomLen("a") != 0 {
+		t.Fatalf("消息未移动到新房间: %+v", history)
+	}
+}
+
+func TestRoomPasswordFailuresDoNotLockOutOthers(t *testing.T) {
+	reg := newRoomRegistry(filepath.Join(t.TempDir(), "rooms.json"), t.Logf)
+	passwordHash, err := hashPassword("team-pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.create(RoomConfig{Name: "team", PasswordHash: passwordHash, Visibility: roomVisibilityPrivate}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 大量并发的错误密码只会排队计算，不会使之后的正确密码被拒绝
+	var wg sync.WaitGroup
+	for i := 0; i < 60; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if reg.checkPassword("team", "wrong-"+strconv.Itoa(i)) {
+				t.Error("错误的密码不应通过")
+			}
+		}(i)
+	}
+	wg.Wait()
+	if !reg.checkPassword("team", "team-pw") {
+		t.Fatal("错误密码之后正确的密码应通过")
+	}
+	if reg.checkPassword("team", "wrong-0") {
+		t.Fatal("缓存的错误结果应保持错误")
+	}
+	if !reg.checkPasswordCached("team", "team-pw") {
+		t.Fatal("通过校验的密码应被缓存")
+	}
+	if reg.checkPasswordCached("team", "never-checked") {
+		t.Fatal("只使用缓存时未校验过的密码不应通过")
+	}
+}
+
+func TestRoomPasswordFailuresLockOutAttackerIP(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Server.Auth = testAdminPassword
+		cfg.RateLimit.Enable = true
+	})
+	rec := do(t, s, http.MethodPost, "/rooms", `{"name":"team","password":"team-pw"}`,
+		"Content-Type", "application/json", "Authorization", "Bearer "+testAdminPassword)
+	expectStatus(t, rec, http.StatusCreated)
+	login := func(ip string, password string) int {
+		req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"room":"team","password":"`+password+`"}`))
+		req.RemoteAddr = ip + ":1234"
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		s.httpServer.Handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// 攻击者的 IP 在达到失败次数后被锁定，不再触发哈希计算
+	locked := false
+	for i := 0; i < 20 && !locked; i++ {
+		switch code := login("198.51.100.66", "wrong-"+strconv.Itoa(i)); code {
+		case http.StatusUnauthorized:
+		case http.StatusTooManyRequests:
+			locked = true
+		default:
+			t.Fatalf("错误的密码，状态码 = %d", code)
+		}
+	}
+	if !locked {
+		t.Fatal("攻击者的 IP 应被锁定")
+	}
+	// 其他客户端的正确密码不受影响
+	if code := login("203.0.113.5", "team-pw"); code != http.StatusOK {
+		t.Fatalf("其他 IP 使用正确的密码登录，状态码 = %d", code)
+	}
+}
+
+func TestRoomListOnlyHashesNamedRooms(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Server.Auth = testAdminPassword
+		cfg.Server.RoomList = true
+	})
+	rec := do(t, s, http.MethodPost, "/rooms", `{"name":"team","password":"team-pw"}`,
+		"Content-Type", "application/json", "Authorization", "Bearer "+testAdminPassword)
+	expectStatus(t, rec, http.StatusCreated)
+
+	listed := func(target string) bool {
+		rec := do(t, s, http.MethodGet, target, "", "X-Room-Auth-Tokens", `["team-pw"]`)
+		expectStatus(t, rec, http.StatusOK)
+		var resp RoomListResponse
+		decodeJSON(t, rec, &resp)
+		for _, room := range resp.Rooms {
+			if room.Name == "team" {
+				return true
+			}
+		}
+		return false
+	}
+
+	if listed("/rooms") {
+		t.Fatal("没有指定房间时不应计算房间密码的哈希")
+	}
+	if !listed("/rooms?room=team") {
+		t.Fatal("指定房间时应校验房间密码")
+	}
+	if !listed("/rooms") {
+		t.Fatal("校验过的密码应使用缓存结果")
+	}
+}
+
+func TestExtractAuthTokensIsCapped(t *testing.T) {
+	tokens := make([]string, 0, 20)
+	for i := 0; i < 20; i++ {
+		tokens = append(tokens, "token-"+strconv.Itoa(i))
+	}
+	req := httptest.NewRequest(http.MethodGet, "/rooms", nil)
+	req.Header.Set("Authorization", "Bearer first")
+	req.Header.Set("X-Room-Auth-Tokens", strings.Join(tokens, ","))
+	got := extractAuthTokens(req)
+	if len(got) != maxAuthTokens || got[0] != "first" {
+		t.Fatalf("extractAuthTokens = %v", got)
+	}
+}
@@ -0,0 +1,288 @@
+package lib
+
+/**
+*** FILE: roomsession.go
+***   POST /login exchanges a room password for a per-room HttpOnly session cookie, so passwords stay out of URLs
+**/
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	roomSessionPrefix       = "ccr_"
+	roomSessionCookiePrefix = "cc_room_"
+	defaultRoomSessionTTL   = 7 * 24 * 3600
+)
+
+var errSessionsDisabled = errors.New("会话登录未启用")
+
+// roomSession 是一个房间的登录会话，credential 是登录时使用的密码的哈希，密码修改后会话随之失效
+type roomSession struct {
+	room       string
+	credential string
+	expires    int64
+	lastSeen   int64
+}
+
+// roomSessionStore 保存房间会话（只保存在内存中，服务重启后需要重新登录）
+type roomSessionStore struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	idle     time.Duration
+	sessions map[string]*roomSession // 会话令牌的 SHA-256 -> 会话
+}
+
+func newRoomSessionStore(ttlSeconds int, idleSeconds int) *roomSessionStore {
+	if ttlSeconds <= 0 {
+		ttlSeconds = defaultRoomSessionTTL
+	}
+	if idleSeconds < 0 {
+		idleSeconds = 0
+	}
+	return &roomSessionStore{
+		ttl:      time.Duration(ttlSeconds) * time.Second,
+		idle:     time.Duration(idleSeconds) * time.Second,
+		sessions: make(map[string]*roomSession),
+	}
+}
+
+func (st *roomSessionStore) expiredLocked(sess *roomSession, now int64) bool {
+	if now >= sess.expires {
+		return true
+	}
+	return st.idle > 0 && now-sess.lastSeen >= int64(st.idle/time.Second)
+}
+
+// create 为房间创建会话，返回会话令牌和过期时间
+func (st *roomSessionStore) create(room string, credential string) (string, int64) {
+	token := roomSessionPrefix + base64.RawURLEncoding.EncodeToString(random_bytes(sessionTokenBytes))
+	now := time.Now()
+	expires := now.Add(st.ttl).Unix()
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for key, sess := range st.sessions {
+		if st.expiredLocked(sess, now.Unix()) {
+			delete(st.sessions, key)
+		}
+	}
+	st.sessions[hashSessionToken(token)] = &roomSession{room: room, credential: credential, expires: expires, lastSeen: now.Unix()}
+	return token, expires
+}
+
+// lookup 返回会话令牌对应的会话并刷新闲置时间，过期的会话被删除
+func (st *roomSessionStore) lookup(token string) (roomSession, bool) {
+	if !strings.HasPrefix(token, roomSessionPrefix) {
+		return roomSession{}, false
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	key := hashSessionToken(token)
+	sess, ok := st.sessions[key]
+	if !ok {
+		return roomSession{}, false
+	}
+	now := time.Now().Unix()
+	if st.expiredLocked(sess, now) {
+		delete(st.sessions, key)
+		return roomSession{}, false
+	}
+	sess.lastSeen = now
+	return *sess, true
+}
+
+func (st *roomSessionStore) remove(token string) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	key := hashSessionToken(token)
+	if _, ok := st.sessions[key]; !ok {
+		return false
+	}
+	delete(st.sessions, key)
+	return true
+}
+
+// roomSessionCookieName 返回房间会话 Cookie 的名称，房间名可能包含 Cookie 名称不允许的字符，因此使用其哈希
+func roomSessionCookieName(room string) string {
+	sum := sha256.Sum256([]byte(normalizeRoomName(room)))
+	return roomSessionCookiePrefix + hex.EncodeToString(sum[:8])
+}
+
+// roomSessionCookieToken 返回请求携带的该房间的会话 Cookie
+func roomSessionCookieToken(r *http.Request, room string) string {
+	if c, err := r.Cookie(roomSessionCookieName(room)); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+// roomSessionCookieTokens 返回请求携带的所有房间会话 Cookie（/rooms 和同时订阅多个房间时使用）
+func roomSessionCookieTokens(r *http.Request) []string {
+	var tokens []string
+	for _, c := range r.Cookies() {
+		if strings.HasPrefix(c.Name, roomSessionCookiePrefix) && c.Value != "" {
+			tokens = append(tokens, c.Value)
+		}
+	}
+	return tokens
+}
+
+// roomSessionCredential 返回 password 可以登录 room 时对应的凭据哈希（全局密码或房间密码）
+func (s *ClipboardServer) roomSessionCredential(room string, password string) (string, bool) {
+	if password == "" {
+		return "", false
+	}
+	if globalPassword := normalizeAuthValue(s.config.Server.Auth); globalPassword != "" && password == globalPassword {
+		return hashSessionToken("auth:" + globalPassword), true
+	}
+	if roomPassword := s.config.Server.RoomAuth[normalizeRoomName(room)]; roomPassword != "" && password == roomPassword {
+		return hashSessionToken("room:" + roomPassword), true
+	}
+	if s.rooms != nil && s.rooms.checkPassword(room, password) {
+		return hashSessionToken("registry:" + s.rooms.passwordHash(room)), true
+	}
+	return "", false
+}
+
+// roomSessionValid 判断会话登录时使用的密码是否仍然有效
+func (s *ClipboardServer) roomSessionValid(sess roomSession) bool {
+	if globalPassword := normalizeAuthValue(s.config.Server.Auth); globalPassword != "" && sess.credential == hashSessionToken("auth:"+globalPassword) {
+		return true
+	}
+	if roomPassword := s.config.Server.RoomAuth[sess.room]; roomPassword != "" {
+		return sess.credential == hashSessionToken("room:"+roomPassword)
+	}
+	// 房间存储中的密码修改、房间删除或改名后会话失效
+	if s.rooms != nil {
+		passwordHash := s.rooms.passwordHash(sess.room)
+		return passwordHash != "" && sess.credential == hashSessionToken("registry:"+passwordHash)
+	}
+	return false
+}
+
+// roomSessionRoom 返回房间会话令牌所属的房间
+func (s *ClipboardServer) roomSessionRoom(token string) (string, bool) {
+	if s.roomSessions == nil || token == "" {
+		return "", false
+	}
+	sess, ok := s.roomSessions.lookup(token)
+	if !ok || !s.roomSessionValid(sess) {
+		return "", false
+	}
+	return sess.room, true
+}
+
+// cookieSameSite 返回会话和设备 Cookie 使用的 SameSite 属性（session.sameSite）
+func (s *ClipboardServer) cookieSameSite() http.SameSite {
+	if strings.EqualFold(s.config.Session.SameSite, "lax") {
+		return http.SameSiteLaxMode
+	}
+	return http.SameSiteStrictMode
+}
+
+func (s *ClipboardServer) roomSessionCookie(r *http.Request, room string, value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     roomSessionCookieName(room),
+		Value:    value,
+		Path:     s.cookiePath(),
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   getScheme(r) == "https",
+		SameSite: s.cookieSameSite(),
+	}
+}
+
+// handleRoomLogin 处理 POST /login：用房间密码（或全局密码）换取该房间的会话 Cookie。
+// 请求体为 JSON {"room": "...", "password": "..."} 或表单
+func (s *ClipboardServer) handleRoomLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "仅允许 POST 请求", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.roomSessions == nil {
+		writeAuthJSONError(w, http.StatusNotFound, errSessionsDisabled.Error())
+		return
+	}
+
+	var body struct {
+		Room     string `json:"room"`
+		Password string `json:"password"`
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&body); err != nil {
+			http.Error(w, "无效的请求体", http.StatusBadRequest)
+			return
+		}
+	} else {
+		r.Body = http.MaxBytesReader(w, r.Body, 4096)
+		body.Room = r.PostFormValue("room")
+		body.Password = r.PostFormValue("password")
+	}
+
+	room := normalizeRoomName(body.Room)
+	clientIP := get_remote_ip(r)
+	requirement := s.resolveRoomAuth(room)
+	if !requirement.Required {
+		// 房间不需要密码，不创建会话
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"room": room, "required": false})
+		return
+	}
+
+	credential, ok := s.roomSessionCredential(room, body.Password)
+	if !ok {
+		s.logger.Printf("房间登录失败: 密码错误，来自 IP: %s, 房间: %s", clientIP, room)
+		writeAuthJSONError(w, http.StatusUnauthorized, "密码错误") // 由 withRateLimit 记录认证失败
+		return
+	}
+
+	token, expires := s.roomSessions.create(room, credential)
+	s.logger.Printf("房间登录成功: IP: %s, 房间: %s", clientIP, room)
+	s.recordAuditToken(r, body.Password, auditAuthLogin, room, "", map[string]any{"method": "password"})
+
+	http.SetCookie(w, s.roomSessionCookie(r, room, token, int(time.Until(time.Unix(expires, 0)).Seconds())))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{"room": room, "required": true, "expiresAt": expires})
+}
+
+// handleRoomLogout 处理 POST /logout?room=xxx：删除该房间的会话，不指定房间时删除请求携带的所有房间会话
+func (s *ClipboardServer) handleRoomLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "仅允许 POST 请求", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.roomSessions == nil {
+		writeAuthJSONError(w, http.StatusNotFound, errSessionsDisabled.Error())
+		return
+	}
+
+	if _, hasRoom := r.URL.Query()["room"]; hasRoom {
+		room := normalizeRoomName(r.URL.Query().Get("room"))
+		if token := roomSessionCookieToken(r, room); token != "" {
+			s.roomSessions.remove(token)
+		}
+		http.SetCookie(w, s.roomSessionCookie(r, room, "", -1))
+	} else {
+		for _, c := range r.Cookies() {
+			if !strings.HasPrefix(c.Name, roomSessionCookiePrefix) {
+				continue
+			}
+			s.roomSessions.remove(c.Value)
+			cookie := s.roomSessionCookie(r, "", "", -1)
+			cookie.Name = c.Name
+			http.SetCookie(w, cookie)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,337 @@
+package lib
+
+/**
+*** FILE: sensitive.go
+***   detect and mask secrets (keys, tokens, OTP codes) in text messages
+**/
+
+import (
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// sensitiveDetector 是检测流水线中的一个检测器，返回需要遮盖的区间
+type sensitiveDetector struct {
+	kind string
+	find func(text string) [][2]int
+}
+
+// regexDetector 用正则匹配整个区间；group > 0 时只遮盖指定的子匹配（例如 password=xxx 中的值）
+func regexDetector(kind string, pattern string, group int) sensitiveDetector {
+	re := regexp.MustCompile(pattern)
+	return sensitiveDetector{
+		kind: kind,
+		find: func(text string) [][2]int {
+			var spans [][2]int
+			for _, m := range re.FindAllStringSubmatchIndex(text, -1) {
+				if 2*group+1 < len(m) && m[2*group] >= 0 {
+					spans = append(spans, [2]int{m[2*group], m[2*group+1]})
+				}
+			}
+			return spans
+		},
+	}
+}
+
+// builtinSensitiveDetectors 内置检测器，顺序不影响结果
+var builtinSensitiveDetectors = []sensitiveDetector{
+	regexDetector("private_key", `-----BEGIN [A-Z0-9 ]*PRIVATE KEY-----[\s\S]*?(?:-----END [A-Z0-9 ]*PRIVATE KEY-----|$)`, 0),
+	regexDetector("aws_access_key", `\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`, 0),
+	regexDetector("github_token", `\b(?:gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})\b`, 0),
+	regexDetector("slack_token", `\bxox[abposr]-[A-Za-z0-9-]{10,}`, 0),
+	regexDetector("stripe_key", `\b[sr]k_(?:live|test)_[A-Za-z0-9]{16,}\b`, 0),
+	regexDetector("google_api_key", `\bAIza[0-9A-Za-z_\-]{35}`, 0),
+	regexDetector("api_key", `\bsk-[A-Za-z0-9_\-]{20,}`, 0),
+	regexDetector("jwt", `\beyJ[A-Za-z0-9_-]{5,}\.eyJ[A-Za-z0-9_-]{5,}\.[A-Za-z0-9_-]{5,}`, 0),
+	regexDetector("password", `(?i)(?:password|passwd|pwd|secret|token|api[_-]?key|access[_-]?key|密码|口令|密钥)["']?\s*[:=：]\s*["']?([^\s"',;]+)`, 1),
+	regexDetector("otp", `(?i)(?:验证码|校验码|动态码|动态密码|otp|passcode|verification code|security code|code)\D{0,12}?(\b\d{4,8}\b)`, 1),
+	regexDetector("otp", `^\s*(\d{6})\s*$`, 1), // 单独的 6 位数字几乎都是一次性验证码
+	{kind: "high_entropy", find: findHighEntropyTokens},
+}
+
+const (
+	highEntropyMinLength = 20  // 参与熵检测的最短词长度
+	highEntropyThreshold = 4.0 // 每个字符的香农熵阈值（bit）
+)
+
+// findHighEntropyTokens 找出看起来像随机密钥的长词：足够长、混合大小写与数字、熵足够高
+func findHighEntropyTokens(text string) [][2]int {
+	var spans [][2]int
+	start := -1
+	flush := func(end int) {
+		if start >= 0 && isHighEntropyToken(text[start:end]) {
+			spans = append(spans, [2]int{start, end})
+		}
+		start = -1
+	}
+	for i, r := range text {
+		if unicode.IsSpace(r) || strings.ContainsRune(`"'<>()[]{},;`, r) {
+			flush(i)
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+	}
+	flush(len(text))
+	return spans
+}
+
+func isHighEntropyToken(token string) bool {
+	if len(token) < highEntropyMinLength || strings.Contains(token, "://") {
+		return false
+	}
+	var upper, lower, digit bool
+	for _, r := range token {
+		switch {
+		case r > unicode.MaxASCII:
+			return false // 非 ASCII 的长词通常是正常文本
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		}
+	}
+	if !(upper && lower && digit) {
+		return false
+	}
+	return shannonEntropy(token) >= highEntropyThreshold
+}
+
+// shannonEntropy 计算字符串每个字符的香农熵
+func shannonEntropy(s string) float64 {
+	counts := make(map[rune]int)
+	total := 0
+	for _, r := range s {
+		counts[r]++
+		total++
+	}
+	entropy := 0.0
+	for _, c := range counts {
+		p := float64(c) / float64(total)
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// compileSensitiveDetectors 组合内置检测器和配置中的自定义正则
+func compileSensitiveDetectors(patterns []string, logf func(format string, v ...interface{})) []sensitiveDetector {
+	detectors := append([]sensitiveDetector{}, builtinSensitiveDetectors...)
+	for _, pattern := range patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			logf("警告: 忽略无效的敏感内容正则 %q: %v", pattern, err)
+			continue
+		}
+		detectors = append(detectors, regexDetector("custom", pattern, 0))
+	}
+	return detectors
+}
+
+// scanSensitive 运行检测流水线，返回命中的类型和遮盖后的文本；未启用或未命中时返回 nil
+func (s *ClipboardServer) scanSensitive(text string) (kinds []string, masked string) {
+	if !s.config.Sensitive.Enable || text == "" {
+		return nil, text
+	}
+
+	var spans [][2]int
+	seen := make(map[string]bool)
+	for _, detector := range s.sensitiveDetectors {
+		found := detector.find(text)
+		if len(found) == 0 {
+			continue
+		}
+		spans = append(spans, found...)
+		if !seen[detector.kind] {
+			seen[detector.kind] = true
+			kinds = append(kinds, detector.kind)
+		}
+	}
+	if len(kinds) == 0 {
+		return nil, text
+	}
+	return kinds, maskSpans(text, spans)
+}
+
+// maskSpans 合并重叠区间后逐段遮盖
+func maskSpans(text string, spans [][2]int) string {
+	sort.Slice(spans, func(i, j int) bool { return spans[i][0] < spans[j][0] })
+
+	var b strings.Builder
+	last := 0
+	for i := 0; i < len(spans); i++ {
+		start, end := spans[i][0], spans[i][1]
+		for i+1 < len(spans) && spans[i+1][0] <= end {
+			i++
+			if spans[i][1] > end {
+				end = spans[i][1]
+			}
+		}
+		if start < last {
+			start = last
+		}
+		b.WriteString(text[last:start])
+		b.WriteString(maskSecret(text[start:end]))
+		last = end
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
+
+// maskSecret 长密钥保留前 4 个字符便于辨认，其余替换为 *
+func maskSecret(secret string) string {
+	runes := []rune(secret)
+	keep := 0
+	if len(runes) >= 16 && !strings.HasPrefix(secret, "-----") {
+		keep = 4
+	}
+	stars := len(runes) - keep
+	if stars > 8 {
+		stars = 8
+	}
+	return string(runes[:keep]) + strings.Repeat("*", stars)
+}
+
+// markSensitive 检测文本消息，命中时设置敏感标记、遮盖内容以及自动过期时间
+func (s *ClipboardServer) markSensitive(textReceive *TextReceive) {
+	kinds, masked := s.scanSensitive(textReceive.Content)
+	if len(kinds) == 0 {
+		textReceive.Sensitive = false
+		textReceive.SensitiveKinds = nil
+		textReceive.Masked = ""
+		textReceive.ExpireAt = 0
+		return
+	}
+
+	textReceive.Sensitive = true
+	textReceive.SensitiveKinds = kinds
+	textReceive.Masked = masked
+	if ttl := s.config.Sensitive.TTL; ttl > 0 {
+		textReceive.ExpireAt = time.Now().Unix() + int64(ttl)
+	}
+}
+
+// markSensitiveFile 对超长文本转存的文件检测完整文本（不只是预览），命中时标记为敏感
+func (s *ClipboardServer) markSensitiveFile(fileReceive *FileReceive, text string) {
+	kinds, _ := s.scanSensitive(text)
+	if len(kinds) == 0 {
+		return
+	}
+	fileReceive.Sensitive = true
+	fileReceive.SensitiveKinds = kinds
+	if ttl := s.config.Sensitive.TTL; ttl > 0 {
+		fileReceive.ExpireAt = time.Now().Unix() + int64(ttl)
+	}
+}
+
+// logText 返回可以写入日志的文本，敏感内容会被遮盖
+func (s *ClipboardServer) logText(text string) string {
+	_, masked := s.scanSensitive(text)
+	return masked
+}
+
+// addSensitiveFields 为内容 JSON 响应添加敏感标记
+func addSensitiveFields(responseData map[string]interface{}, textReceive *TextReceive) {
+	if !textReceive.Sensitive {
+		return
+	}
+	responseData["sensitive"] = true
+	responseData["sensitiveKinds"] = textReceive.SensitiveKinds
+	if textReceive.ExpireAt > 0 {
+		responseData["expireAt"] = textReceive.ExpireAt
+	}
+}
+
+// addSensitiveFileFields 为文件信息 JSON 响应添加敏感标记
+func addSensitiveFileFields(responseData map[string]interface{}, fileReceive *FileReceive) {
+	if !fileReceive.Sensitive {
+		return
+	}
+	responseData["sensitive"] = true
+	responseData["sensitiveKinds"] = fileReceive.SensitiveKinds
+	if fileReceive.ExpireAt > 0 {
+		responseData["expireAt"] = fileReceive.ExpireAt
+	}
+}
+
+// allowSensitiveFile 敏感文件只在请求显式 reveal 时返回原文，否则返回 403 并返回 false
+func (s *ClipboardServer) allowSensitiveFile(w http.ResponseWriter, r *http.Request, sensitive bool, name string) bool {
+	if !sensitive {
+		return true
+	}
+	if !isRevealRequest(r) {
+		http.Error(w, "敏感内容需要使用 ?reveal=1 获取原文", http.StatusForbidden)
+		return false
+	}
+	s.logger.Printf("敏感文件内容已按请求返回原文: %s, 来源: %s", name, get_remote_ip(r))
+	return true
+}
+
+// isRevealRequest 判断请求是否显式要求显示敏感内容原文
+func isRevealRequest(r *http.Request) bool {
+	reveal := strings.ToLower(r.URL.Query().Get("reveal"))
+	return reveal == "1" || reveal == "true"
+}
+
+// expireSensitiveLoop 定期撤销已到期的敏感消息
+func (s *ClipboardServer) expireSensitiveLoop() {
+	if !s.config.Sensitive.Enable || s.config.Sensitive.TTL <= 0 {
+		return
+	}
+
+	interval := 10 * time.Second
+	if ttl := time.Duration(s.config.Sensitive.TTL) * time.Second; ttl < interval {
+		interval = ttl
+	}
+	s.logger.Printf("敏感消息自动过期任务已启动，过期时间: %d 秒", s.config.Sensitive.TTL)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.expireSensitiveMessages()
+	}
+}
+
+func (s *ClipboardServer) expireSensitiveMessages() {
+	now := time.Now().Unix()
+
+	s.messageQueue.Lock()
+	expired := s.messageQueue.DeleteWhere(func(msg *PostEvent) bool {
+		if fileReceive := msg.Data.FileReceive; fileReceive != nil {
+			return fileReceive.ExpireAt > 0 && fileReceive.ExpireAt <= now
+		}
+		textReceive := msg.Data.TextReceive
+		return textReceive != nil && textReceive.ExpireAt > 0 && textReceive.ExpireAt <= now
+	})
+	if len(expired) == 0 {
+		s.messageQueue.Unlock()
+		return
+	}
+
+	var cascaded, orphaned []PostEvent
+	for _, msg := range expired {
+		c, o := s.applyReplyRevokePolicyLocked(msg)
+		cascaded = append(cascaded, c...)
+		orphaned = append(orphaned, o...)
+	}
+	s.messageQueue.Unlock()
+
+	for _, msg := range expired {
+		s.logger.Printf("敏感消息已过期并撤销, ID: %d (房间: %s)", msg.Data.ID(), normalizeRoomName(msg.Data.Room()))
+		s.cleanupRevokedMessage(msg)
+	}
+	for _, reply := range cascaded {
+		s.logger.Printf("级联撤销回复消息 ID: %d (父消息 ID: %d)", reply.Data.ID(), reply.Data.ReplyTo())
+		s.cleanupRevokedMessage(reply)
+	}
+	for _, msg := range orphaned {
+		s.broadcastMessageUpdate(msg)
+	}
+	s.saveHistoryData()
+}
@@ -0,0 +1,165 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestServer 创建使用临时目录的服务器并设置路由，mutate 可以在创建前修改默认配置
+func newTestServer(t testing.TB, mutate func(cfg *Config)) *ClipboardServer {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := defaultConfig()
+	cfg.Server.StorageDir = filepath.Join(dir, "uploads")
+	cfg.Server.HistoryFile = filepath.Join(dir, "history.json")
+	cfg.RateLimit.Enable = false
+	cfg.Audit.Enable = false
+	if mutate != nil {
+		mutate(cfg)
+	}
+
+	s, err := NewClipboardServer(cfg)
+	if err != nil {
+		t.Fatalf("NewClipboardServer: %v", err)
+	}
+	s.logger.SetOutput(io.Discard)
+	s.setupRoutes()
+	return s
+}
+
+// do 发送请求并返回响应，headers 中的键值对设置为请求头
+func do(t testing.TB, s *ClipboardServer, method string, target string, body string, headers ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, target, reader)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	rec := httptest.NewRecorder()
+	s.httpServer.Handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// decodeJSON 解析响应体
+func decodeJSON(t testing.TB, rec *httptest.ResponseRecorder, v any) {
+	t.Helper()
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("解析响应失败: %v，响应: %s", err, rec.Body.String())
+	}
+}
+
+// expectStatus 检查响应状态码
+func expectStatus(t testing.TB, rec *httptest.ResponseRecorder, want int) {
+	t.Helper()
+	if rec.Code != want {
+		t.Fatalf("状态码 = %d，期望 %d，响应: %s", rec.Code, want, rec.Body.String())
+	}
+}
+
+// cookieValue 返回响应设置的 Cookie
+func cookieValue(rec *httptest.ResponseRecorder, name string) (string, bool) {
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == name {
+			return c.Value, true
+		}
+	}
+	return "", false
+}
+
+// postText 以 headers 发送文本消息，返回消息 ID
+func postText(t testing.TB, s *ClipboardServer, target string, content string, headers ...string) string {
+	t.Helper()
+	rec := do(t, s, http.MethodPost, target, content, append([]string{"Content-Type", "text/plain"}, headers...)...)
+	expectStatus(t, rec, http.StatusOK)
+	var resp struct {
+		ID string `json:"id"`
+	}
+	decodeJSON(t, rec, &resp)
+	return resp.ID
+}
+
+// startTestServer 在 httptest.Server 上运行服务器路由（WebSocket 测试使用）
+func startTestServer(t testing.TB, s *ClipboardServer) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewServer(s.httpServer.Handler)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// dialPush 连接 /push，query 为查询字符串（不含 ?）
+func dialPush(t testing.TB, ts *httptest.Server, query string, header http.Header) *websocket.Conn {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/push?" + query
+	conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		t.Fatalf("连接 /push 失败: %v（状态码 %d）", err, status)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// readEvents 读取 WebSocket 消息直到 d 时间内没有新消息，返回事件名 -> 载荷列表
+func readEvents(t testing.TB, conn *websocket.Conn, d time.Duration) map[string][]json.RawMessage {
+	t.Helper()
+	events := make(map[string][]json.RawMessage)
+	for {
+		conn.SetReadDeadline(time.Now().Add(d))
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return events
+		}
+		var msg struct {
+			Event string          `json:"event"`
+			Data  json.RawMessage `json:"data"`
+		}
+		if json.Unmarshal(data, &msg) == nil {
+			events[msg.Event] = append(events[msg.Event], msg.Data)
+		}
+	}
+}
+
+// waitFor 等待 cond 成立，超时后测试失败
+func waitFor(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("等待超时: %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// readSSE 读取 SSE 流 d 时间，返回已收到的内容和状态码
+func readSSE(t testing.TB, ts *httptest.Server, target string, d time.Duration) (string, int) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("请求 %s 失败: %v", target, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body) // 超时后返回已读取的部分
+	return string(body), resp.StatusCode
+}
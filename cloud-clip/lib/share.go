@@ -0,0 +1,598 @@
+package lib
+
+/**
+*** FILE: share.go
+***   HMAC-signed, expiring share links (/s/{token}) granting read access to a single message or file
+**/
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultShareTTL = 24 * 3600       // 分享链接默认有效期（秒）
+	shareSigLen     = 16              // 链接中 HMAC-SHA256 签名保留的字节数
+	shareSaveDelay  = 5 * time.Second // 下载次数变化后延迟写入的时间
+)
+
+var (
+	errShareNotFound = errors.New("分享链接不存在或已被撤销")
+	errShareExpired  = errors.New("分享链接已过期")
+	errShareUsedUp   = errors.New("分享链接的下载次数已用完")
+)
+
+// Share 是一个分享链接，只允许读取一条消息。链接本身只包含 ID、过期时间和签名，下载次数和口令保存在服务端
+type Share struct {
+	ID             string `json:"id"`
+	MessageID      int    `json:"messageId"`
+	Room           string `json:"room"`
+	Created        int64  `json:"created"`
+	CreatedBy      string `json:"createdBy,omitempty"`
+	Expires        int64  `json:"expires"`
+	MaxDownloads   int    `json:"maxDownloads,omitempty"` // 0 表示不限制
+	Downloads      int    `json:"downloads"`
+	PassphraseHash string `json:"passphraseHash,omitempty"`
+	// Fingerprint 是创建时消息的指纹（见 shareFingerprint）。消息 ID 在重启后会被重新使用，
+	// 访问时指纹不一致说明原消息已不存在，避免旧链接返回之后的其他消息
+	Fingerprint string `json:"fingerprint"`
+}
+
+// ShareInfo 是返回给房间成员的分享链接信息（不含口令哈希）
+type ShareInfo struct {
+	ID           string `json:"id"`
+	URL          string `json:"url"`
+	MessageID    int    `json:"messageId"`
+	Room         string `json:"room"`
+	Created      int64  `json:"created"`
+	CreatedBy    string `json:"createdBy,omitempty"`
+	Expires      int64  `json:"expires"`
+	MaxDownloads int    `json:"maxDownloads,omitempty"`
+	Downloads    int    `json:"downloads"`
+	Protected    bool   `json:"protected"` // 是否需要口令
+}
+
+// shareStore 保存分享链接，持久化到 shares.json；签名密钥来自 share.secret 或 share.key
+type shareStore struct {
+	mu     sync.Mutex
+	path   string
+	key    []byte
+	shares map[string]*Share
+	// 下载次数只在内存中更新，由 saveTimer 延迟写入；没有待写入的修改时为 nil
+	saveTimer *time.Timer
+	logf      func(format string, v ...any)
+}
+
+// sharesFilePath 返回分享链接存储文件路径（与用户存储在同一目录）
+func sharesFilePath(cfg *Config) string {
+	return filepath.Join(filepath.Dir(usersFilePath(cfg)), "shares.json")
+}
+
+func newShareStore(cfg *Config, logf func(format string, v ...any)) *shareStore {
+	path := sharesFilePath(cfg)
+	st := &shareStore{
+		path:   path,
+		key:    loadShareKey(cfg, logf),
+		shares: make(map[string]*Share),
+		logf:   logf,
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logf("警告: 读取分享链接存储 %s 失败: %v", path, err)
+		}
+		return st
+	}
+	var shares []Share
+	if err := json.Unmarshal(data, &shares); err != nil {
+		logf("警告: 解析分享链接存储 %s 失败: %v", path, err)
+		return st
+	}
+	for i := range shares {
+		st.shares[shares[i].ID] = &shares[i]
+	}
+	return st
+}
+
+// loadShareKey 返回签名密钥：配置了 share.secret 时使用它，否则读取 share.key，不存在时生成一个并保存。
+// 密钥改变后已发出的链接全部失效。
+func loadShareKey(cfg *Config, logf func(format string, v ...any)) []byte {
+	if cfg.Share.Secret != "" {
+		return []byte(cfg.Share.Secret)
+	}
+
+	path := filepath.Join(filepath.Dir(sharesFilePath(cfg)), "share.key")
+	if data, err := os.ReadFile(path); err == nil {
+		if key, err := hex.DecodeString(strings.TrimSpace(string(data))); err == nil && len(key) >= 32 {
+			return key
+		}
+		logf("警告: 分享链接密钥 %s 无效，重新生成", path)
+	}
+
+	key := random_bytes(32)
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+		logf("警告: 保存分享链接密钥 %s 失败，重启后已有的分享链接将失效: %v", path, err)
+	}
+	return key
+}
+
+// saveLocked 删除过期的分享链接并写入文件，必须在 st.mu 锁定时调用
+func (st *shareStore) saveLocked() error {
+	if st.saveTimer != nil {
+		st.saveTimer.Stop()
+		st.saveTimer = nil
+	}
+	now := time.Now().Unix()
+	shares := make([]Share, 0, len(st.shares))
+	for id, sh := range st.shares {
+		if now >= sh.Expires {
+			delete(st.shares, id)
+			continue
+		}
+		shares = append(shares, *sh)
+	}
+	sort.Slice(shares, func(i, j int) bool { return shares[i].Created < shares[j].Created })
+
+	data, err := json.MarshalIndent(shares, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(st.path, data, 0600)
+}
+
+// scheduleSaveLocked 在 shareSaveDelay 后写入文件，期间的多次修改合并为一次写入，必须在 st.mu 锁定时调用
+func (st *shareStore) scheduleSaveLocked() {
+	if st.saveTimer != nil {
+		return
+	}
+	st.saveTimer = time.AfterFunc(shareSaveDelay, func() {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		st.saveTimer = nil
+		if err := st.saveLocked(); err != nil {
+			st.logf("警告: 保存分享链接存储失败: %v", err)
+		}
+	})
+}
+
+// flush 立即写入延迟的修改（服务器停止时调用）
+func (st *shareStore) flush() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.saveTimer == nil {
+		return nil
+	}
+	return st.saveLocked()
+}
+
+// sign 返回分享链接中的令牌：{id}.{过期时间}.{签名}
+func (st *shareStore) sign(id string, expires int64) string {
+	payload := id + "." + strconv.FormatInt(expires, 10)
+	mac := hmac.New(sha256.New, st.key)
+	mac.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:shareSigLen])
+}
+
+// verify 校验令牌签名和过期时间，返回分享链接 ID
+func (st *shareStore) verify(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errShareNotFound
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", errShareNotFound
+	}
+	if !hmac.Equal([]byte(st.sign(parts[0], expires)), []byte(token)) {
+		return "", errShareNotFound
+	}
+	if time.Now().Unix() >= expires {
+		return "", errShareExpired
+	}
+	return parts[0], nil
+}
+
+func (st *shareStore) create(sh Share) (Share, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	sh.ID = hex.EncodeToString(random_bytes(8))
+	st.shares[sh.ID] = &sh
+	if err := st.saveLocked(); err != nil {
+		delete(st.shares, sh.ID)
+		return Share{}, err
+	}
+	return sh, nil
+}
+
+func (st *shareStore) get(id string) (Share, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	sh, ok := st.shares[id]
+	if !ok {
+		return Share{}, false
+	}
+	return *sh, true
+}
+
+// consume 记录一次下载，超过最大下载次数时返回 errShareUsedUp。
+// 计数在内存中立即生效，文件延迟写入，因此进程异常退出时可能丢失最近几秒的计数
+func (st *shareStore) consume(id string) (Share, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	sh, ok := st.shares[id]
+	if !ok {
+		return Share{}, errShareNotFound
+	}
+	if sh.MaxDownloads > 0 && sh.Downloads >= sh.MaxDownloads {
+		return Share{}, errShareUsedUp
+	}
+	sh.Downloads++
+	st.scheduleSaveLocked()
+	return *sh, nil
+}
+
+// revoke 删除房间中的分享链接
+func (st *shareStore) revoke(id string, room string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	sh, ok := st.shares[id]
+	if !ok || sh.Room != room {
+		return errShareNotFound
+	}
+	delete(st.shares, id)
+	return st.saveLocked()
+}
+
+// removeMessages 删除房间中指向这些消息的分享链接（消息被撤销时调用），返回删除的数量
+func (st *shareStore) removeMessages(room string, ids ...int) int {
+	remove := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		remove[id] = true
+	}
+	return st.removeWhere(func(sh *Share) bool { return sh.Room == room && remove[sh.MessageID] })
+}
+
+// removeRoom 删除房间中的全部分享链接（房间被清空、删除或改名时调用），返回删除的数量
+func (st *shareStore) removeRoom(room string) int {
+	return st.removeWhere(func(sh *Share) bool { return sh.Room == room })
+}
+
+func (st *shareStore) removeWhere(match func(sh *Share) bool) int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	removed := 0
+	for id, sh := range st.shares {
+		if match(sh) {
+			delete(st.shares, id)
+			removed++
+		}
+	}
+	if removed > 0 {
+		if err := st.saveLocked(); err != nil {
+			st.logf("警告: 保存分享链接存储失败: %v", err)
+		}
+	}
+	return removed
+}
+
+// shareFingerprint 返回消息的指纹：发送时间、类型，以及文本内容或文件缓存 UUID 的 SHA-256。
+// 修改文本后指纹随之改变，原来的分享链接失效
+func shareFingerprint(msg *PostEvent) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\x00%s\x00", msg.Data.Timestamp(), msg.Data.Type())
+	switch {
+	case msg.Data.TextReceive != nil:
+		h.Write([]byte(msg.Data.TextReceive.Content))
+	case msg.Data.FileReceive != nil:
+		h.Write([]byte(msg.Data.FileReceive.Cache))
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// list 返回房间中未过期的分享链接
+func (st *shareStore) list(room string) []Share {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	now := time.Now().Unix()
+	shares := []Share{}
+	for _, sh := range st.shares {
+		if sh.Room == room && now < sh.Expires {
+			shares = append(shares, *sh)
+		}
+	}
+	sort.Slice(shares, func(i, j int) bool { return shares[i].Created < shares[j].Created })
+	return shares
+}
+
+func (s *ClipboardServer) shareInfo(r *http.Request, sh Share) ShareInfo {
+	return ShareInfo{
+		ID:           sh.ID,
+		URL:          fmt.Sprintf("%s://%s%s/s/%s", getScheme(r), r.Host, s.config.Server.Prefix, s.shares.sign(sh.ID, sh.Expires)),
+		MessageID:    sh.MessageID,
+		Room:         sh.Room,
+		Created:      sh.Created,
+		CreatedBy:    sh.CreatedBy,
+		Expires:      sh.Expires,
+		MaxDownloads: sh.MaxDownloads,
+		Downloads:    sh.Downloads,
+		Protected:    sh.PassphraseHash != "",
+	}
+}
+
+// handleShares 处理房间成员的分享链接管理：
+// POST /share?room=xxx 创建；GET /share?room=xxx 列出房间中的分享链接；DELETE /share/{id}?room=xxx 撤销
+func (s *ClipboardServer) handleShares(w http.ResponseWriter, r *http.Request) {
+	if !s.config.Share.Enable {
+		http.NotFound(w, r)
+		return
+	}
+	room := normalizeRoomName(r.URL.Query().Get("room"))
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, s.config.Server.Prefix+"/share"), "/")
+
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		s.handleCreateShare(w, r, room)
+	case id == "" && r.Method == http.MethodGet:
+		infos := []ShareInfo{}
+		for _, sh := range s.shares.list(room) {
+			infos = append(infos, s.shareInfo(r, sh))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(map[string]any{"room": room, "shares": infos})
+	case id != "" && r.Method == http.MethodDelete:
+		if err := s.shares.revoke(id, room); err != nil {
+			if err == errShareNotFound {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			s.logger.Printf("错误: 保存分享链接存储失败: %v", err)
+			http.Error(w, "撤销分享链接失败", http.StatusInternalServerError)
+			return
+		}
+		s.logger.Printf("撤销分享链接 %s，房间: %s，操作者: %s", id, room, s.requester(r))
+		s.recordAudit(r, auditShareRevoke, room, id, nil)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "不支持的请求方法", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *ClipboardServer) handleCreateShare(w http.ResponseWriter, r *http.Request, room string) {
+	var body struct {
+		ID           int    `json:"id"`           // 消息 ID
+		ExpiresIn    string `json:"expiresIn"`    // 如 "1h"、"7d"，为空时使用 share.defaultTTL
+		MaxDownloads int    `json:"maxDownloads"` // 0 表示不限制
+		Passphrase   string `json:"passphrase"`   // 为空表示不需要口令
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&body); err != nil {
+		http.Error(w, "无效的请求体", http.StatusBadRequest)
+		return
+	}
+	if body.MaxDownloads < 0 {
+		http.Error(w, "无效的下载次数", http.StatusBadRequest)
+		return
+	}
+
+	ttl := time.Duration(s.config.Share.DefaultTTL) * time.Second
+	if body.ExpiresIn != "" {
+		parsed, err := parseTokenExpiry(body.ExpiresIn)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "无效的有效期: "+body.ExpiresIn, http.StatusBadRequest)
+			return
+		}
+		ttl = parsed
+	}
+	if ttl <= 0 {
+		ttl = defaultShareTTL * time.Second
+	}
+	if maxTTL := time.Duration(s.config.Share.MaxTTL) * time.Second; maxTTL > 0 && ttl > maxTTL {
+		http.Error(w, fmt.Sprintf("有效期不能超过 %s", maxTTL), http.StatusBadRequest)
+		return
+	}
+
+	// 只能分享请求房间中的消息，敏感消息不允许分享
+	s.messageQueue.Lock()
+	found := s.messageQueue.Get(body.ID)
+	var msg PostEvent
+	if found != nil {
+		msg = *found
+	}
+	s.messageQueue.Unlock()
+	// 发给其他设备的私信按未找到处理，避免通过分享链接绕过收件人限制
+	if found == nil || normalizeRoomName(msg.Data.Room()) != room || !msg.Data.VisibleTo(s.requestDeviceID(r)) {
+		http.Error(w, "内容未找到", http.StatusNotFound)
+		return
+	}
+	if (msg.Data.TextReceive != nil && msg.Data.TextReceive.Sensitive) || (msg.Data.FileReceive != nil && msg.Data.FileReceive.Sensitive) {
+		http.Error(w, "敏感内容不能分享", http.StatusForbidden)
+		return
+	}
+
+	sh := Share{
+		MessageID:    body.ID,
+		Room:         room,
+		Created:      time.Now().Unix(),
+		CreatedBy:    s.requester(r),
+		Expires:      time.Now().Add(ttl).Unix(),
+		MaxDownloads: body.MaxDownloads,
+		Fingerprint:  shareFingerprint(&msg),
+	}
+	if body.Passphrase != "" {
+		hash, err := hashPassword(body.Passphrase)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sh.PassphraseHash = hash
+	}
+
+	sh, err := s.shares.create(sh)
+	if err != nil {
+		s.logger.Printf("错误: 保存分享链接存储失败: %v", err)
+		http.Error(w, "保存分享链接失败", http.StatusInternalServerError)
+		return
+	}
+	s.logger.Printf("创建分享链接 %s，消息: %d，房间: %s，创建者: %s，来自 IP: %s", sh.ID, sh.MessageID, room, sh.CreatedBy, get_remote_ip(r))
+	s.recordAudit(r, auditShareCreate, room, sh.ID, map[string]any{"message": sh.MessageID, "expiresAt": sh.Expires, "maxDownloads": sh.MaxDownloads, "protected": sh.PassphraseHash != ""})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(s.shareInfo(r, sh))
+}
+
+// sharePassphrase 返回请求中的口令：X-Share-Passphrase 头或 POST 表单的 passphrase 字段（不接受查询参数，避免口令出现在日志中）
+func sharePassphrase(r *http.Request) string {
+	if passphrase := r.Header.Get("X-Share-Passphrase"); passphrase != "" {
+		return passphrase
+	}
+	if r.Method == http.MethodPost {
+		r.Body = io.NopCloser(io.LimitReader(r.Body, 4096))
+		return r.PostFormValue("passphrase")
+	}
+	return ""
+}
+
+// writeSharePassphraseForm 返回输入口令的页面（浏览器访问时），其他客户端只返回错误信息
+func writeSharePassphraseForm(w http.ResponseWriter, r *http.Request, message string) {
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Error(w, message, http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusUnauthorized)
+	fmt.Fprintf(w, `<!DOCTYPE html><html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width,initial-scale=1"><title>Cloud Clipboard</title></head>
+<body style="font-family:sans-serif;max-width:360px;margin:4em auto"><p>%s</p>
+<form method="post"><input type="password" name="passphrase" autofocus required style="width:100%%;padding:.5em;box-sizing:border-box">
+<button type="submit" style="margin-top:1em;padding:.5em 2em">OK</button></form></body></html>`, html.EscapeString(message))
+}
+
+// handleShareAccess 处理 GET/POST /s/{token}：校验签名、过期时间、下载次数和口令后返回分享的消息，不需要房间认证
+func (s *ClipboardServer) handleShareAccess(w http.ResponseWriter, r *http.Request) {
+	if !s.config.Share.Enable {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodPost {
+		http.Error(w, "不支持的请求方法", http.StatusMethodNotAllowed)
+		return
+	}
+
+	clientIP := get_remote_ip(r)
+	token := strings.TrimPrefix(r.URL.Path, s.config.Server.Prefix+"/s/")
+	id, err := s.shares.verify(token)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	sh, ok := s.shares.get(id)
+	if !ok {
+		http.Error(w, errShareNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	if sh.PassphraseHash != "" {
+		passphrase := sharePassphrase(r)
+		if passphrase == "" {
+			writeSharePassphraseForm(w, r, "该分享链接需要口令")
+			return
+		}
+		if !verifyPassword(sh.PassphraseHash, passphrase) {
+			s.logger.Printf("分享链接 %s 口令错误，来自 IP: %s", sh.ID, clientIP)
+			writeSharePassphraseForm(w, r, "口令错误")
+			return
+		}
+	}
+
+	// 第一步：在锁内复制消息，消息已被撤销时链接失效；同一 ID 的其他消息（重启后 ID 被重新使用）按链接不存在处理
+	s.messageQueue.Lock()
+	found := s.messageQueue.Get(sh.MessageID)
+	var msg PostEvent
+	if found != nil {
+		msg = *found
+	}
+	s.messageQueue.Unlock()
+	if found == nil {
+		http.Error(w, "分享的内容已不存在", http.StatusGone)
+		return
+	}
+	if normalizeRoomName(msg.Data.Room()) != sh.Room || sh.Fingerprint == "" || !hmac.Equal([]byte(shareFingerprint(&msg)), []byte(sh.Fingerprint)) {
+		http.Error(w, errShareNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	var file *os.File
+	if msg.Data.FileReceive != nil {
+		s.runMutex.Lock()
+		fileInfo, ok := s.uploadFileMap[msg.Data.FileReceive.Cache]
+		s.runMutex.Unlock()
+		if !ok || fileInfo.ExpireTime < time.Now().Unix() {
+			http.Error(w, "分享的文件已过期", http.StatusGone)
+			return
+		}
+		if file, err = os.Open(filepath.Join(s.storageFolder, msg.Data.FileReceive.Cache)); err != nil {
+			s.logger.Printf("错误: 打开文件失败: %v", err)
+			http.Error(w, "文件在磁盘上未找到", http.StatusGone)
+			return
+		}
+		defer file.Close()
+	}
+
+	// 第二步：计入下载次数（HEAD 请求除外；分段请求也计入，否则可以用 Range 绕过次数限制）
+	if r.Method != http.MethodHead {
+		if sh, err = s.shares.consume(sh.ID); err != nil {
+			if err == errShareUsedUp || err == errShareNotFound {
+				http.Error(w, err.Error(), http.StatusGone)
+				return
+			}
+			s.logger.Printf("警告: 保存分享链接存储失败: %v", err)
+		}
+		s.logger.Printf("分享链接 %s 被访问（第 %d 次），消息: %d，来自 IP: %s", sh.ID, sh.Downloads, sh.MessageID, clientIP)
+	}
+
+	// 第三步：返回内容
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	if file != nil {
+		stat, err := file.Stat()
+		if err != nil {
+			http.Error(w, "无法获取文件状态", http.StatusInternalServerError)
+			return
+		}
+		dispositionType := "inline"
+		if r.URL.Query().Get("download") == "true" {
+			dispositionType = "attachment"
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf("%s; filename=%q", dispositionType, msg.Data.FileReceive.Name))
+		http.ServeContent(w, r, msg.Data.FileReceive.Name, stat.ModTime(), file)
+		return
+	}
+	if msg.Data.TextReceive == nil {
+		http.Error(w, "分享的内容已不存在", http.StatusGone)
+		return
+	}
+	content := msg.Data.TextReceive.Content
+	if !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(content))
+}
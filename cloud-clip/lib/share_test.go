@@ -0,0 +1,168 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func createTestShare(t *testing.T, s *ClipboardServer, body string, headers ...string) (ShareInfo, int) {
+	t.Helper()
+	headers = append(headers, "Content-Type", "application/json")
+	rec := do(t, s, http.MethodPost, "/share?room=", body, headers...)
+	var info ShareInfo
+	if rec.Code == http.StatusCreated {
+		decodeJSON(t, rec, &info)
+	}
+	return info, rec.Code
+}
+
+func TestShareRespectsDirectRecipient(t *testing.T) {
+	s := newTestServer(t, nil)
+	targetID, targetSecret := registerTestDevice(t, s, "目标")
+	otherID, otherSecret := registerTestDevice(t, s, "其他")
+	directID := postText(t, s, "/text?to="+targetID, "direct secret")
+	body := `{"id":` + directID + `}`
+
+	for name, headers := range map[string][]string{
+		"匿名":   nil,
+		"其他设备": {"X-Device-Id", otherID, "X-Device-Secret", otherSecret},
+	} {
+		if _, code := createTestShare(t, s, body, headers...); code != http.StatusNotFound {
+			t.Fatalf("%s: 分享发给其他设备的私信，状态码 = %d", name, code)
+		}
+	}
+	if _, code := createTestShare(t, s, body, "X-Device-Id", targetID, "X-Device-Secret", targetSecret); code != http.StatusCreated {
+		t.Fatalf("收件设备分享私信，状态码 = %d", code)
+	}
+}
+
+func TestShareDownloadsAreDebounced(t *testing.T) {
+	s := newTestServer(t, nil)
+	id := postText(t, s, "/text", "shared")
+	info, code := createTestShare(t, s, `{"id":`+id+`,"maxDownloads":2}`)
+	if code != http.StatusCreated {
+		t.Fatalf("创建分享链接，状态码 = %d", code)
+	}
+	link, err := url.Parse(info.URL)
+	if err != nil {
+		t.Fatalf("解析分享链接 %q: %v", info.URL, err)
+	}
+
+	storedDownloads := func() int {
+		t.Helper()
+		data, err := os.ReadFile(s.shares.path)
+		if err != nil {
+			t.Fatalf("读取分享链接存储: %v", err)
+		}
+		var shares []Share
+		if err := json.Unmarshal(data, &shares); err != nil {
+			t.Fatalf("解析分享链接存储: %v", err)
+		}
+		if len(shares) != 1 {
+			t.Fatalf("分享链接数量 = %d", len(shares))
+		}
+		return shares[0].Downloads
+	}
+
+	for i := 0; i < 2; i++ {
+		expectStatus(t, do(t, s, http.MethodGet, link.Path, ""), http.StatusOK)
+	}
+	// 次数限制立即生效，但文件要等到延迟写入时才更新
+	expectStatus(t, do(t, s, http.MethodGet, link.Path, ""), http.StatusGone)
+	if n := storedDownloads(); n != 0 {
+		t.Fatalf("下载后立即写入了文件，downloads = %d", n)
+	}
+	if err := s.shares.flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if n := storedDownloads(); n != 2 {
+		t.Fatalf("flush 后 downloads = %d，期望 2", n)
+	}
+	s.shares.mu.Lock()
+	pending := s.shares.saveTimer != nil
+	s.shares.mu.Unlock()
+	if pending {
+		t.Fatal("flush 后仍有待写入的修改")
+	}
+}
+
+// shareLinkPath 创建分享链接并返回链接路径
+func shareLinkPath(t *testing.T, s *ClipboardServer, room string, id string, headers ...string) string {
+	t.Helper()
+	headers = append(headers, "Content-Type", "application/json")
+	rec := do(t, s, http.MethodPost, "/share?room="+room, `{"id":`+id+`}`, headers...)
+	expectStatus(t, rec, http.StatusCreated)
+	var info ShareInfo
+	decodeJSON(t, rec, &info)
+	link, err := url.Parse(info.URL)
+	if err != nil {
+		t.Fatalf("解析分享链接 %q: %v", info.URL, err)
+	}
+	return link.Path
+}
+
+func TestSharesRemovedWithMessages(t *testing.T) {
+	s := newRoomsTestServer(t)
+	auth := []string{"Authorization", "Bearer team-pw"}
+	post := func() string { return postText(t, s, "/text?room=team", "team secret", auth...) }
+	expectRemoved := func(t *testing.T, link string) {
+		t.Helper()
+		expectStatus(t, do(t, s, http.MethodGet, link, ""), http.StatusNotFound)
+		if shares := s.shares.list("team"); len(shares) != 0 {
+			t.Fatalf("房间中仍有 %d 个分享链接", len(shares))
+		}
+	}
+
+	t.Run("撤销消息", func(t *testing.T) {
+		id := post()
+		link := shareLinkPath(t, s, "team", id, auth...)
+		expectStatus(t, do(t, s, http.MethodGet, link, ""), http.StatusOK)
+		expectStatus(t, do(t, s, http.MethodDelete, "/revoke/"+id+"?room=team", "", auth...), http.StatusOK)
+		expectRemoved(t, link)
+	})
+	t.Run("清空房间", func(t *testing.T) {
+		link := shareLinkPath(t, s, "team", post(), auth...)
+		expectStatus(t, do(t, s, http.MethodDelete, "/revoke/all?room=team", "", auth...), http.StatusOK)
+		expectRemoved(t, link)
+	})
+	t.Run("房间改名", func(t *testing.T) {
+		link := shareLinkPath(t, s, "team", post(), auth...)
+		expectStatus(t, do(t, s, http.MethodPatch, "/rooms/team", `{"name":"crew"}`, "Content-Type", "application/json", "Authorization", "Bearer "+testAdminPassword), http.StatusOK)
+		expectRemoved(t, link)
+		if shares := s.shares.list("crew"); len(shares) != 0 {
+			t.Fatalf("新房间中有 %d 个分享链接", len(shares))
+		}
+		expectStatus(t, do(t, s, http.MethodPatch, "/rooms/crew", `{"name":"team"}`, "Content-Type", "application/json", "Authorization", "Bearer "+testAdminPassword), http.StatusOK)
+	})
+	t.Run("删除房间", func(t *testing.T) {
+		link := shareLinkPath(t, s, "team", post(), auth...)
+		expectStatus(t, do(t, s, http.MethodDelete, "/rooms/team", "", "Authorization", "Bearer "+testAdminPassword), http.StatusNoContent)
+		expectRemoved(t, link)
+	})
+}
+
+func TestShareRejectsReusedMessageID(t *testing.T) {
+	s := newTestServer(t, nil)
+	id := postText(t, s, "/text", "original")
+	link := shareLinkPath(t, s, "", id)
+	expectStatus(t, do(t, s, http.MethodGet, link, ""), http.StatusOK)
+
+	// 模拟重启后同一 ID 被分配给另一条消息
+	n, _ := strconv.Atoi(id)
+	s.messageQueue.Lock()
+	msg := s.messageQueue.Get(n)
+	msg.Data.TextReceive.Content = "a later message"
+	msg.Data.TextReceive.Timestamp++
+	s.messageQueue.Unlock()
+
+	rec := do(t, s, http.MethodGet, link, "")
+	expectStatus(t, rec, http.StatusNotFound)
+	if strings.Contains(rec.Body.String(), "later") {
+		t.Fatal("旧分享链接返回了其他消息")
+	}
+}
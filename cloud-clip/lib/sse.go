@@ -0,0 +1,147 @@
+package lib
+
+/**
+*** FILE: sse.go
+***   GET /events: Server-Sent Events stream of room events
+**/
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sseKeepaliveInterval 发送注释行保持连接的间隔，避免代理因空闲断开连接
+const sseKeepaliveInterval = 15 * time.Second
+
+// handleEvents 以 SSE 形式推送房间事件，事件与 /push 相同（receive、update、revoke、clearAll、connect、disconnect 等）
+func (s *ClipboardServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method != http.MethodGet {
+		http.Error(w, "仅允许 GET 请求", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ip := get_remote_ip(r)
+	room := normalizeRoomName(r.URL.Query().Get("room"))
+	if s.resolveRoomAuth(room).Required && !s.requestCanAccessRoom(r, room) {
+		s.logger.Printf("SSE 认证失败。来自 IP: %s, 房间: %s", ip, room)
+		writeAuthJSONError(w, http.StatusUnauthorized, "无权访问该房间")
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "当前连接不支持流式响应", http.StatusInternalServerError)
+		return
+	}
+
+	// 浏览器 EventSource 重连时通过 Last-Event-ID 头续传，curl 等工具也可以使用 ?lastEventId=
+	lastSeq := int64(-1)
+	lastEventID := strings.TrimSpace(r.Header.Get("Last-Event-ID"))
+	if lastEventID == "" {
+		lastEventID = strings.TrimSpace(r.URL.Query().Get("lastEventId"))
+	}
+	if lastEventID != "" {
+		if seq, err := strconv.ParseInt(lastEventID, 10, 64); err == nil && seq >= 0 {
+			lastSeq = seq
+		}
+	}
+
+	sub, missed, resumed := s.hub.subscribeFrom(room, "", lastSeq)
+	defer s.hub.unsubscribe(sub)
+	s.logger.Printf("新 SSE 客户端连接: %s, 房间: %s, Last-Event-ID: %d, 续传: %t", ip, room, lastSeq, lastSeq >= 0 && resumed)
+	defer s.logger.Printf("SSE 客户端断开连接: %s, 房间: %s", ip, room)
+
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // 禁止 nginx 缓冲
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 3000\n\n")
+
+	if lastSeq >= 0 && resumed {
+		for _, ev := range missed {
+			if err := writeSSEEvent(w, ev.Seq, ev.Message); err != nil {
+				return
+			}
+		}
+	} else {
+		// 新连接或无法续传：与 /push 一样先发送当前在线设备和历史消息
+		for _, message := range s.roomSnapshot(room) {
+			if err := writeSSEEvent(w, sub.startSeq, message); err != nil {
+				return
+			}
+		}
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(sseKeepaliveInterval)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case ev := <-sub.events:
+			if err := writeSSEEvent(w, ev.Seq, ev.Message); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-sub.done:
+			// 缓冲已满或房间被删除、改名时被 hub 断开，先写出已投递的事件，客户端可以通过 Last-Event-ID 续传
+			for _, ev := range sub.drain() {
+				if writeSSEEvent(w, ev.Seq, ev.Message) != nil {
+					break
+				}
+			}
+			flusher.Flush()
+			return
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// roomSnapshot 返回房间当前在线设备的 connect 事件和历史消息的 receive 事件（不含私信）
+func (s *ClipboardServer) roomSnapshot(room string) []WebSocketMessage {
+	var messages []WebSocketMessage
+
+	s.runMutex.Lock()
+	for _, devMeta := range s.getRoomDevicesLocked(room, "") {
+		messages = append(messages, WebSocketMessage{Event: "connect", Data: devMeta})
+	}
+	s.runMutex.Unlock()
+
+	s.messageQueue.Lock()
+	for _, msg := range s.messageQueue.RoomHistory(room) {
+		if msg.Data.VisibleTo("") {
+			if payload := msg.Data.Payload(); payload != nil {
+				messages = append(messages, WebSocketMessage{Event: "receive", Data: payload})
+			}
+		}
+	}
+	s.messageQueue.Unlock()
+
+	return messages
+}
+
+// writeSSEEvent 写入一条 SSE 事件，id 为 0 时省略 id 字段
+func writeSSEEvent(w http.ResponseWriter, id int64, message WebSocketMessage) error {
+	data, err := json.Marshal(message.Data)
+	if err != nil {
+		return err
+	}
+	if id > 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", id); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", message.Event, data)
+	return err
+}
@@ -0,0 +1,182 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type sseEvent struct {
+	ID    int64
+	Event string
+	Data  string
+}
+
+// readSSEEvents 读取 SSE 流 d 时间并解析事件，headers 中的键值对设置为请求头
+func readSSEEvents(t *testing.T, ts *httptest.Server, target string, d time.Duration, headers ...string) []sseEvent {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("请求 %s 失败: %v", target, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s 状态码 = %d", target, resp.StatusCode)
+	}
+
+	var events []sseEvent
+	var current sseEvent
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() { // 超时后读取出错，返回已解析的事件
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if current.Event != "" {
+				events = append(events, current)
+			}
+			current = sseEvent{}
+		case strings.HasPrefix(line, "id: "):
+			current.ID, _ = strconv.ParseInt(strings.TrimPrefix(line, "id: "), 10, 64)
+		case strings.HasPrefix(line, "event: "):
+			current.Event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			current.Data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+	return events
+}
+
+// receivedContents 返回 receive 事件中的文本内容
+func receivedContents(t *testing.T, events []sseEvent) []string {
+	t.Helper()
+	contents := []string{}
+	for _, ev := range events {
+		if ev.Event != "receive" {
+			continue
+		}
+		var data struct {
+			Content string `json:"content"`
+		}
+		if err := json.Unmarshal([]byte(ev.Data), &data); err != nil {
+			t.Fatal(err)
+		}
+		contents = append(contents, data.Content)
+	}
+	return contents
+}
+
+// keepHubRoom 保持房间的订阅，使 hub 记录房间的最近事件
+func keepHubRoom(t *testing.T, s *ClipboardServer, room string) {
+	t.Helper()
+	sub := s.hub.subscribe(room, "")
+	t.Cleanup(func() { s.hub.unsubscribe(sub) })
+}
+
+func TestSSESnapshotOnNewConnection(t *testing.T) {
+	s := newTestServer(t, nil)
+	ts := startTestServer(t, s)
+	postText(t, s, "/text", "one")
+	postText(t, s, "/text", "two")
+
+	events := readSSEEvents(t, ts, "/events", 200*time.Millisecond)
+	if got := receivedContents(t, events); strings.Join(got, ",") != "one,two" {
+		t.Fatalf("新连接的历史消息 = %v", got)
+	}
+}
+
+func TestSSEResumesFromLastEventID(t *testing.T) {
+	s := newTestServer(t, nil)
+	ts := startTestServer(t, s)
+	keepHubRoom(t, s, "default")
+	for _, content := range []string{"one", "two", "three"} {
+		postText(t, s, "/text", content)
+	}
+
+	all := readSSEEvents(t, ts, "/events?lastEventId=0", 200*time.Millisecond)
+	if got := receivedContents(t, all); strings.Join(got, ",") != "one,two,three" {
+		t.Fatalf("从 0 续传 = %v", got)
+	}
+	for i := 1; i < len(all); i++ {
+		if all[i].ID <= all[i-1].ID {
+			t.Fatalf("事件 ID 不递增: %+v", all)
+		}
+	}
+
+	// 浏览器重连时使用 Last-Event-ID 头，只补发之后的事件，不重复发送历史消息
+	resumed := readSSEEvents(t, ts, "/events", 200*time.Millisecond, "Last-Event-ID", strconv.FormatInt(all[0].ID, 10))
+	if got := receivedContents(t, resumed); strings.Join(got, ",") != "two,three" {
+		t.Fatalf("续传 = %v", got)
+	}
+	last := strconv.FormatInt(all[len(all)-1].ID, 10)
+	if got := readSSEEvents(t, ts, "/events?lastEventId="+last, 200*time.Millisecond); len(got) != 0 {
+		t.Fatalf("已是最新时不应补发事件: %+v", got)
+	}
+}
+
+func TestSSEResyncsAfterGap(t *testing.T) {
+	s := newTestServer(t, nil)
+	ts := startTestServer(t, s)
+	keepHubRoom(t, s, "default")
+	first := postText(t, s, "/text", "one")
+	events := readSSEEvents(t, ts, "/events?lastEventId=0", 200*time.Millisecond)
+	if len(events) != 1 || events[0].Event != "receive" {
+		t.Fatalf("事件 = %+v", events)
+	}
+	lastID := strconv.FormatInt(events[0].ID, 10)
+
+	// 续传点之后的事件已被移出最近事件缓冲，无法完整续传时重新发送快照
+	for i := 0; i <= hubRecentEvents; i++ {
+		s.hub.publish(hubEvent{Room: "default", Message: WebSocketMessage{Event: "ping"}})
+	}
+	postText(t, s, "/text", "two")
+
+	tests := []struct {
+		name   string
+		lastID string
+	}{
+		{"续传点已被移出", lastID},
+		{"续传点晚于当前序号（服务端重启）", "999999"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := readSSEEvents(t, ts, "/events", 200*time.Millisecond, "Last-Event-ID", tt.lastID)
+			if contents := receivedContents(t, got); strings.Join(contents, ",") != "one,two" {
+				t.Fatalf("重新同步的消息 = %v（第一条消息 ID %s）", contents, first)
+			}
+			for _, ev := range got {
+				if ev.Event == "ping" {
+					t.Fatal("重新同步时不应补发缓冲中的事件")
+				}
+			}
+		})
+	}
+}
+
+func TestSSERequiresRoomAccess(t *testing.T) {
+	s := newRoomsTestServer(t)
+	ts := startTestServer(t, s)
+
+	_, status := readSSE(t, ts, "/events?room=team", 200*time.Millisecond)
+	if status != http.StatusUnauthorized {
+		t.Fatalf("未认证状态码 = %d，期望 401", status)
+	}
+	_, status = readSSE(t, ts, "/events?room=team&auth=team-pw", 200*time.Millisecond)
+	if status != http.StatusOK {
+		t.Fatalf("使用房间密码状态码 = %d，期望 200", status)
+	}
+}
@@ -0,0 +1,211 @@
+package lib
+
+/**
+*** FILE: thread.go
+***   handle reply threads between messages
+**/
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	replyRevokeOrphan  = "orphan"  // 父消息撤销后保留回复，清除其 replyTo
+	replyRevokeCascade = "cascade" // 父消息撤销后一并撤销所有回复
+)
+
+var (
+	errMessageNotFound  = errors.New("消息未找到")
+	errRoomUnauthorized = errors.New("无权访问该房间")
+)
+
+// validateReplyParent 校验父消息存在且与新消息处于同一房间
+func (s *ClipboardServer) validateReplyParent(room string, replyTo int) error {
+	s.messageQueue.Lock()
+	defer s.messageQueue.Unlock()
+
+	parent := s.messageQueue.Get(replyTo)
+	if parent == nil {
+		return fmt.Errorf("回复的父消息不存在: %d", replyTo)
+	}
+	if normalizeRoomName(parent.Data.Room()) != normalizeRoomName(room) {
+		return fmt.Errorf("回复的父消息 %d 不在房间 %s 中", replyTo, normalizeRoomName(room))
+	}
+	return nil
+}
+
+// countRepliesLocked 统计设备可见的直接回复数量（不计发给其他设备的私信），必须在 messageQueue 锁定时调用
+func (s *ClipboardServer) countRepliesLocked(id int, deviceID string) int {
+	parent := s.messageQueue.Get(id)
+	if parent == nil {
+		return 0
+	}
+	count := 0
+	s.messageQueue.RangeRoom(parent.Data.Room(), func(msg *PostEvent) bool {
+		if msg.Data.ReplyTo() == id && msg.Data.VisibleTo(deviceID) {
+			count++
+		}
+		return true
+	})
+	return count
+}
+
+// applyReplyRevokePolicyLocked 按 replyRevoke 配置处理被撤销消息的回复，必须在 messageQueue 锁定时调用。
+// cascade 策略下返回被一并移除的回复（含多级回复）；orphan 策略下返回被清除 replyTo 的直接回复。
+func (s *ClipboardServer) applyReplyRevokePolicyLocked(parent PostEvent) (cascaded []PostEvent, orphaned []PostEvent) {
+	room := normalizeRoomName(parent.Data.Room())
+
+	if s.config.Server.ReplyRevoke == replyRevokeCascade {
+		revokedIDs := map[int]bool{parent.Data.ID(): true}
+		for {
+			removed := s.messageQueue.DeleteInRoom(room, func(msg *PostEvent) bool {
+				if revokedIDs[msg.Data.ReplyTo()] {
+					revokedIDs[msg.Data.ID()] = true
+					return true
+				}
+				return false
+			})
+			cascaded = append(cascaded, removed...)
+			if len(removed) == 0 {
+				return cascaded, nil
+			}
+		}
+	}
+
+	s.messageQueue.RangeRoom(room, func(msg *PostEvent) bool {
+		if msg.Data.ReplyTo() == parent.Data.ID() {
+			msg.Data.SetReplyTo(0)
+			orphaned = append(orphaned, *msg)
+		}
+		return true
+	})
+	return nil, orphaned
+}
+
+// broadcastMessageUpdate 向房间（私信则只向目标设备）广播消息的 update 事件
+func (s *ClipboardServer) broadcastMessageUpdate(msg PostEvent) {
+	payload := msg.Data.Payload()
+	if payload == nil {
+		return
+	}
+
+	wsMsg := WebSocketMessage{
+		Event: "update",
+		Data:  payload,
+	}
+	if to := msg.Data.To(); to != "" {
+		s.sendWebSocketMessageToDevice(wsMsg, msg.Data.Room(), to)
+		return
+	}
+	s.broadcastWebSocketMessage(wsMsg, msg.Data.Room())
+}
+
+// addReplyFields 为内容 JSON 响应添加 replyTo 和 replyCount 字段
+func addReplyFields(responseData map[string]interface{}, msg PostEvent, replyCount int) {
+	responseData["replyCount"] = replyCount
+	if replyTo := msg.Data.ReplyTo(); replyTo > 0 {
+		responseData["replyTo"] = strconv.Itoa(replyTo)
+	}
+}
+
+// threadItemLocked 构建线程中单条消息的 JSON 表示，必须在 messageQueue 锁定时调用
+func (s *ClipboardServer) threadItemLocked(msg PostEvent, deviceID string) map[string]interface{} {
+	item := map[string]interface{}{
+		"id":        strconv.Itoa(msg.Data.ID()),
+		"timestamp": msg.Data.Timestamp(),
+	}
+	addReplyFields(item, msg, s.countRepliesLocked(msg.Data.ID(), deviceID))
+
+	if fileReceive := msg.Data.FileReceive; fileReceive != nil {
+		item["type"] = DetermineResponseType(fileReceive.Name)
+		item["name"] = fileReceive.Name
+		item["size"] = fileReceive.Size
+		item["uuid"] = fileReceive.Cache
+		item["url"] = fileReceive.URL
+	} else if textReceive := msg.Data.Masked().TextReceive; textReceive != nil {
+		item["type"] = "text"
+		item["content"] = textReceive.Content
+		addSensitiveFields(item, textReceive)
+	}
+	return item
+}
+
+// handleThread 处理 GET /content/{id}/thread，返回消息及其所有（多级）回复
+func (s *ClipboardServer) handleThread(w http.ResponseWriter, r *http.Request, idStr string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "仅允许 GET 请求", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(strings.TrimSuffix(idStr, ".json"))
+	if err != nil {
+		http.Error(w, "无效的内容 ID", http.StatusBadRequest)
+		return
+	}
+
+	_, hasRequestedRoom := r.URL.Query()["room"]
+	requestedRoom := normalizeRoomName(r.URL.Query().Get("room"))
+	s.logger.Printf("处理回复线程请求, ID: %d, 房间参数存在: %t", id, hasRequestedRoom)
+	deviceID := s.requestDeviceID(r)
+
+	// 先检查房间权限再判断消息是否存在，未认证的请求不能借助 404 探测受保护房间中的消息 ID
+	if hasRequestedRoom && !s.requestCanAccessRoom(r, requestedRoom) {
+		writeAuthJSONError(w, http.StatusUnauthorized, "无权访问该房间")
+		return
+	}
+
+	// 在锁内构建响应，释放锁后再输出，避免慢客户端阻塞消息队列
+	s.messageQueue.Lock()
+	var response map[string]interface{}
+	unauthorized := false
+	if found := s.messageQueue.Get(id); found != nil {
+		room := normalizeRoomName(found.Data.Room())
+		switch {
+		case !hasRequestedRoom && !s.requestCanAccessRoom(r, room):
+			unauthorized = true
+		case hasRequestedRoom && room != requestedRoom, !found.Data.VisibleTo(deviceID):
+			// 不在请求的房间中或是发给其他设备的私信，按未找到处理
+		default:
+			// 队列按时间顺序排列，回复总是在父消息之后，一次遍历即可收集多级回复
+			inThread := map[int]bool{id: true}
+			replies := []map[string]interface{}{}
+			s.messageQueue.RangeRoom(room, func(msg *PostEvent) bool {
+				if msg.Data.ID() != id && inThread[msg.Data.ReplyTo()] {
+					inThread[msg.Data.ID()] = true
+					if msg.Data.VisibleTo(deviceID) {
+						replies = append(replies, s.threadItemLocked(*msg, deviceID))
+					}
+				}
+				return true
+			})
+			response = map[string]interface{}{
+				"root":       s.threadItemLocked(*found, deviceID),
+				"replies":    replies,
+				"replyCount": len(replies),
+			}
+		}
+	}
+	s.messageQueue.Unlock()
+
+	if unauthorized {
+		writeAuthJSONError(w, http.StatusUnauthorized, "无权访问该房间")
+		return
+	}
+	if response == nil {
+		writeJSONNotFound(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func writeJSONNotFound(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(map[string]string{"error": "内容未找到"})
+}
@@ -0,0 +1,116 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// threadResponse 是 GET /content/{id}/thread 的响应
+type threadResponse struct {
+	Root       map[string]any   `json:"root"`
+	Replies    []map[string]any `json:"replies"`
+	ReplyCount int              `json:"replyCount"`
+}
+
+func getThread(t *testing.T, s *ClipboardServer, target string, headers ...string) threadResponse {
+	t.Helper()
+	rec := do(t, s, http.MethodGet, target, "", headers...)
+	expectStatus(t, rec, http.StatusOK)
+	var thread threadResponse
+	decodeJSON(t, rec, &thread)
+	return thread
+}
+
+func TestThreadHidesOtherDevicesDirectReplies(t *testing.T) {
+	s := newTestServer(t, nil)
+	targetID, targetSecret := registerTestDevice(t, s, "目标")
+	root := postText(t, s, "/text", "root")
+	reply := postText(t, s, "/text?replyTo="+root, "reply")
+	postText(t, s, "/text?replyTo="+reply, "nested reply")
+	postText(t, s, "/text?replyTo="+root+"&to="+targetID, "direct reply")
+	postText(t, s, "/text", "unrelated")
+
+	thread := getThread(t, s, "/content/"+root+"/thread")
+	if len(thread.Replies) != 2 || thread.ReplyCount != 2 {
+		t.Fatalf("匿名请求的回复 = %v", thread.Replies)
+	}
+	if got := thread.Root["replyCount"]; got != float64(1) {
+		t.Fatalf("匿名请求的根消息 replyCount = %v，不应计入其他设备的私信", got)
+	}
+	if thread.Replies[0]["content"] != "reply" || thread.Replies[1]["content"] != "nested reply" {
+		t.Fatalf("回复顺序 = %v", thread.Replies)
+	}
+
+	thread = getThread(t, s, "/content/"+root+"/thread", "X-Device-Id", targetID, "X-Device-Secret", targetSecret)
+	if len(thread.Replies) != 3 || thread.Root["replyCount"] != float64(2) {
+		t.Fatalf("收件设备的线程 = %+v", thread)
+	}
+
+	// /content/{id}.json 的 replyCount 同样不计入其他设备的私信
+	rec := do(t, s, http.MethodGet, "/content/"+root+".json", "")
+	expectStatus(t, rec, http.StatusOK)
+	var item map[string]any
+	decodeJSON(t, rec, &item)
+	if item["replyCount"] != float64(1) {
+		t.Fatalf("/content 的 replyCount = %v", item["replyCount"])
+	}
+}
+
+func TestThreadChecksRoomAccessFirst(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Server.RoomAuth = map[string]string{"alpha": "pw-alpha"}
+	})
+	id := postText(t, s, "/text?room=alpha", "alpha secret", "Authorization", "Bearer pw-alpha")
+
+	// 未认证时不论消息是否存在都返回 401
+	for _, target := range []string{"/content/" + id + "/thread?room=alpha", "/content/999/thread?room=alpha", "/content/" + id + "/thread"} {
+		expectStatus(t, do(t, s, http.MethodGet, target, ""), http.StatusUnauthorized)
+	}
+	expectStatus(t, do(t, s, http.MethodGet, "/content/999/thread?room=alpha", "", "Authorization", "Bearer pw-alpha"), http.StatusNotFound)
+	expectStatus(t, do(t, s, http.MethodGet, "/content/"+id+"/thread?room=default", ""), http.StatusNotFound)
+	thread := getThread(t, s, "/content/"+id+"/thread?room=alpha", "Authorization", "Bearer pw-alpha")
+	if thread.Root["content"] != "alpha secret" {
+		t.Fatalf("根消息 = %v", thread.Root)
+	}
+}
+
+func TestThreadIsServedWithoutQueueLock(t *testing.T) {
+	s := newTestServer(t, nil)
+	root := postText(t, s, "/text", "root")
+	postText(t, s, "/text?replyTo="+root, "reply")
+
+	bw := &blockingWriter{ResponseRecorder: httptest.NewRecorder(), writing: make(chan struct{}), release: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.httpServer.Handler.ServeHTTP(bw, httptest.NewRequest(http.MethodGet, "/content/"+root+"/thread", nil))
+	}()
+	select {
+	case <-bw.writing:
+	case <-done:
+		t.Fatalf("响应没有写入内容，状态码 = %d", bw.Code)
+	case <-time.After(2 * time.Second):
+		t.Fatal("等待写入响应超时")
+	}
+	locked := make(chan struct{})
+	go func() {
+		s.messageQueue.Lock()
+		s.messageQueue.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		close(bw.release)
+		t.Fatal("输出响应时仍持有 messageQueue 锁")
+	}
+	close(bw.release)
+	<-done
+	var thread threadResponse
+	if err := json.Unmarshal(bw.Body.Bytes(), &thread); err != nil || len(thread.Replies) != 1 {
+		t.Fatalf("响应 = %s", bw.Body.String())
+	}
+}
@@ -1,6 +1,7 @@
 package lib
 
 import (
+	"container/list"
 	"log"
 	"net/http"
 	"sync"
@@ -16,8 +17,9 @@ import (
 **/
 // WebSocketMessage 是专门用于通过 WebSocket 发送给前端的结构
 type WebSocketMessage struct {
-	Event string      `json:"event"` // 将是 "receive", "config", "connect", "disconnect", "revoke", "clearAll" 等
-	Data  interface{} `json:"data"`  // 将是前端期望的直接载荷，如 *TextReceive, *FileReceive, DeviceMeta, map[string]string 等
+	Event string      `json:"event"`          // 将是 "receive", "config", "connect", "disconnect", "revoke", "clearAll" 等
+	Data  interface{} `json:"data"`           // 将是前端期望的直接载荷，如 *TextReceive, *FileReceive, DeviceMeta, map[string]string 等
+	Room  string      `json:"room,omitempty"` // 事件所属的房间，一个连接加入多个房间时用于区分
 }
 
 type PostEvent struct {
@@ -25,13 +27,18 @@ type PostEvent struct {
 	Data  ReceiveHolder `json:"data"`
 }
 
+// PostList 是消息队列：每个房间一个环形缓冲区（最多 history_len 条），
+// 另有按 ID 的索引和一个按加入顺序排列的全局链表。除 Append/RemoveById/ClearAll 外的方法都需要调用方持有锁。
 type PostList struct {
 	sync.Mutex
 	nextid      int
 	history_len int
 	logger      *log.Logger // 新增：用于记录日志
 
-	List []PostEvent `json:"receive"`
+	rooms    map[string]*roomRing // 规范化房间名 -> 房间消息
+	index    map[int]*postEntry   // 消息ID -> 消息
+	order    *list.List           // 所有消息按加入顺序排列，元素为 *postEntry
+	unscoped int                  // 旧版本历史中未指定房间（Room 为空）的消息数量
 }
 
 type PostData struct {
@@ -49,11 +56,13 @@ type PostData struct {
 
 // DeviceMeta 保存连接设备的信息
 type DeviceMeta struct {
-	ID      string `json:"id"`      // 设备ID
-	Type    string `json:"type"`    // 例如："Desktop", "Mobile"
-	Device  string `json:"device"`  // 例如："Apple Mac", "iPhone"
-	OS      string `json:"os"`      // 例如："macOS 14", "iOS 17"
-	Browser string `json:"browser"` // 例如："Chrome 120"
+	ID       string `json:"id"`                 // 设备ID
+	Type     string `json:"type"`               // 例如："Desktop", "Mobile"
+	Device   string `json:"device"`             // 例如："Apple Mac", "iPhone"
+	OS       string `json:"os"`                 // 例如："macOS 14", "iOS 17"
+	Browser  string `json:"browser"`            // 例如："Chrome 120"
+	Name     string `json:"name,omitempty"`     // 客户端设置的设备昵称，例如："Alice 的笔记本"
+	Sessions int    `json:"sessions,omitempty"` // 该设备在房间中的会话数（同一设备打开的多个标签页/连接）
 }
 
 // ClipboardServer 结构体定义
@@ -63,13 +72,14 @@ type ClipboardServer struct {
 	logger          *log.Logger
 	messageQueue    *PostList
 	websockets      map[*websocket.Conn]bool
-	room_ws         map[*websocket.Conn]string
-	uploadFileMap   map[string]File       // 从 history.go 的全局变量迁移过来
-	deviceConnected map[string]DeviceMeta // 更改为将 deviceID 映射到 DeviceMeta
+	room_ws         map[*websocket.Conn]map[string]string // 连接 -> 已加入的房间 -> 该房间使用的 token
+	uploadFileMap   map[string]File                       // 从 history.go 的全局变量迁移过来
+	deviceConnected map[string]DeviceMeta                 // 更改为将 deviceID 映射到 DeviceMeta
 	storageFolder   string
 	historyFilePath string
 	isRunning       bool
 	connDeviceIDMap map[*websocket.Conn]string
+	deviceSessions  map[string]int // 设备ID -> 该设备的 /push 连接数，最后一个连接断开时才从 deviceConnected 中移除
 	runMutex        sync.Mutex
 	parser          *uaparser.Parser // UA解析器实例
 	deviceHashSeed  uint32           // 将 deviceHashSeed 添加到服务器实例
@@ -78,6 +88,54 @@ type ClipboardServer struct {
 	roomStats         map[string]*RoomStat `json:"-"` // 房间统计信息，不序列化
 	roomStatsMutex    sync.RWMutex         `json:"-"` // 房间统计读写锁
 	roomCleanupTicker *time.Ticker         `json:"-"` // 房间清理定时器
+
+	// 消息回执（消息ID -> 送达/已读设备）
+	receipts        map[int]*receiptState
+	receiptsMutex   sync.Mutex
+	receiptsPruneAt int // 回执数量达到该值时才清理，见 pruneReceipts
+
+	// 等待目标设备上线后投递的私信（设备ID -> 消息），由 runMutex 保护
+	pendingDirect map[string][]PostEvent
+
+	// 事件分发中心，/push 和 /events 的订阅者都从这里接收事件
+	hub           *eventHub
+	wsSubscribers map[*websocket.Conn]*hubSubscriber // 由 runMutex 保护
+
+	// 客户端提供了稳定设备ID的设备（昵称、首次/最近连接时间）
+	devices *deviceRegistry
+
+	// 用户账号和登录会话，未启用时为 nil
+	users *userStore
+
+	// OpenID Connect 登录，未启用时为 nil
+	oidc *oidcStore
+
+	// 通过房间管理 API 创建的房间，未启用时为 nil
+	rooms *roomRegistry
+
+	// POST /login 创建的房间会话，未启用时为 nil
+	roomSessions *roomSessionStore
+
+	// API 令牌（按路由限制权限和房间）
+	tokens *tokenStore
+
+	// 待兑换的设备配对码（只在内存中）
+	pairings *pairingStore
+
+	// 单条消息的分享链接
+	shares *shareStore
+
+	// 限流和认证失败锁定，未启用时为 nil
+	limiter *rateLimiter
+
+	// 审计日志，未启用时为 nil
+	audit *auditLog
+
+	// 可信反向代理，决定是否采用 X-Forwarded-* / Forwarded / PROXY 协议中的客户端地址
+	proxies *proxyResolver
+
+	// 敏感内容检测流水线（内置检测器 + sensitive.patterns）
+	sensitiveDetectors []sensitiveDetector
 }
 
 // file item in File[]
@@ -88,6 +146,7 @@ type File struct {
 	UploadTime int64  `json:"uploadTime"`
 	ExpireTime int64  `json:"expireTime"`
 	Room       string `json:"room,omitempty"`
+	Sensitive  bool   `json:"sensitive,omitempty"` // 由包含敏感内容的超长文本转存，下载原文需要 reveal=1
 }
 
 // History represents the entire JSON structure
@@ -102,15 +161,22 @@ type ReceiveBase struct {
 	ID           int               `json:"id"`
 	Type         string            `json:"type"`
 	Room         string            `json:"room"`
-	Timestamp    int64             `json:"timestamp"`    // Unix timestamp (seconds)
-	SenderIP     string            `json:"senderIP"`     // 发送者 IP 地址
-	SenderDevice map[string]string `json:"senderDevice"` // 发送者设备信息 (来自 User-Agent 解析)
+	Timestamp    int64             `json:"timestamp"`         // Unix timestamp (seconds)
+	SenderIP     string            `json:"senderIP"`          // 发送者 IP 地址
+	SenderDevice map[string]string `json:"senderDevice"`      // 发送者设备信息 (来自 User-Agent 解析)
+	To           string            `json:"to,omitempty"`      // 私信目标设备ID，为空表示发送给整个房间
+	ReplyTo      int               `json:"replyTo,omitempty"` // 回复的父消息ID，0 表示不是回复
 }
 
 // "text" type item in Receive[]
 type TextReceive struct {
 	ReceiveBase        // 嵌入基础结构
 	Content     string `json:"content,omitempty"`
+	// 敏感内容检测结果，Masked 为遮盖后的内容，ExpireAt 为自动撤销时间（Unix 秒，0 表示不过期）
+	Sensitive      bool     `json:"sensitive,omitempty"`
+	SensitiveKinds []string `json:"sensitiveKinds,omitempty"`
+	Masked         string   `json:"masked,omitempty"`
+	ExpireAt       int64    `json:"expireAt,omitempty"`
 	// 为设备连接/断开事件添加字段
 	DeviceConnection *DeviceMeta `json:"deviceConnection,omitempty"` // 新增字段
 	DeviceID         string      `json:"deviceID,omitempty"`         // 新增字段 (用于断开连接)
@@ -124,7 +190,13 @@ type FileReceive struct {
 	Cache       string `json:"cache"` // Cache 通常就是 UUID
 	Expire      int64  `json:"expire"`
 	Thumbnail   string `json:"thumbnail"`
-	URL         string `json:"url,omitempty"` // 新增 URL 字段
+	URL         string `json:"url,omitempty"`     // 新增 URL 字段
+	Digest      string `json:"digest,omitempty"`  // 文件内容的 SHA-256 摘要，用于重复检测
+	Preview     string `json:"preview,omitempty"` // 由超长文本转存的文件，保存文本开头部分用于展示
+	// 超长文本转存的文件对完整文本做敏感内容检测，字段含义与 TextReceive 相同（预览已遮盖）
+	Sensitive      bool     `json:"sensitive,omitempty"`
+	SensitiveKinds []string `json:"sensitiveKinds,omitempty"`
+	ExpireAt       int64    `json:"expireAt,omitempty"`
 	// 也可以在这里为设备事件添加字段以保持对称性，如果需要的话
 	// DeviceConnection *DeviceMeta `json:"deviceConnection,omitempty"`
 	// DeviceID         string      `json:"deviceID,omitempty"`
@@ -139,12 +211,13 @@ type ReceiveHolder struct {
 // 房间列表
 // RoomInfo 房间信息结构体
 type RoomInfo struct {
-	Name         string `json:"name"`         // 房间名称（空字符串表示公共房间）
-	MessageCount int    `json:"messageCount"` // 消息数量
-	DeviceCount  int    `json:"deviceCount"`  // 设备数量
-	LastActive   int64  `json:"lastActive"`   // 最后活跃时间（Unix时间戳）
-	IsActive     bool   `json:"isActive"`     // 是否活跃（有设备连接）
-	IsProtected  bool   `json:"isProtected"`  // 是否为受保护房间
+	Name         string `json:"name"`                  // 房间名称（空字符串表示公共房间）
+	MessageCount int    `json:"messageCount"`          // 消息数量
+	DeviceCount  int    `json:"deviceCount"`           // 设备数量
+	LastActive   int64  `json:"lastActive"`            // 最后活跃时间（Unix时间戳）
+	IsActive     bool   `json:"isActive"`              // 是否活跃（有设备连接）
+	IsProtected  bool   `json:"isProtected"`           // 是否为受保护房间
+	Description  string `json:"description,omitempty"` // 房间描述（通过房间管理 API 设置）
 }
 
 // RoomListResponse 房间列表响应结构体
@@ -154,7 +227,7 @@ type RoomListResponse struct {
 
 // RoomStat 房间统计信息（内部使用）
 type RoomStat struct {
-	MessageCount int             `json:"messageCount"`
-	LastActive   int64           `json:"lastActive"`
-	DeviceIDs    map[string]bool `json:"-"` // 当前连接的设备ID集合
+	MessageCount int            `json:"messageCount"`
+	LastActive   int64          `json:"lastActive"`
+	DeviceIDs    map[string]int `json:"-"` // 当前连接的设备ID -> 会话数
 }
@@ -0,0 +1,609 @@
+package lib
+
+/**
+*** FILE: users.go
+***   user accounts: hashed passwords in a local store, login sessions, per-user room membership
+**/
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// argon2id 参数（OWASP 推荐的最低配置，约 19 MiB 内存，适合路由器等小内存设备）
+const (
+	argon2Time    = 2
+	argon2Memory  = 19 * 1024
+	argon2Threads = 1
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+
+	defaultSessionTTL  = 7 * 24 * 3600 // 默认登录会话有效期（秒）
+	sessionTokenBytes  = 32
+	sessionTokenPrefix = "ccs_"
+)
+
+// 用户名：1-32 个字母、数字、下划线、点或连字符
+var userNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,32}$`)
+
+var (
+	errUserNotFound    = errors.New("用户不存在")
+	errUserExists      = errors.New("用户已存在")
+	errInvalidUserName = errors.New("无效的用户名")
+	errInvalidPassword = errors.New("用户名或密码错误")
+	errUsersDisabled   = errors.New("用户账号未启用")
+	errUnsupportedHash = errors.New("不支持的密码哈希格式")
+
+	// 用户不存在时用于校验的哈希，首次登录时才计算
+	dummyPasswordHash = sync.OnceValue(func() string { return mustHashPassword("cloud-clipboard") })
+)
+
+// User 是用户存储中的一个用户。Rooms 为可以访问的房间，"*" 表示所有房间；管理员可以访问所有房间
+type User struct {
+	Name         string   `json:"name"`
+	PasswordHash string   `json:"passwordHash"`
+	Rooms        []string `json:"rooms"`
+	Admin        bool     `json:"admin,omitempty"`
+	Created      int64    `json:"created"`
+}
+
+// canAccessRoom 判断用户是否是房间的成员
+func (u *User) canAccessRoom(room string) bool {
+	if u.Admin {
+		return true
+	}
+	room = normalizeRoomName(room)
+	for _, member := range u.Rooms {
+		if member == "*" || normalizeRoomName(member) == room {
+			return true
+		}
+	}
+	return false
+}
+
+// userSession 是一个登录会话，passwordHash 为登录时的密码哈希，修改密码后旧会话失效
+type userSession struct {
+	user         string
+	passwordHash string
+	expires      int64
+}
+
+// UserInfo 是返回给客户端的用户信息（不含密码哈希）
+type UserInfo struct {
+	Name  string   `json:"name"`
+	Rooms []string `json:"rooms"`
+	Admin bool     `json:"admin,omitempty"`
+}
+
+// LoginResponse 是 /auth/login 的响应
+type LoginResponse struct {
+	Token     string   `json:"token"`
+	ExpiresAt int64    `json:"expiresAt"`
+	User      UserInfo `json:"user"`
+}
+
+// userStore 保存用户（持久化到 users.json）和登录会话（只保存在内存中，服务重启后需要重新登录）。
+// 命令行修改用户文件后，服务端在下次认证时按修改时间重新加载。
+type userStore struct {
+	mu         sync.Mutex
+	path       string
+	modTime    time.Time
+	users      map[string]*User
+	sessions   map[string]*userSession // 会话令牌的 SHA-256 -> 会话
+	sessionTTL time.Duration
+	logf       func(format string, v ...any)
+}
+
+// usersFilePath 返回用户存储文件路径，未配置时为历史文件所在目录的 users.json
+func usersFilePath(cfg *Config) string {
+	if cfg.Users.File != "" {
+		return cfg.Users.File
+	}
+	historyFile := cfg.Server.HistoryFile
+	if historyFile == "" {
+		historyFile = filepath.Join(cfg.Server.StorageDir, "history.json")
+	}
+	return filepath.Join(filepath.Dir(historyFile), "users.json")
+}
+
+func newUserStore(path string, sessionTTL int, logf func(format string, v ...any)) *userStore {
+	if sessionTTL <= 0 {
+		sessionTTL = defaultSessionTTL
+	}
+	st := &userStore{
+		path:       path,
+		users:      make(map[string]*User),
+		sessions:   make(map[string]*userSession),
+		sessionTTL: time.Duration(sessionTTL) * time.Second,
+		logf:       logf,
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if err := st.loadLocked(); err != nil && !os.IsNotExist(err) {
+		logf("警告: 加载用户存储 %s 失败: %v", path, err)
+	}
+	return st
+}
+
+// loadLocked 从文件加载用户，必须在 st.mu 锁定时调用
+func (st *userStore) loadLocked() error {
+	info, err := os.Stat(st.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(st.path)
+	if err != nil {
+		return err
+	}
+	var users []User
+	if err := json.Unmarshal(data, &users); err != nil {
+		return err
+	}
+
+	st.users = make(map[string]*User, len(users))
+	for i := range users {
+		st.users[users[i].Name] = &users[i]
+	}
+	st.modTime = info.ModTime()
+	return nil
+}
+
+// reloadIfChangedLocked 用户文件在外部被修改（例如通过命令行）时重新加载，必须在 st.mu 锁定时调用
+func (st *userStore) reloadIfChangedLocked() {
+	info, err := os.Stat(st.path)
+	if err != nil || info.ModTime().Equal(st.modTime) {
+		return
+	}
+	if err := st.loadLocked(); err != nil {
+		st.logf("警告: 重新加载用户存储 %s 失败: %v", st.path, err)
+		return
+	}
+	st.logf("用户存储已重新加载: %d 个用户", len(st.users))
+}
+
+// saveLocked 将用户写入文件，必须在 st.mu 锁定时调用
+func (st *userStore) saveLocked() error {
+	users := make([]User, 0, len(st.users))
+	for _, u := range st.users {
+		users = append(users, *u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+
+	data, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(st.path, data, 0600); err != nil {
+		return err
+	}
+	if info, err := os.Stat(st.path); err == nil {
+		st.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// add 添加用户，password 为明文，保存为 argon2id 哈希
+func (st *userStore) add(name string, password string, rooms []string, admin bool) error {
+	if !userNamePattern.MatchString(name) {
+		return errInvalidUserName
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.reloadIfChangedLocked()
+	if _, exists := st.users[name]; exists {
+		return errUserExists
+	}
+	st.users[name] = &User{Name: name, PasswordHash: hash, Rooms: normalizeUserRooms(rooms), Admin: admin, Created: time.Now().Unix()}
+	return st.saveLocked()
+}
+
+// remove 删除用户，该用户的登录会话随之失效
+func (st *userStore) remove(name string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.reloadIfChangedLocked()
+	if _, exists := st.users[name]; !exists {
+		return errUserNotFound
+	}
+	delete(st.users, name)
+	return st.saveLocked()
+}
+
+// setPassword 修改用户密码，该用户已有的登录会话随之失效
+func (st *userStore) setPassword(name string, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.reloadIfChangedLocked()
+	u, exists := st.users[name]
+	if !exists {
+		return errUserNotFound
+	}
+	u.PasswordHash = hash
+	return st.saveLocked()
+}
+
+// setRooms 修改用户可以访问的房间
+func (st *userStore) setRooms(name string, rooms []string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.reloadIfChangedLocked()
+	u, exists := st.users[name]
+	if !exists {
+		return errUserNotFound
+	}
+	u.Rooms = normalizeUserRooms(rooms)
+	return st.saveLocked()
+}
+
+// list 按用户名顺序返回所有用户
+func (st *userStore) list() []UserInfo {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.reloadIfChangedLocked()
+
+	infos := make([]UserInfo, 0, len(st.users))
+	for _, u := range st.users {
+		infos = append(infos, u.info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+func (u *User) info() UserInfo {
+	rooms := u.Rooms
+	if rooms == nil {
+		rooms = []string{}
+	}
+	return UserInfo{Name: u.Name, Rooms: rooms, Admin: u.Admin}
+}
+
+// login 校验用户名和密码，成功时创建登录会话并返回会话令牌
+func (st *userStore) login(name string, password string) (LoginResponse, error) {
+	st.mu.Lock()
+	st.reloadIfChangedLocked()
+	var passwordHash string
+	var info UserInfo
+	u, exists := st.users[name]
+	if exists {
+		passwordHash = u.PasswordHash
+		info = u.info()
+	}
+	st.mu.Unlock()
+
+	// 用户不存在时也计算一次哈希，避免通过响应时间判断用户名是否存在
+	if !exists {
+		verifyPassword(dummyPasswordHash(), password)
+		return LoginResponse{}, errInvalidPassword
+	}
+	if !verifyPassword(passwordHash, password) {
+		return LoginResponse{}, errInvalidPassword
+	}
+
+	token := sessionTokenPrefix + base64.RawURLEncoding.EncodeToString(random_bytes(sessionTokenBytes))
+	expires := time.Now().Add(st.sessionTTL).Unix()
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.pruneSessionsLocked()
+	st.sessions[hashSessionToken(token)] = &userSession{user: name, passwordHash: passwordHash, expires: expires}
+	return LoginResponse{Token: token, ExpiresAt: expires, User: info}, nil
+}
+
+// logout 使会话令牌失效
+func (st *userStore) logout(token string) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	key := hashSessionToken(token)
+	if _, ok := st.sessions[key]; !ok {
+		return false
+	}
+	delete(st.sessions, key)
+	return true
+}
+
+// authenticate 返回会话令牌对应的用户。会话过期、用户被删除或修改了密码时返回 false
+func (st *userStore) authenticate(token string) (*User, bool) {
+	if !strings.HasPrefix(token, sessionTokenPrefix) {
+		return nil, false
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	key := hashSessionToken(token)
+	sess, ok := st.sessions[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().Unix() >= sess.expires {
+		delete(st.sessions, key)
+		return nil, false
+	}
+	st.reloadIfChangedLocked()
+	u, exists := st.users[sess.user]
+	if !exists || u.PasswordHash != sess.passwordHash {
+		delete(st.sessions, key)
+		return nil, false
+	}
+	copied := *u
+	return &copied, true
+}
+
+// pruneSessionsLocked 移除已过期的会话，必须在 st.mu 锁定时调用
+func (st *userStore) pruneSessionsLocked() {
+	now := time.Now().Unix()
+	for key, sess := range st.sessions {
+		if now >= sess.expires {
+			delete(st.sessions, key)
+		}
+	}
+}
+
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeUserRooms 规范化房间名并去重，"*" 保持不变
+func normalizeUserRooms(rooms []string) []string {
+	normalized := []string{}
+	seen := make(map[string]bool)
+	for _, room := range rooms {
+		room = strings.TrimSpace(room)
+		if room != "*" {
+			room = normalizeRoomName(room)
+		}
+		if !seen[room] {
+			seen[room] = true
+			normalized = append(normalized, room)
+		}
+	}
+	return normalized
+}
+
+// hashPassword 使用 argon2id 计算密码哈希，格式为 $argon2id$v=19$m=...,t=...,p=...$salt$hash
+func hashPassword(password string) (string, error) {
+	if password == "" {
+		return "", errors.New("密码不能为空")
+	}
+	salt := random_bytes(argon2SaltLen)
+	key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func mustHashPassword(password string) string {
+	hash, err := hashPassword(password)
+	if err != nil {
+		panic(err)
+	}
+	return hash
+}
+
+// verifyPassword 校验密码，支持 argon2id 和 bcrypt（$2a$ / $2b$ / $2y$）哈希
+func verifyPassword(encoded string, password string) bool {
+	if strings.HasPrefix(encoded, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password)) == nil
+	}
+	ok, err := verifyArgon2id(encoded, password)
+	return err == nil && ok
+}
+
+func verifyArgon2id(encoded string, password string) (bool, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false, errUnsupportedHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, errUnsupportedHash
+	}
+	var memory, iterations uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return false, errUnsupportedHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, errUnsupportedHash
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(want) == 0 {
+		return false, errUnsupportedHash
+	}
+
+	got := argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(want)))
+	return subtle.ConstantTimeCompare(got, want) == 1, nil
+}
+
+// sessionUser 返回 token 对应的登录用户，未启用用户账号或 token 不是有效的会话令牌时返回 false
+func (s *ClipboardServer) sessionUser(token string) (*User, bool) {
+	if s.users == nil || token == "" {
+		return nil, false
+	}
+	return s.users.authenticate(token)
+}
+
+// handleAuth 处理 /auth/login、/auth/logout 和 /auth/me
+func (s *ClipboardServer) handleAuth(w http.ResponseWriter, r *http.Request) {
+	// 添加 CORS 头
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+	// 处理预检请求
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if s.users == nil {
+		writeAuthJSONError(w, http.StatusNotFound, errUsersDisabled.Error())
+		return
+	}
+
+	switch strings.TrimPrefix(r.URL.Path, s.config.Server.Prefix+"/auth/") {
+	case "login":
+		if r.Method != http.MethodPost {
+			http.Error(w, "仅允许 POST 请求", http.StatusMethodNotAllowed)
+			return
+		}
+		s.handleLogin(w, r)
+	case "logout":
+		if r.Method != http.MethodPost {
+			http.Error(w, "仅允许 POST 请求", http.StatusMethodNotAllowed)
+			return
+		}
+		if !s.users.logout(extractAuthToken(r)) {
+			writeAuthJSONError(w, http.StatusUnauthorized, "无效的会话令牌")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "me":
+		if r.Method != http.MethodGet {
+			http.Error(w, "仅允许 GET 请求", http.StatusMethodNotAllowed)
+			return
+		}
+		u, ok := s.sessionUser(extractAuthToken(r))
+		if !ok {
+			writeAuthJSONError(w, http.StatusUnauthorized, "无效的会话令牌")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(u.info())
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *ClipboardServer) handleLogin(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&body); err != nil {
+		http.Error(w, "无效的请求体", http.StatusBadRequest)
+		return
+	}
+
+	clientIP := get_remote_ip(r)
+	resp, err := s.users.login(strings.TrimSpace(body.Username), body.Password)
+	if err != nil {
+		s.logger.Printf("登录失败: 用户 [%s]，来自 IP: %s", body.Username, clientIP)
+		writeAuthJSONError(w, http.StatusUnauthorized, errInvalidPassword.Error())
+		return
+	}
+	s.logger.Printf("登录成功: 用户 [%s]，来自 IP: %s", resp.User.Name, clientIP)
+	s.recordAuditToken(r, resp.Token, auditAuthLogin, "", resp.User.Name, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// runUserCommand 执行 -useradd / -userdel / -userpasswd / -userrooms / -userlist 命令，没有指定用户管理命令时返回 false
+func runUserCommand(cfg *Config) bool {
+	if *flg_useradd == "" && *flg_userdel == "" && *flg_userpasswd == "" && *flg_userrooms == "" && !*flg_userlist {
+		return false
+	}
+
+	st := newUserStore(usersFilePath(cfg), cfg.Users.SessionTTL, log.Printf)
+	if !cfg.Users.Enable {
+		fmt.Println("提示: 配置文件中未启用用户账号（users.enable），添加的用户在启用前不会生效")
+	}
+
+	var err error
+	switch {
+	case *flg_useradd != "":
+		var password string
+		if password, err = cliPassword(); err == nil {
+			err = st.add(*flg_useradd, password, splitUserRooms(*flg_rooms), *flg_admin)
+		}
+		if err == nil {
+			fmt.Printf("已添加用户 %s\n", *flg_useradd)
+			auditCLI(cfg, auditUserAdd, *flg_useradd, map[string]any{"rooms": splitUserRooms(*flg_rooms), "admin": *flg_admin})
+		}
+	case *flg_userdel != "":
+		if err = st.remove(*flg_userdel); err == nil {
+			fmt.Printf("已删除用户 %s\n", *flg_userdel)
+			auditCLI(cfg, auditUserDelete, *flg_userdel, nil)
+		}
+	case *flg_userpasswd != "":
+		var password string
+		if password, err = cliPassword(); err == nil {
+			err = st.setPassword(*flg_userpasswd, password)
+		}
+		if err == nil {
+			fmt.Printf("已修改用户 %s 的密码，该用户需要重新登录\n", *flg_userpasswd)
+			auditCLI(cfg, auditUserPassword, *flg_userpasswd, nil)
+		}
+	case *flg_userrooms != "":
+		if err = st.setRooms(*flg_userrooms, splitUserRooms(*flg_rooms)); err == nil {
+			fmt.Printf("已修改用户 %s 的房间\n", *flg_userrooms)
+			auditCLI(cfg, auditUserRooms, *flg_userrooms, map[string]any{"rooms": splitUserRooms(*flg_rooms)})
+		}
+	default:
+		for _, u := range st.list() {
+			role := ""
+			if u.Admin {
+				role = " (管理员)"
+			}
+			fmt.Printf("%s%s\t%s\n", u.Name, role, strings.Join(u.Rooms, ","))
+		}
+	}
+
+	if err != nil {
+		fmt.Printf("错误: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("用户存储: %s\n", st.path)
+	return true
+}
+
+// cliPassword 返回 -password 指定的密码，未指定时从标准输入读取一行
+func cliPassword() (string, error) {
+	if *flg_password != "" {
+		return *flg_password, nil
+	}
+	fmt.Print("请输入密码: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("读取密码失败: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func splitUserRooms(rooms string) []string {
+	if strings.TrimSpace(rooms) == "" {
+		return nil
+	}
+	return strings.Split(rooms, ",")
+}
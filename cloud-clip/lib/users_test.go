@@ -0,0 +1,146 @@
+package lib
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newUsersTestServer(t *testing.T, sessionTTL int) *ClipboardServer {
+	t.Helper()
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Server.RoomAuth = map[string]string{"team": "team-pw", "other": "other-pw"}
+		cfg.Users.Enable = true
+		cfg.Users.SessionTTL = sessionTTL
+	})
+	if err := s.users.add("alice", "alice-pw", []string{"team"}, false); err != nil {
+		t.Fatal(err)
+	}
+	postText(t, s, "/text?room=team", "team note", "Authorization", "Bearer team-pw")
+	postText(t, s, "/text?room=other", "other note", "Authorization", "Bearer other-pw")
+	return s
+}
+
+// loginUser 通过 /auth/login 登录，返回登录结果
+func loginUser(t *testing.T, s *ClipboardServer, name string, password string) LoginResponse {
+	t.Helper()
+	rec := do(t, s, http.MethodPost, "/auth/login", `{"username":"`+name+`","password":"`+password+`"}`, "Content-Type", "application/json")
+	expectStatus(t, rec, http.StatusOK)
+	var resp LoginResponse
+	decodeJSON(t, rec, &resp)
+	return resp
+}
+
+// expireUserSessions 将所有登录会话的过期时间改为已过期
+func expireUserSessions(s *ClipboardServer) {
+	s.users.mu.Lock()
+	defer s.users.mu.Unlock()
+	for _, sess := range s.users.sessions {
+		sess.expires = time.Now().Unix() - 1
+	}
+}
+
+func TestUserSessionGrantsMemberRooms(t *testing.T) {
+	s := newUsersTestServer(t, 0)
+	login := loginUser(t, s, "alice", "alice-pw")
+	if !strings.HasPrefix(login.Token, sessionTokenPrefix) || login.User.Name != "alice" {
+		t.Fatalf("登录结果 = %+v", login)
+	}
+	auth := []string{"Authorization", "Bearer " + login.Token}
+
+	tests := []struct {
+		name    string
+		target  string
+		headers []string
+		want    int
+	}{
+		{"当前用户", "/auth/me", auth, http.StatusOK},
+		{"成员房间", "/content/latest.json?room=team", auth, http.StatusOK},
+		{"非成员房间", "/content/latest.json?room=other", auth, http.StatusUnauthorized},
+		{"未登录", "/content/latest.json?room=team", nil, http.StatusUnauthorized},
+		{"房间密码仍然有效", "/content/latest.json?room=team", []string{"Authorization", "Bearer team-pw"}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expectStatus(t, do(t, s, http.MethodGet, tt.target, "", tt.headers...), tt.want)
+		})
+	}
+
+	rec := do(t, s, http.MethodPost, "/auth/login", `{"username":"alice","password":"wrong"}`, "Content-Type", "application/json")
+	expectStatus(t, rec, http.StatusUnauthorized)
+	rec = do(t, s, http.MethodPost, "/auth/login", `{"username":"nobody","password":"alice-pw"}`, "Content-Type", "application/json")
+	expectStatus(t, rec, http.StatusUnauthorized)
+}
+
+func TestUserSessionExpires(t *testing.T) {
+	s := newUsersTestServer(t, 60)
+	login := loginUser(t, s, "alice", "alice-pw")
+	if now := time.Now().Unix(); login.ExpiresAt < now+59 || login.ExpiresAt > now+61 {
+		t.Fatalf("ExpiresAt = %d，期望约 %d", login.ExpiresAt, now+60)
+	}
+	auth := []string{"Authorization", "Bearer " + login.Token}
+	expectStatus(t, do(t, s, http.MethodGet, "/content/latest.json?room=team", "", auth...), http.StatusOK)
+
+	// 过期的会话不能再访问房间，并从会话表中移除
+	expireUserSessions(s)
+	expectStatus(t, do(t, s, http.MethodGet, "/auth/me", "", auth...), http.StatusUnauthorized)
+	expectStatus(t, do(t, s, http.MethodGet, "/content/latest.json?room=team", "", auth...), http.StatusUnauthorized)
+	s.users.mu.Lock()
+	remaining := len(s.users.sessions)
+	s.users.mu.Unlock()
+	if remaining != 0 {
+		t.Fatalf("过期会话仍有 %d 个", remaining)
+	}
+
+	// 重新登录后可以继续访问
+	login = loginUser(t, s, "alice", "alice-pw")
+	expectStatus(t, do(t, s, http.MethodGet, "/auth/me", "", "Authorization", "Bearer "+login.Token), http.StatusOK)
+}
+
+func TestUserSessionEndsOnLogoutPasswordChangeAndRemoval(t *testing.T) {
+	tests := []struct {
+		name string
+		end  func(t *testing.T, s *ClipboardServer, token string)
+	}{
+		{"退出登录", func(t *testing.T, s *ClipboardServer, token string) {
+			expectStatus(t, do(t, s, http.MethodPost, "/auth/logout", "", "Authorization", "Bearer "+token), http.StatusNoContent)
+		}},
+		{"修改密码", func(t *testing.T, s *ClipboardServer, token string) {
+			if err := s.users.setPassword("alice", "new-pw"); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"删除用户", func(t *testing.T, s *ClipboardServer, token string) {
+			if err := s.users.remove("alice"); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newUsersTestServer(t, 0)
+			token := loginUser(t, s, "alice", "alice-pw").Token
+			tt.end(t, s, token)
+			expectStatus(t, do(t, s, http.MethodGet, "/auth/me", "", "Authorization", "Bearer "+token), http.StatusUnauthorized)
+			expectStatus(t, do(t, s, http.MethodGet, "/content/latest.json?room=team", "", "Authorization", "Bearer "+token), http.StatusUnauthorized)
+		})
+	}
+}
+
+func TestUserStoreSavesPasswordHash(t *testing.T) {
+	s := newUsersTestServer(t, 0)
+	data, err := os.ReadFile(s.users.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "alice-pw") || !strings.Contains(string(data), "$argon2id$") {
+		t.Fatalf("用户文件应只保存密码哈希: %s", data)
+	}
+	// 会话只保存在内存中
+	token := loginUser(t, s, "alice", "alice-pw").Token
+	if data, _ = os.ReadFile(s.users.path); strings.Contains(string(data), token) {
+		t.Fatal("用户文件中不应保存会话令牌")
+	}
+}
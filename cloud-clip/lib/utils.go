@@ -288,6 +288,81 @@ func (r *ReceiveHolder) SenderIP() string {
 	return ""
 }
 
+func (r *ReceiveHolder) To() string {
+	if r.TextReceive != nil {
+		return r.TextReceive.To
+	} else if r.FileReceive != nil {
+		return r.FileReceive.To
+	}
+	return ""
+}
+
+func (r *ReceiveHolder) ReplyTo() int {
+	if r.TextReceive != nil {
+		return r.TextReceive.ReplyTo
+	} else if r.FileReceive != nil {
+		return r.FileReceive.ReplyTo
+	}
+	return 0
+}
+
+func (r *ReceiveHolder) SetReplyTo(replyTo int) {
+	if r.TextReceive != nil {
+		r.TextReceive.ReplyTo = replyTo
+	} else if r.FileReceive != nil {
+		r.FileReceive.ReplyTo = replyTo
+	}
+}
+
+func (r *ReceiveHolder) SetRoom(room string) {
+	if r.TextReceive != nil {
+		r.TextReceive.Room = room
+	} else if r.FileReceive != nil {
+		r.FileReceive.Room = room
+	}
+}
+
+// Payload 返回发送给前端的直接载荷 (*TextReceive 或 *FileReceive)
+func (r *ReceiveHolder) Payload() interface{} {
+	if r.TextReceive != nil {
+		return r.Masked().TextReceive
+	} else if r.FileReceive != nil {
+		return r.FileReceive
+	}
+	return nil
+}
+
+// Masked 返回可以展示在列表中的消息：敏感文本的内容替换为遮盖后的版本，其余原样返回
+func (r *ReceiveHolder) Masked() ReceiveHolder {
+	if r.TextReceive == nil || !r.TextReceive.Sensitive {
+		return *r
+	}
+	masked := *r.TextReceive
+	masked.Content = masked.Masked
+	masked.Masked = ""
+	return ReceiveHolder{TextReceive: &masked}
+}
+
+// Clone 复制 TextReceive / FileReceive，返回的副本在释放 messageQueue 锁后仍可安全读取（消息修改时原结构会被原地更新）
+func (r *ReceiveHolder) Clone() ReceiveHolder {
+	var c ReceiveHolder
+	if r.TextReceive != nil {
+		text := *r.TextReceive
+		c.TextReceive = &text
+	}
+	if r.FileReceive != nil {
+		file := *r.FileReceive
+		c.FileReceive = &file
+	}
+	return c
+}
+
+// VisibleTo 判断消息是否对指定设备可见（非私信，或私信目标为该设备）
+func (r *ReceiveHolder) VisibleTo(deviceID string) bool {
+	to := r.To()
+	return to == "" || to == deviceID
+}
+
 func (r *ReceiveHolder) SenderDevice() map[string]string {
 	if r.TextReceive != nil {
 		return r.TextReceive.SenderDevice
@@ -307,31 +382,21 @@ func (s *ClipboardServer) parse_user_agent(uaString string) map[string]string {
 	}
 }
 
-// get_remote_ip(r *http.Request) (保持不变)
+// get_remote_ip 返回客户端 IP。转发头已由 withClientAddr 按 trustedProxies 解析并写回 r.RemoteAddr，这里不再读取请求头
 func get_remote_ip(r *http.Request) string {
-	ip := r.Header.Get("X-Forwarded-For")
-	if ip == "" {
-		ip = r.Header.Get("X-Real-IP")
-	}
-	if ip == "" {
-		remoteAddr := r.RemoteAddr
-		host, _, err := net.SplitHostPort(remoteAddr)
-		if err == nil {
-			ip = host
-		} else {
-			ip = remoteAddr
-		}
-	}
-	ips := strings.Split(ip, ",")
-	if len(ips) > 0 {
-		ip = strings.TrimSpace(ips[0])
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
 	}
-	return ip
+	return host
 }
 
-// getScheme (保持不变)
+// getScheme 返回请求的协议：可信代理转发的协议，否则按连接是否为 TLS 判断
 func getScheme(r *http.Request) string {
-	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+	if scheme, ok := r.Context().Value(schemeContextKey{}).(string); ok {
+		return scheme
+	}
+	if r.TLS != nil {
 		return "https"
 	}
 	return "http"
@@ -0,0 +1,203 @@
+package lib
+
+/**
+*** FILE: wsproto.go
+***   client -> server frames over /push (send_text, update, revoke, clear, ack, subscribe, unsubscribe)
+**/
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// ClientFrame 是客户端通过 /push 连接发送给服务端的 JSON 帧
+type ClientFrame struct {
+	Event     string          `json:"event"`
+	RequestID string          `json:"requestId,omitempty"` // 客户端生成的请求ID，服务端在 result 帧中原样返回
+	Room      string          `json:"room,omitempty"`      // 帧作用的房间，为空时为连接的默认房间
+	Data      json.RawMessage `json:"data,omitempty"`
+}
+
+// FrameResult 是服务端对客户端帧的 result 回复
+type FrameResult struct {
+	RequestID string `json:"requestId,omitempty"`
+	Event     string `json:"event"` // 对应的请求帧类型
+	Room      string `json:"room,omitempty"`
+	OK        bool   `json:"ok"`
+	Error     string `json:"error,omitempty"`
+	ID        int    `json:"id,omitempty"`    // 涉及的消息ID
+	Type      string `json:"type,omitempty"`  // send_text 生成的消息类型（超长文本转存时为 file）
+	URL       string `json:"url,omitempty"`   // send_text 生成的消息内容 URL
+	Count     int    `json:"count,omitempty"` // clear 清除的消息数量
+	// 帧被限流时建议的重试等待秒数
+	RetryAfter int `json:"retryAfter,omitempty"`
+}
+
+// sendTextFrameData 是 send_text 帧的载荷
+type sendTextFrameData struct {
+	Content string `json:"content"`
+	To      string `json:"to"`
+	ReplyTo int    `json:"replyTo"`
+}
+
+// messageFrameData 是 update / revoke 帧的载荷
+type messageFrameData struct {
+	ID      int    `json:"id"`
+	Content string `json:"content"`
+}
+
+// parseClientFrame 尝试将 WebSocket 文本帧解析为 ClientFrame，心跳等非 JSON 内容返回 false
+func parseClientFrame(p []byte) (ClientFrame, bool) {
+	var frame ClientFrame
+	if len(p) == 0 || p[0] != '{' {
+		return frame, false
+	}
+	if err := json.Unmarshal(p, &frame); err != nil || frame.Event == "" {
+		return frame, false
+	}
+	return frame, true
+}
+
+// handleClientFrame 分发客户端发来的帧。除 ack 外的帧总会收到 result 回复；ack 只在带有 requestId 时回复。
+func (s *ClipboardServer) handleClientFrame(client *pushClient, frame ClientFrame) {
+	result := FrameResult{RequestID: frame.RequestID, Event: frame.Event}
+	var err error
+
+	// 帧和 HTTP 请求使用同样的限流，被限流的帧不做任何处理
+	if wait, locked := s.allowFrame(client.r, frame.Event); wait > 0 {
+		result.RetryAfter = int(math.Ceil(math.Max(wait.Seconds(), 1)))
+		err = errRateLimited
+		if locked {
+			err = errAuthLocked
+		}
+	} else {
+		switch frame.Event {
+		case "subscribe":
+			err = s.handleSubscribeFrame(client, frame, &result)
+		case "unsubscribe":
+			err = s.handleUnsubscribeFrame(client, frame, &result)
+		default:
+			err = s.handleRoomFrame(client, frame, &result)
+		}
+	}
+
+	conn := client.conn
+	if err != nil {
+		s.logger.Printf("警告: 处理来自 %s (ID: %s) 的 %s 帧失败: %v", conn.RemoteAddr(), client.deviceID, frame.Event, err)
+		result.Error = err.Error()
+	} else {
+		result.OK = true
+	}
+
+	if frame.Event == "ack" && frame.RequestID == "" {
+		return
+	}
+	if !s.sendToWebSocket(conn, WebSocketMessage{Event: "result", Data: result, Room: result.Room}) {
+		s.logger.Printf("错误: 发送 result 到客户端 %s 失败: 连接已关闭", conn.RemoteAddr())
+	}
+}
+
+// handleRoomFrame 处理作用于连接已加入的某个房间的帧，每个帧都按连接在该房间的 token 重新校验权限
+func (s *ClipboardServer) handleRoomFrame(client *pushClient, frame ClientFrame, result *FrameResult) error {
+	room, token, err := s.frameRoom(client, frame)
+	result.Room = room
+	if err != nil {
+		return err
+	}
+	if !s.canAccessRoom(room, token) {
+		return errRoomUnauthorized
+	}
+	if !s.tokenHasScope(token, frameScope(frame.Event)) {
+		return fmt.Errorf("API 令牌缺少权限: %s", frameScope(frame.Event))
+	}
+
+	switch frame.Event {
+	case "ack":
+		return s.handleAckFrame(client.deviceID, room, frame.Data)
+	case "send_text":
+		return s.handleSendTextFrame(client.r, room, frame.Data, result)
+	case "update":
+		if err := s.handleUpdateFrame(client.r, room, frame.Data, result); err != nil {
+			return err
+		}
+		s.recordAuditToken(client.r, token, auditMessageEdit, room, strconv.Itoa(result.ID), map[string]any{"via": "websocket"})
+		return nil
+	case "revoke":
+		if err := s.handleRevokeFrame(room, token, frame.Data, result); err != nil {
+			return err
+		}
+		s.recordAuditToken(client.r, token, auditMessageRevoke, room, strconv.Itoa(result.ID), map[string]any{"via": "websocket"})
+		return nil
+	case "clear":
+		s.logger.Printf("处理来自 %s (ID: %s) 的 clear 帧 (房间: '%s')", client.conn.RemoteAddr(), client.deviceID, room)
+		result.Count = s.clearRoom(room)
+		s.recordAuditToken(client.r, token, auditRoomClear, room, "", map[string]any{"count": result.Count, "via": "websocket"})
+		return nil
+	default:
+		return fmt.Errorf("未知帧类型: %s", frame.Event)
+	}
+}
+
+func (s *ClipboardServer) handleSendTextFrame(r *http.Request, room string, raw json.RawMessage, result *FrameResult) error {
+	var data sendTextFrameData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return fmt.Errorf("无法解析 send_text 帧: %w", err)
+	}
+	if data.Content == "" {
+		return errors.New("文本内容为空")
+	}
+
+	opts, err := s.newMessageOptions(room, data.To, data.ReplyTo)
+	if err != nil {
+		return err
+	}
+	event, err := s.postText(data.Content, room, opts, r)
+	if err != nil {
+		return err
+	}
+
+	result.ID = event.Data.ID()
+	result.Type = "text"
+	if event.Data.FileReceive != nil {
+		result.Type = "file"
+	}
+	result.URL = fmt.Sprintf("%s://%s%s/content/%d", getScheme(r), r.Host, s.config.Server.Prefix, result.ID)
+	if room != "default" {
+		result.URL += fmt.Sprintf("?room=%s", room)
+	}
+	return nil
+}
+
+func (s *ClipboardServer) handleUpdateFrame(r *http.Request, room string, raw json.RawMessage, result *FrameResult) error {
+	var data messageFrameData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return fmt.Errorf("无法解析 update 帧: %w", err)
+	}
+	if data.Content == "" {
+		return errors.New("文本内容为空")
+	}
+	if s.config.Text.Limit > 0 && len(data.Content) > s.config.Text.Limit {
+		return fmt.Errorf("%w (最大 %d 字符)", errTextTooLarge, s.config.Text.Limit)
+	}
+
+	result.ID = data.ID
+	if !s.updateTextMessage(data.ID, data.Content, room, r) {
+		return errMessageNotFound
+	}
+	return nil
+}
+
+func (s *ClipboardServer) handleRevokeFrame(room string, token string, raw json.RawMessage, result *FrameResult) error {
+	var data messageFrameData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return fmt.Errorf("无法解析 revoke 帧: %w", err)
+	}
+
+	result.ID = data.ID
+	_, err := s.revokeMessage(data.ID, room, true, func(string) string { return token })
+	return err
+}
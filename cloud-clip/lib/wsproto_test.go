@@ -0,0 +1,172 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// sendFrame 通过 /push 连接发送客户端帧
+func sendFrame(t testing.TB, conn *websocket.Conn, event string, requestID string, room string, data any) {
+	t.Helper()
+	frame := map[string]any{"event": event, "requestId": requestID, "room": room, "data": data}
+	if err := conn.WriteJSON(frame); err != nil {
+		t.Fatalf("发送 %s 帧: %v", event, err)
+	}
+}
+
+// waitFrameResult 读取连接上的消息直到收到 requestId 对应的 result，其他事件被忽略。
+// 读取超时后连接不能再使用，所以这里只在确定会收到 result 时等待
+func waitFrameResult(t testing.TB, conn *websocket.Conn, requestID string) FrameResult {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		var msg struct {
+			Event string      `json:"event"`
+			Data  FrameResult `json:"data"`
+		}
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("等待 %s 的 result: %v", requestID, err)
+		}
+		if json.Unmarshal(data, &msg) == nil && msg.Event == "result" {
+			if msg.Data.RequestID != requestID {
+				t.Fatalf("收到意外的 result: %+v，期望 %s", msg.Data, requestID)
+			}
+			return msg.Data
+		}
+	}
+}
+
+// frameResult 发送一个帧并等待对应的 result
+func frameResult(t testing.TB, conn *websocket.Conn, event string, room string, data any) FrameResult {
+	t.Helper()
+	requestID := event + "-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	sendFrame(t, conn, event, requestID, room, data)
+	return waitFrameResult(t, conn, requestID)
+}
+
+func TestPushFramesManageMessages(t *testing.T) {
+	s := newTestServer(t, nil)
+	ts := startTestServer(t, s)
+	conn := dialPush(t, ts, "room=default", nil)
+
+	sent := frameResult(t, conn, "send_text", "", map[string]any{"content": "hello"})
+	if !sent.OK || sent.ID == 0 || sent.Type != "text" || !strings.HasSuffix(sent.URL, "/content/"+strconv.Itoa(sent.ID)) {
+		t.Fatalf("send_text result = %+v", sent)
+	}
+	id := strconv.Itoa(sent.ID)
+
+	if result := frameResult(t, conn, "update", "", map[string]any{"id": sent.ID, "content": "hello again"}); !result.OK {
+		t.Fatalf("update result = %+v", result)
+	}
+	rec := do(t, s, http.MethodGet, "/content/"+id, "")
+	expectStatus(t, rec, http.StatusOK)
+	if got := strings.TrimSpace(rec.Body.String()); got != "hello again" {
+		t.Fatalf("更新后的内容 = %q", got)
+	}
+
+	if result := frameResult(t, conn, "revoke", "", map[string]any{"id": sent.ID}); !result.OK || result.ID != sent.ID {
+		t.Fatalf("revoke result = %+v", result)
+	}
+	expectStatus(t, do(t, s, http.MethodGet, "/content/"+id, ""), http.StatusNotFound)
+	if result := frameResult(t, conn, "revoke", "", map[string]any{"id": sent.ID}); result.OK {
+		t.Fatalf("重复撤销应失败: %+v", result)
+	}
+
+	postText(t, s, "/text", "one")
+	postText(t, s, "/text", "two")
+	if result := frameResult(t, conn, "clear", "", nil); !result.OK || result.Count != 2 {
+		t.Fatalf("clear result = %+v", result)
+	}
+
+	for _, tt := range []struct {
+		event string
+		data  any
+	}{
+		{"send_text", map[string]any{"content": ""}},
+		{"update", map[string]any{"id": 9999, "content": "x"}},
+		{"unknown", nil},
+	} {
+		if result := frameResult(t, conn, tt.event, "", tt.data); result.OK || result.Error == "" {
+			t.Fatalf("%s 帧应失败: %+v", tt.event, result)
+		}
+	}
+
+	// 不带 requestId 的 ack 帧不回复 result：下一个收到的 result 属于之后发送的帧
+	sendFrame(t, conn, "ack", "", "", map[string]any{"id": sent.ID})
+	frameResult(t, conn, "send_text", "", map[string]any{"content": "after ack"})
+}
+
+func TestPushFramesRequireJoinedRoom(t *testing.T) {
+	s := newRoomsTestServer(t)
+	ts := startTestServer(t, s)
+	conn := dialPush(t, ts, "room=default", http.Header{"Authorization": {"Bearer " + testAdminPassword}})
+
+	// 帧只能作用于连接已加入的房间，不能借用连接的认证写入其他房间
+	for _, event := range []string{"send_text", "clear", "ack"} {
+		result := frameResult(t, conn, event, "team", map[string]any{"content": "x"})
+		if result.OK || result.Room != "team" {
+			t.Fatalf("%s 帧作用于未加入的房间应失败: %+v", event, result)
+		}
+	}
+	s.messageQueue.Lock()
+	n := s.messageQueue.RoomLen("team")
+	s.messageQueue.Unlock()
+	if n != 0 {
+		t.Fatalf("房间 team 中有 %d 条消息", n)
+	}
+}
+
+func TestPushFramesRequireTokenScope(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Server.Auth = testAdminPassword
+	})
+	reader, err := s.tokens.create("reader", []string{scopeRead}, nil, 0, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer, err := s.tokens.create("writer", []string{scopeRead, scopePostText}, nil, 0, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	existing := postText(t, s, "/text", "keep me", "Authorization", "Bearer "+testAdminPassword)
+	existingID, _ := strconv.Atoi(existing)
+	ts := startTestServer(t, s)
+
+	tests := []struct {
+		name  string
+		token string
+		event string
+		data  any
+		ok    bool
+	}{
+		{"只读令牌发送文本", reader.Token, "send_text", map[string]any{"content": "x"}, false},
+		{"只读令牌修改消息", reader.Token, "update", map[string]any{"id": existingID, "content": "x"}, false},
+		{"只读令牌撤销消息", reader.Token, "revoke", map[string]any{"id": existingID}, false},
+		{"只读令牌清空房间", reader.Token, "clear", nil, false},
+		{"只读令牌确认送达", reader.Token, "ack", map[string]any{"id": existingID}, true},
+		{"发送令牌撤销消息", writer.Token, "revoke", map[string]any{"id": existingID}, false},
+		{"发送令牌清空房间", writer.Token, "clear", nil, false},
+		{"发送令牌发送文本", writer.Token, "send_text", map[string]any{"content": "x"}, true},
+		{"房间密码不受权限限制", testAdminPassword, "revoke", map[string]any{"id": existingID}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := dialPush(t, ts, "room=default", http.Header{"Authorization": {"Bearer " + tt.token}})
+			result := frameResult(t, conn, tt.event, "", tt.data)
+			if result.OK != tt.ok {
+				t.Fatalf("result = %+v，期望 ok = %t", result, tt.ok)
+			}
+			if !tt.ok && tt.token != testAdminPassword && !strings.Contains(result.Error, frameScope(tt.event)) {
+				t.Fatalf("错误信息应说明缺少的权限: %+v", result)
+			}
+		})
+	}
+}
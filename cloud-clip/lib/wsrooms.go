@@ -0,0 +1,206 @@
+package lib
+
+/**
+*** FILE: wsrooms.go
+***   join / leave rooms on a /push connection (/push?room=a&room=b, subscribe / unsubscribe frames)
+**/
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// pushClient 是一个 /push 连接的上下文
+type pushClient struct {
+	conn     *websocket.Conn
+	r        *http.Request // 建立连接时的升级请求，用于认证和记录发送者信息
+	sub      *hubSubscriber
+	deviceID string
+	meta     DeviceMeta
+	room     string // 帧中未指定房间时使用的默认房间（连接时的第一个房间）
+}
+
+// subscribeFrameData 是 subscribe 帧的载荷，auth 为该房间的密码（可选）
+type subscribeFrameData struct {
+	Auth string `json:"auth"`
+}
+
+// parsePushRooms 返回 /push 请求要加入的房间（规范化并去重），未指定时为 default
+func parsePushRooms(r *http.Request) []string {
+	var rooms []string
+	seen := make(map[string]bool)
+	for _, room := range r.URL.Query()["room"] {
+		room = normalizeRoomName(room)
+		if !seen[room] {
+			seen[room] = true
+			rooms = append(rooms, room)
+		}
+	}
+	if len(rooms) == 0 {
+		rooms = append(rooms, "default")
+	}
+	return rooms
+}
+
+// joinRoom 将连接加入房间：发送房间内的在线设备和历史消息，并向房间广播 connect 事件。
+// 已加入时只更新 token。连接已关闭时返回 false。
+func (s *ClipboardServer) joinRoom(client *pushClient, room string, token string) bool {
+	// 第一步：在锁内注册并收集房间内的其他设备
+	var devicesInRoom []DeviceMeta
+	s.runMutex.Lock()
+	rooms := s.room_ws[client.conn]
+	if rooms == nil {
+		s.runMutex.Unlock()
+		return false
+	}
+	if _, joined := rooms[room]; joined {
+		rooms[room] = token
+		s.runMutex.Unlock()
+		return true
+	}
+	rooms[room] = token
+	s.updateRoomDeviceCount(room, client.deviceID, true)
+	sessions := s.hub.join(client.sub, room)
+	meta, ok := s.deviceConnected[client.deviceID]
+	if !ok {
+		meta = client.meta
+	}
+	meta.Sessions = sessions
+	devicesInRoom = s.getRoomDevicesLocked(room, client.deviceID)
+	s.runMutex.Unlock()
+	s.logger.Printf("WebSocket 客户端 %s (ID: %s) 加入房间: %s", client.conn.RemoteAddr(), client.deviceID, room)
+
+	// 第二步：向新连接发送房间内当前连接的设备列表
+	for _, devMeta := range devicesInRoom {
+		if !client.sub.send(WebSocketMessage{Event: "connect", Data: devMeta, Room: room}) {
+			s.logger.Printf("错误: 发送现有设备 %s 信息到新客户端 %s 失败: 连接已关闭", devMeta.ID, client.conn.RemoteAddr())
+			return false
+		}
+	}
+
+	// 第三步：向房间内的其他客户端广播新设备连接，设备已有其他会话在房间中时只广播会话数变化
+	event := "connect"
+	if sessions > 1 {
+		event = "device"
+	}
+	s.broadcastWebSocketMessageToRoomExcept(WebSocketMessage{Event: event, Data: meta}, room, client.conn)
+
+	// 第四步：发送历史消息和设备离线期间收到的私信
+	var historyMessages []PostEvent
+	s.messageQueue.Lock()
+	for _, msg := range s.messageQueue.RoomHistory(room) {
+		if msg.Data.VisibleTo(client.deviceID) {
+			historyMessages = append(historyMessages, msg)
+		}
+	}
+	s.messageQueue.Unlock()
+
+	// 已在历史消息中的私信不重复发送
+	replayed := make(map[int]bool, len(historyMessages))
+	for _, msg := range historyMessages {
+		replayed[msg.Data.ID()] = true
+	}
+	for _, pending := range s.takePendingDirect(client.deviceID, room) {
+		if !replayed[pending.Data.ID()] {
+			historyMessages = append(historyMessages, pending)
+		}
+	}
+
+	for _, msg := range historyMessages {
+		clientPayload := msg.Data.Payload()
+		if clientPayload == nil {
+			continue
+		}
+		if !client.sub.send(WebSocketMessage{Event: "receive", Data: clientPayload, Room: room}) {
+			s.logger.Printf("错误: 发送历史消息到客户端 %s 失败: 连接已关闭", client.conn.RemoteAddr())
+			return false
+		}
+	}
+	s.logger.Printf("已发送 %d 条历史消息到客户端 %s (房间: %s)", len(historyMessages), client.conn.RemoteAddr(), room)
+	return true
+}
+
+// leaveRoom 将连接移出房间并向房间广播 disconnect 事件，连接未加入该房间时返回 false
+func (s *ClipboardServer) leaveRoom(client *pushClient, room string) bool {
+	s.runMutex.Lock()
+	rooms := s.room_ws[client.conn]
+	if _, joined := rooms[room]; !joined {
+		s.runMutex.Unlock()
+		return false
+	}
+	delete(rooms, room)
+	s.updateRoomDeviceCount(room, client.deviceID, false)
+	s.runMutex.Unlock()
+
+	remaining := s.hub.leave(client.sub, room)
+	s.logger.Printf("WebSocket 客户端 %s (ID: %s) 离开房间: %s", client.conn.RemoteAddr(), client.deviceID, room)
+	s.broadcastDeviceLeft(client.deviceID, room, remaining)
+	return true
+}
+
+// frameRoom 返回帧作用的房间和连接在该房间使用的 token，连接未加入该房间时返回错误
+func (s *ClipboardServer) frameRoom(client *pushClient, frame ClientFrame) (string, string, error) {
+	room := client.room
+	if strings.TrimSpace(frame.Room) != "" {
+		room = normalizeRoomName(frame.Room)
+	}
+
+	s.runMutex.Lock()
+	token, joined := s.room_ws[client.conn][room]
+	s.runMutex.Unlock()
+	if !joined {
+		return room, "", fmt.Errorf("未加入房间: %s", room)
+	}
+	return room, token, nil
+}
+
+func (s *ClipboardServer) handleSubscribeFrame(client *pushClient, frame ClientFrame, result *FrameResult) error {
+	if strings.TrimSpace(frame.Room) == "" {
+		return errors.New("未指定房间")
+	}
+	room := normalizeRoomName(frame.Room)
+	result.Room = room
+
+	var data subscribeFrameData
+	if len(frame.Data) > 0 {
+		if err := json.Unmarshal(frame.Data, &data); err != nil {
+			return fmt.Errorf("无法解析 subscribe 帧: %w", err)
+		}
+	}
+
+	// 帧中的 auth 优先，其次是建立连接时提供的 token。认证失败同样计入锁定，被锁定的 IP 不能再尝试
+	if s.authLocked(client.r) {
+		return errAuthLocked
+	}
+	tokens := extractAuthTokens(client.r)
+	if auth := strings.TrimSpace(data.Auth); auth != "" {
+		tokens = append([]string{auth}, tokens...)
+	}
+	token, ok := s.roomAccessToken(room, tokens)
+	if !ok {
+		s.authFailed(client.r)
+		return errRoomUnauthorized
+	}
+	if !s.joinRoom(client, room, token) {
+		return errors.New("连接已关闭")
+	}
+	return nil
+}
+
+func (s *ClipboardServer) handleUnsubscribeFrame(client *pushClient, frame ClientFrame, result *FrameResult) error {
+	if strings.TrimSpace(frame.Room) == "" {
+		return errors.New("未指定房间")
+	}
+	room := normalizeRoomName(frame.Room)
+	result.Room = room
+
+	if !s.leaveRoom(client, room) {
+		return fmt.Errorf("未加入房间: %s", room)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func newMultiRoomTestServer(t *testing.T) *ClipboardServer {
+	t.Helper()
+	return newTestServer(t, func(cfg *Config) {
+		cfg.Server.RoomAuth = map[string]string{"alpha": "pw-alpha", "beta": "pw-beta"}
+	})
+}
+
+// waitReceive 读取连接上的消息直到收到 receive 事件，返回事件所属的房间和文本内容
+func waitReceive(t *testing.T, conn *websocket.Conn) (room string, content string) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		var msg struct {
+			Event string `json:"event"`
+			Room  string `json:"room"`
+			Data  struct {
+				Content string `json:"content"`
+			} `json:"data"`
+		}
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("等待 receive 事件: %v", err)
+		}
+		if json.Unmarshal(data, &msg) == nil && msg.Event == "receive" {
+			return msg.Room, msg.Data.Content
+		}
+	}
+}
+
+func roomTokensHeader(tokens ...string) http.Header {
+	data, _ := json.Marshal(tokens)
+	return http.Header{"X-Room-Auth-Tokens": {string(data)}}
+}
+
+func TestPushJoinsMultipleRooms(t *testing.T) {
+	s := newMultiRoomTestServer(t)
+	ts := startTestServer(t, s)
+	conn := dialPush(t, ts, "room=alpha&room=beta&room=open", roomTokensHeader("pw-alpha", "pw-beta"))
+	waitFor(t, "连接加入三个房间", func() bool { return len(s.hub.devicesInRoom("open", "")) == 1 })
+
+	for _, room := range []string{"alpha", "beta", "open"} {
+		if len(s.hub.devicesInRoom(room, "")) != 1 {
+			t.Fatalf("房间 %s 中没有在线设备", room)
+		}
+	}
+
+	// 事件带有所属房间
+	postText(t, s, "/text?room=beta", "to beta", "Authorization", "Bearer pw-beta")
+	if room, content := waitReceive(t, conn); room != "beta" || content != "to beta" {
+		t.Fatalf("收到房间 %q 的 %q", room, content)
+	}
+	postText(t, s, "/text?room=open", "to open")
+	if room, content := waitReceive(t, conn); room != "open" || content != "to open" {
+		t.Fatalf("收到房间 %q 的 %q", room, content)
+	}
+}
+
+func TestPushRejectsUnauthorizedRoom(t *testing.T) {
+	s := newMultiRoomTestServer(t)
+	ts := startTestServer(t, s)
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/push?room=alpha&room=beta"
+
+	// 每个房间分别认证，任一房间认证失败时拒绝整个连接
+	_, resp, err := websocket.DefaultDialer.Dial(url, roomTokensHeader("pw-alpha"))
+	if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("缺少 beta 的密码时应返回 401: %v", err)
+	}
+	_, resp, err = websocket.DefaultDialer.Dial(url, roomTokensHeader("pw-alpha", "pw-alpha-wrong"))
+	if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("beta 的密码错误时应返回 401: %v", err)
+	}
+	dialPush(t, ts, "room=alpha&room=beta", roomTokensHeader("pw-beta", "pw-alpha"))
+}
+
+func TestPushSubscribeAndUnsubscribeFrames(t *testing.T) {
+	s := newMultiRoomTestServer(t)
+	ts := startTestServer(t, s)
+	conn := dialPush(t, ts, "room=open", nil)
+
+	if result := frameResult(t, conn, "subscribe", "alpha", nil); result.OK || result.Error != errRoomUnauthorized.Error() {
+		t.Fatalf("没有密码时 subscribe = %+v", result)
+	}
+	if result := frameResult(t, conn, "subscribe", "alpha", map[string]any{"auth": "pw-beta"}); result.OK {
+		t.Fatalf("使用其他房间的密码 subscribe = %+v", result)
+	}
+	if result := frameResult(t, conn, "subscribe", "", nil); result.OK {
+		t.Fatalf("未指定房间 subscribe = %+v", result)
+	}
+	if len(s.hub.devicesInRoom("alpha", "")) != 0 {
+		t.Fatal("认证失败的连接不应加入房间")
+	}
+
+	if result := frameResult(t, conn, "subscribe", "alpha", map[string]any{"auth": "pw-alpha"}); !result.OK || result.Room != "alpha" {
+		t.Fatalf("subscribe = %+v", result)
+	}
+	if len(s.hub.devicesInRoom("alpha", "")) != 1 {
+		t.Fatal("subscribe 后房间 alpha 中应有在线设备")
+	}
+	postText(t, s, "/text?room=alpha", "to alpha", "Authorization", "Bearer pw-alpha")
+	if room, content := waitReceive(t, conn); room != "alpha" || content != "to alpha" {
+		t.Fatalf("收到房间 %q 的 %q", room, content)
+	}
+	// 加入后可以在该房间发送帧
+	if result := frameResult(t, conn, "send_text", "alpha", map[string]any{"content": "from frame"}); !result.OK {
+		t.Fatalf("send_text = %+v", result)
+	}
+
+	if result := frameResult(t, conn, "unsubscribe", "alpha", nil); !result.OK {
+		t.Fatalf("unsubscribe = %+v", result)
+	}
+	if len(s.hub.devicesInRoom("alpha", "")) != 0 {
+		t.Fatal("unsubscribe 后房间 alpha 中不应有在线设备")
+	}
+	if result := frameResult(t, conn, "unsubscribe", "alpha", nil); result.OK {
+		t.Fatalf("重复 unsubscribe = %+v", result)
+	}
+	if result := frameResult(t, conn, "send_text", "alpha", map[string]any{"content": "x"}); result.OK {
+		t.Fatalf("离开房间后 send_text = %+v", result)
+	}
+
+	// 离开后不再收到该房间的事件，其他房间不受影响
+	postText(t, s, "/text?room=alpha", "after leave", "Authorization", "Bearer pw-alpha")
+	postText(t, s, "/text?room=open", "still here")
+	if room, content := waitReceive(t, conn); room != "open" || content != "still here" {
+		t.Fatalf("收到房间 %q 的 %q", room, content)
+	}
+}